@@ -14,6 +14,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/logging"
 	"github.com/DIMO-Network/shared"
 	"github.com/rs/zerolog"
 )
@@ -27,6 +28,10 @@ func main() {
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to load settings")
 	}
+	if settings.RedactLogs() {
+		out := logging.NewWriter(os.Stdout, logging.NewRedactor(&settings))
+		logger = zerolog.New(out).With().Timestamp().Str("app", "b2b-fleet-mgr-api").Logger()
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
@@ -1,16 +1,23 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"os"
+	"net/url"
+	"path/filepath"
 	"strconv"
+	"time"
 
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/auth"
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/controllers"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
 	"github.com/DIMO-Network/shared/middleware/metrics"
-	jwtware "github.com/gofiber/contrib/jwt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 	fiberrecover "github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/rs/zerolog"
 )
@@ -39,12 +46,20 @@ func App(settings *config.Settings, logger *zerolog.Logger, commitHash string) *
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "https://localdev.dimo.org:3008", // localhost development
 		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS,PATCH",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Tenant-Id",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Tenant-Id, Idempotency-Key",
+		ExposeHeaders:    "Idempotent-Replayed",
 		AllowCredentials: true,
 	}))
 
-	// serve static content for production
-	app.Get("/", loadStaticIndex)
+	app.Use(securityHeaders(settings))
+
+	// serve static content for production. The html pages go through htmlPage so each gets a CSP nonce,
+	// tracking.html with its own tighter policy.
+	mainPage := htmlPage(settings, "dist/index.html", appCSP(settings), false)
+	app.Get("/", mainPage)
+	app.Get("/index.html", mainPage)
+	app.Get("/login.html", htmlPage(settings, "dist/login.html", appCSP(settings), false))
+	app.Get("/tracking.html", htmlPage(settings, "dist/tracking.html", trackingCSP(), true))
 	// btw we may need routes setup like we do in dimo-admin if we bring in a routing engine etc
 
 	staticConfig := fiber.Static{
@@ -56,39 +71,81 @@ func App(settings *config.Settings, logger *zerolog.Logger, commitHash string) *
 	app.Static("/", "./dist", staticConfig)
 	app.Static("/assets", "./dist/assets", staticConfig)
 
+	cspReportCtrl := controllers.NewCSPReportController(settings, logger)
+
 	// application routes
 	app.Get("/health", healthCheck)
 	app.Get("/version", getVersion)
-
-	vehiclesCtrl := controllers.NewVehiclesController(settings, logger)
-	identityCtrl := controllers.NewIdentityController(settings, logger)
+	// public, so each client gets a few reports a minute, the rest are answered and dropped
+	app.Post("/csp-report", limiter.New(limiter.Config{
+		Max:          10,
+		Expiration:   time.Minute,
+		LimitReached: func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) },
+	}), cspReportCtrl.CollectReport)
+
+	// the local records are the only state the BFF keeps, refuse to start rather than lose them request by request
+	if err := store.CheckWritable(settings.GetDataDir()); err != nil {
+		logger.Fatal().Err(err).Msg("data dir is not usable, set DATA_DIR to a writable volume")
+	}
+	identityAPI := newIdentityAPIService(settings, logger)
+	jobTracker := newJobTracker(settings, logger)
+	vehiclesCtrl := controllers.NewVehiclesController(settings, logger, identityAPI, jobTracker)
+	jobsCtrl := controllers.NewJobsController(settings, logger, jobTracker)
+	bulkTransferCtrl := controllers.NewBulkTransferController(settings, logger, newBulkTransferRunner(settings, logger, jobTracker, identityAPI))
+	identityCtrl := controllers.NewIdentityController(settings, logger, identityAPI)
+	earningsCtrl := controllers.NewEarningsController(settings, logger, identityAPI)
 	settingsCtrl := controllers.NewSettingsController(settings, logger)
 	accountsCtrl := controllers.NewAccountsController(settings, logger)
 	definitionsCtrl := controllers.NewDefinitionsController(settings, logger)
 	genericProxyCtrl := controllers.NewGenericProxyController(settings, logger)
+	trackingCtrl := controllers.NewTrackingController(settings, logger)
+	auditCtrl := controllers.NewAuditController(settings, logger)
+	idempotencyCtrl := controllers.NewIdempotencyController(settings, logger)
 
-	jwtAuth := jwtware.New(jwtware.Config{
-		JWKSetURLs: []string{settings.JwtKeySetURL.String()},
-	})
+	verifier, err := auth.NewVerifier(settings, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up JWT verification")
+	}
+	jwtAuth := verifier.Middleware
+	developerJWT := newDeveloperJWTService(settings, logger)
+	developerAuth := developerAuthMiddleware(developerJWT, logger)
+	tokenExchange := newTokenExchangeService(settings, logger, developerJWT)
+	dropPrivileges := dropPrivilegesMiddleware(tokenExchange)
+	telemetryCtrl := controllers.NewTelemetryController(settings, logger, newTelemetryService(settings, logger, tokenExchange))
+	onboardingPipeline := newOnboardingPipeline(settings, logger, jobTracker, developerJWT)
+	onboardingCtrl := controllers.NewOnboardingController(settings, logger, onboardingPipeline)
+	recoveryCtrl := controllers.NewRecoveryController(settings, logger, newRecovery(settings, logger, jobTracker, onboardingPipeline, identityAPI))
 	knownOracles := settings.GetOracles()
 
-	// Public tracking routes (no JWT, validated by share link UUID in backend)
-	app.Get("/tracking/:shareID", genericProxyCtrl.TrackingProxy)
-	app.Post("/tracking/:shareID/telemetry", genericProxyCtrl.TrackingProxy)
-	app.Post("/tracking/:shareID/trips", genericProxyCtrl.TrackingProxy)
+	// Public tracking routes (no JWT). The share link is checked here before anything reaches the oracle,
+	// and queries are limited to the signals the share covers.
+	app.Get("/tracking/:shareID", trackingCtrl.GetShare)
+	app.Post("/tracking/:shareID/telemetry", trackingCtrl.Telemetry)
+	app.Post("/tracking/:shareID/trips", trackingCtrl.Trips)
 
 	// these are general to the app, not oracle specific
 	app.Get("/public/settings", settingsCtrl.GetPublicSettings)
 	app.Get("/public/oracles", settingsCtrl.GetOracles)
 	app.Get("/identity/vehicle/:tokenID", identityCtrl.GetVehicleByTokenID)
+	// fan out to many identity queries per request, so only for signed in users
+	app.Post("/identity/vehicles", jwtAuth, identityCtrl.GetVehiclesByTokenIDs)
 	app.Post("/identity/proxy", identityCtrl.ProxyGraphQLQuery)
 	app.Get("/identity/definition/:id", identityCtrl.GetDefinitionByID)
 	app.Get("/identity/owner/:owner", identityCtrl.GetOwnerBy0x)
-	app.Post("/definitions/decodevin", jwtAuth, definitionsCtrl.DecodeVIN)
+	app.Get("/identity/owner/:owner/all", jwtAuth, identityCtrl.ExportOwnerVehicles)
+	app.Post("/definitions/decodevin", jwtAuth, developerAuth, definitionsCtrl.DecodeVIN) // developer auth
 
-	// oracle group with route parameter.
-	oracleApp := app.Group("/oracle/:oracleID", jwtAuth, oracleIDMiddleware(knownOracles))
+	// oracle group with route parameter. Every non-GET request in it is written to the audit log, and one carrying an
+	// Idempotency-Key is answered once, with the first response replayed to its retries.
+	oracleApp := app.Group("/oracle/:oracleID", jwtAuth, oracleIDMiddleware(knownOracles), auditCtrl.Middleware, idempotencyCtrl.Middleware)
 	oracleApp.Get("/permissions", genericProxyCtrl.Proxy)
+	// audit log of mutating requests, for the caller's tenant
+	oracleApp.Get("/audit", auditCtrl.GetAuditLog)
+	oracleApp.Get("/audit/export", auditCtrl.ExportAuditLog)
+	// mint, transfer, disconnect and delete jobs the BFF follows, stream is server-sent events
+	oracleApp.Get("/jobs", jobsCtrl.ListJobs)
+	oracleApp.Get("/jobs/stream", jobsCtrl.StreamJobs)
+	oracleApp.Get("/jobs/:id", jobsCtrl.GetJob)
 	// dashboard
 	oracleApp.Get("/dashboard/stats", genericProxyCtrl.Proxy)
 	// pending vehicles
@@ -98,13 +155,19 @@ func App(settings *config.Settings, logger *zerolog.Logger, commitHash string) *
 	oracleApp.Delete("/pending-vehicle/vin-to-imei/:imei", genericProxyCtrl.Proxy)
 	oracleApp.Get("/pending-vehicle-telemetry/:imei", genericProxyCtrl.Proxy)
 	oracleApp.Delete("/pending-vehicle-telemetry/:imei", genericProxyCtrl.Proxy)
+	// device commands, checked against the device type's catalog. Destructive ones need a confirmation token.
 	oracleApp.Post("/pending-vehicle/command/:imei", vehiclesCtrl.SubmitCommand)
+	oracleApp.Post("/pending-vehicle/command/:imei/confirmation", vehiclesCtrl.ConfirmCommand)
+	oracleApp.Get("/pending-vehicle/command/:imei/catalog", vehiclesCtrl.GetCommandCatalog)
+	oracleApp.Get("/pending-vehicle/command/:imei/history", vehiclesCtrl.GetCommandHistory)
 
 	oracleApp.Get("/vehicles", genericProxyCtrl.Proxy)
 	oracleApp.Get("/vehicle/verify", vehiclesCtrl.GetVehiclesVerificationStatus)
 	oracleApp.Post("/vehicle/verify", vehiclesCtrl.SubmitVehiclesVerification)
 	// fleets
-	oracleApp.Get("/fleet/vehicles", genericProxyCtrl.Proxy)
+	oracleApp.Get("/fleet/vehicles", vehiclesCtrl.GetFleetVehicles) // ?enrich=identity joins identity data
+	oracleApp.Get("/fleet/grant-gaps", vehiclesCtrl.GetGrantGapReport)
+	oracleApp.Get("/fleet/earnings", earningsCtrl.GetFleetEarnings) // ?format=csv for finance
 	oracleApp.Get("/fleet/vehicles/apimaz/:vin", genericProxyCtrl.Proxy)
 	oracleApp.Post("/fleet/vehicles/apimaz/:vin/sync", genericProxyCtrl.Proxy)
 	oracleApp.Post("/fleet/vehicles/r1/sync", genericProxyCtrl.Proxy)
@@ -113,6 +176,12 @@ func App(settings *config.Settings, logger *zerolog.Logger, commitHash string) *
 	oracleApp.Get("/fleet/vehicles/telemetry-info/:tokenID", genericProxyCtrl.Proxy)
 	oracleApp.Post("/fleet/vehicles/telemetry/:tokenID", genericProxyCtrl.Proxy)
 	oracleApp.Post("/fleet/vehicles/fetch", genericProxyCtrl.Proxy)
+	// signals straight from telemetry-api, history downsampled for charts
+	oracleApp.Get("/vehicles/:tokenID/signals", telemetryCtrl.GetLatestSignals)
+	oracleApp.Get("/vehicles/:tokenID/signals/history", telemetryCtrl.GetSignalHistory)
+	// pending, verify, mint, fleet, identity, disconnect and delete combined into one state per vehicle
+	oracleApp.Get("/vehicles/lifecycle", vehiclesCtrl.GetFleetLifecycle)
+	oracleApp.Get("/vehicles/:vin/lifecycle", vehiclesCtrl.GetVehicleLifecycle)
 	oracleApp.Get("/fleet/groups", genericProxyCtrl.Proxy)
 	oracleApp.Post("/fleet/groups", genericProxyCtrl.Proxy)
 	oracleApp.Get("/fleet/groups/:id", genericProxyCtrl.Proxy)
@@ -130,6 +199,7 @@ func App(settings *config.Settings, logger *zerolog.Logger, commitHash string) *
 	oracleApp.Delete("/fleet/vehicles/shares/:shareID", genericProxyCtrl.Proxy)
 	oracleApp.Post("/fleet/vehicles/:tokenID/share", genericProxyCtrl.Proxy)
 	oracleApp.Get("/fleet/vehicles/:tokenID/shares", genericProxyCtrl.Proxy)
+	oracleApp.Get("/fleet/vehicles/shares/:shareID/access", trackingCtrl.GetShareAccessLog)
 
 	// report
 	oracleApp.Post("/fleet/reports", genericProxyCtrl.Proxy)
@@ -145,22 +215,41 @@ func App(settings *config.Settings, logger *zerolog.Logger, commitHash string) *
 	oracleApp.Get("/vehicle/mint/status", vehiclesCtrl.GetVehiclesMintStatus)
 	oracleApp.Post("/vehicle/mint", vehiclesCtrl.SubmitVehiclesMintData)
 
+	// onboarding a fleet from a VIN/IMEI manifest, run in the background up to the mint signatures
+	oracleApp.Post("/onboarding", onboardingCtrl.StartOnboarding)
+	oracleApp.Get("/onboarding", onboardingCtrl.ListOnboardings)
+	oracleApp.Get("/onboarding/:id", onboardingCtrl.GetOnboarding)
+	oracleApp.Post("/onboarding/:id/signatures", onboardingCtrl.SignOnboarding)
+	oracleApp.Post("/onboarding/:id/resume", onboardingCtrl.ResumeOnboarding)
+
+	// shared deletes and onboardings left half done, resumed or rolled back with the calls made recorded
+	oracleApp.Get("/recovery", recoveryCtrl.ListRecoveryChains)
+	oracleApp.Get("/recovery/:id", recoveryCtrl.GetRecoveryChain)
+	oracleApp.Post("/recovery/:id/resume", recoveryCtrl.ResumeRecoveryChain)
+	oracleApp.Post("/recovery/:id/rollback", recoveryCtrl.RollbackRecoveryChain)
+
 	// Disconnect vehicle
-	oracleApp.Get("/vehicle/disconnect", genericProxyCtrl.Proxy)
+	oracleApp.Get("/vehicle/disconnect", vehiclesCtrl.GetDisconnectData)
 	oracleApp.Post("/vehicle/disconnect", vehiclesCtrl.SubmitDisconnectData)
-	oracleApp.Post("/vehicle/disconnect/shared", vehiclesCtrl.SubmitSharedAccountDisconnect)
+	oracleApp.Post("/vehicle/disconnect/shared", dropPrivileges, vehiclesCtrl.SubmitSharedAccountDisconnect)
 	oracleApp.Get("/vehicle/disconnect/status", vehiclesCtrl.GetDisconnectStatus)
 
 	// Transfer vehicle
 	oracleApp.Get("/vehicle/transfer", vehiclesCtrl.GetTransferData)
 	oracleApp.Post("/vehicle/transfer", vehiclesCtrl.SubmitTransferData)
-	oracleApp.Post("/vehicle/transfer/shared", vehiclesCtrl.SubmitSharedAccountTransfer)
+	oracleApp.Post("/vehicle/transfer/shared", dropPrivileges, vehiclesCtrl.SubmitSharedAccountTransfer)
 	oracleApp.Get("/vehicle/transfer/status", vehiclesCtrl.GetTransferStatus)
+	// bulk transfers, text/csv or JSON upload, run in the background and resumable
+	oracleApp.Post("/vehicle/transfer/bulk", bulkTransferCtrl.StartBulkTransfer)
+	oracleApp.Get("/vehicle/transfer/bulk", bulkTransferCtrl.ListBulkTransfers)
+	oracleApp.Get("/vehicle/transfer/bulk/:id", bulkTransferCtrl.GetBulkTransfer)
+	oracleApp.Get("/vehicle/transfer/bulk/:id/report", bulkTransferCtrl.GetBulkTransferReport)
+	oracleApp.Post("/vehicle/transfer/bulk/:id/resume", bulkTransferCtrl.ResumeBulkTransfer)
 
 	// Delete vehicle
 	oracleApp.Get("/vehicle/delete", vehiclesCtrl.GetDeleteData)
 	oracleApp.Post("/vehicle/delete", vehiclesCtrl.SubmitDeleteData)
-	oracleApp.Post("/vehicle/delete/shared", vehiclesCtrl.SubmitSharedAccountDelete)
+	oracleApp.Post("/vehicle/delete/shared", dropPrivileges, vehiclesCtrl.SubmitSharedAccountDelete)
 	oracleApp.Get("/vehicle/delete/status", vehiclesCtrl.GetDeleteStatus)
 
 	oracleApp.Get("/vehicle/:vin", vehiclesCtrl.GetVehicleFromOracle)
@@ -272,15 +361,6 @@ func getVersion(c *fiber.Ctx) error {
 	})
 }
 
-func loadStaticIndex(ctx *fiber.Ctx) error {
-	dat, err := os.ReadFile("dist/index.html")
-	if err != nil {
-		return err
-	}
-	ctx.Set("Content-Type", "text/html; charset=utf-8")
-	return ctx.Status(fiber.StatusOK).Send(dat)
-}
-
 // ErrorHandler custom handler to log recovered errors using our logger and return json instead of string
 func ErrorHandler(c *fiber.Ctx, err error, logger *zerolog.Logger) error {
 	code := fiber.StatusInternalServerError // Default 500 statuscode
@@ -340,3 +420,165 @@ func oracleIDMiddleware(oracles []config.Oracle) fiber.Handler {
 		return c.Next()
 	}
 }
+
+// newDeveloperJWTService sets up the developer JWT used by "developer auth" routes and starts refreshing it in the
+// background. Nil when no DIMO client is configured.
+func newDeveloperJWTService(settings *config.Settings, logger *zerolog.Logger) service.DIMOJWTService {
+	if settings.DIMOClientID == "" {
+		logger.Warn().Msg("DIMO_CLIENT_ID not set, developer auth routes will pass the user's JWT through")
+		return nil
+	}
+	keyStore := service.NewFileKeyStore(settings.GetDIMOSigningKeyFile())
+	if settings.DIMOSigningKeyPEM != "" {
+		keyStore = service.NewStaticKeyStore(settings.DIMOSigningKeyPEM)
+	}
+	svc := service.NewDIMOJWTService(*logger, service.DIMOJWTConfig{
+		APIURL:          settings.DIMOAPIURL.String(),
+		ClientID:        settings.DIMOClientID,
+		ClientSecret:    settings.DIMOClientSecret,
+		KeyStore:        keyStore,
+		RotateEvery:     settings.GetDIMOKeyRotation(),
+		RotationOverlap: settings.GetDIMOKeyOverlap(),
+	})
+	svc.Start(context.Background())
+	return svc
+}
+
+// newTokenExchangeService trades the developer JWT for vehicle privilege tokens. Nil without a developer JWT or a
+// token exchange url.
+func newTokenExchangeService(settings *config.Settings, logger *zerolog.Logger, developerJWT service.DIMOJWTService) service.TokenExchangeService {
+	if developerJWT == nil || settings.TokenExchangeAPIURL.Host == "" {
+		return nil
+	}
+	if settings.VehicleNFTAddress == "" {
+		logger.Fatal().Msg("VEHICLE_NFT_ADDRESS is required with TOKEN_EXCHANGE_API_URL")
+	}
+	return service.NewTokenExchangeService(*logger, settings.TokenExchangeAPIURL.String(), settings.VehicleNFTAddress, developerJWT)
+}
+
+// dropPrivilegesMiddleware drops the cached privilege tokens of the vehicle in a shared account transfer, disconnect
+// or delete once the oracle has accepted it, the privileges came from the vehicle's previous owner.
+func dropPrivilegesMiddleware(tokenExchange service.TokenExchangeService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if tokenExchange == nil {
+			return c.Next()
+		}
+		if err := c.Next(); err != nil || c.Response().StatusCode() >= fiber.StatusMultipleChoices {
+			return err
+		}
+		var req struct {
+			TokenID json.Number `json:"tokenId"`
+		}
+		if json.Unmarshal(c.Body(), &req) == nil {
+			if tokenID, err := strconv.ParseUint(req.TokenID.String(), 10, 64); err == nil {
+				tokenExchange.Invalidate(tokenID)
+			}
+		}
+		return nil
+	}
+}
+
+// newIdentityAPIService is the identity api client with its lookup cache, shared by the controllers that read or
+// change vehicle ownership
+func newIdentityAPIService(settings *config.Settings, logger *zerolog.Logger) service.IdentityAPI {
+	return service.NewIdentityAPIService(*logger, settings.IdentityAPIURL.String(), service.IdentityCacheConfig{
+		Size:          settings.IdentityCacheSize,
+		VehicleTTL:    time.Duration(settings.IdentityVehicleCacheSeconds) * time.Second,
+		DefinitionTTL: time.Duration(settings.IdentityDefinitionCacheMinutes) * time.Minute,
+	})
+}
+
+// newJobTracker loads the tracked jobs from the data dir and starts polling the unfinished ones
+func newJobTracker(settings *config.Settings, logger *zerolog.Logger) *service.JobTracker {
+	tracker := service.NewJobTracker(*logger, service.JobTrackerConfig{
+		StorePath:       filepath.Join(settings.GetDataDir(), "jobs.jsonl"),
+		OracleURLs:      oracleURLs(settings),
+		PollInterval:    time.Duration(settings.JobPollSeconds) * time.Second,
+		MaxPollInterval: time.Duration(settings.JobPollMaxSeconds) * time.Second,
+		Timeout:         time.Duration(settings.JobTimeoutMinutes) * time.Minute,
+	})
+	tracker.Start(context.Background())
+	return tracker
+}
+
+// oracleURLs are the configured oracle base urls by oracle id, for the services that call oracles in the background
+func oracleURLs(settings *config.Settings) map[string]url.URL {
+	urls := map[string]url.URL{}
+	for _, o := range settings.GetOracles() {
+		urls[o.OracleID] = o.URL
+	}
+	return urls
+}
+
+// newBulkTransferRunner submits bulk transfers, dropping the cached identity data of every vehicle it transfers
+func newBulkTransferRunner(settings *config.Settings, logger *zerolog.Logger, jobs *service.JobTracker, identityAPI service.IdentityAPI) *service.BulkTransferRunner {
+	return service.NewBulkTransferRunner(*logger, service.BulkTransferConfig{
+		StorePath:   filepath.Join(settings.GetDataDir(), "bulk_transfers.jsonl"),
+		OracleURLs:  oracleURLs(settings),
+		Concurrency: settings.BulkConcurrency,
+		Pace:        time.Duration(settings.BulkPaceMillis) * time.Millisecond,
+		OnSubmitted: identityAPI.InvalidateVehicle,
+	}, jobs)
+}
+
+// newOnboardingPipeline runs onboardings, decoding VINs with the developer JWT when there is one
+func newOnboardingPipeline(settings *config.Settings, logger *zerolog.Logger, jobs *service.JobTracker, developerJWT service.DIMOJWTService) *service.OnboardingPipeline {
+	limits, err := settings.GetOnboardingConcurrency()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid onboarding concurrency")
+	}
+	concurrency := map[service.OnboardingStage]int{}
+	for _, stage := range service.OnboardingStages {
+		concurrency[stage] = settings.BulkConcurrency
+		if n, ok := limits[string(stage)]; ok {
+			concurrency[stage] = n
+		}
+	}
+	return service.NewOnboardingPipeline(*logger, service.OnboardingConfig{
+		StorePath:      filepath.Join(settings.GetDataDir(), "onboarding.jsonl"),
+		OracleURLs:     oracleURLs(settings),
+		DefinitionsURL: settings.DefinitionAPIURL,
+		DeveloperJWT:   developerJWT,
+		Concurrency:    concurrency,
+	}, jobs)
+}
+
+// newRecovery follows the tracker's shared deletes and the pipeline's onboardings, dropping the cached identity data
+// of every vehicle a resumed delete submits
+func newRecovery(settings *config.Settings, logger *zerolog.Logger, jobs *service.JobTracker, onboarding *service.OnboardingPipeline, identityAPI service.IdentityAPI) *service.Recovery {
+	recovery := service.NewRecovery(*logger, service.RecoveryConfig{
+		StorePath:   filepath.Join(settings.GetDataDir(), "recovery.jsonl"),
+		OracleURLs:  oracleURLs(settings),
+		StallAfter:  settings.GetRecoveryStallAfter(),
+		OnSubmitted: identityAPI.InvalidateVehicle,
+	}, jobs, onboarding)
+	recovery.Start(context.Background())
+	return recovery
+}
+
+// newTelemetryService reads telemetry-api with vehicle privilege tokens exchanged for the developer JWT. Nil without
+// a token exchange or a telemetry-api url.
+func newTelemetryService(settings *config.Settings, logger *zerolog.Logger, tokenExchange service.TokenExchangeService) service.TelemetryAPI {
+	if tokenExchange == nil || settings.TelemetryAPIURL.Host == "" {
+		return nil
+	}
+	return service.NewTelemetryAPIService(*logger, settings.TelemetryAPIURL.String(), tokenExchange)
+}
+
+// developerAuthMiddleware marks a route as "developer auth": the upstream call is made with the app's developer JWT
+// instead of the user's. Controllers pick it up with developerAuthHeader and pass it to ProxyRequest as authHeader.
+// The user's JWT must still be checked before this.
+func developerAuthMiddleware(svc service.DIMOJWTService, logger *zerolog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if svc == nil {
+			return c.Next()
+		}
+		jwt, err := svc.GetDeveloperJWT()
+		if err != nil {
+			logger.Err(err).Str("path", c.Path()).Msg("failed to get developer JWT")
+			return fiber.NewError(fiber.StatusServiceUnavailable, "developer authentication unavailable")
+		}
+		c.Locals("developerAuth", "Bearer "+jwt)
+		return c.Next()
+	}
+}
@@ -0,0 +1,166 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// map tiles and place names for the fleet and tracking maps
+const (
+	osmTiles     = "https://*.tile.openstreetmap.org"
+	osmNominatim = "https://nominatim.openstreetmap.org"
+	leafletCSS   = "https://unpkg.com"
+)
+
+// securityHeaders sets the headers that apply to every response. The Content-Security-Policy is per page and
+// is set where the html is served, see htmlPage.
+func securityHeaders(settings *config.Settings) fiber.Handler {
+	hsts := ""
+	if maxAge := settings.GetHSTSMaxAge(); maxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(maxAge) + "; includeSubDomains"
+	}
+	return func(c *fiber.Ctx) error {
+		if hsts != "" {
+			c.Set(fiber.HeaderStrictTransportSecurity, hsts)
+		}
+		c.Set(fiber.HeaderXFrameOptions, settings.GetFrameOptions())
+		c.Set(fiber.HeaderReferrerPolicy, settings.GetReferrerPolicy())
+		c.Set(fiber.HeaderPermissionsPolicy, settings.GetPermissionsPolicy())
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		return c.Next()
+	}
+}
+
+// cspPolicy returns the Content-Security-Policy of a page for the nonce it was served with
+type cspPolicy func(nonce string) string
+
+// appCSP is the policy for the fleet manager and login pages. Besides our own origin the app talks to the login,
+// accounts, turnkey and chain endpoints in settings when signing, so those origins are allowed to connect.
+func appCSP(settings *config.Settings) cspPolicy {
+	connect := []string{"'self'", osmNominatim}
+	for _, u := range []url.URL{settings.LoginURL, settings.AccountsAPIURL, settings.TurnkeyAPIURL, settings.RPCURL,
+		settings.BundlerURL, settings.PaymasterURL, settings.IdentityAPIURL} {
+		if o := origin(u); o != "" {
+			connect = append(connect, o)
+		}
+	}
+	connect = append(connect, strings.Fields(settings.CSPExtraConnectSrc)...)
+	img := append([]string{"'self'", "data:", "blob:", osmTiles, "https://www.dimo.org", "https://assets.dimo.org"},
+		strings.Fields(settings.CSPExtraImgSrc)...)
+	frame := append([]string{"'self'", "https://*.turnkey.com"}, strings.Fields(settings.CSPExtraFrameSrc)...)
+
+	return func(nonce string) string {
+		return buildCSP([][]string{
+			{"default-src", "'self'"},
+			{"script-src", "'self'", "'nonce-" + nonce + "'"},
+			// lit templates use inline style attributes all over
+			{"style-src", "'self'", "'unsafe-inline'", leafletCSS},
+			append([]string{"img-src"}, img...),
+			{"font-src", "'self'", "data:"},
+			append([]string{"connect-src"}, dedupe(connect)...),
+			append([]string{"frame-src"}, frame...),
+			{"object-src", "'none'"},
+			{"base-uri", "'self'"},
+			{"form-action", "'self'"},
+			{"frame-ancestors", "'none'"},
+			{"report-uri", "/csp-report"},
+			{"report-to", "csp"},
+		})
+	}
+}
+
+// trackingCSP is the policy for the public tracking page, which only ever talks to us and draws a map
+func trackingCSP() cspPolicy {
+	return func(nonce string) string {
+		return buildCSP([][]string{
+			{"default-src", "'none'"},
+			{"script-src", "'self'", "'nonce-" + nonce + "'"},
+			{"style-src", "'self'", "'unsafe-inline'", leafletCSS},
+			{"img-src", "'self'", "data:", osmTiles, "https://www.dimo.org"},
+			{"font-src", "'self'"},
+			{"connect-src", "'self'", osmNominatim},
+			{"object-src", "'none'"},
+			{"base-uri", "'none'"},
+			{"form-action", "'none'"},
+			{"frame-ancestors", "'none'"},
+			{"report-uri", "/csp-report"},
+			{"report-to", "csp"},
+		})
+	}
+}
+
+// trackingPermissionsPolicy denies everything the tracking page has no use for, passkeys included
+const trackingPermissionsPolicy = "publickey-credentials-get=(), publickey-credentials-create=(), camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+
+// htmlPage serves one of the SPA's html entry points with a fresh nonce on every script tag and the matching CSP
+func htmlPage(settings *config.Settings, file string, policy cspPolicy, tight bool) fiber.Handler {
+	cspHeader := fiber.HeaderContentSecurityPolicy
+	if settings.CSPReportOnly {
+		cspHeader = fiber.HeaderContentSecurityPolicyReportOnly
+	}
+	return func(c *fiber.Ctx) error {
+		dat, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		nonce, err := newNonce()
+		if err != nil {
+			return err
+		}
+		dat = bytes.ReplaceAll(dat, []byte("<script"), []byte(`<script nonce="`+nonce+`"`))
+
+		c.Set(cspHeader, policy(nonce))
+		c.Set("Reporting-Endpoints", `csp="/csp-report"`)
+		if tight {
+			c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+			c.Set(fiber.HeaderPermissionsPolicy, trackingPermissionsPolicy)
+		}
+		// the nonce changes every time, never let a cache hand out an old one
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		c.Set("Content-Type", "text/html; charset=utf-8")
+		return c.Status(fiber.StatusOK).Send(dat)
+	}
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func buildCSP(directives [][]string) string {
+	parts := make([]string, 0, len(directives))
+	for _, d := range directives {
+		parts = append(parts, strings.Join(d, " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func origin(u url.URL) string {
+	if u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func dedupe(in []string) []string {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(in))
+	for _, v := range in {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestHTMLPage_Nonce(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "index.html")
+	html := `<html><head><script type="module" src="/assets/index.js"></script></head><body><script>1</script></body></html>`
+	if err := os.WriteFile(page, []byte(html), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := &config.Settings{Environment: "prod"}
+	app := fiber.New()
+	app.Use(securityHeaders(settings))
+	app.Get("/", htmlPage(settings, page, appCSP(settings), false))
+	app.Get("/tracking.html", htmlPage(settings, page, trackingCSP(), true))
+
+	nonces := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+
+		m := regexp.MustCompile(`<script nonce="([^"]+)"`).FindAllStringSubmatch(string(body), -1)
+		if len(m) != 2 || m[0][1] != m[1][1] {
+			t.Fatalf("expected both script tags to carry the same nonce: %s", body)
+		}
+		nonce := m[0][1]
+		nonces[nonce] = true
+
+		csp := resp.Header.Get(fiber.HeaderContentSecurityPolicy)
+		if !strings.Contains(csp, "'nonce-"+nonce+"'") {
+			t.Errorf("CSP %q does not allow nonce %s", csp, nonce)
+		}
+		if !strings.HasPrefix(resp.Header.Get(fiber.HeaderStrictTransportSecurity), "max-age=31536000") {
+			t.Errorf("expected HSTS in prod, got %q", resp.Header.Get(fiber.HeaderStrictTransportSecurity))
+		}
+		if !strings.Contains(resp.Header.Get(fiber.HeaderPermissionsPolicy), "publickey-credentials-get=(self)") {
+			t.Errorf("passkeys must stay allowed on the app, got %q", resp.Header.Get(fiber.HeaderPermissionsPolicy))
+		}
+	}
+	if len(nonces) != 2 {
+		t.Errorf("expected a fresh nonce per request")
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/tracking.html", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csp := resp.Header.Get(fiber.HeaderContentSecurityPolicy); !strings.HasPrefix(csp, "default-src 'none'") {
+		t.Errorf("expected the tracking page to get the tight policy, got %q", csp)
+	}
+	if resp.Header.Get(fiber.HeaderReferrerPolicy) != "no-referrer" {
+		t.Errorf("expected no-referrer on the tracking page, got %q", resp.Header.Get(fiber.HeaderReferrerPolicy))
+	}
+}
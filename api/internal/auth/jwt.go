@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+// principalKey is the fiber Locals key the verified caller is stored under
+const principalKey = "principal"
+
+// revokedCheckInterval is how often the revoked ids file is checked for changes
+const revokedCheckInterval = 30 * time.Second
+
+// Principal is the caller of a request, from a verified JWT
+type Principal struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	TokenID   string
+	Wallet    string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Claims    jwt.MapClaims
+}
+
+// GetPrincipal returns the verified caller, nil on routes without JWT auth
+func GetPrincipal(c *fiber.Ctx) *Principal {
+	p, _ := c.Locals(principalKey).(*Principal)
+	return p
+}
+
+// Verifier checks bearer tokens against a set of trusted issuers. Unlike a single JWKS keyfunc, a token is only
+// accepted when its iss is one we trust, it is signed by that issuer's keys, carries one of that issuer's audiences,
+// is within its validity window (give or take the clock skew) and hasn't been revoked.
+type Verifier struct {
+	logger  *zerolog.Logger
+	skew    time.Duration
+	issuers map[string]issuerKeys
+
+	revokedFile string
+	mu          sync.Mutex
+	revoked     map[string]bool
+	revokedMod  time.Time
+	revokedAt   time.Time
+}
+
+type issuerKeys struct {
+	audiences []string
+	keyfunc   jwt.Keyfunc
+}
+
+// NewVerifier fetches the keys of every trusted issuer, failing if any can't be loaded.
+func NewVerifier(settings *config.Settings, logger *zerolog.Logger) (*Verifier, error) {
+	trusted, err := settings.GetTrustedIssuers()
+	if err != nil {
+		return nil, err
+	}
+	v := &Verifier{
+		logger:      logger,
+		skew:        settings.GetJwtClockSkew(),
+		issuers:     make(map[string]issuerKeys, len(trusted)),
+		revokedFile: settings.JwtRevokedIDsFile,
+	}
+	for _, iss := range trusted {
+		jwks, err := keyfunc.Get(iss.JWKSURL, keyfunc.Options{
+			RefreshErrorHandler: func(err error) {
+				logger.Err(err).Str("jwks", iss.JWKSURL).Msg("failed to refresh JWK set")
+			},
+			RefreshInterval:   time.Hour,
+			RefreshRateLimit:  5 * time.Minute,
+			RefreshTimeout:    10 * time.Second,
+			RefreshUnknownKID: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get JWK set for issuer %s: %w", iss.Issuer, err)
+		}
+		v.issuers[iss.Issuer] = issuerKeys{audiences: iss.Audiences, keyfunc: jwks.Keyfunc}
+	}
+	return v, nil
+}
+
+// newVerifierWithKeys is for tests, skipping the JWKS fetch
+func newVerifierWithKeys(logger *zerolog.Logger, skew time.Duration, issuers map[string]issuerKeys) *Verifier {
+	return &Verifier{logger: logger, skew: skew, issuers: issuers}
+}
+
+// Middleware verifies the bearer token and stores the Principal in Locals
+func (v *Verifier) Middleware(c *fiber.Ctx) error {
+	header := c.Get(fiber.HeaderAuthorization)
+	raw, found := strings.CutPrefix(header, "Bearer ")
+	if !found || raw == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Missing or malformed JWT")
+	}
+
+	p, err := v.Verify(raw)
+	if err != nil {
+		v.logger.Debug().Err(err).Msg("rejected JWT")
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid or expired JWT")
+	}
+	c.Locals(principalKey, p)
+	return c.Next()
+}
+
+// Verify validates a raw token and returns its principal
+func (v *Verifier) Verify(raw string) (*Principal, error) {
+	// read the issuer first, it decides which keys and audiences apply. Nothing from this parse is trusted.
+	unverified, _, err := jwt.NewParser().ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	iss, err := unverified.Claims.GetIssuer()
+	if err != nil {
+		return nil, err
+	}
+	trusted, ok := v.issuers[iss]
+	if !ok {
+		return nil, fmt.Errorf("untrusted issuer %q", iss)
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(raw, claims, trusted.keyfunc,
+		jwt.WithIssuer(iss),
+		jwt.WithAudience(trusted.audiences...),
+		jwt.WithLeeway(v.skew),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "PS256"}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	p := &Principal{Issuer: iss, Claims: claims}
+	p.Subject, _ = claims.GetSubject()
+	p.Audience, _ = claims.GetAudience()
+	p.TokenID, _ = claims["jti"].(string)
+	p.Wallet, _ = claims["ethereum_address"].(string)
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		p.ExpiresAt = exp.Time
+	}
+	if iat, _ := claims.GetIssuedAt(); iat != nil {
+		p.IssuedAt = iat.Time
+	}
+
+	if p.TokenID != "" && v.isRevoked(p.TokenID) {
+		return nil, fmt.Errorf("token %s has been revoked", p.TokenID)
+	}
+	return p, nil
+}
+
+// isRevoked checks the deny-list, re-reading the file when it has changed. If the file can't be read the last
+// good list stays in force.
+func (v *Verifier) isRevoked(jti string) bool {
+	if v.revokedFile == "" {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if time.Since(v.revokedAt) > revokedCheckInterval {
+		v.revokedAt = time.Now()
+		if err := v.loadRevoked(); err != nil {
+			v.logger.Err(err).Str("file", v.revokedFile).Msg("failed to read revoked token ids")
+		}
+	}
+	return v.revoked[jti]
+}
+
+func (v *Verifier) loadRevoked() error {
+	info, err := os.Stat(v.revokedFile)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(v.revokedMod) {
+		return nil
+	}
+	f, err := os.Open(v.revokedFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	revoked := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			revoked[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	v.revoked = revoked
+	v.revokedMod = info.ModTime()
+	v.logger.Info().Int("count", len(revoked)).Msg("loaded revoked token ids")
+	return nil
+}
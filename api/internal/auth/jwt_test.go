@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+const (
+	testIssuer   = "https://auth.dimo.zone"
+	testAudience = "0x51dacC165f1306Abfbf0a6312ec96E13AAA826DB"
+)
+
+func newTestVerifier(t *testing.T) (*Verifier, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	v := newVerifierWithKeys(&logger, time.Minute, map[string]issuerKeys{
+		testIssuer: {
+			audiences: []string{testAudience},
+			keyfunc:   func(*jwt.Token) (any, error) { return &key.PublicKey, nil },
+		},
+	})
+	return v, key
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func claims(mod func(jwt.MapClaims)) jwt.MapClaims {
+	c := jwt.MapClaims{
+		"iss":              testIssuer,
+		"aud":              testAudience,
+		"sub":              "user-1",
+		"jti":              "token-1",
+		"ethereum_address": "0xabc",
+		"iat":              time.Now().Unix(),
+		"exp":              time.Now().Add(time.Hour).Unix(),
+	}
+	if mod != nil {
+		mod(c)
+	}
+	return c
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	v, key := newTestVerifier(t)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", token: sign(t, key, claims(nil))},
+		{name: "expired within skew", token: sign(t, key, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }))},
+		{name: "expired", token: sign(t, key, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-5 * time.Minute).Unix() })), wantErr: true},
+		{name: "no expiry", token: sign(t, key, claims(func(c jwt.MapClaims) { delete(c, "exp") })), wantErr: true},
+		{name: "other client", token: sign(t, key, claims(func(c jwt.MapClaims) { c["aud"] = "0xsomeoneelse" })), wantErr: true},
+		{name: "untrusted issuer", token: sign(t, key, claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example" })), wantErr: true},
+		{name: "wrong key", token: sign(t, otherKey, claims(nil)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (p.Subject != "user-1" || p.Wallet != "0xabc" || p.Issuer != testIssuer) {
+				t.Errorf("unexpected principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestVerifier_Revoked(t *testing.T) {
+	v, key := newTestVerifier(t)
+	v.revokedFile = filepath.Join(t.TempDir(), "revoked.txt")
+	if err := os.WriteFile(v.revokedFile, []byte("# revoked ids\ntoken-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.Verify(sign(t, key, claims(nil))); err == nil {
+		t.Error("expected a revoked token to be rejected")
+	}
+	if _, err := v.Verify(sign(t, key, claims(func(c jwt.MapClaims) { c["jti"] = "token-2" }))); err != nil {
+		t.Errorf("expected other tokens to pass, got %v", err)
+	}
+}
+
+func TestVerifier_Middleware(t *testing.T) {
+	v, key := newTestVerifier(t)
+	app := fiber.New()
+	app.Get("/", v.Middleware, func(c *fiber.Ctx) error {
+		return c.SendString(GetPrincipal(c).Subject)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+sign(t, key, claims(nil)))
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest(http.MethodGet, "/", nil), -1)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 without a token, got %d", resp.StatusCode)
+	}
+}
@@ -1,6 +1,13 @@
 package config
 
-import "net/url"
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Settings struct {
 	Environment          string  `yaml:"ENVIRONMENT"`
@@ -19,22 +26,426 @@ type Settings struct {
 	TurnkeyOrgID     string  `yaml:"TURNKEY_ORG_ID"`
 	TurnkeyAPIURL    url.URL `yaml:"TURNKEY_API_URL"`
 
+	// identity lookups cache, see service.IdentityCacheConfig for the defaults
+	IdentityCacheSize              int `yaml:"IDENTITY_CACHE_SIZE"`
+	IdentityVehicleCacheSeconds    int `yaml:"IDENTITY_VEHICLE_CACHE_SECONDS"`
+	IdentityDefinitionCacheMinutes int `yaml:"IDENTITY_DEFINITION_CACHE_MINUTES"`
+	// most token ids POST /identity/vehicles takes at once
+	IdentityBatchMaxTokenIDs int `yaml:"IDENTITY_BATCH_MAX_TOKEN_IDS"`
+	// SACD grants the grant-gap report checks fleet vehicles for, comma separated entries of
+	// "label|grantee address|privileges", privileges being space separated ids or names. See GetRequiredGrants.
+	SacdRequiredGrants string `yaml:"SACD_REQUIRED_GRANTS"`
+	// most vehicles /identity/owner/:owner/all exports, paging through the owner's inventory
+	IdentityExportMaxVehicles int `yaml:"IDENTITY_EXPORT_MAX_VEHICLES"`
+	// how long /fleet/earnings keeps a caller's fleet and its earnings before reading them again
+	FleetEarningsCacheMinutes int `yaml:"FLEET_EARNINGS_CACHE_MINUTES"`
+
 	TurnkeyRPID    string  `yaml:"TURNKEY_RP_ID"`
 	JwtKeySetURL   url.URL `yaml:"JWT_KEY_SET_URL"`
 	ClientID       string  `yaml:"CLIENT_ID"`
 	LoginURL       url.URL `yaml:"LOGIN_URL"`
 	AccountsAPIURL url.URL `yaml:"ACCOUNTS_API_URL"`
 
+	// Trusted JWT issuers, comma separated entries of "issuer|jwks url|audience audience ...". When empty the
+	// issuer of JWT_KEY_SET_URL is trusted with CLIENT_ID as the audience. See GetTrustedIssuers.
+	JwtTrustedIssuers   string `yaml:"JWT_TRUSTED_ISSUERS"`
+	JwtClockSkewSeconds int    `yaml:"JWT_CLOCK_SKEW_SECONDS"`
+	// optional file of revoked token ids (jti), one per line. Re-read when it changes.
+	JwtRevokedIDsFile string `yaml:"JWT_REVOKED_IDS_FILE"`
+
 	// DIMO JWT Configuration
 	DIMOAPIURL       url.URL `yaml:"DIMO_API_URL"`
 	DIMOClientID     string  `yaml:"DIMO_CLIENT_ID"`
 	DIMOClientSecret string  `yaml:"DIMO_CLIENT_SECRET"`
+	// vehicle privilege tokens for calling DIMO's telemetry and fetch APIs directly, exchanged with the developer JWT
+	TokenExchangeAPIURL url.URL `yaml:"TOKEN_EXCHANGE_API_URL"`
+	VehicleNFTAddress   string  `yaml:"VEHICLE_NFT_ADDRESS"`
+	// telemetry-api GraphQL endpoint for the signals and signal history endpoints. History range is capped at
+	// TELEMETRY_MAX_RANGE_DAYS.
+	TelemetryAPIURL       url.URL `yaml:"TELEMETRY_API_URL"`
+	TelemetryMaxRangeDays int     `yaml:"TELEMETRY_MAX_RANGE_DAYS"`
+	// The developer JWT signing key: PEM from a secret, or else a PEM file, created on first use. The key is
+	// rotated every DIMO_KEY_ROTATION_DAYS, the new one signing after DIMO_KEY_OVERLAP_MINUTES.
+	DIMOSigningKeyPEM     string `yaml:"DIMO_SIGNING_KEY_PEM"`
+	DIMOSigningKeyFile    string `yaml:"DIMO_SIGNING_KEY_FILE"`
+	DIMOKeyRotationDays   int    `yaml:"DIMO_KEY_ROTATION_DAYS"`
+	DIMOKeyOverlapMinutes int    `yaml:"DIMO_KEY_OVERLAP_MINUTES"`
+
+	// DataDir is where the BFF keeps its local, append-only records (share access log etc.)
+	DataDir string `yaml:"DATA_DIR"`
+
+	// CommandConfirmationSecret signs the confirmation tokens of destructive device commands, so any replica can
+	// check them. Empty uses a key file in DATA_DIR, created on first use.
+	CommandConfirmationSecret string `yaml:"COMMAND_CONFIRMATION_SECRET"`
+	// CommandHistoryRetentionDays is how long a device command is kept in its device's history, 90 days by default
+	CommandHistoryRetentionDays int `yaml:"COMMAND_HISTORY_RETENTION_DAYS"`
+
+	// Job tracking: submitted mint, transfer, disconnect and delete jobs are polled until done, or until they've been
+	// polled for JOB_TIMEOUT_MINUTES, not counting time spent awaiting the submitter's credentials. Poll waits start at
+	// JOB_POLL_SECONDS and double up to JOB_POLL_MAX_SECONDS.
+	JobTimeoutMinutes int `yaml:"JOB_TIMEOUT_MINUTES"`
+	JobPollSeconds    int `yaml:"JOB_POLL_SECONDS"`
+	JobPollMaxSeconds int `yaml:"JOB_POLL_MAX_SECONDS"`
+
+	// Bulk runs submit BULK_CONCURRENCY requests at once, at most one every BULK_PACE_MILLIS, so a large run
+	// doesn't crowd out the tenant's signer. Zero takes the defaults, 4 and 500.
+	BulkConcurrency int `yaml:"BULK_CONCURRENCY"`
+	BulkPaceMillis  int `yaml:"BULK_PACE_MILLIS"`
+	// OnboardingConcurrency is how many requests each onboarding stage makes at once, as stage=n entries, eg.
+	// "link=8,verify=2". Stages left out get BULK_CONCURRENCY.
+	OnboardingConcurrency string `yaml:"ONBOARDING_CONCURRENCY"`
+
+	// VIN list lookups (verify, mint and disconnect/delete status) go upstream VIN_CHUNK_SIZE vins per request, at
+	// most VIN_CHUNK_CONCURRENCY at once, so a large fleet doesn't run into URL length limits. Zero takes 50 and 4.
+	VinChunkSize        int `yaml:"VIN_CHUNK_SIZE"`
+	VinChunkConcurrency int `yaml:"VIN_CHUNK_CONCURRENCY"`
+
+	// IdempotencyWindowMinutes is how long the first response to an Idempotency-Key is replayed, a day by default
+	IdempotencyWindowMinutes int `yaml:"IDEMPOTENCY_WINDOW_MINUTES"`
+
+	// RecoveryStallMinutes is how long a step of a multi-step operation may go without progress before the operation
+	// is reported as stalled, 30 minutes by default
+	RecoveryStallMinutes int `yaml:"RECOVERY_STALL_MINUTES"`
+
+	// Public vehicle tracking gateway. Signals are a comma separated list of telemetry-api signal names
+	// a share link may expose; a share that carries its own list is narrowed to it.
+	TrackingAllowedSignals       string `yaml:"TRACKING_ALLOWED_SIGNALS"`
+	TrackingMaxRangeHours        int    `yaml:"TRACKING_MAX_RANGE_HOURS"`
+	TrackingNegativeCacheSeconds int    `yaml:"TRACKING_NEGATIVE_CACHE_SECONDS"`
+	// TrackingAccessRetentionDays is how long views of a share link are kept in its access log, 90 days by default
+	TrackingAccessRetentionDays int `yaml:"TRACKING_ACCESS_RETENTION_DAYS"`
+
+	// Security headers for the served SPA. Extra CSP sources are space separated, eg. "https://a.example https://b.example"
+	CSPReportOnly      bool   `yaml:"CSP_REPORT_ONLY"`
+	CSPExtraConnectSrc string `yaml:"CSP_EXTRA_CONNECT_SRC"`
+	CSPExtraImgSrc     string `yaml:"CSP_EXTRA_IMG_SRC"`
+	CSPExtraFrameSrc   string `yaml:"CSP_EXTRA_FRAME_SRC"`
+	HSTSMaxAgeSeconds  int    `yaml:"HSTS_MAX_AGE_SECONDS"`
+	FrameOptions       string `yaml:"FRAME_OPTIONS"`
+	ReferrerPolicy     string `yaml:"REFERRER_POLICY"`
+	PermissionsPolicy  string `yaml:"PERMISSIONS_POLICY"`
+
+	// LogRedaction is true or false, empty redacts in prod only. The lists are comma separated and add to the defaults.
+	LogRedaction         string `yaml:"LOG_REDACTION"`
+	LogRedactQueryParams string `yaml:"LOG_REDACT_QUERY_PARAMS"`
+	LogRedactFields      string `yaml:"LOG_REDACT_FIELDS"`
 }
 
 func (s *Settings) IsProduction() bool {
 	return s.Environment == "prod" // this string is set in the helm chart values-prod.yaml
 }
 
+// GetDIMOSigningKeyFile is where the developer JWT signing key is kept when it doesn't come from a secret
+func (s *Settings) GetDIMOSigningKeyFile() string {
+	if s.DIMOSigningKeyFile != "" {
+		return s.DIMOSigningKeyFile
+	}
+	return filepath.Join(s.GetDataDir(), "dimo_signing_key.pem")
+}
+
+// GetCommandConfirmationKeyFile is where the device command confirmation key is kept when it doesn't come from a secret
+func (s *Settings) GetCommandConfirmationKeyFile() string {
+	return filepath.Join(s.GetDataDir(), "command_confirmation.key")
+}
+
+// GetCommandHistoryRetention is how long device commands are kept in their history, 90 days unless set
+func (s *Settings) GetCommandHistoryRetention() time.Duration {
+	if s.CommandHistoryRetentionDays <= 0 {
+		return 90 * 24 * time.Hour
+	}
+	return time.Duration(s.CommandHistoryRetentionDays) * 24 * time.Hour
+}
+
+// GetDIMOKeyRotation is how long a developer JWT signing key is used before a scheduled rotation, 0 uses the default
+func (s *Settings) GetDIMOKeyRotation() time.Duration {
+	return time.Duration(s.DIMOKeyRotationDays) * 24 * time.Hour
+}
+
+// GetDIMOKeyOverlap is how long a rotated key is registered before it signs, 0 uses the default
+func (s *Settings) GetDIMOKeyOverlap() time.Duration {
+	return time.Duration(s.DIMOKeyOverlapMinutes) * time.Minute
+}
+
+// RedactLogs says whether PII is masked in the logs, always in prod unless turned off explicitly
+func (s *Settings) RedactLogs() bool {
+	switch strings.ToLower(s.LogRedaction) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return s.IsProduction()
+}
+
+// GetLogRedactQueryParams are the query params whose values are masked wherever a URL is logged
+func (s *Settings) GetLogRedactQueryParams() []string {
+	return append([]string{"vin", "vins", "owner_address", "targetWalletAddress", "walletAddress", "email", "search",
+		"imei", "tokenId"}, splitList(s.LogRedactQueryParams)...)
+}
+
+// GetLogRedactFields are the JSON fields whose values are masked in logged fields and bodies
+func (s *Settings) GetLogRedactFields() []string {
+	return append([]string{"vin", "email", "wallet", "walletAddress", "owner", "ownerAddress", "owner_address",
+		"targetWalletAddress", "imei", "tokenId", "licensePlate", "license_plate", "password", "otp", "signature"},
+		splitList(s.LogRedactFields)...)
+}
+
+// TrustedIssuer is a JWT issuer we accept tokens from, where to get its keys and the audiences a token must carry one of
+type TrustedIssuer struct {
+	Issuer    string
+	JWKSURL   string
+	Audiences []string
+}
+
+// GetTrustedIssuers parses JWT_TRUSTED_ISSUERS. An entry without audiences requires CLIENT_ID.
+func (s *Settings) GetTrustedIssuers() ([]TrustedIssuer, error) {
+	if s.JwtTrustedIssuers == "" {
+		jwks := s.JwtKeySetURL
+		if jwks.Host == "" {
+			return nil, fmt.Errorf("JWT_KEY_SET_URL or JWT_TRUSTED_ISSUERS is required")
+		}
+		return []TrustedIssuer{{
+			Issuer:    jwks.Scheme + "://" + jwks.Host,
+			JWKSURL:   jwks.String(),
+			Audiences: []string{s.ClientID},
+		}}, nil
+	}
+
+	var issuers []TrustedIssuer
+	for _, entry := range splitList(s.JwtTrustedIssuers) {
+		parts := strings.Split(entry, "|")
+		if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("JWT_TRUSTED_ISSUERS entry %q must be issuer|jwks url|audiences", entry)
+		}
+		iss := TrustedIssuer{Issuer: strings.TrimSpace(parts[0]), JWKSURL: strings.TrimSpace(parts[1])}
+		if len(parts) > 2 {
+			iss.Audiences = strings.Fields(parts[2])
+		}
+		if len(iss.Audiences) == 0 {
+			iss.Audiences = []string{s.ClientID}
+		}
+		issuers = append(issuers, iss)
+	}
+	return issuers, nil
+}
+
+// RequiredGrant is a SACD grant every fleet vehicle should carry, eg. to the oracle's developer license
+type RequiredGrant struct {
+	Label      string
+	Grantee    string
+	Privileges []string
+}
+
+// GetRequiredGrants parses SACD_REQUIRED_GRANTS. When it's empty the app's own developer license, DIMO_CLIENT_ID, is
+// required to have non-location data, which is what the signal endpoints read with.
+func (s *Settings) GetRequiredGrants() ([]RequiredGrant, error) {
+	if s.SacdRequiredGrants == "" {
+		if s.DIMOClientID == "" {
+			return nil, nil
+		}
+		return []RequiredGrant{{Label: "app", Grantee: s.DIMOClientID, Privileges: []string{"1"}}}, nil
+	}
+
+	var grants []RequiredGrant
+	for _, entry := range splitList(s.SacdRequiredGrants) {
+		parts := strings.Split(entry, "|")
+		if len(parts) != 3 || strings.TrimSpace(parts[1]) == "" || len(strings.Fields(parts[2])) == 0 {
+			return nil, fmt.Errorf("SACD_REQUIRED_GRANTS entry %q must be label|grantee|privileges", entry)
+		}
+		grants = append(grants, RequiredGrant{
+			Label:      strings.TrimSpace(parts[0]),
+			Grantee:    strings.TrimSpace(parts[1]),
+			Privileges: strings.Fields(parts[2]),
+		})
+	}
+	return grants, nil
+}
+
+// GetOnboardingConcurrency parses ONBOARDING_CONCURRENCY into the concurrency of each stage it names
+func (s *Settings) GetOnboardingConcurrency() (map[string]int, error) {
+	limits := map[string]int{}
+	for _, entry := range splitList(s.OnboardingConcurrency) {
+		stage, n, ok := strings.Cut(entry, "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if !ok || err != nil || limit <= 0 {
+			return nil, fmt.Errorf("ONBOARDING_CONCURRENCY entry %q must be stage=n", entry)
+		}
+		limits[strings.TrimSpace(stage)] = limit
+	}
+	return limits, nil
+}
+
+// GetJwtClockSkew is how far token exp/nbf/iat may be off from our clock, one minute by default
+func (s *Settings) GetJwtClockSkew() time.Duration {
+	if s.JwtClockSkewSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(s.JwtClockSkewSeconds) * time.Second
+}
+
+// GetVinChunkSize is the most vins sent upstream in one request's query, 50 unless set
+func (s *Settings) GetVinChunkSize() int {
+	if s.VinChunkSize <= 0 {
+		return 50
+	}
+	return s.VinChunkSize
+}
+
+// GetVinChunkConcurrency is how many chunks of a VIN list are requested at once, 4 unless set
+func (s *Settings) GetVinChunkConcurrency() int {
+	if s.VinChunkConcurrency <= 0 {
+		return 4
+	}
+	return s.VinChunkConcurrency
+}
+
+// GetIdempotencyWindow is how long a response is kept for replay under its Idempotency-Key, 24 hours unless set
+func (s *Settings) GetIdempotencyWindow() time.Duration {
+	if s.IdempotencyWindowMinutes <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(s.IdempotencyWindowMinutes) * time.Minute
+}
+
+// GetRecoveryStallAfter is how long a multi-step operation may go without progress before it's stalled, 30 minutes
+// unless set
+func (s *Settings) GetRecoveryStallAfter() time.Duration {
+	if s.RecoveryStallMinutes <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(s.RecoveryStallMinutes) * time.Minute
+}
+
+// GetDataDir returns the directory for local records, defaulting to ./data
+func (s *Settings) GetDataDir() string {
+	if s.DataDir == "" {
+		return "data"
+	}
+	return s.DataDir
+}
+
+// defaultTrackingSignals are the signals the tracking page asks for
+var defaultTrackingSignals = []string{
+	"currentLocationCoordinates",
+	"obdIsEngineBlocked",
+	"isIgnitionOn",
+	"speed",
+	"powertrainFuelSystemRelativeLevel",
+	"powertrainTransmissionTravelledDistance",
+	"powertrainCombustionEngineSpeed",
+	"lowVoltageBatteryCurrentVoltage",
+}
+
+// GetTrackingAllowedSignals returns the signals a public share link may expose
+func (s *Settings) GetTrackingAllowedSignals() []string {
+	if s.TrackingAllowedSignals == "" {
+		return defaultTrackingSignals
+	}
+	return splitList(s.TrackingAllowedSignals)
+}
+
+// GetTrackingMaxRange is the widest time range a public tracking query may ask for. The tracking page
+// asks for the last 7 days of trips, so the default leaves a day of slack on top of that.
+func (s *Settings) GetTrackingMaxRange() time.Duration {
+	if s.TrackingMaxRangeHours <= 0 {
+		return 8 * 24 * time.Hour
+	}
+	return time.Duration(s.TrackingMaxRangeHours) * time.Hour
+}
+
+// GetTrackingAccessRetention is how long share link views are kept, 90 days unless set
+func (s *Settings) GetTrackingAccessRetention() time.Duration {
+	if s.TrackingAccessRetentionDays <= 0 {
+		return 90 * 24 * time.Hour
+	}
+	return time.Duration(s.TrackingAccessRetentionDays) * 24 * time.Hour
+}
+
+// GetTrackingNegativeCacheTTL is how long an unknown or expired share ID is answered without asking the oracle
+func (s *Settings) GetTrackingNegativeCacheTTL() time.Duration {
+	if s.TrackingNegativeCacheSeconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(s.TrackingNegativeCacheSeconds) * time.Second
+}
+
+// GetIdentityBatchMaxTokenIDs is the most vehicles a batch identity lookup takes, 500 unless set
+func (s *Settings) GetIdentityBatchMaxTokenIDs() int {
+	if s.IdentityBatchMaxTokenIDs <= 0 {
+		return 500
+	}
+	return s.IdentityBatchMaxTokenIDs
+}
+
+// GetIdentityExportMaxVehicles is the most vehicles an owner export reads, 10000 unless set
+func (s *Settings) GetIdentityExportMaxVehicles() int {
+	if s.IdentityExportMaxVehicles <= 0 {
+		return 10_000
+	}
+	return s.IdentityExportMaxVehicles
+}
+
+// GetFleetEarningsCacheTTL is how long a fleet earnings rollup is reused, 15 minutes unless set
+func (s *Settings) GetFleetEarningsCacheTTL() time.Duration {
+	if s.FleetEarningsCacheMinutes <= 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(s.FleetEarningsCacheMinutes) * time.Minute
+}
+
+// GetTelemetryMaxRange is the widest range the signal history endpoint serves, 90 days unless set
+func (s *Settings) GetTelemetryMaxRange() time.Duration {
+	if s.TelemetryMaxRangeDays <= 0 {
+		return 90 * 24 * time.Hour
+	}
+	return time.Duration(s.TelemetryMaxRangeDays) * 24 * time.Hour
+}
+
+// GetHSTSMaxAge is the Strict-Transport-Security max-age, one year in prod unless set. 0 means don't send it,
+// which is what we want locally so the browser doesn't pin localdev.dimo.org to https for a year.
+func (s *Settings) GetHSTSMaxAge() int {
+	if s.HSTSMaxAgeSeconds > 0 {
+		return s.HSTSMaxAgeSeconds
+	}
+	if s.IsProduction() {
+		return 31536000
+	}
+	return 0
+}
+
+func (s *Settings) GetFrameOptions() string {
+	if s.FrameOptions == "" {
+		return "DENY"
+	}
+	return s.FrameOptions
+}
+
+func (s *Settings) GetReferrerPolicy() string {
+	if s.ReferrerPolicy == "" {
+		return "strict-origin-when-cross-origin"
+	}
+	return s.ReferrerPolicy
+}
+
+// GetPermissionsPolicy defaults to allowing WebAuthn on our own origin only, it's how users sign with passkeys
+func (s *Settings) GetPermissionsPolicy() string {
+	if s.PermissionsPolicy == "" {
+		return "publickey-credentials-get=(self), publickey-credentials-create=(self), camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+	}
+	return s.PermissionsPolicy
+}
+
+// splitList splits a comma separated setting, trimming blanks
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func (s *Settings) GetOracles() []Oracle {
 	return []Oracle{
 		// 		{
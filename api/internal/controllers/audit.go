@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// auditRedactedKeys are body fields that never go into the audit hash as-is: one time codes, signatures and the like
+var auditRedactedKeys = map[string]bool{
+	"password":  true,
+	"otp":       true,
+	"code":      true,
+	"signature": true,
+	"token":     true,
+	"secret":    true,
+	// a destructive device command's single use confirmation
+	"confirmationtoken": true,
+}
+
+// AuditRecord is one mutating request through the BFF
+type AuditRecord struct {
+	Time      time.Time         `json:"time"`
+	Subject   string            `json:"subject,omitempty"`
+	Wallet    string            `json:"wallet,omitempty"`
+	TenantID  string            `json:"tenantId,omitempty"`
+	OracleID  string            `json:"oracleId"`
+	Method    string            `json:"method"`
+	Route     string            `json:"route"`
+	Params    map[string]string `json:"params,omitempty"`
+	BodyHash  string            `json:"bodyHash,omitempty"`
+	Status    int               `json:"status"`
+	LatencyMs int64             `json:"latencyMs"`
+	// DryRun is a ?dryRun=true request that only answered what it would affect, nothing was changed
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// auditDryRunLocal is set by handlers that answered a dry run instead of changing anything
+const auditDryRunLocal = "auditDryRun"
+
+// AuditController keeps the append-only audit log of every non-GET request to the oracle group, which covers the
+// generic proxy and the VehiclesController mutations, and serves it back to fleet managers.
+type AuditController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	log      *store.JSONL[AuditRecord]
+}
+
+func NewAuditController(settings *config.Settings, logger *zerolog.Logger) *AuditController {
+	return &AuditController{
+		settings: settings,
+		logger:   logger,
+		log:      store.NewJSONL[AuditRecord](filepath.Join(settings.GetDataDir(), "audit.jsonl")),
+	}
+}
+
+// Middleware records the request once the handler is done, with the status the upstream answered.
+// Must run after jwt auth and the oracleID middleware.
+func (a *AuditController) Middleware(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			status = fe.Code
+		}
+	}
+	subject, wallet := jwtActor(c)
+	oracleID, _ := c.Locals("oracleID").(string)
+
+	rec := AuditRecord{
+		Time:      start.UTC(),
+		Subject:   subject,
+		Wallet:    wallet,
+		TenantID:  c.Get("Tenant-Id"),
+		OracleID:  oracleID,
+		Method:    c.Method(),
+		Route:     c.Route().Path,
+		Params:    c.AllParams(),
+		BodyHash:  redactedBodyHash(c.Body()),
+		Status:    status,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	rec.DryRun, _ = c.Locals(auditDryRunLocal).(bool)
+	delete(rec.Params, "oracleID")
+	if appendErr := a.log.Append(rec); appendErr != nil {
+		a.logger.Err(appendErr).Str("route", rec.Route).Msg("failed to write audit record")
+	}
+	return err
+}
+
+// GetAuditLog
+// @Summary Audit log of mutating requests
+// @Description Lists audit records for the caller's tenant, newest first. Filters: subject, wallet, method, route, status, tokenID (any param value), from, to (RFC3339).
+// @Tags Audit
+// @Produce json
+// @Param skip query int false "records to skip"
+// @Param take query int false "page size, default 50, max 500"
+// @Success 200 {object} AuditLogResponse
+// @Security     BearerAuth
+// @Router /oracle/{oracleID}/audit [get]
+func (a *AuditController) GetAuditLog(c *fiber.Ctx) error {
+	records, err := a.query(c)
+	if err != nil {
+		return err
+	}
+	skip := max(c.QueryInt("skip", 0), 0)
+	take := min(max(c.QueryInt("take", 50), 1), 500)
+
+	page := []AuditRecord{}
+	if skip < len(records) {
+		page = records[skip:min(skip+take, len(records))]
+	}
+	return c.JSON(AuditLogResponse{Records: page, TotalCount: len(records)})
+}
+
+// ExportAuditLog
+// @Summary Export the audit log as CSV
+// @Description Same filters as the audit log, every matching record, newest first
+// @Tags Audit
+// @Produce text/csv
+// @Success 200
+// @Security     BearerAuth
+// @Router /oracle/{oracleID}/audit/export [get]
+func (a *AuditController) ExportAuditLog(c *fiber.Ctx) error {
+	records, err := a.query(c)
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit.csv"`)
+	w := csv.NewWriter(c.Response().BodyWriter())
+	_ = w.Write([]string{"time", "subject", "wallet", "tenant_id", "oracle_id", "method", "route", "params", "body_hash", "status", "latency_ms"})
+	for _, r := range records {
+		params, _ := json.Marshal(r.Params)
+		_ = w.Write([]string{
+			r.Time.Format(time.RFC3339), r.Subject, r.Wallet, r.TenantID, r.OracleID, r.Method, r.Route,
+			string(params), r.BodyHash, strconv.Itoa(r.Status), strconv.FormatInt(r.LatencyMs, 10),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// query returns the records of the caller's tenant on this oracle that match the query filters, newest first
+func (a *AuditController) query(c *fiber.Ctx) ([]AuditRecord, error) {
+	tenantID, err := requireTenantAccess(c, a.settings)
+	if err != nil {
+		return nil, err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+
+	var from, to time.Time
+	if v := c.Query("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "from must be an RFC3339 time")
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "to must be an RFC3339 time")
+		}
+	}
+	subject := c.Query("subject")
+	wallet := c.Query("wallet")
+	method := strings.ToUpper(c.Query("method"))
+	route := c.Query("route")
+	status := c.QueryInt("status", 0)
+	tokenID := c.Query("tokenID")
+
+	var records []AuditRecord
+	err = a.log.Scan(func(r AuditRecord) bool {
+		switch {
+		case r.TenantID != tenantID || r.OracleID != oracleID,
+			subject != "" && r.Subject != subject,
+			wallet != "" && !strings.EqualFold(r.Wallet, wallet),
+			method != "" && r.Method != method,
+			route != "" && !strings.Contains(r.Route, route),
+			status != 0 && r.Status != status,
+			!from.IsZero() && r.Time.Before(from),
+			!to.IsZero() && r.Time.After(to),
+			tokenID != "" && !hasParamValue(r.Params, tokenID):
+			return true
+		}
+		records = append(records, r)
+		return true
+	})
+	if err != nil {
+		a.logger.Err(err).Msg("failed to read audit log")
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "failed to read audit log")
+	}
+	// newest first
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+type AuditLogResponse struct {
+	Records    []AuditRecord `json:"records"`
+	TotalCount int           `json:"totalCount"`
+}
+
+func hasParamValue(params map[string]string, v string) bool {
+	for _, p := range params {
+		if p == v {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedBodyHash hashes the request body with sensitive fields blanked, so two records can be compared for
+// "same payload" without the log holding the payload. JSON is re-encoded first so key order doesn't matter.
+func redactedBodyHash(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var doc any
+	if err := json.Unmarshal(body, &doc); err == nil {
+		redactKeys(doc, auditRedactedKeys)
+		if canonical, err := json.Marshal(doc); err == nil {
+			body = canonical
+		}
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// redactKeys replaces, in place, the values of any object keys in keys (case insensitive) anywhere in doc
+func redactKeys(doc any, keys map[string]bool) {
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, val := range v {
+			if keys[strings.ToLower(k)] {
+				v[k] = "[REDACTED]"
+				continue
+			}
+			redactKeys(val, keys)
+		}
+	case []any:
+		for _, item := range v {
+			redactKeys(item, keys)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestAuditController(t *testing.T) {
+	logger := zerolog.Nop()
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/vehicle/transfer/shared" {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer oracle.Close()
+	u, _ := url.Parse(oracle.URL)
+
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, DataDir: t.TempDir()}
+	audit := NewAuditController(settings, &logger)
+	vehicles := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, "", service.IdentityCacheConfig{}), nil)
+	proxy := NewGenericProxyController(settings, &logger)
+
+	app := fiber.New()
+	group := app.Group("/oracle/:oracleID", func(c *fiber.Ctx) error {
+		c.Locals("oracleID", c.Params("oracleID"))
+		return c.Next()
+	}, audit.Middleware)
+	group.Get("/vehicles", proxy.Proxy)
+	group.Post("/vehicle/transfer/shared", vehicles.SubmitSharedAccountTransfer)
+	group.Delete("/fleet/groups/:id", proxy.Proxy)
+	group.Get("/audit", audit.GetAuditLog)
+	group.Get("/audit/export", audit.ExportAuditLog)
+
+	send := func(method, path, tenant, body string) *http.Response {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Tenant-Id", tenant)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	send(http.MethodGet, "/oracle/kaufmann/vehicles", "t1", "")
+	send(http.MethodPost, "/oracle/kaufmann/vehicle/transfer/shared", "t1", `{"tokenId": 7, "targetWalletAddress": "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "otp": "123456"}`)
+	send(http.MethodDelete, "/oracle/kaufmann/fleet/groups/g1", "t1", "")
+	send(http.MethodDelete, "/oracle/kaufmann/fleet/groups/g2", "t2", "")
+
+	resp := send(http.MethodGet, "/oracle/kaufmann/audit?take=10", "t1", "")
+	var got AuditLogResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.TotalCount != 2 {
+		t.Fatalf("expected 2 records for tenant t1, got %d: %+v", got.TotalCount, got.Records)
+	}
+	// newest first
+	if got.Records[0].Route != "/oracle/:oracleID/fleet/groups/:id" || got.Records[0].Params["id"] != "g1" {
+		t.Errorf("unexpected first record %+v", got.Records[0])
+	}
+	transfer := got.Records[1]
+	if transfer.Status != http.StatusAccepted || transfer.BodyHash == "" || transfer.OracleID != "kaufmann" {
+		t.Errorf("unexpected transfer record %+v", transfer)
+	}
+	// same body with a different one time code hashes the same
+	if transfer.BodyHash != redactedBodyHash([]byte(`{"otp": "999999", "targetWalletAddress": "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", "tokenId": 7}`)) {
+		t.Errorf("body hash should ignore redacted fields and key order")
+	}
+
+	resp = send(http.MethodGet, "/oracle/kaufmann/audit?method=DELETE&tokenID=g1", "t1", "")
+	_ = json.NewDecoder(resp.Body).Decode(&got)
+	if got.TotalCount != 1 {
+		t.Errorf("expected filters to match one record, got %d", got.TotalCount)
+	}
+
+	resp = send(http.MethodGet, "/oracle/kaufmann/audit/export", "t1", "")
+	csvBody, _ := io.ReadAll(resp.Body)
+	if lines := strings.Count(string(csvBody), "\n"); lines != 3 {
+		t.Errorf("expected header and 2 rows in export, got %d lines: %s", lines, csvBody)
+	}
+}
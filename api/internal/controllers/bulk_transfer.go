@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// bulkTransferMaxRows caps an upload, a run is one fleet's worth of vehicles
+const bulkTransferMaxRows = 5000
+
+// BulkTransferController runs shared account transfers for a list of vehicles, see service.BulkTransferRunner
+type BulkTransferController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	runner   *service.BulkTransferRunner
+}
+
+func NewBulkTransferController(settings *config.Settings, logger *zerolog.Logger, runner *service.BulkTransferRunner) *BulkTransferController {
+	return &BulkTransferController{settings: settings, logger: logger, runner: runner}
+}
+
+type BulkTransferRequest struct {
+	Rows []BulkTransferRequestRow `json:"rows"`
+}
+
+type BulkTransferRequestRow struct {
+	TokenID             json.Number `json:"tokenId"`
+	TargetWalletAddress string      `json:"targetWalletAddress"`
+}
+
+type BulkTransfersRes struct {
+	BulkTransfers []service.BulkTransfer `json:"bulkTransfers"`
+}
+
+// StartBulkTransfer
+// @Summary Start a bulk transfer
+// @Description Transfers every vehicle in the list to its target wallet through the shared account transfer. The
+// @Description body is JSON, {rows: [{tokenId, targetWalletAddress}]}, or a text/csv upload with tokenId and
+// @Description targetWalletAddress columns, the header row optional. Every row is checked first and nothing is
+// @Description submitted if any is invalid. The run goes on in the background, each accepted transfer tracked as a job.
+// @Tags Vehicles
+// @Accept json,text/csv
+// @Produce json
+// @Success 202 {object} service.BulkTransfer
+// @Failure 400 {object} ValidationErrorRes
+// @Router /oracle/{oracleID}/vehicle/transfer/bulk [post]
+func (b *BulkTransferController) StartBulkTransfer(c *fiber.Ctx) error {
+	tenantID, err := b.tenant(c)
+	if err != nil {
+		return err
+	}
+	v := &validator{}
+	rows := parseBulkTransferRows(c, v)
+	if !v.ok() {
+		return v.respond(c)
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	subject, _ := jwtActor(c)
+	run := b.runner.Start(service.BulkTransfer{OracleID: oracleID, TenantID: tenantID, Subject: subject, Rows: rows}, jobCredentials(c))
+	return c.Status(fiber.StatusAccepted).JSON(run)
+}
+
+// ListBulkTransfers
+// @Summary Bulk transfers
+// @Description The tenant's bulk transfers newest first, with row counts by state but not the rows
+// @Tags Vehicles
+// @Produce json
+// @Success 200 {object} BulkTransfersRes
+// @Router /oracle/{oracleID}/vehicle/transfer/bulk [get]
+func (b *BulkTransferController) ListBulkTransfers(c *fiber.Ctx) error {
+	tenantID, err := b.tenant(c)
+	if err != nil {
+		return err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	runs := b.runner.List(oracleID, tenantID)
+	if runs == nil {
+		runs = []service.BulkTransfer{}
+	}
+	return c.JSON(BulkTransfersRes{BulkTransfers: runs})
+}
+
+// GetBulkTransfer
+// @Summary Bulk transfer
+// @Tags Vehicles
+// @Produce json
+// @Param id path string true "bulk transfer id"
+// @Success 200 {object} service.BulkTransfer
+// @Router /oracle/{oracleID}/vehicle/transfer/bulk/{id} [get]
+func (b *BulkTransferController) GetBulkTransfer(c *fiber.Ctx) error {
+	run, err := b.run(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(run)
+}
+
+// GetBulkTransferReport
+// @Summary Bulk transfer report
+// @Description Every row with its job id and outcome, as a CSV download unless format=json
+// @Tags Vehicles
+// @Produce text/csv,json
+// @Param id path string true "bulk transfer id"
+// @Param format query string false "csv (default) or json"
+// @Success 200
+// @Router /oracle/{oracleID}/vehicle/transfer/bulk/{id}/report [get]
+func (b *BulkTransferController) GetBulkTransferReport(c *fiber.Ctx) error {
+	run, err := b.run(c)
+	if err != nil {
+		return err
+	}
+	filename := "bulk-transfer-" + run.ID
+	switch c.Query("format", "csv") {
+	case "json":
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`.json"`)
+		return c.JSON(run)
+	case "csv":
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "format must be csv or json")
+	}
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`.csv"`)
+	w := csv.NewWriter(c.Response().BodyWriter())
+	_ = w.Write([]string{"row", "token_id", "target_wallet_address", "state", "job_id", "oracle_job_id", "attempts", "error"})
+	for _, row := range run.Rows {
+		_ = w.Write([]string{strconv.Itoa(row.Row), row.TokenID, row.TargetWalletAddress, string(row.State), row.JobID,
+			row.OracleJobID, strconv.Itoa(row.Attempts), row.Error})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// ResumeBulkTransfer
+// @Summary Resume a bulk transfer
+// @Description Submits the rows that haven't succeeded and aren't in flight, failed ones included, with the caller's
+// @Description credentials. For runs interrupted by a restart or an expired token. Rows a restart left submitting may
+// @Description have been transferred already, they are only submitted again with retrySubmitting=true.
+// @Tags Vehicles
+// @Produce json
+// @Param id path string true "bulk transfer id"
+// @Param retrySubmitting query bool false "submit rows left submitting by a restart again too"
+// @Success 202 {object} service.BulkTransfer
+// @Failure 409 "still running, or nothing left to submit"
+// @Router /oracle/{oracleID}/vehicle/transfer/bulk/{id}/resume [post]
+func (b *BulkTransferController) ResumeBulkTransfer(c *fiber.Ctx) error {
+	if _, err := b.run(c); err != nil {
+		return err
+	}
+	subject, _ := jwtActor(c)
+	run, err := b.runner.Resume(c.Params("id"), subject, jobCredentials(c), c.QueryBool("retrySubmitting"))
+	switch {
+	case errors.Is(err, service.ErrBulkTransferRunning), errors.Is(err, service.ErrNothingToResume):
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	case err != nil:
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).JSON(run)
+}
+
+func (b *BulkTransferController) tenant(c *fiber.Ctx) (string, error) {
+	if b.runner == nil {
+		return "", fiber.NewError(fiber.StatusServiceUnavailable, "bulk transfers are not enabled")
+	}
+	return requireTenantAccess(c, b.settings)
+}
+
+// run is the bulk transfer in the path, if it's the caller's tenant's
+func (b *BulkTransferController) run(c *fiber.Ctx) (service.BulkTransfer, error) {
+	tenantID, err := b.tenant(c)
+	if err != nil {
+		return service.BulkTransfer{}, err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	run, ok := b.runner.Get(c.Params("id"))
+	if !ok || run.OracleID != oracleID || run.TenantID != tenantID {
+		return service.BulkTransfer{}, fiber.NewError(fiber.StatusNotFound, "bulk transfer not found")
+	}
+	return run, nil
+}
+
+// parseBulkTransferRows reads the upload, JSON or CSV, and checks every row. Errors name the JSON path, or the line
+// of the CSV.
+func parseBulkTransferRows(c *fiber.Ctx, v *validator) []service.BulkTransferRow {
+	var rows []BulkTransferRequestRow
+	var fields []string
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), "text/csv") {
+		rows, fields = parseBulkTransferCSV(c.Body(), v)
+	} else {
+		var req BulkTransferRequest
+		if !decodeBody(c, v, &req) {
+			return nil
+		}
+		rows = req.Rows
+		for i := range rows {
+			fields = append(fields, fmt.Sprintf("rows[%d]", i))
+		}
+	}
+	if !v.ok() {
+		return nil
+	}
+	switch {
+	case len(rows) == 0:
+		v.add("rows", "at least one row is required")
+		return nil
+	case len(rows) > bulkTransferMaxRows:
+		v.add("rows", "at most %d rows", bulkTransferMaxRows)
+		return nil
+	}
+
+	res := make([]service.BulkTransferRow, len(rows))
+	seen := make(map[string]string, len(rows))
+	for i, row := range rows {
+		v.tokenID(fields[i]+".tokenId", row.TokenID)
+		v.address(fields[i]+".targetWalletAddress", row.TargetWalletAddress)
+		if first, dup := seen[row.TokenID.String()]; dup && row.TokenID != "" {
+			v.add(fields[i]+".tokenId", "duplicate of %s", first)
+		} else {
+			seen[row.TokenID.String()] = fields[i]
+		}
+		res[i] = service.BulkTransferRow{TokenID: row.TokenID.String(), TargetWalletAddress: row.TargetWalletAddress}
+	}
+	return res
+}
+
+// bulkTransferColumns are the columns of a bulk transfer CSV, tokenId then targetWalletAddress without a header
+var bulkTransferColumns = []csvColumn{
+	{names: []string{"tokenid"}, required: true},
+	{names: []string{"targetwalletaddress", "walletaddress", "wallet"}, required: true},
+}
+
+func parseBulkTransferCSV(body []byte, v *validator) ([]BulkTransferRequestRow, []string) {
+	records, fields := readCSVManifest(body, v, bulkTransferColumns)
+	rows := make([]BulkTransferRequestRow, len(records))
+	for i, rec := range records {
+		rows[i] = BulkTransferRequestRow{TokenID: json.Number(rec["tokenid"]), TargetWalletAddress: rec["targetwalletaddress"]}
+	}
+	return rows, fields
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestBulkTransferController(t *testing.T) {
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/vehicle/transfer/shared" {
+			_, _ = w.Write([]byte(`{"jobId":"77"}`))
+		}
+	}))
+	defer oracle.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	oracleID := settings.GetOracles()[0].OracleID
+	urls := map[string]url.URL{oracleID: *u}
+	dir := t.TempDir()
+	jobs := service.NewJobTracker(logger, service.JobTrackerConfig{StorePath: filepath.Join(dir, "jobs.jsonl"), OracleURLs: urls})
+	runner := service.NewBulkTransferRunner(logger, service.BulkTransferConfig{
+		StorePath: filepath.Join(dir, "bulk_transfers.jsonl"), OracleURLs: urls, Pace: time.Millisecond,
+	}, jobs)
+	ctrl := NewBulkTransferController(settings, &logger, runner)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", oracleID)
+		return c.Next()
+	})
+	app.Post("/vehicle/transfer/bulk", ctrl.StartBulkTransfer)
+	app.Get("/vehicle/transfer/bulk/:id", ctrl.GetBulkTransfer)
+	app.Get("/vehicle/transfer/bulk/:id/report", ctrl.GetBulkTransferReport)
+
+	send := func(method, target, contentType, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Tenant-Id", "t1")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// every bad row is reported, by line, and nothing runs
+	resp := send(http.MethodPost, "/vehicle/transfer/bulk", "text/csv", "token_id,wallet\n12,"+testGrantee+"\nabc,"+testGrantee+"\n\n12,0x1234\n")
+	var invalid ValidationErrorRes
+	_ = json.NewDecoder(resp.Body).Decode(&invalid)
+	if resp.StatusCode != http.StatusBadRequest || len(invalid.Errors) != 3 ||
+		invalid.Errors[0].Field != "line 3.tokenId" || invalid.Errors[2].Field != "line 5.tokenId" {
+		t.Fatalf("expected the bad lines reported, got %d %+v", resp.StatusCode, invalid.Errors)
+	}
+	if resp := send(http.MethodPost, "/vehicle/transfer/bulk", "application/json", `{"rows":[]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an empty upload rejected, got %d", resp.StatusCode)
+	}
+
+	// a header is optional
+	resp = send(http.MethodPost, "/vehicle/transfer/bulk", "text/csv", "12,"+testGrantee+"\n13,"+testGrantee+"\n")
+	var run service.BulkTransfer
+	_ = json.NewDecoder(resp.Body).Decode(&run)
+	if resp.StatusCode != http.StatusAccepted || len(run.Rows) != 2 || run.TenantID != "t1" {
+		t.Fatalf("expected the run started, got %d %+v", resp.StatusCode, run)
+	}
+	for deadline := time.Now().Add(5 * time.Second); run.State == service.BulkRunRunning && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		run, _ = runner.Get(run.ID)
+	}
+
+	resp = send(http.MethodGet, "/vehicle/transfer/bulk/"+run.ID+"/report", "", "")
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[1][1] != "12" || rows[1][3] != string(service.BulkRowSubmitted) || rows[2][5] != "77" {
+		t.Errorf("unexpected report %v", rows)
+	}
+	if !strings.Contains(resp.Header.Get(fiber.HeaderContentDisposition), "bulk-transfer-"+run.ID+".csv") {
+		t.Errorf("expected a download, got %q", resp.Header.Get(fiber.HeaderContentDisposition))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/auth"
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
 	"github.com/gofiber/fiber/v2"
 )
@@ -50,3 +51,38 @@ func stripOraclePrefix(p string) string {
 	}
 	return p
 }
+
+// developerAuthHeader is the Authorization header for routes marked "developer auth" in the route table, empty
+// elsewhere. Pass it to ProxyRequest as authHeader.
+func developerAuthHeader(c *fiber.Ctx) string {
+	h, _ := c.Locals("developerAuth").(string)
+	return h
+}
+
+// jwtActor returns who is making the request, from the verified principal: the subject, and the wallet when
+// the token carries one. Both are empty on routes without JWT auth.
+func jwtActor(c *fiber.Ctx) (subject string, wallet string) {
+	p := auth.GetPrincipal(c)
+	if p == nil {
+		return "", ""
+	}
+	return p.Subject, p.Wallet
+}
+
+// requireTenantAccess checks with the oracle that the caller may act in the tenant named by their Tenant-Id header,
+// for BFF endpoints that serve tenant data the oracle isn't in the path of. Returns the tenant id.
+func requireTenantAccess(c *fiber.Ctx, s *config.Settings) (string, error) {
+	tenantID := strings.Clone(c.Get("Tenant-Id"))
+	if tenantID == "" {
+		return "", fiber.NewError(fiber.StatusBadRequest, "Tenant-Id header is required")
+	}
+	u := GetOracleURL(c, s)
+	status, _, err := upstreamCall(c, fiber.MethodGet, u.JoinPath("/v1/permissions"), nil)
+	if err != nil {
+		return "", fiber.NewError(fiber.StatusBadGateway, "failed to check tenant access")
+	}
+	if status != fiber.StatusOK {
+		return "", fiber.NewError(fiber.StatusForbidden, "no access to tenant")
+	}
+	return tenantID, nil
+}
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"encoding/json"
+	"maps"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// cspReportMaxBytes is far more than any real report, anything bigger is dropped unread
+	cspReportMaxBytes = 64 * 1024
+	// cspReportsPerMinute is the most reports kept a minute, from everyone. Anyone can post here, and a browser
+	// reports a violation again on every page load.
+	cspReportsPerMinute = 60
+	// cspReportDedupe is how long a report of a directive and blocked uri already kept is dropped
+	cspReportDedupe = time.Hour
+	// cspReportMaxRecords is the most reports the file keeps, the older half is dropped when it gets there
+	cspReportMaxRecords = 10_000
+)
+
+// CSPReport is one Content-Security-Policy violation, as reported by a browser
+type CSPReport struct {
+	Time               time.Time `json:"time"`
+	DocumentURI        string    `json:"documentUri"`
+	BlockedURI         string    `json:"blockedUri"`
+	ViolatedDirective  string    `json:"violatedDirective"`
+	EffectiveDirective string    `json:"effectiveDirective,omitempty"`
+	Disposition        string    `json:"disposition,omitempty"`
+	SourceFile         string    `json:"sourceFile,omitempty"`
+	LineNumber         int       `json:"lineNumber,omitempty"`
+	UserAgent          string    `json:"userAgent"`
+}
+
+type CSPReportController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	reports  *store.JSONL[CSPReport]
+
+	mu sync.Mutex
+	// seen is when each directive and blocked uri was last kept
+	seen        map[string]time.Time
+	windowStart time.Time
+	inWindow    int
+	logged      int
+}
+
+func NewCSPReportController(settings *config.Settings, logger *zerolog.Logger) *CSPReportController {
+	r := &CSPReportController{
+		settings: settings,
+		logger:   logger,
+		reports:  store.NewJSONL[CSPReport](filepath.Join(settings.GetDataDir(), "csp_reports.jsonl")),
+		seen:     map[string]time.Time{},
+	}
+	err := r.reports.Scan(func(CSPReport) bool {
+		r.logged++
+		return true
+	})
+	if err != nil {
+		logger.Err(err).Msg("failed to read CSP reports")
+	}
+	return r
+}
+
+// legacyCSPReport is the report-uri format, application/csp-report
+type legacyCSPReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+	} `json:"csp-report"`
+}
+
+// reportingAPIReport is the Reporting API format, application/reports+json, which batches reports in an array
+type reportingAPIReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+	} `json:"body"`
+}
+
+// CollectReport
+// @Summary Collect CSP violation reports
+// @Description Browsers post here when the SPA's Content-Security-Policy blocks something. Accepts both the report-uri and Reporting API formats.
+// @Description A violation already reported within the hour is dropped, and so is anything past 60 reports a minute.
+// @Tags Security
+// @Accept json
+// @Success 204
+// @Router /csp-report [post]
+func (r *CSPReportController) CollectReport(c *fiber.Ctx) error {
+	body := c.Body()
+	if len(body) == 0 || len(body) > cspReportMaxBytes {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	now := time.Now().UTC()
+	ua := c.Get(fiber.HeaderUserAgent)
+	var reports []CSPReport
+
+	var legacy legacyCSPReport
+	var batch []reportingAPIReport
+	switch {
+	case json.Unmarshal(body, &batch) == nil:
+		for _, b := range batch {
+			if b.Type != "csp-violation" {
+				continue
+			}
+			reports = append(reports, CSPReport{
+				Time: now, DocumentURI: b.Body.DocumentURL, BlockedURI: b.Body.BlockedURL,
+				ViolatedDirective: b.Body.EffectiveDirective, EffectiveDirective: b.Body.EffectiveDirective,
+				Disposition: b.Body.Disposition, SourceFile: b.Body.SourceFile, LineNumber: b.Body.LineNumber, UserAgent: ua,
+			})
+		}
+	case json.Unmarshal(body, &legacy) == nil && legacy.Report.ViolatedDirective != "":
+		l := legacy.Report
+		reports = append(reports, CSPReport{
+			Time: now, DocumentURI: l.DocumentURI, BlockedURI: l.BlockedURI, ViolatedDirective: l.ViolatedDirective,
+			EffectiveDirective: l.EffectiveDirective, Disposition: l.Disposition, SourceFile: l.SourceFile,
+			LineNumber: l.LineNumber, UserAgent: ua,
+		})
+	}
+
+	for _, rep := range reports {
+		r.keep(rep)
+	}
+	// browsers ignore the answer, don't give anyone probing the endpoint anything to go on
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// keep logs and stores the report, unless the same violation was kept within cspReportDedupe or the minute's
+// cspReportsPerMinute are used up
+func (r *CSPReportController) keep(rep CSPReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := rep.ViolatedDirective + "\x00" + rep.BlockedURI
+	if last, ok := r.seen[key]; ok && rep.Time.Sub(last) < cspReportDedupe {
+		return
+	}
+	if rep.Time.Sub(r.windowStart) >= time.Minute {
+		r.windowStart, r.inWindow = rep.Time, 0
+	}
+	if r.inWindow >= cspReportsPerMinute {
+		return
+	}
+	if len(r.seen) >= cspReportMaxRecords {
+		maps.DeleteFunc(r.seen, func(_ string, at time.Time) bool { return rep.Time.Sub(at) >= cspReportDedupe })
+	}
+	r.seen[key] = rep.Time
+	r.inWindow++
+
+	r.logger.Warn().Str("directive", rep.ViolatedDirective).Str("blocked", rep.BlockedURI).
+		Str("document", rep.DocumentURI).Msg("CSP violation reported")
+	if err := r.reports.Append(rep); err != nil {
+		r.logger.Err(err).Msg("failed to store CSP report")
+		return
+	}
+	if r.logged++; r.logged >= cspReportMaxRecords {
+		r.trimLocked()
+	}
+}
+
+// trimLocked drops the older half of the stored reports
+func (r *CSPReportController) trimLocked() {
+	var reports []CSPReport
+	err := r.reports.Scan(func(rep CSPReport) bool {
+		reports = append(reports, rep)
+		return true
+	})
+	if err == nil {
+		reports = reports[len(reports)/2:]
+		err = r.reports.Rewrite(reports)
+	}
+	if err != nil {
+		r.logger.Err(err).Msg("failed to trim CSP reports")
+		return
+	}
+	r.logged = len(reports)
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestCSPReportController_CollectReport(t *testing.T) {
+	logger := zerolog.Nop()
+	ctrl := NewCSPReportController(&config.Settings{DataDir: t.TempDir()}, &logger)
+	app := fiber.New()
+	app.Post("/csp-report", ctrl.CollectReport)
+	report := func(blocked string) {
+		t.Helper()
+		body := `{"csp-report":{"document-uri":"https://app.example/","blocked-uri":"` + blocked + `","violated-directive":"script-src"}}`
+		resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/csp-report", strings.NewReader(body)), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", resp.StatusCode)
+		}
+	}
+	stored := func() int {
+		n := 0
+		_ = ctrl.reports.Scan(func(CSPReport) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	// the same violation again is dropped
+	report("https://evil.example/a.js")
+	report("https://evil.example/a.js")
+	if n := stored(); n != 1 {
+		t.Errorf("expected the repeat dropped, got %d reports", n)
+	}
+	// and past the minute's reports, so is everything else
+	for i := range cspReportsPerMinute + 5 {
+		report(fmt.Sprintf("https://evil.example/%d.js", i))
+	}
+	if n := stored(); n != cspReportsPerMinute {
+		t.Errorf("expected %d reports kept in the minute, got %d", cspReportsPerMinute, n)
+	}
+
+	// a full file drops its older half
+	ctrl.logged = cspReportMaxRecords - 1
+	ctrl.inWindow = 0
+	report("https://evil.example/last.js")
+	if n := stored(); n != (cspReportsPerMinute+1)-(cspReportsPerMinute+1)/2 || ctrl.logged != n {
+		t.Errorf("expected the older half dropped, got %d reports with %d logged", n, ctrl.logged)
+	}
+}
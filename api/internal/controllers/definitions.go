@@ -21,7 +21,7 @@ func NewDefinitionsController(settings *config.Settings, logger *zerolog.Logger)
 func (v *DefinitionsController) DecodeVIN(c *fiber.Ctx) error {
 	targetURL := v.settings.DefinitionAPIURL.JoinPath("/device-definitions/decode-vin")
 
-	return ProxyRequest(c, targetURL, c.Body(), v.logger)
+	return ProxyRequest(c, targetURL, c.Body(), v.logger, developerAuthHeader(c))
 }
 
 func (v *DefinitionsController) TopDefinitions(c *fiber.Ctx) error {
@@ -0,0 +1,840 @@
+package controllers
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultDeviceType is the oracle's vins.device_type default, rows from before the column are smart5 devices
+	defaultDeviceType = "smart5"
+	// commandConfirmationTTL is how long a confirmation token for a destructive command can be used
+	commandConfirmationTTL = 5 * time.Minute
+	// commandResponseMaxLen is the most of an upstream response kept in the command history
+	commandResponseMaxLen = 16 << 10
+)
+
+// CommandParamType is how a command parameter is typed in the catalog
+type CommandParamType string
+
+const (
+	CommandParamInt  CommandParamType = "int"
+	CommandParamBool CommandParamType = "bool"
+	CommandParamEnum CommandParamType = "enum"
+)
+
+// CommandParam is a parameter of a device command. Min and Max bound an int, Values lists what an enum takes.
+type CommandParam struct {
+	Name        string           `json:"name"`
+	Type        CommandParamType `json:"type"`
+	Required    bool             `json:"required"`
+	Min         int64            `json:"min,omitempty"`
+	Max         int64            `json:"max,omitempty"`
+	Values      []string         `json:"values,omitempty"`
+	Description string           `json:"description"`
+}
+
+// CommandSpec is a command the oracle can send a device. Destructive commands change how the vehicle runs or lose
+// data on the device, they're only sent with a confirmation token.
+type CommandSpec struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Params      []CommandParam `json:"params,omitempty"`
+	Destructive bool           `json:"destructive"`
+}
+
+// deviceCommandCatalog is the commands known for each device type. Commands to device types without an entry are sent
+// as they come, unchecked.
+var deviceCommandCatalog = map[string][]CommandSpec{
+	"smart5": {
+		{Name: "immobilizer/on", Description: "Blocks the engine from starting", Destructive: true},
+		{Name: "immobilizer/off", Description: "Lets the engine start again"},
+		{Name: "device/reset", Description: "Restarts the device, it reconnects within a couple of minutes"},
+		{Name: "output/set", Description: "Switches a digital output of the device", Params: []CommandParam{
+			{Name: "output", Type: CommandParamInt, Required: true, Min: 1, Max: 4, Description: "digital output number"},
+			{Name: "on", Type: CommandParamBool, Required: true, Description: "whether the output is switched on"},
+		}},
+		{Name: "records/interval", Description: "Sets how often the device records", Params: []CommandParam{
+			{Name: "seconds", Type: CommandParamInt, Required: true, Min: 5, Max: 3600, Description: "seconds between records"},
+			{Name: "mode", Type: CommandParamEnum, Values: []string{"moving", "stopped"}, Description: "which records, moving by default"},
+		}},
+		{Name: "records/clear", Description: "Deletes the records the device hasn't sent yet", Destructive: true},
+	},
+}
+
+// CommandAck is how far a sent command got
+type CommandAck string
+
+const (
+	// CommandPending is a command the oracle accepted that the device hasn't acknowledged yet
+	CommandPending      CommandAck = "pending"
+	CommandAcknowledged CommandAck = "acknowledged"
+	// CommandFailed is a command the oracle accepted that never reached the device, or that the device refused
+	CommandFailed CommandAck = "failed"
+	// CommandRejected is a command the oracle refused or couldn't be reached for
+	CommandRejected CommandAck = "rejected"
+)
+
+// DeviceCommandRecord is one command sent to a device. Records are appended again as their acknowledgement comes in,
+// the last one written for an ID wins.
+type DeviceCommandRecord struct {
+	ID         string         `json:"id"`
+	Time       time.Time      `json:"time"`
+	Subject    string         `json:"subject,omitempty"`
+	Wallet     string         `json:"wallet,omitempty"`
+	TenantID   string         `json:"tenantId,omitempty"`
+	OracleID   string         `json:"oracleId"`
+	IMEI       string         `json:"imei"`
+	DeviceType string         `json:"deviceType"`
+	Command    string         `json:"command"`
+	Params     map[string]any `json:"params,omitempty"`
+	// Payload is the body sent to the oracle
+	Payload json.RawMessage `json:"payload"`
+	// Status is the oracle's response status, 0 when it couldn't be reached
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// OracleCommandID is the oracle's id for the command, when its response has one, used to match the acknowledgement
+	OracleCommandID string     `json:"oracleCommandId,omitempty"`
+	Ack             CommandAck `json:"ack"`
+	AckDetail       string     `json:"ackDetail,omitempty"`
+	AckAt           *time.Time `json:"ackAt,omitempty"`
+}
+
+type DeviceCommandHistoryRes struct {
+	IMEI       string                `json:"imei"`
+	DeviceType string                `json:"deviceType"`
+	Commands   []DeviceCommandRecord `json:"commands"`
+}
+
+type DeviceCommandCatalogRes struct {
+	IMEI       string        `json:"imei"`
+	DeviceType string        `json:"deviceType"`
+	Commands   []CommandSpec `json:"commands"`
+}
+
+type CommandConfirmationRes struct {
+	ConfirmationToken string      `json:"confirmationToken"`
+	ExpiresAt         time.Time   `json:"expiresAt"`
+	Command           CommandSpec `json:"command"`
+}
+
+type deviceCommandRequest struct {
+	Command           string         `json:"command"`
+	Params            map[string]any `json:"params"`
+	ConfirmationToken string         `json:"confirmationToken"`
+}
+
+// deviceCommand is a validated command, ready to send
+type deviceCommand struct {
+	imei       string
+	deviceType string
+	tokenID    uint64
+	spec       CommandSpec
+	params     map[string]any
+	payload    []byte
+	token      string
+}
+
+// usedConfirmation is a confirmation token that sent its command, kept until it expires
+type usedConfirmation struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// deviceCommands keeps the history of the commands sent through the BFF, and checks the confirmation tokens of
+// destructive ones. A token is an HMAC over its scope and expiry, so any replica can check it, and the tokens used
+// are recorded next to the history so each sends its command once. Both files are followed into memory, picking up
+// what other replicas write, and compacted down to the tokens not expired yet and the history within its retention.
+type deviceCommands struct {
+	logger    *zerolog.Logger
+	log       *store.JSONL[DeviceCommandRecord]
+	used      *store.JSONL[usedConfirmation]
+	key       []byte
+	retention time.Duration
+
+	// mu serializes redeeming, so two requests with the same token can't both find it unused, and guards the rest
+	mu sync.Mutex
+	// nonces are the tokens used, with when they expire
+	nonces     map[string]time.Time
+	usedCursor store.Cursor
+	usedLogged int
+	// records are the history by id, in their latest state, and byDevice their ids by oracle, tenant and imei
+	records   map[string]DeviceCommandRecord
+	byDevice  map[string][]string
+	logCursor store.Cursor
+	logLogged int
+	lastSweep time.Time
+}
+
+func newDeviceCommands(logger *zerolog.Logger, dataDir string, key []byte, retention time.Duration) *deviceCommands {
+	d := &deviceCommands{
+		logger:    logger,
+		log:       store.NewJSONL[DeviceCommandRecord](filepath.Join(dataDir, "device_commands.jsonl")),
+		used:      store.NewJSONL[usedConfirmation](filepath.Join(dataDir, "command_confirmations.jsonl")),
+		key:       key,
+		retention: retention,
+		nonces:    map[string]time.Time{},
+		records:   map[string]DeviceCommandRecord{},
+		byDevice:  map[string][]string{},
+		lastSweep: time.Now(),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.readLocked(); err != nil {
+		logger.Err(err).Msg("failed to read device command history")
+		return d
+	}
+	// down to what's kept, the files are never pruned otherwise
+	d.compactLocked(1)
+	return d
+}
+
+// commandConfirmationKey is the key confirmation tokens are signed with: the configured secret, else the key file,
+// created on first use. Replicas share it through the data dir.
+func commandConfirmationKey(settings *config.Settings) ([]byte, error) {
+	if settings.CommandConfirmationSecret != "" {
+		return []byte(settings.CommandConfirmationSecret), nil
+	}
+	path := settings.GetCommandConfirmationKeyFile()
+	if key, err := os.ReadFile(path); err == nil && len(key) > 0 {
+		return key, nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		// another replica created it first
+		if key, err := os.ReadFile(path); err != nil || len(key) > 0 {
+			return key, err
+		}
+		return nil, errors.New("command confirmation key file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return key, err
+}
+
+// confirm hands out a single use token for the command in scope
+func (d *deviceCommands) confirm(scope string) (string, time.Time) {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	expiresAt := time.Now().Add(commandConfirmationTTL).UTC().Truncate(time.Second)
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return nonce + "." + expiry + "." + d.sign(nonce, expiry, scope), expiresAt
+}
+
+// redeem uses up the token, true when it was handed out for the command in scope, hasn't expired and wasn't used
+// before. A token for another command is left as it is.
+func (d *deviceCommands) redeem(token, scope string) (bool, error) {
+	nonce, rest, _ := strings.Cut(token, ".")
+	expiry, sig, _ := strings.Cut(rest, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(d.sign(nonce, expiry, scope))) {
+		return false, nil
+	}
+	expiresAt := time.Unix(unix, 0).UTC()
+	if !time.Now().Before(expiresAt) {
+		return false, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.readLocked(); err != nil {
+		return false, err
+	}
+	d.sweepLocked()
+	if _, used := d.nonces[nonce]; used {
+		return false, nil
+	}
+	if err := d.used.Append(usedConfirmation{Nonce: nonce, ExpiresAt: expiresAt}); err != nil {
+		return false, err
+	}
+	// counted when it's read back
+	d.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+func (d *deviceCommands) sign(nonce, expiry, scope string) string {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(strings.Join([]string{nonce, expiry, scope}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// history is the device's commands on the oracle for the tenant, newest first
+func (d *deviceCommands) history(oracleID, tenantID, imei string) ([]DeviceCommandRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.readLocked()
+	d.sweepLocked()
+	ids := d.byDevice[deviceKey(oracleID, tenantID, imei)]
+	records := make([]DeviceCommandRecord, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, d.records[id])
+	}
+	slices.SortFunc(records, func(a, b DeviceCommandRecord) int {
+		return b.Time.Compare(a.Time)
+	})
+	return records, err
+}
+
+// record adds a command to the history, or its new state
+func (d *deviceCommands) record(rec DeviceCommandRecord) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// appended under the lock so a compaction can't write the log over it
+	if err := d.log.Append(rec); err != nil {
+		return err
+	}
+	d.indexLocked(rec)
+	return nil
+}
+
+// readLocked takes in the tokens used and the commands recorded since the last read, by any replica
+func (d *deviceCommands) readLocked() error {
+	now := time.Now()
+	n := 0
+	reset, err := d.used.Tail(&d.usedCursor, func(u usedConfirmation) {
+		n++
+		if now.Before(u.ExpiresAt) {
+			d.nonces[u.Nonce] = u.ExpiresAt
+		}
+	})
+	if reset {
+		d.usedLogged = 0
+	}
+	d.usedLogged += n
+	if err != nil {
+		return err
+	}
+
+	n = 0
+	cutoff := now.Add(-d.retention)
+	reset, err = d.log.Tail(&d.logCursor, func(rec DeviceCommandRecord) {
+		n++
+		if rec.Time.After(cutoff) {
+			d.indexLocked(rec)
+		}
+	})
+	if reset {
+		d.logLogged = 0
+	}
+	d.logLogged += n
+	return err
+}
+
+func (d *deviceCommands) indexLocked(rec DeviceCommandRecord) {
+	if _, ok := d.records[rec.ID]; !ok {
+		key := deviceKey(rec.OracleID, rec.TenantID, rec.IMEI)
+		d.byDevice[key] = append(d.byDevice[key], rec.ID)
+	}
+	d.records[rec.ID] = rec
+}
+
+// sweepLocked drops the expired tokens and the commands past the retention, at most once a minute, and compacts the
+// files once they're most of them
+func (d *deviceCommands) sweepLocked() {
+	now := time.Now()
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+	maps.DeleteFunc(d.nonces, func(_ string, expiresAt time.Time) bool {
+		return !now.Before(expiresAt)
+	})
+	cutoff := now.Add(-d.retention)
+	for key, ids := range d.byDevice {
+		ids = slices.DeleteFunc(ids, func(id string) bool {
+			if d.records[id].Time.After(cutoff) {
+				return false
+			}
+			delete(d.records, id)
+			return true
+		})
+		if len(ids) == 0 {
+			delete(d.byDevice, key)
+		} else {
+			d.byDevice[key] = ids
+		}
+	}
+	d.compactLocked(2)
+}
+
+// compactLocked rewrites each file with what's kept in memory, once it has more than factor times as many records
+func (d *deviceCommands) compactLocked(factor int) {
+	if d.usedLogged > factor*len(d.nonces) {
+		used := make([]usedConfirmation, 0, len(d.nonces))
+		for nonce, expiresAt := range d.nonces {
+			used = append(used, usedConfirmation{Nonce: nonce, ExpiresAt: expiresAt})
+		}
+		slices.SortFunc(used, func(a, b usedConfirmation) int { return a.ExpiresAt.Compare(b.ExpiresAt) })
+		if err := d.used.Rewrite(used); err != nil {
+			d.logger.Err(err).Msg("failed to compact command confirmations")
+		} else {
+			d.usedLogged = len(used)
+		}
+	}
+	if d.logLogged > factor*len(d.records) {
+		records := slices.SortedFunc(maps.Values(d.records), func(a, b DeviceCommandRecord) int {
+			return a.Time.Compare(b.Time)
+		})
+		if err := d.log.Rewrite(records); err != nil {
+			d.logger.Err(err).Msg("failed to compact device command history")
+		} else {
+			d.logLogged = len(records)
+		}
+	}
+}
+
+func deviceKey(oracleID, tenantID, imei string) string {
+	return strings.Join([]string{oracleID, tenantID, imei}, "\x00")
+}
+
+// SubmitCommand
+// @Summary Send a command to a device
+// @Description Sends a command from the device type's catalog, with its params checked against it. Device types
+// @Description without a catalog take any command, sent as is. Body: { command, params, confirmationToken }.
+// @Description Destructive commands need a confirmationToken from the confirmation endpoint and are answered 428
+// @Description without one. Every command sent is kept in the history.
+// @Tags Vehicles
+// @Accept json
+// @Produce json
+// @Param imei path string true "device imei"
+// @Success 200
+// @Failure 400 {object} ValidationErrorRes
+// @Failure 428 "destructive command without a valid confirmation token"
+// @Router /oracle/{oracleID}/pending-vehicle/command/{imei} [post]
+func (v *VehiclesController) SubmitCommand(c *fiber.Ctx) error {
+	cmd, val, err := v.deviceCommand(c)
+	if err != nil {
+		return err
+	}
+	if !val.ok() {
+		return val.respond(c)
+	}
+	subject, wallet := jwtActor(c)
+	oracleID, _ := c.Locals("oracleID").(string)
+	rec := DeviceCommandRecord{
+		ID:         newCommandID(),
+		Time:       time.Now().UTC(),
+		Subject:    subject,
+		Wallet:     wallet,
+		TenantID:   strings.Clone(c.Get("Tenant-Id")),
+		OracleID:   oracleID,
+		IMEI:       cmd.imei,
+		DeviceType: cmd.deviceType,
+		Command:    cmd.spec.Name,
+		Params:     cmd.params,
+		Payload:    cmd.payload,
+	}
+	if cmd.spec.Destructive {
+		confirmed, err := v.commands.redeem(cmd.token, commandScope(rec))
+		if err != nil {
+			v.logger.Err(err).Str("imei", rec.IMEI).Msg("failed to check the command confirmation")
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to check the confirmation token")
+		}
+		if !confirmed {
+			return fiber.NewError(fiber.StatusPreconditionRequired,
+				cmd.spec.Name+" is destructive, send it with a confirmationToken from the confirmation endpoint")
+		}
+	}
+
+	u := GetOracleURL(c, v.settings)
+	status, body, err := upstreamCall(c, fiber.MethodPost, u.JoinPath("/v1/pending-vehicle/command", cmd.imei), cmd.payload)
+	rec.Status = status
+	rec.Response = commandResponse(body)
+	switch {
+	case err != nil:
+		rec.Ack, rec.AckDetail = CommandRejected, err.Error()
+	case status >= fiber.StatusMultipleChoices:
+		rec.Ack, rec.AckDetail = CommandRejected, "oracle returned "+strconv.Itoa(status)
+	default:
+		rec.Ack = CommandPending
+		var res map[string]any
+		if json.Unmarshal(body, &res) == nil {
+			rec.OracleCommandID = itemString(res, "id", "commandId", "kore_command_sid")
+			rec.ackFrom(itemString(res, "status"), time.Now())
+		}
+	}
+	if appendErr := v.commands.record(rec); appendErr != nil {
+		v.logger.Err(appendErr).Str("imei", rec.IMEI).Msg("failed to write device command record")
+	}
+
+	if err != nil {
+		v.logger.Err(err).Str("imei", rec.IMEI).Msg("failed to send device command")
+		return fiber.NewError(fiber.StatusBadGateway, "failed to send the command")
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(status).Send(body)
+}
+
+// ConfirmCommand
+// @Summary Confirmation token for a destructive command
+// @Description Checks the command like SubmitCommand does and returns a token that sends exactly it, to this device,
+// @Description once, by the caller, within 5 minutes.
+// @Tags Vehicles
+// @Accept json
+// @Produce json
+// @Param imei path string true "device imei"
+// @Success 200 {object} CommandConfirmationRes
+// @Failure 400 {object} ValidationErrorRes
+// @Router /oracle/{oracleID}/pending-vehicle/command/{imei}/confirmation [post]
+func (v *VehiclesController) ConfirmCommand(c *fiber.Ctx) error {
+	cmd, val, err := v.deviceCommand(c)
+	if err != nil {
+		return err
+	}
+	if !val.ok() {
+		return val.respond(c)
+	}
+	if !cmd.spec.Destructive {
+		val.add("command", "%s isn't destructive, it's sent without confirmation", cmd.spec.Name)
+		return val.respond(c)
+	}
+	subject, _ := jwtActor(c)
+	oracleID, _ := c.Locals("oracleID").(string)
+	token, expiresAt := v.commands.confirm(commandScope(DeviceCommandRecord{
+		Subject: subject, TenantID: c.Get("Tenant-Id"), OracleID: oracleID, IMEI: cmd.imei, Payload: cmd.payload,
+	}))
+	return c.JSON(CommandConfirmationRes{ConfirmationToken: token, ExpiresAt: expiresAt, Command: cmd.spec})
+}
+
+// GetCommandCatalog
+// @Summary Commands a device takes
+// @Description The catalog of commands for the device's type, with their params. Empty for a device type without a
+// @Description catalog, whose commands aren't checked.
+// @Tags Vehicles
+// @Produce json
+// @Param imei path string true "device imei"
+// @Success 200 {object} DeviceCommandCatalogRes
+// @Router /oracle/{oracleID}/pending-vehicle/command/{imei}/catalog [get]
+func (v *VehiclesController) GetCommandCatalog(c *fiber.Ctx) error {
+	imei := c.Params("imei")
+	val := &validator{}
+	if val.imei("imei", imei); !val.ok() {
+		return val.respond(c)
+	}
+	deviceType, _, err := v.commandDevice(c, imei)
+	if err != nil {
+		return err
+	}
+	return c.JSON(DeviceCommandCatalogRes{IMEI: imei, DeviceType: deviceType, Commands: append([]CommandSpec{}, deviceCommandCatalog[deviceType]...)})
+}
+
+// GetCommandHistory
+// @Summary Commands sent to a device
+// @Description The commands sent to the device through the BFF for the caller's tenant, newest first, with who sent
+// @Description them, what was sent, the oracle's response and whether the device acknowledged them. Pending
+// @Description acknowledgements are looked up on the oracle's vehicle first.
+// @Tags Vehicles
+// @Produce json
+// @Param imei path string true "device imei"
+// @Success 200 {object} DeviceCommandHistoryRes
+// @Router /oracle/{oracleID}/pending-vehicle/command/{imei}/history [get]
+func (v *VehiclesController) GetCommandHistory(c *fiber.Ctx) error {
+	imei := strings.Clone(c.Params("imei"))
+	val := &validator{}
+	if val.imei("imei", imei); !val.ok() {
+		return val.respond(c)
+	}
+	tenantID, err := requireTenantAccess(c, v.settings)
+	if err != nil {
+		return err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	records, err := v.commands.history(oracleID, tenantID, imei)
+	if err != nil {
+		v.logger.Err(err).Msg("failed to read device command history")
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to read the command history")
+	}
+	deviceType, tokenID, err := v.commandDevice(c, imei)
+	if err != nil {
+		return err
+	}
+	if tokenID != 0 && slices.ContainsFunc(records, func(r DeviceCommandRecord) bool { return r.Ack == CommandPending }) {
+		v.refreshCommandAcks(c, tokenID, records)
+	}
+	return c.JSON(DeviceCommandHistoryRes{IMEI: imei, DeviceType: deviceType, Commands: records})
+}
+
+// deviceCommand reads and checks the command in the request against the device's catalog, when its type has one.
+// The validator has what's wrong with it.
+func (v *VehiclesController) deviceCommand(c *fiber.Ctx) (deviceCommand, *validator, error) {
+	val := &validator{}
+	imei := strings.Clone(c.Params("imei"))
+	val.imei("imei", imei)
+	var req deviceCommandRequest
+	if !decodeBody(c, val, &req) || !val.ok() {
+		return deviceCommand{}, val, nil
+	}
+	if val.required("command", req.Command); !val.ok() {
+		return deviceCommand{}, val, nil
+	}
+
+	deviceType, tokenID, err := v.commandDevice(c, imei)
+	if err != nil {
+		return deviceCommand{}, val, err
+	}
+	specs, catalogued := deviceCommandCatalog[deviceType]
+	spec, params := CommandSpec{Name: req.Command}, req.Params
+	if catalogued {
+		i := slices.IndexFunc(specs, func(s CommandSpec) bool { return s.Name == req.Command })
+		if i < 0 {
+			names := make([]string, len(specs))
+			for j, s := range specs {
+				names[j] = s.Name
+			}
+			val.add("command", "must be one of %s for %s devices", strings.Join(names, ", "), deviceType)
+			return deviceCommand{}, val, nil
+		}
+		spec = specs[i]
+		if params = validateCommandParams(val, spec, req.Params); !val.ok() {
+			return deviceCommand{}, val, nil
+		}
+	}
+
+	payload := map[string]any{"command": spec.Name}
+	if len(params) > 0 {
+		payload["params"] = params
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return deviceCommand{}, val, err
+	}
+	return deviceCommand{
+		imei: imei, deviceType: deviceType, tokenID: tokenID, spec: spec, params: params, payload: body, token: req.ConfirmationToken,
+	}, val, nil
+}
+
+// validateCommandParams checks params against the spec and returns them typed, nil when there are none
+func validateCommandParams(v *validator, spec CommandSpec, params map[string]any) map[string]any {
+	var out map[string]any
+	for _, p := range spec.Params {
+		field := "params." + p.Name
+		raw, ok := params[p.Name]
+		if !ok || raw == nil {
+			if p.Required {
+				v.add(field, "is required")
+			}
+			continue
+		}
+		var value any
+		switch p.Type {
+		case CommandParamInt:
+			num, isNum := raw.(json.Number)
+			n, err := num.Int64()
+			if !isNum || err != nil {
+				v.add(field, "must be a whole number")
+				continue
+			}
+			if n < p.Min || n > p.Max {
+				v.add(field, "must be between %d and %d", p.Min, p.Max)
+				continue
+			}
+			value = n
+		case CommandParamBool:
+			b, isBool := raw.(bool)
+			if !isBool {
+				v.add(field, "must be true or false")
+				continue
+			}
+			value = b
+		case CommandParamEnum:
+			s, isString := raw.(string)
+			if !isString || !slices.Contains(p.Values, s) {
+				v.add(field, "must be one of %s", strings.Join(p.Values, ", "))
+				continue
+			}
+			value = s
+		}
+		if out == nil {
+			out = map[string]any{}
+		}
+		out[p.Name] = value
+	}
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		if !slices.ContainsFunc(spec.Params, func(p CommandParam) bool { return p.Name == name }) {
+			v.add("params."+name, "isn't a param of %s", spec.Name)
+		}
+	}
+	return out
+}
+
+// commandDevice is the device's type and, once it's minted, its vehicle token id. The fleet vehicles are looked at
+// first, then the pending ones. A device neither lists, or listed without a type, is a smart5, the oracle's default.
+func (v *VehiclesController) commandDevice(c *fiber.Ctx, imei string) (string, uint64, error) {
+	u := GetOracleURL(c, v.settings)
+	fleetURL := u.JoinPath("/v1/fleet/vehicles")
+	fleetURL.RawQuery = url.Values{"search": {imei}, "take": {strconv.Itoa(fleetScanPageSize)}}.Encode()
+	var fleet struct {
+		Items []map[string]any `json:"items"`
+	}
+	found, err := v.impactGet(c, fleetURL, &fleet)
+	if err != nil {
+		v.logger.Err(err).Str("imei", imei).Msg("failed to look up the device in the fleet")
+		return "", 0, fiber.NewError(fiber.StatusBadGateway, "failed to look up the device")
+	}
+	if found {
+		for _, item := range fleet.Items {
+			if itemString(item, "imei") == imei {
+				tokenID, _ := itemTokenID(item)
+				return strings.ToLower(cmp.Or(itemString(item, "device_type", "deviceType"), defaultDeviceType)), tokenID, nil
+			}
+		}
+	}
+
+	pending, _, err := v.listPendingVehicles(c, u, imei)
+	if err != nil {
+		v.logger.Err(err).Str("imei", imei).Msg("failed to look up the pending device")
+		return "", 0, fiber.NewError(fiber.StatusBadGateway, "failed to look up the device")
+	}
+	for _, p := range pending {
+		if p.IMEI == imei {
+			return strings.ToLower(cmp.Or(p.DeviceType, defaultDeviceType)), 0, nil
+		}
+	}
+	return defaultDeviceType, 0, nil
+}
+
+// refreshCommandAcks matches the pending records, in place, with the commands on the oracle's vehicle, by the
+// oracle's id when the submit response had one, else with the oldest command of the same name sent after them.
+// Acknowledgements found are appended to the history. Nothing changes when the vehicle can't be read.
+func (v *VehiclesController) refreshCommandAcks(c *fiber.Ctx, tokenID uint64, records []DeviceCommandRecord) {
+	u := GetOracleURL(c, v.settings)
+	var vehicle struct {
+		Commands []map[string]any `json:"commands"`
+	}
+	if found, err := v.impactGet(c, u.JoinPath("/v1/fleet/vehicles", strconv.FormatUint(tokenID, 10)), &vehicle); !found {
+		if err != nil {
+			v.logger.Warn().Err(err).Uint64("tokenId", tokenID).Msg("failed to read device commands")
+		}
+		return
+	}
+	type oracleCommand struct {
+		ids       []string
+		name      string
+		status    string
+		createdAt time.Time
+	}
+	commands := make([]oracleCommand, 0, len(vehicle.Commands))
+	for _, item := range vehicle.Commands {
+		createdAt, _ := time.Parse(time.RFC3339, itemString(item, "created_at"))
+		commands = append(commands, oracleCommand{
+			ids:       []string{itemString(item, "id"), itemString(item, "kore_command_sid")},
+			name:      itemString(item, "command"),
+			status:    itemString(item, "status"),
+			createdAt: createdAt,
+		})
+	}
+	slices.SortFunc(commands, func(a, b oracleCommand) int { return a.createdAt.Compare(b.createdAt) })
+
+	claimed := make([]bool, len(commands))
+	now := time.Now()
+	// oldest first, so each takes the earliest command left
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := &records[i]
+		if rec.Ack != CommandPending {
+			continue
+		}
+		match := slices.IndexFunc(commands, func(oc oracleCommand) bool {
+			return rec.OracleCommandID != "" && slices.Contains(oc.ids, rec.OracleCommandID)
+		})
+		if match < 0 && rec.OracleCommandID == "" {
+			for j, oc := range commands {
+				// the oracle's clock may be a little behind ours
+				if !claimed[j] && strings.EqualFold(oc.name, rec.Command) && !oc.createdAt.Before(rec.Time.Add(-time.Minute)) {
+					match = j
+					break
+				}
+			}
+		}
+		if match < 0 {
+			continue
+		}
+		claimed[match] = true
+		if !rec.ackFrom(commands[match].status, now) {
+			continue
+		}
+		if err := v.commands.record(*rec); err != nil {
+			v.logger.Err(err).Str("imei", rec.IMEI).Msg("failed to write device command record")
+		}
+	}
+}
+
+// ackFrom sets the acknowledgement from a status the oracle reported for the command. Returns whether it changed.
+func (r *DeviceCommandRecord) ackFrom(status string, at time.Time) bool {
+	ack := CommandPending
+	switch s := strings.ToLower(status); {
+	case s == "":
+		return false
+	case strings.Contains(s, "fail"), strings.Contains(s, "error"), strings.Contains(s, "undelivered"),
+		strings.Contains(s, "reject"), strings.Contains(s, "expired"):
+		ack = CommandFailed
+	case slices.Contains([]string{"delivered", "received", "acknowledged", "acked", "success", "succeeded", "completed", "done"}, s):
+		ack = CommandAcknowledged
+	}
+	if ack == r.Ack && status == r.AckDetail {
+		return false
+	}
+	r.Ack, r.AckDetail = ack, status
+	if ack != CommandPending {
+		at = at.UTC()
+		r.AckAt = &at
+	}
+	return true
+}
+
+// commandScope is what a confirmation token is good for: the same payload to the same device, by the same caller
+func commandScope(r DeviceCommandRecord) string {
+	return strings.Join([]string{r.Subject, r.TenantID, r.OracleID, r.IMEI, string(r.Payload)}, "\x00")
+}
+
+// commandResponse is the upstream response as it's kept in the history, a JSON string when it isn't JSON
+func commandResponse(body []byte) json.RawMessage {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+	if len(body) <= commandResponseMaxLen && json.Valid(body) {
+		return append(json.RawMessage(nil), body...)
+	}
+	s, _ := json.Marshal(string(body[:min(len(body), commandResponseMaxLen)]))
+	return s
+}
+
+func newCommandID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestVehiclesController_Commands(t *testing.T) {
+	const (
+		fleetIMEI   = "356938035643825"
+		kamaleoIMEI = "356938035643817"
+	)
+	var mu sync.Mutex
+	var sent []string
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/v1/permissions":
+		case r.URL.Path == "/v1/fleet/vehicles":
+			if strings.Contains(fleetIMEI, r.URL.Query().Get("search")) {
+				_, _ = w.Write([]byte(`{"items":[{"imei":"` + fleetIMEI + `","vehicle_token_id":7,"device_type":"smart5"}]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"items":[]}`))
+		case r.URL.Path == "/v1/fleet/vehicles/7":
+			created := time.Now().UTC().Format(time.RFC3339)
+			_, _ = w.Write([]byte(`{"commands":[
+				{"id":"c1","command":"output/set","status":"delivered","created_at":"` + created + `"},
+				{"id":"c2","command":"immobilizer/on","status":"failed","created_at":"` + created + `"}]}`))
+		case r.URL.Path == "/v1/pending-vehicles":
+			_, _ = w.Write([]byte(`{"vehicles":[{"imei":"` + kamaleoIMEI + `","deviceType":"gv58"}]}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/pending-vehicle/command/"):
+			body, _ := io.ReadAll(r.Body)
+			sent = append(sent, string(body))
+			_, _ = w.Write([]byte(`{"message":"command sent"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oracle.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, DataDir: t.TempDir()}
+	logger := zerolog.Nop()
+	ctrl := NewVehiclesController(settings, &logger, nil, nil)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	app.Post("/pending-vehicle/command/:imei", ctrl.SubmitCommand)
+	app.Post("/pending-vehicle/command/:imei/confirmation", ctrl.ConfirmCommand)
+	app.Get("/pending-vehicle/command/:imei/catalog", ctrl.GetCommandCatalog)
+	app.Get("/pending-vehicle/command/:imei/history", ctrl.GetCommandHistory)
+
+	send := func(method, target, tenantID, body string, res any) int {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Tenant-Id", tenantID)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = json.NewDecoder(resp.Body).Decode(res)
+		return resp.StatusCode
+	}
+	command := "/pending-vehicle/command/" + fleetIMEI
+
+	// params are checked against the catalog, all problems at once
+	var invalid ValidationErrorRes
+	status := send(http.MethodPost, command, "t1", `{"command":"output/set","params":{"output":9,"on":"yes","speed":1}}`, &invalid)
+	fields := map[string]bool{}
+	for _, e := range invalid.Errors {
+		fields[e.Field] = true
+	}
+	if status != http.StatusBadRequest || !fields["params.output"] || !fields["params.on"] || !fields["params.speed"] {
+		t.Errorf("expected the bad params reported, got %d %+v", status, invalid)
+	}
+	if status := send(http.MethodPost, command, "t1", `{"command":"reboot"}`, &invalid); status != http.StatusBadRequest ||
+		invalid.Errors[0].Field != "command" {
+		t.Errorf("expected an unknown command rejected, got %d %+v", status, invalid)
+	}
+	// a device type without a catalog takes its commands as they come
+	if status := send(http.MethodPost, "/pending-vehicle/command/"+kamaleoIMEI, "t1", `{"command":"gps/report","params":{"every":30}}`, &struct{}{}); status != http.StatusOK {
+		t.Errorf("expected a command to a device type without a catalog sent, got %d", status)
+	}
+
+	if status := send(http.MethodPost, command, "t1", `{"command":"output/set","params":{"output":2,"on":true}}`, &struct{}{}); status != http.StatusOK {
+		t.Fatalf("expected the command sent, got %d", status)
+	}
+
+	// a destructive command goes out once per confirmation
+	if status := send(http.MethodPost, command, "t1", `{"command":"immobilizer/on"}`, &struct{}{}); status != http.StatusPreconditionRequired {
+		t.Errorf("expected an unconfirmed immobilizer refused, got %d", status)
+	}
+	if status := send(http.MethodPost, command+"/confirmation", "t1", `{"command":"immobilizer/off"}`, &struct{}{}); status != http.StatusBadRequest {
+		t.Errorf("expected no confirmation for a harmless command, got %d", status)
+	}
+	var conf CommandConfirmationRes
+	if status := send(http.MethodPost, command+"/confirmation", "t1", `{"command":"immobilizer/on"}`, &conf); status != http.StatusOK || conf.ConfirmationToken == "" {
+		t.Fatalf("expected a confirmation token, got %d %+v", status, conf)
+	}
+	confirmed := `{"command":"immobilizer/on","confirmationToken":"` + conf.ConfirmationToken + `"}`
+	if status := send(http.MethodPost, command, "t2", confirmed, &struct{}{}); status != http.StatusPreconditionRequired {
+		t.Errorf("expected the token refused in another tenant, got %d", status)
+	}
+	if status := send(http.MethodPost, command, "t1", confirmed, &struct{}{}); status != http.StatusOK {
+		t.Errorf("expected the confirmed immobilizer sent, got %d", status)
+	}
+	if status := send(http.MethodPost, command, "t1", confirmed, &struct{}{}); status != http.StatusPreconditionRequired {
+		t.Errorf("expected the token used up, got %d", status)
+	}
+	// tokens are checked without the instance that handed them out, and stay used up
+	other := NewVehiclesController(settings, &logger, nil, nil)
+	if ok, err := other.commands.redeem(conf.ConfirmationToken, "another scope"); ok || err != nil {
+		t.Errorf("expected the token refused for another command, got %v %v", ok, err)
+	}
+	var again CommandConfirmationRes
+	send(http.MethodPost, command+"/confirmation", "t1", `{"command":"immobilizer/on"}`, &again)
+	scope := commandScope(DeviceCommandRecord{TenantID: "t1", OracleID: "kaufmann", IMEI: fleetIMEI, Payload: []byte(`{"command":"immobilizer/on"}`)})
+	if ok, err := other.commands.redeem(again.ConfirmationToken, scope); !ok || err != nil {
+		t.Errorf("expected another instance to take the token, got %v %v", ok, err)
+	}
+	if status := send(http.MethodPost, command, "t1", `{"command":"immobilizer/on","confirmationToken":"`+again.ConfirmationToken+`"}`, &struct{}{}); status != http.StatusPreconditionRequired {
+		t.Errorf("expected the token used up on the other instance, got %d", status)
+	}
+	mu.Lock()
+	if len(sent) != 3 || sent[0] != `{"command":"gps/report","params":{"every":30}}` ||
+		sent[1] != `{"command":"output/set","params":{"on":true,"output":2}}` || sent[2] != `{"command":"immobilizer/on"}` {
+		t.Errorf("unexpected commands sent upstream %q", sent)
+	}
+	mu.Unlock()
+
+	// the acknowledgements are picked up from the vehicle's commands
+	var history DeviceCommandHistoryRes
+	if status := send(http.MethodGet, command+"/history", "t1", "", &history); status != http.StatusOK || len(history.Commands) != 2 {
+		t.Fatalf("expected both commands in the history, got %d %+v", status, history)
+	}
+	immobilizer, output := history.Commands[0], history.Commands[1]
+	if output.Command != "output/set" || output.Ack != CommandAcknowledged || output.AckAt == nil || output.Params["output"] != float64(2) ||
+		string(output.Response) != `{"message":"command sent"}` {
+		t.Errorf("expected the output command acknowledged, got %+v", output)
+	}
+	if immobilizer.Command != "immobilizer/on" || immobilizer.Ack != CommandFailed || immobilizer.AckDetail != "failed" {
+		t.Errorf("expected the immobilizer failed, got %+v", immobilizer)
+	}
+	if send(http.MethodGet, command+"/history", "t2", "", &history); len(history.Commands) != 0 {
+		t.Errorf("expected another tenant's history empty, got %+v", history.Commands)
+	}
+
+	var catalog DeviceCommandCatalogRes
+	if status := send(http.MethodGet, "/pending-vehicle/command/356938035643809/catalog", "t1", "", &catalog); status != http.StatusOK ||
+		catalog.DeviceType != "smart5" || len(catalog.Commands) == 0 {
+		t.Errorf("expected an unlisted device taken as a smart5, got %d %+v", status, catalog)
+	}
+	catalog = DeviceCommandCatalogRes{}
+	if send(http.MethodGet, "/pending-vehicle/command/"+kamaleoIMEI+"/catalog", "t1", "", &catalog); catalog.DeviceType != "gv58" || len(catalog.Commands) != 0 {
+		t.Errorf("expected no commands for a gv58, got %+v", catalog)
+	}
+	if send(http.MethodGet, "/pending-vehicle/command/"+kamaleoIMEI+"/history", "t1", "", &history); len(history.Commands) != 1 ||
+		history.Commands[0].Command != "gps/report" || history.Commands[0].DeviceType != "gv58" {
+		t.Errorf("expected the gv58 command in its history, got %+v", history.Commands)
+	}
+
+	// a restart compacts away the expired tokens, the commands past the retention and the acknowledgements' rewrites
+	_ = ctrl.commands.used.Append(usedConfirmation{Nonce: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	_ = ctrl.commands.log.Append(DeviceCommandRecord{ID: "old", Time: time.Now().AddDate(0, 0, -91), OracleID: "kaufmann",
+		TenantID: "t1", IMEI: fleetIMEI, Command: "device/reset"})
+	restarted := NewVehiclesController(settings, &logger, nil, nil)
+	used, logged := 0, 0
+	_ = restarted.commands.used.Scan(func(usedConfirmation) bool { used++; return true })
+	_ = restarted.commands.log.Scan(func(DeviceCommandRecord) bool { logged++; return true })
+	if used != 2 || logged != 3 {
+		t.Errorf("expected 2 tokens and 3 commands kept, got %d and %d", used, logged)
+	}
+	if records, _ := restarted.commands.history("kaufmann", "t1", fleetIMEI); len(records) != 2 || records[0].Ack != CommandFailed {
+		t.Errorf("expected the history reloaded in its latest state, got %+v", records)
+	}
+}
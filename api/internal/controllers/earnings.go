@@ -0,0 +1,371 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// earnings windows, the buckets weekly rewards are totalled into
+const (
+	windowWeek    = "week"
+	windowMonth   = "month"
+	windowQuarter = "quarter"
+	windowYear    = "year"
+)
+
+const (
+	// maxEarningsRange is as far back as a vehicle's earnings history is read, see service.VehicleEarnings
+	maxEarningsRange     = 2 * 365 * 24 * time.Hour
+	defaultEarningsRange = 365 * 24 * time.Hour
+	// maxEarningsCacheEntries bounds the rollup cache, expired entries are dropped first
+	maxEarningsCacheEntries = 200
+)
+
+// EarningsController totals DIMO rewards over the caller's fleet. Reading a fleet's earnings takes a page of the
+// fleet per 500 vehicles and an identity lookup per 50, so what was read is kept for a while per caller and fleet
+// filter, and every window and range is cut from it.
+type EarningsController struct {
+	settings    *config.Settings
+	logger      *zerolog.Logger
+	identityAPI service.IdentityAPI
+
+	mu    sync.Mutex
+	cache map[string]*fleetEarnings
+	now   func() time.Time
+}
+
+func NewEarningsController(settings *config.Settings, logger *zerolog.Logger, identityAPI service.IdentityAPI) *EarningsController {
+	return &EarningsController{
+		settings:    settings,
+		logger:      logger,
+		identityAPI: identityAPI,
+		cache:       map[string]*fleetEarnings{},
+		now:         time.Now,
+	}
+}
+
+// fleetEarnings is a fleet and the earnings of its vehicles, as read at readAt
+type fleetEarnings struct {
+	vehicles  []fleetVehicleRef
+	earnings  map[uint64]service.VehicleEarnings
+	truncated bool
+	readAt    time.Time
+}
+
+// EarningsWindow is the rewards paid for the weeks beginning in [start, end). Token amounts are exact decimal strings.
+type EarningsWindow struct {
+	Start                   time.Time           `json:"start"`
+	End                     time.Time           `json:"end"`
+	Tokens                  service.TokenAmount `json:"tokens" swaggertype:"string"`
+	StreakTokens            service.TokenAmount `json:"streakTokens" swaggertype:"string"`
+	AftermarketDeviceTokens service.TokenAmount `json:"aftermarketDeviceTokens" swaggertype:"string"`
+	SyntheticDeviceTokens   service.TokenAmount `json:"syntheticDeviceTokens" swaggertype:"string"`
+}
+
+// GroupEarnings is the earnings of a fleet group's vehicles. A vehicle in more than one group counts in each, so
+// group totals can add up to more than the fleet's.
+type GroupEarnings struct {
+	GroupID        string              `json:"groupId"`
+	Name           string              `json:"name"`
+	Vehicles       int                 `json:"vehicles"`
+	LifetimeTokens service.TokenAmount `json:"lifetimeTokens" swaggertype:"string"`
+	PeriodTokens   service.TokenAmount `json:"periodTokens" swaggertype:"string"`
+	Windows        []EarningsWindow    `json:"windows"`
+}
+
+// FleetEarningsRes is the fleet's earnings between from and to, in total, per window and per fleet group. Vehicles
+// in no group are under the group with an empty id.
+type FleetEarningsRes struct {
+	From           time.Time           `json:"from"`
+	To             time.Time           `json:"to"`
+	Window         string              `json:"window"`
+	Vehicles       int                 `json:"vehicles"`
+	NotOnChain     int                 `json:"notOnChain"`
+	LifetimeTokens service.TokenAmount `json:"lifetimeTokens" swaggertype:"string"`
+	PeriodTokens   service.TokenAmount `json:"periodTokens" swaggertype:"string"`
+	Windows        []EarningsWindow    `json:"windows"`
+	Groups         []GroupEarnings     `json:"groups"`
+	Truncated      bool                `json:"truncated"`
+	ReadAt         time.Time           `json:"readAt"`
+}
+
+// GetFleetEarnings
+// @Summary Fleet earnings rollup
+// @Description DIMO rewards of every minted fleet vehicle, totalled per window (week, month, quarter or year) between
+// @Description from and to and per fleet group. Weeks count in the window they begin in. The fleet and its earnings
+// @Description are cached per caller for FLEET_EARNINGS_CACHE_MINUTES, refresh=true reads them again; readAt says when
+// @Description they were read. format=csv returns one row per window for the fleet and for each group.
+// @Tags Vehicles
+// @Produce json
+// @Produce text/csv
+// @Param from query string false "RFC3339 or YYYY-MM-DD, defaults to a year before to"
+// @Param to query string false "RFC3339 or YYYY-MM-DD, defaults to now"
+// @Param window query string false "week, month (default), quarter or year"
+// @Param search query string false "passed to the fleet vehicle listing"
+// @Param filter query string false "passed to the fleet vehicle listing, eg. group:<id>"
+// @Param refresh query bool false "read the fleet and its earnings again"
+// @Param format query string false "json (default) or csv"
+// @Success 200 {object} FleetEarningsRes
+// @Router /oracle/{oracleID}/fleet/earnings [get]
+func (e *EarningsController) GetFleetEarnings(c *fiber.Ctx) error {
+	v := &validator{}
+	now := e.now().UTC()
+	to := parseEarningsTime(v, "to", c.Query("to"), now)
+	from := parseEarningsTime(v, "from", c.Query("from"), to.Add(-defaultEarningsRange))
+	switch {
+	case !from.Before(to):
+		v.add("from", "must be before to")
+	case to.Sub(from) > maxEarningsRange:
+		v.add("from", "range can be at most %d days", int(maxEarningsRange.Hours()/24))
+	}
+	window := c.Query("window", windowMonth)
+	if !slices.Contains([]string{windowWeek, windowMonth, windowQuarter, windowYear}, window) {
+		v.add("window", "must be week, month, quarter or year")
+	}
+	format := c.Query("format", "json")
+	if format != "json" && format != "csv" {
+		v.add("format", "must be json or csv")
+	}
+	if !v.ok() {
+		return v.respond(c)
+	}
+
+	fleet, err := e.fleetEarnings(c, c.QueryBool("refresh"))
+	if err != nil {
+		return err
+	}
+	res := rollupEarnings(fleet, from, to, window)
+
+	c.Set("X-Truncated", strconv.FormatBool(res.Truncated))
+	if format == "json" {
+		return c.JSON(res)
+	}
+	filename := "fleet-earnings-" + from.Format(time.DateOnly) + "-" + to.Format(time.DateOnly) + ".csv"
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	c.Set(fiber.HeaderContentType, "text/csv")
+	w := csv.NewWriter(c.Response().BodyWriter())
+	_ = w.Write([]string{"scope", "group_id", "group_name", "vehicles", "window_start", "window_end", "tokens",
+		"streak_tokens", "aftermarket_device_tokens", "synthetic_device_tokens"})
+	writeRows := func(scope, groupID, name string, vehicles int, windows []EarningsWindow) {
+		for _, win := range windows {
+			_ = w.Write([]string{scope, groupID, name, strconv.Itoa(vehicles),
+				win.Start.Format(time.RFC3339), win.End.Format(time.RFC3339), win.Tokens.String(),
+				win.StreakTokens.String(), win.AftermarketDeviceTokens.String(), win.SyntheticDeviceTokens.String()})
+		}
+	}
+	writeRows("fleet", "", "", res.Vehicles, res.Windows)
+	for _, g := range res.Groups {
+		writeRows("group", g.GroupID, g.Name, g.Vehicles, g.Windows)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// fleetEarnings is the caller's fleet and its earnings, from the cache unless it's expired or refresh is asked for.
+// The key has the caller, tenant and oracle in it as the fleet listing depends on all three.
+func (e *EarningsController) fleetEarnings(c *fiber.Ctx, refresh bool) (*fleetEarnings, error) {
+	subject, _ := jwtActor(c)
+	oracleID, _ := c.Locals("oracleID").(string)
+	key := strings.Join([]string{oracleID, c.Get("Tenant-Id"), subject, c.Query("search"), c.Query("filter")}, "\x00")
+	now := e.now()
+	ttl := e.settings.GetFleetEarningsCacheTTL()
+
+	e.mu.Lock()
+	cached, ok := e.cache[key]
+	e.mu.Unlock()
+	if ok && !refresh && now.Sub(cached.readAt) < ttl {
+		return cached, nil
+	}
+
+	vehicles, truncated, err := listFleetVehicles(c, e.settings, e.logger)
+	if err != nil {
+		return nil, err
+	}
+	tokenIDs := make([]uint64, len(vehicles))
+	for i, vehicle := range vehicles {
+		tokenIDs[i] = vehicle.tokenID
+	}
+	earnings, err := e.identityAPI.GetVehicleEarnings(tokenIDs)
+	if err != nil {
+		e.logger.Err(err).Int("count", len(tokenIDs)).Msg("failed to get fleet earnings")
+		return nil, fiber.NewError(fiber.StatusBadGateway, "failed to get vehicle earnings")
+	}
+	fleet := &fleetEarnings{vehicles: vehicles, earnings: earnings, truncated: truncated, readAt: now}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.cache) >= maxEarningsCacheEntries {
+		for k, entry := range e.cache {
+			if now.Sub(entry.readAt) >= ttl {
+				delete(e.cache, k)
+			}
+		}
+		// still full of live entries, make room
+		for k := range e.cache {
+			if len(e.cache) < maxEarningsCacheEntries {
+				break
+			}
+			delete(e.cache, k)
+		}
+	}
+	e.cache[key] = fleet
+	return fleet, nil
+}
+
+// rollupEarnings totals the fleet's earnings into windows between from and to, for the fleet and for each group
+func rollupEarnings(fleet *fleetEarnings, from, to time.Time, window string) FleetEarningsRes {
+	res := FleetEarningsRes{
+		From:      from,
+		To:        to,
+		Window:    window,
+		Windows:   earningsWindows(from, to, window),
+		Groups:    []GroupEarnings{},
+		Truncated: fleet.truncated,
+		ReadAt:    fleet.readAt,
+	}
+	groups := map[string]*GroupEarnings{}
+	var groupOrder []string
+	groupFor := func(g fleetGroupRef) *GroupEarnings {
+		if ge, ok := groups[g.ID]; ok {
+			return ge
+		}
+		ge := &GroupEarnings{GroupID: g.ID, Name: g.Name, Windows: earningsWindows(from, to, window)}
+		groups[g.ID] = ge
+		groupOrder = append(groupOrder, g.ID)
+		return ge
+	}
+
+	for _, vehicle := range fleet.vehicles {
+		earnings, ok := fleet.earnings[vehicle.tokenID]
+		if !ok {
+			res.NotOnChain++
+			continue
+		}
+		vehicleGroups := vehicle.groups
+		if len(vehicleGroups) == 0 {
+			vehicleGroups = []fleetGroupRef{{Name: "Ungrouped"}}
+		}
+		res.Vehicles++
+		res.LifetimeTokens = res.LifetimeTokens.Add(earnings.TotalTokens)
+		var targets []*GroupEarnings
+		for _, g := range vehicleGroups {
+			ge := groupFor(g)
+			ge.Vehicles++
+			ge.LifetimeTokens = ge.LifetimeTokens.Add(earnings.TotalTokens)
+			targets = append(targets, ge)
+		}
+
+		for _, week := range earnings.History {
+			idx := windowIndex(res.Windows, week.BeginningTime)
+			if idx < 0 {
+				continue
+			}
+			addWeek(&res.Windows[idx], week)
+			res.PeriodTokens = res.PeriodTokens.Add(week.Tokens())
+			for _, ge := range targets {
+				addWeek(&ge.Windows[idx], week)
+				ge.PeriodTokens = ge.PeriodTokens.Add(week.Tokens())
+			}
+		}
+	}
+	for _, id := range groupOrder {
+		res.Groups = append(res.Groups, *groups[id])
+	}
+	return res
+}
+
+func addWeek(w *EarningsWindow, week service.EarningsWeek) {
+	w.Tokens = w.Tokens.Add(week.Tokens())
+	w.StreakTokens = w.StreakTokens.Add(week.StreakTokens)
+	w.AftermarketDeviceTokens = w.AftermarketDeviceTokens.Add(week.AftermarketDeviceTokens)
+	w.SyntheticDeviceTokens = w.SyntheticDeviceTokens.Add(week.SyntheticDeviceTokens)
+}
+
+// earningsWindows are the windows covering [from, to), the first starting at or before from, every one listed even
+// when nothing was earned in it. The first and last are cut to from and to.
+func earningsWindows(from, to time.Time, window string) []EarningsWindow {
+	var windows []EarningsWindow
+	for start := windowStart(from, window); start.Before(to); {
+		end := nextWindow(start, window)
+		windows = append(windows, EarningsWindow{Start: maxTime(start, from), End: minTime(end, to)})
+		start = end
+	}
+	return windows
+}
+
+func windowIndex(windows []EarningsWindow, t time.Time) int {
+	for i, w := range windows {
+		if !t.Before(w.Start) && t.Before(w.End) {
+			return i
+		}
+	}
+	return -1
+}
+
+// windowStart is the start of the window t is in, in UTC: monday of its week, or the first day of its month,
+// quarter or year
+func windowStart(t time.Time, window string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch window {
+	case windowWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case windowQuarter:
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, time.UTC)
+	case windowYear:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func nextWindow(start time.Time, window string) time.Time {
+	switch window {
+	case windowWeek:
+		return start.AddDate(0, 0, 7)
+	case windowQuarter:
+		return start.AddDate(0, 3, 0)
+	case windowYear:
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// parseEarningsTime takes an RFC3339 time or a date, which is midnight UTC
+func parseEarningsTime(v *validator, field, raw string, def time.Time) time.Time {
+	if raw == "" {
+		return def
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC()
+	}
+	if t, err := time.Parse(time.DateOnly, raw); err == nil {
+		return t
+	}
+	v.add(field, "must be an RFC3339 time or a YYYY-MM-DD date")
+	return def
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestEarningsController_GetFleetEarnings(t *testing.T) {
+	var oracleCalls atomic.Int32
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oracleCalls.Add(1)
+		_, _ = w.Write([]byte(`{"totalCount":4,"items":[
+			{"vin":"A","vehicle_token_id":1,"groups":[{"id":"g1","name":"North"}]},
+			{"vin":"B","vehicle_token_id":2,"groups":[{"id":"g1","name":"North"},{"id":"g2","name":"South"}]},
+			{"vin":"C","vehicle_token_id":3},
+			{"vin":"D","vehicle_token_id":4}]}`))
+	}))
+	defer oracle.Close()
+	week := func(begin string, streak float64, synthetic string) map[string]any {
+		return map[string]any{"beginningTime": begin, "streakTokens": streak, "syntheticDeviceTokens": synthetic} // BigDecimal, as a string
+	}
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		earnings := func(total string, weeks ...map[string]any) map[string]any {
+			return map[string]any{"earnings": map[string]any{"totalTokens": total, "history": map[string]any{"nodes": weeks}}}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			// 18 decimals, more than a float64 adds up exactly
+			"v1": earnings("100.500000000000000001", week("2026-03-30T05:00:00Z", 1, "2.000000000000000001"), week("2026-02-02T05:00:00Z", 0, "4")),
+			"v2": earnings("10.000000000000000002", week("2026-03-02T05:00:00Z", 1, "0")),
+			"v3": earnings("0"),
+			"v4": nil,
+		}})
+	}))
+	defer identity.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	ctrl := NewEarningsController(settings, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}))
+	ctrl.now = func() time.Time { return time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC) }
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	app.Get("/fleet/earnings", ctrl.GetFleetEarnings)
+
+	get := func(target string) *http.Response {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/fleet/earnings?from=2026-02-01&window=month")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var res FleetEarningsRes
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Vehicles != 3 || res.NotOnChain != 1 || res.LifetimeTokens.String() != "110.500000000000000003" ||
+		res.PeriodTokens.String() != "8.000000000000000001" {
+		t.Fatalf("unexpected totals %+v", res)
+	}
+	// february, march and the first half of april
+	if len(res.Windows) != 3 || res.Windows[0].Tokens.String() != "4" || res.Windows[1].Tokens.String() != "4.000000000000000001" ||
+		res.Windows[2].Tokens.String() != "0" {
+		t.Fatalf("unexpected windows %+v", res.Windows)
+	}
+	if !res.Windows[2].End.Equal(res.To) {
+		t.Errorf("expected the last window cut to to, got %v", res.Windows[2].End)
+	}
+	groups := map[string]GroupEarnings{}
+	for _, g := range res.Groups {
+		groups[g.GroupID] = g
+	}
+	if north := groups["g1"]; north.Vehicles != 2 || north.PeriodTokens.String() != "8.000000000000000001" ||
+		north.LifetimeTokens.String() != "110.500000000000000003" {
+		t.Errorf("unexpected North group %+v", north)
+	}
+	if south := groups["g2"]; south.Vehicles != 1 || south.Windows[1].StreakTokens.String() != "1" {
+		t.Errorf("unexpected South group %+v", south)
+	}
+	if ungrouped := groups[""]; ungrouped.Vehicles != 1 || ungrouped.PeriodTokens.String() != "0" {
+		t.Errorf("unexpected ungrouped vehicles %+v", ungrouped)
+	}
+
+	// another window over the same fleet comes from the cache
+	resp = get("/fleet/earnings?from=2026-02-01&window=quarter&format=csv")
+	if resp.StatusCode != http.StatusOK || oracleCalls.Load() != 1 {
+		t.Fatalf("expected a cached csv, got %d after %d fleet reads", resp.StatusCode, oracleCalls.Load())
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header, fleet and three groups, each with Q1 and the start of Q2
+	if len(rows) != 9 || rows[1][0] != "fleet" || rows[1][6] != "8.000000000000000001" {
+		t.Errorf("unexpected csv %v", rows)
+	}
+
+	if get("/fleet/earnings?refresh=true"); oracleCalls.Load() != 2 {
+		t.Error("expected refresh to read the fleet again")
+	}
+	if resp := get("/fleet/earnings?window=day"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an unknown window rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	at := time.Date(2026, 5, 14, 13, 0, 0, 0, time.UTC) // a thursday
+	tests := map[string]time.Time{
+		windowWeek:    time.Date(2026, 5, 11, 0, 0, 0, 0, time.UTC),
+		windowMonth:   time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC),
+		windowQuarter: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+		windowYear:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for window, want := range tests {
+		if got := windowStart(at, window); !got.Equal(want) {
+			t.Errorf("%s: expected %v, got %v", window, want, got)
+		}
+	}
+}
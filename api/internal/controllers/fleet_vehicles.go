@@ -0,0 +1,265 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// identity_mismatches values, set on an enriched fleet vehicle when the oracle and the chain disagree
+const (
+	mismatchNotOnChain = "not_on_chain"
+	mismatchOwner      = "owner"
+	mismatchDefinition = "definition"
+)
+
+const (
+	// fleetScanMaxVehicles is the most fleet vehicles a fleet-wide report reads
+	fleetScanMaxVehicles = 5000
+	fleetScanPageSize    = 500
+)
+
+// VehicleIdentity is what ?enrich=identity adds to a fleet vehicle, from the identity api
+type VehicleIdentity struct {
+	Owner        string              `json:"owner"`
+	MintedAt     string              `json:"minted_at"`
+	Definition   *identityDefinition `json:"definition"`
+	SacdGrantees []string            `json:"sacd_grantees"`
+	Connection   string              `json:"connection,omitempty"`
+}
+
+type identityDefinition struct {
+	ID    string `json:"id"`
+	Make  string `json:"make"`
+	Model string `json:"model"`
+	Year  int    `json:"year"`
+}
+
+// identityVehicle is the vehicle lookup of the identity service
+type identityVehicle struct {
+	Owner    string `json:"owner"`
+	MintedAt string `json:"mintedAt"`
+	Sacds    struct {
+		Nodes    []service.SACD `json:"nodes"`
+		PageInfo struct {
+			EndCursor   string `json:"endCursor"`
+			HasNextPage bool   `json:"hasNextPage"`
+		} `json:"pageInfo"`
+	} `json:"sacds"`
+	SyntheticDevice *struct {
+		Connection *struct {
+			Name string `json:"name"`
+		} `json:"connection"`
+	} `json:"syntheticDevice"`
+	Definition *identityDefinition `json:"definition"`
+}
+
+// GetFleetVehicles
+// @Summary Fleet vehicles
+// @Description The oracle's fleet vehicle page. With enrich=identity each minted vehicle also gets its on-chain owner,
+// @Description definition, SACD grantees and mint date under identity, in one batched identity lookup, and
+// @Description identity_mismatches lists where the oracle and the chain disagree: not_on_chain, owner, definition.
+// @Description When the identity api is down the page comes back as is, with X-Identity-Enrichment: unavailable.
+// @Tags Vehicles
+// @Produce json
+// @Param enrich query string false "identity"
+// @Success 200
+// @Router /oracle/{oracleID}/fleet/vehicles [get]
+func (v *VehiclesController) GetFleetVehicles(c *fiber.Ctx) error {
+	query, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid query string")
+	}
+	enrich := query.Get("enrich")
+	query.Del("enrich")
+	if enrich != "" && enrich != "identity" {
+		val := &validator{}
+		val.add("enrich", "must be identity")
+		return val.respond(c)
+	}
+
+	u := GetOracleURL(c, v.settings)
+	targetURL := u.JoinPath("/v1/fleet/vehicles")
+	if enrich == "" {
+		targetURL.RawQuery = string(c.Request().URI().QueryString())
+		return ProxyRequest(c, targetURL, nil, v.logger)
+	}
+	targetURL.RawQuery = query.Encode()
+
+	status, body, err := upstreamCall(c, fiber.MethodGet, targetURL, nil)
+	if err != nil {
+		v.logger.Err(err).Msg("failed to get fleet vehicles")
+		return fiber.NewError(fiber.StatusBadGateway, "failed to get fleet vehicles")
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if status != fiber.StatusOK {
+		return c.Status(status).Send(body)
+	}
+
+	// everything but the items passes through untouched, and so does every field of each item
+	var page map[string]json.RawMessage
+	var items []map[string]any
+	if err := json.Unmarshal(body, &page); err != nil {
+		return fiber.NewError(fiber.StatusBadGateway, "unexpected fleet vehicles response")
+	}
+	dec := json.NewDecoder(bytes.NewReader(page["items"]))
+	dec.UseNumber()
+	if err := dec.Decode(&items); err != nil {
+		return fiber.NewError(fiber.StatusBadGateway, "unexpected fleet vehicles response")
+	}
+	v.enrichWithIdentity(c, items)
+	page["items"], err = json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return c.JSON(page)
+}
+
+// enrichWithIdentity adds identity and identity_mismatches to each item with a token id
+func (v *VehiclesController) enrichWithIdentity(c *fiber.Ctx, items []map[string]any) {
+	var tokenIDs []uint64
+	for _, item := range items {
+		if id, ok := itemTokenID(item); ok {
+			tokenIDs = append(tokenIDs, id)
+		}
+	}
+	if len(tokenIDs) == 0 {
+		return
+	}
+	found, err := v.identityAPI.GetVehiclesByTokenIDs(tokenIDs)
+	if err != nil {
+		v.logger.Err(err).Int("count", len(tokenIDs)).Msg("failed to enrich fleet vehicles with identity")
+		c.Set("X-Identity-Enrichment", "unavailable")
+		return
+	}
+
+	for _, item := range items {
+		id, ok := itemTokenID(item)
+		if !ok {
+			continue
+		}
+		mismatches := []string{}
+		raw, ok := found[id]
+		var vehicle identityVehicle
+		if !ok || json.Unmarshal(raw, &vehicle) != nil {
+			item["identity"] = nil
+			item["identity_mismatches"] = append(mismatches, mismatchNotOnChain)
+			continue
+		}
+
+		identity := VehicleIdentity{
+			Owner:        vehicle.Owner,
+			MintedAt:     vehicle.MintedAt,
+			Definition:   vehicle.Definition,
+			SacdGrantees: []string{},
+		}
+		for _, sacd := range vehicle.Sacds.Nodes {
+			identity.SacdGrantees = append(identity.SacdGrantees, sacd.Grantee)
+		}
+		if vehicle.SyntheticDevice != nil && vehicle.SyntheticDevice.Connection != nil {
+			identity.Connection = vehicle.SyntheticDevice.Connection.Name
+		}
+
+		if owner := itemString(item, "owner", "owner_address"); owner != "" && !strings.EqualFold(owner, vehicle.Owner) {
+			mismatches = append(mismatches, mismatchOwner)
+		}
+		if defID := itemString(item, "device_definition_id"); defID != "" && vehicle.Definition != nil && defID != vehicle.Definition.ID {
+			mismatches = append(mismatches, mismatchDefinition)
+		}
+		item["identity"] = identity
+		item["identity_mismatches"] = mismatches
+	}
+}
+
+// itemTokenID is the vehicle token id of an oracle fleet vehicle, missing until it's minted
+func itemTokenID(item map[string]any) (uint64, bool) {
+	var raw string
+	switch id := item["vehicle_token_id"].(type) {
+	case json.Number:
+		raw = id.String()
+	case string:
+		raw = id
+	}
+	n, err := strconv.ParseUint(raw, 10, 64)
+	return n, err == nil && n > 0
+}
+
+// itemString is the first of the fields the item has as a non-empty string
+func itemString(item map[string]any, fields ...string) string {
+	for _, f := range fields {
+		if s, ok := item[f].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// fleetVehicleRef is a minted fleet vehicle as a fleet-wide report needs it
+type fleetVehicleRef struct {
+	vin     string
+	tokenID uint64
+	groups  []fleetGroupRef
+	// item is the oracle's record as listed
+	item map[string]any
+}
+
+type fleetGroupRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// listFleetVehicles pages through the caller's fleet on the oracle, keeping the minted vehicles. The search and filter
+// query params are passed on. The bool says the fleet has more than fleetScanMaxVehicles.
+func listFleetVehicles(c *fiber.Ctx, s *config.Settings, logger *zerolog.Logger) ([]fleetVehicleRef, bool, error) {
+	u := GetOracleURL(c, s)
+	var vehicles []fleetVehicleRef
+	for skip := 0; ; skip += fleetScanPageSize {
+		if skip >= fleetScanMaxVehicles {
+			return vehicles, true, nil
+		}
+		targetURL := u.JoinPath("/v1/fleet/vehicles")
+		targetURL.RawQuery = url.Values{
+			"skip":   {strconv.Itoa(skip)},
+			"take":   {strconv.Itoa(fleetScanPageSize)},
+			"search": {c.Query("search")},
+			"filter": {c.Query("filter")},
+		}.Encode()
+		status, body, err := upstreamCall(c, fiber.MethodGet, targetURL, nil)
+		if err != nil {
+			logger.Err(err).Msg("failed to list fleet vehicles")
+			return nil, false, fiber.NewError(fiber.StatusBadGateway, "failed to list fleet vehicles")
+		}
+		if status != fiber.StatusOK {
+			return nil, false, fiber.NewError(status, "failed to list fleet vehicles")
+		}
+		var page struct {
+			Items []map[string]any `json:"items"`
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&page); err != nil {
+			return nil, false, fiber.NewError(fiber.StatusBadGateway, "unexpected fleet vehicles response")
+		}
+		for _, item := range page.Items {
+			id, ok := itemTokenID(item)
+			if !ok {
+				continue
+			}
+			vehicle := fleetVehicleRef{vin: itemString(item, "vin"), tokenID: id, item: item}
+			if raw, err := json.Marshal(item["groups"]); err == nil {
+				_ = json.Unmarshal(raw, &vehicle.groups)
+			}
+			vehicles = append(vehicles, vehicle)
+		}
+		if len(page.Items) < fleetScanPageSize {
+			return vehicles, false, nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestVehiclesController_GetFleetVehicles(t *testing.T) {
+	var oracleQuery string
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oracleQuery = r.URL.RawQuery
+		_, _ = w.Write([]byte(`{"totalCount":3,"items":[
+			{"vin":"A","vehicle_token_id":7,"owner":"0xAAA","device_definition_id":"ford_f-150_2022","license_plate":"X1"},
+			{"vin":"B","vehicle_token_id":8,"owner":"0xbbb"},
+			{"vin":"C","vehicle_token_id":null}]}`))
+	}))
+	defer oracle.Close()
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"v7":{"owner":"0xccc","mintedAt":"2024-01-01T00:00:00Z",
+			"sacds":{"nodes":[{"grantee":"0xoracle","permissions":"0x3ffc"}]},
+			"syntheticDevice":{"connection":{"name":"Smartcar"}},
+			"definition":{"id":"ford_f-150_2022","make":"Ford","model":"F-150","year":2022}},"v8":null}}`))
+	}))
+	defer identity.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	ctrl := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}), nil)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	app.Get("/fleet/vehicles", ctrl.GetFleetVehicles)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/fleet/vehicles?skip=0&take=3&enrich=identity", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if oracleQuery != "skip=0&take=3" {
+		t.Errorf("expected enrich not to reach the oracle, got %q", oracleQuery)
+	}
+	var page struct {
+		TotalCount int `json:"totalCount"`
+		Items      []struct {
+			LicensePlate       string           `json:"license_plate"`
+			Identity           *VehicleIdentity `json:"identity"`
+			IdentityMismatches []string         `json:"identity_mismatches"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 3 || len(page.Items) != 3 || page.Items[0].LicensePlate != "X1" {
+		t.Fatalf("expected the oracle page to pass through, got %+v", page)
+	}
+
+	minted := page.Items[0]
+	if minted.Identity == nil || minted.Identity.Owner != "0xccc" || minted.Identity.Connection != "Smartcar" ||
+		len(minted.Identity.SacdGrantees) != 1 || minted.Identity.Definition.Make != "Ford" {
+		t.Errorf("unexpected identity %+v", minted.Identity)
+	}
+	if len(minted.IdentityMismatches) != 1 || minted.IdentityMismatches[0] != mismatchOwner {
+		t.Errorf("expected an owner mismatch, got %v", minted.IdentityMismatches)
+	}
+	if burned := page.Items[1]; burned.Identity != nil || len(burned.IdentityMismatches) != 1 || burned.IdentityMismatches[0] != mismatchNotOnChain {
+		t.Errorf("expected vehicle 8 flagged not on chain, got %+v", burned)
+	}
+	if unminted := page.Items[2]; unminted.IdentityMismatches != nil {
+		t.Errorf("expected an unminted vehicle left alone, got %+v", unminted)
+	}
+
+	// without enrich it's a plain proxy
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/fleet/vehicles?take=3&skip=0", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || oracleQuery != "take=3&skip=0" {
+		t.Errorf("expected the query passed through as is, got %d %q", resp.StatusCode, oracleQuery)
+	}
+}
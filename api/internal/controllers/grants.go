@@ -0,0 +1,339 @@
+package controllers
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+// grant gap reasons
+const (
+	gapMissing      = "missing"      // no grant to the grantee at all
+	gapExpired      = "expired"      // grants to the grantee, all expired
+	gapInsufficient = "insufficient" // a live grant without all the privileges required
+)
+
+// DecodedSACD is a SACD grant with its permissions mask decoded
+type DecodedSACD struct {
+	Grantee     string   `json:"grantee"`
+	Permissions string   `json:"permissions"`
+	Privileges  []string `json:"privileges"`
+	ExpiresAt   string   `json:"expiresAt,omitempty"`
+}
+
+// GrantGap is a fleet vehicle whose grant to a grantee falls short. Fix is the grant that would close the gap: the
+// privileges required plus those already granted, so re-granting doesn't take any away.
+type GrantGap struct {
+	TokenID           uint64   `json:"tokenId"`
+	VIN               string   `json:"vin"`
+	Label             string   `json:"label"`
+	Grantee           string   `json:"grantee"`
+	Reason            string   `json:"reason"`
+	MissingPrivileges []string `json:"missingPrivileges"`
+	GrantedPrivileges []string `json:"grantedPrivileges"`
+	ExpiredAt         string   `json:"expiredAt,omitempty"`
+	Fix               GrantFix `json:"fix"`
+}
+
+// GrantFix is the SACD to set, permissions being the mask to pass to setPermissions
+type GrantFix struct {
+	Grantee     string  `json:"grantee"`
+	Permissions string  `json:"permissions"`
+	Privileges  []int64 `json:"privileges"`
+}
+
+// GrantGapReport lists the gaps over the fleet. GrantsTruncated are vehicles with more than grantReportMaxSACDs
+// grants whose first ones fall short: the rest weren't read, so they may or may not have a gap.
+type GrantGapReport struct {
+	VehiclesChecked  int        `json:"vehiclesChecked"`
+	VehiclesWithGaps int        `json:"vehiclesWithGaps"`
+	NotOnChain       []uint64   `json:"notOnChain"`
+	GrantsTruncated  []uint64   `json:"grantsTruncated"`
+	Truncated        bool       `json:"truncated"`
+	Gaps             []GrantGap `json:"gaps"`
+}
+
+// grantReportMaxSACDs is the most grants read per vehicle for the gap report
+const grantReportMaxSACDs = 1000
+
+// requiredGrant is a config.RequiredGrant with its privileges parsed
+type requiredGrant struct {
+	label      string
+	grantee    string
+	privileges []int64
+}
+
+// GetGrantGapReport
+// @Summary SACD grant gaps over the fleet
+// @Description Checks every minted fleet vehicle for the SACD grants in SACD_REQUIRED_GRANTS, or for the grantee
+// @Description and privileges given, and lists those where the grantee is missing, only has expired grants or lacks
+// @Description a privilege, with the permissions mask that would fix it. A vehicle's grants are paged through, up to
+// @Description 1000; one with more whose first 1000 fall short is listed under grantsTruncated instead.
+// @Tags Vehicles
+// @Produce json
+// @Param grantee query string false "check this grantee instead of the configured ones, eg. a customer's license"
+// @Param privileges query string false "with grantee, comma separated privilege ids or names"
+// @Param search query string false "passed to the fleet vehicle listing"
+// @Param filter query string false "passed to the fleet vehicle listing, eg. group:<id>"
+// @Success 200 {object} GrantGapReport
+// @Router /oracle/{oracleID}/fleet/grant-gaps [get]
+func (v *VehiclesController) GetGrantGapReport(c *fiber.Ctx) error {
+	grants, val := v.requiredGrants(c)
+	if !val.ok() {
+		return val.respond(c)
+	}
+	if len(grants) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "no required grants configured, pass grantee and privileges")
+	}
+
+	vehicles, truncated, err := listFleetVehicles(c, v.settings, v.logger)
+	if err != nil {
+		return err
+	}
+	tokenIDs := make([]uint64, len(vehicles))
+	for i, vehicle := range vehicles {
+		tokenIDs[i] = vehicle.tokenID
+	}
+	found, err := v.identityAPI.GetVehiclesByTokenIDs(tokenIDs)
+	if err != nil {
+		v.logger.Err(err).Int("count", len(tokenIDs)).Msg("failed to look up fleet vehicles for the grant report")
+		return fiber.NewError(fiber.StatusBadGateway, "failed to look up vehicle grants")
+	}
+
+	report := GrantGapReport{Truncated: truncated, NotOnChain: []uint64{}, GrantsTruncated: []uint64{}, Gaps: []GrantGap{}}
+	identities := make(map[uint64]*identityVehicle, len(found))
+	for _, vehicle := range vehicles {
+		var identity identityVehicle
+		if raw, ok := found[vehicle.tokenID]; ok && json.Unmarshal(raw, &identity) == nil {
+			identities[vehicle.tokenID] = &identity
+		}
+	}
+	grantsTruncated, err := v.readAllSACDs(identities)
+	if err != nil {
+		v.logger.Err(err).Msg("failed to page through vehicle grants for the grant report")
+		return fiber.NewError(fiber.StatusBadGateway, "failed to look up vehicle grants")
+	}
+
+	now := time.Now()
+	for _, vehicle := range vehicles {
+		identity, ok := identities[vehicle.tokenID]
+		if !ok {
+			report.NotOnChain = append(report.NotOnChain, vehicle.tokenID)
+			continue
+		}
+		report.VehiclesChecked++
+		gaps := grantGaps(vehicle, *identity, grants, now)
+		if len(gaps) > 0 && grantsTruncated[vehicle.tokenID] {
+			report.GrantsTruncated = append(report.GrantsTruncated, vehicle.tokenID)
+			continue
+		}
+		if len(gaps) > 0 {
+			report.VehiclesWithGaps++
+			report.Gaps = append(report.Gaps, gaps...)
+		}
+	}
+	return c.JSON(report)
+}
+
+// readAllSACDs pages through the grants of the vehicles that have more than the lookup returned, a few vehicles at
+// a time, adding them to the vehicle. Vehicles with more than grantReportMaxSACDs are returned.
+func (v *VehiclesController) readAllSACDs(identities map[uint64]*identityVehicle) (map[uint64]bool, error) {
+	var mu sync.Mutex
+	truncated := map[uint64]bool{}
+	group := errgroup.Group{}
+	group.SetLimit(4)
+	for tokenID, identity := range identities {
+		pageInfo := identity.Sacds.PageInfo
+		if !pageInfo.HasNextPage || pageInfo.EndCursor == "" {
+			continue
+		}
+		group.Go(func() error {
+			more, moreLeft, err := service.ListVehicleSACDs(v.identityAPI, tokenID, pageInfo.EndCursor,
+				max(grantReportMaxSACDs-len(identity.Sacds.Nodes), 1))
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			identity.Sacds.Nodes = append(identity.Sacds.Nodes, more...)
+			truncated[tokenID] = moreLeft
+			return nil
+		})
+	}
+	return truncated, group.Wait()
+}
+
+// requiredGrants are the grants to check for: the ones asked for in the query, else the configured ones
+func (v *VehiclesController) requiredGrants(c *fiber.Ctx) ([]requiredGrant, *validator) {
+	val := &validator{}
+	var configured []config.RequiredGrant
+	if grantee := c.Query("grantee"); grantee != "" {
+		val.address("grantee", grantee)
+		privs := splitList(c.Query("privileges"))
+		if len(privs) == 0 {
+			val.add("privileges", "is required with grantee")
+		}
+		configured = []config.RequiredGrant{{Label: "requested", Grantee: grantee, Privileges: privs}}
+	} else {
+		var err error
+		if configured, err = v.settings.GetRequiredGrants(); err != nil {
+			v.logger.Err(err).Msg("invalid SACD_REQUIRED_GRANTS")
+			val.add("grantee", "no valid required grants configured, pass grantee and privileges")
+			return nil, val
+		}
+	}
+
+	var grants []requiredGrant
+	for _, g := range configured {
+		rg := requiredGrant{label: g.Label, grantee: g.Grantee}
+		for _, p := range g.Privileges {
+			id, err := service.ParsePrivilege(p)
+			if err != nil {
+				val.add("privileges", "%s", err.Error())
+				continue
+			}
+			rg.privileges = append(rg.privileges, id)
+		}
+		slices.Sort(rg.privileges)
+		grants = append(grants, rg)
+	}
+	return grants, val
+}
+
+// grantGaps checks a vehicle's SACDs against each required grant. Privileges of every live grant to the grantee
+// count, a vehicle can carry more than one.
+func grantGaps(vehicle fleetVehicleRef, identity identityVehicle, grants []requiredGrant, now time.Time) []GrantGap {
+	var gaps []GrantGap
+	for _, g := range grants {
+		var granted []int64
+		var found bool
+		var expiredAt string
+		for _, sacd := range identity.Sacds.Nodes {
+			if !strings.EqualFold(sacd.Grantee, g.grantee) {
+				continue
+			}
+			found = true
+			if exp, err := time.Parse(time.RFC3339, sacd.ExpiresAt); err == nil && !exp.After(now) {
+				expiredAt = max(expiredAt, sacd.ExpiresAt)
+				continue
+			}
+			privs, err := service.DecodeSACDPermissions(sacd.Permissions)
+			if err != nil {
+				continue
+			}
+			for _, p := range privs {
+				if !slices.Contains(granted, p) {
+					granted = append(granted, p)
+				}
+			}
+		}
+		slices.Sort(granted)
+		missing := service.MissingPrivileges(granted, g.privileges)
+		if len(missing) == 0 {
+			continue
+		}
+
+		gap := GrantGap{
+			TokenID:           vehicle.tokenID,
+			VIN:               vehicle.vin,
+			Label:             g.label,
+			Grantee:           g.grantee,
+			Reason:            gapInsufficient,
+			MissingPrivileges: privilegeNames(missing),
+			GrantedPrivileges: privilegeNames(granted),
+		}
+		switch {
+		case !found:
+			gap.Reason = gapMissing
+		case len(granted) == 0 && expiredAt != "":
+			gap.Reason = gapExpired
+			gap.ExpiredAt = expiredAt
+		}
+		fix := slices.Concat(granted, missing)
+		slices.Sort(fix)
+		gap.Fix = GrantFix{Grantee: g.grantee, Permissions: service.EncodeSACDPermissions(fix), Privileges: fix}
+		gaps = append(gaps, gap)
+	}
+	return gaps
+}
+
+// decodeSACDs is the vehicle's grants with their privileges named
+func decodeSACDs(identity identityVehicle) []DecodedSACD {
+	out := make([]DecodedSACD, 0, len(identity.Sacds.Nodes))
+	for _, sacd := range identity.Sacds.Nodes {
+		d := DecodedSACD{Grantee: sacd.Grantee, Permissions: sacd.Permissions, ExpiresAt: sacd.ExpiresAt, Privileges: []string{}}
+		if privs, err := service.DecodeSACDPermissions(sacd.Permissions); err == nil {
+			d.Privileges = privilegeNames(privs)
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+func privilegeNames(ids []int64) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = service.PrivilegeName(id)
+	}
+	return names
+}
+
+// splitList splits a comma separated query param, trimming blanks
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// withDecodedSACDs adds privileges, the decoded permissions, to each SACD of an identity vehicle. Only the nodes
+// change, pageInfo and anything else under sacds is passed on, and so is anything it can't read.
+func withDecodedSACDs(vehicle json.RawMessage) json.RawMessage {
+	var fields, sacds map[string]json.RawMessage
+	var identity identityVehicle
+	if json.Unmarshal(vehicle, &fields) != nil || json.Unmarshal(vehicle, &identity) != nil ||
+		json.Unmarshal(fields["sacds"], &sacds) != nil || sacds == nil {
+		return vehicle
+	}
+	var err error
+	if sacds["nodes"], err = json.Marshal(decodeSACDs(identity)); err != nil {
+		return vehicle
+	}
+	if fields["sacds"], err = json.Marshal(sacds); err != nil {
+		return vehicle
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return vehicle
+	}
+	return out
+}
+
+// withDecodedVehicleSACDs is withDecodedSACDs for a whole vehicle lookup response, {"data":{"vehicle":...}}
+func withDecodedVehicleSACDs(body []byte) []byte {
+	var res map[string]json.RawMessage
+	var data map[string]json.RawMessage
+	if json.Unmarshal(body, &res) != nil || json.Unmarshal(res["data"], &data) != nil || data["vehicle"] == nil {
+		return body
+	}
+	data["vehicle"] = withDecodedSACDs(data["vehicle"])
+	var err error
+	if res["data"], err = json.Marshal(data); err != nil {
+		return body
+	}
+	out, err := json.Marshal(res)
+	if err != nil {
+		return body
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+const testGrantee = "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+
+func TestVehiclesController_GetGrantGapReport(t *testing.T) {
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"totalCount":5,"items":[
+			{"vin":"A","vehicle_token_id":1},{"vin":"B","vehicle_token_id":2},{"vin":"C","vehicle_token_id":3},
+			{"vin":"D","vehicle_token_id":4},{"vin":"E","vehicle_token_id":5},{"vin":"F"},
+			{"vin":"G","vehicle_token_id":6},{"vin":"H","vehicle_token_id":7}]}`))
+	}))
+	defer oracle.Close()
+	other := `{"grantee":"0x0000000000000000000000000000000000000001","permissions":"0x3ffc"}`
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req service.GraphQLRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		// the grants past the first page: vehicle 6 has the required one on its second page, vehicle 7 has more
+		// than are read
+		paging := strings.Contains(req.Query, "sacds(first: ")
+		switch {
+		case paging && strings.Contains(req.Query, "tokenId: 6)"):
+			_, _ = w.Write([]byte(`{"data":{"vehicle":{"sacds":{"nodes":[{"grantee":"` + testGrantee + `","permissions":"0x3ffc"}],
+				"pageInfo":{"hasNextPage":false}}}}}`))
+			return
+		case paging:
+			_, _ = w.Write([]byte(`{"data":{"vehicle":{"sacds":{"nodes":[` + strings.Repeat(other+",", 99) + other + `],
+				"pageInfo":{"hasNextPage":true,"endCursor":"next"}}}}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{
+			"v6":{"sacds":{"nodes":[` + other + `],"pageInfo":{"hasNextPage":true,"endCursor":"c6"}}},
+			"v7":{"sacds":{"nodes":[` + other + `],"pageInfo":{"hasNextPage":true,"endCursor":"c7"}}},
+			"v1":{"sacds":{"nodes":[{"grantee":"` + testGrantee + `","permissions":"0x3ffc","expiresAt":"2999-01-01T00:00:00Z"}]}},
+			"v2":{"sacds":{"nodes":[]}},
+			"v3":{"sacds":{"nodes":[{"grantee":"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed","permissions":"0x3ffc","expiresAt":"2020-01-01T00:00:00Z"}]}},
+			"v4":{"sacds":{"nodes":[{"grantee":"` + testGrantee + `","permissions":"0x3c","expiresAt":"2999-01-01T00:00:00Z"}]}},
+			"v5":null}}`))
+	}))
+	defer identity.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, SacdRequiredGrants: "oracle|" + testGrantee + "|1 VEHICLE_ALL_TIME_LOCATION"}
+	logger := zerolog.Nop()
+	ctrl := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}), nil)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	app.Get("/fleet/grant-gaps", ctrl.GetGrantGapReport)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/fleet/grant-gaps", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var report GrantGapReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.VehiclesChecked != 6 || report.VehiclesWithGaps != 3 || len(report.NotOnChain) != 1 || report.NotOnChain[0] != 5 ||
+		len(report.GrantsTruncated) != 1 || report.GrantsTruncated[0] != 7 {
+		t.Fatalf("unexpected summary %+v", report)
+	}
+	want := map[uint64]string{2: gapMissing, 3: gapExpired, 4: gapInsufficient}
+	for _, gap := range report.Gaps {
+		if want[gap.TokenID] != gap.Reason {
+			t.Errorf("vehicle %d: expected %q, got %q", gap.TokenID, want[gap.TokenID], gap.Reason)
+		}
+	}
+	insufficient := report.Gaps[2]
+	if len(insufficient.MissingPrivileges) != 1 || insufficient.MissingPrivileges[0] != "VEHICLE_ALL_TIME_LOCATION" ||
+		len(insufficient.GrantedPrivileges) != 2 {
+		t.Errorf("unexpected privileges %+v", insufficient)
+	}
+	// the fix keeps VEHICLE_COMMANDS, which was granted though not required
+	if insufficient.Fix.Permissions != "0x33c" || insufficient.Fix.Grantee != testGrantee {
+		t.Errorf("unexpected fix %+v", insufficient.Fix)
+	}
+	if report.Gaps[1].ExpiredAt != "2020-01-01T00:00:00Z" {
+		t.Errorf("expected the expiry on the expired gap, got %+v", report.Gaps[1])
+	}
+
+	// a customer's grantee can be checked instead
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/fleet/grant-gaps?grantee="+testGrantee+"&privileges=VEHICLE_TELEPORT", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an unknown privilege rejected, got %d", resp.StatusCode)
+	}
+}
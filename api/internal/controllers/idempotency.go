@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	idempotencyKeyMaxLen = 255
+	// idempotencyMaxBody is the largest response kept for replay, mutations answer with a job id or a small object
+	idempotencyMaxBody = 1 << 20
+)
+
+// idempotencyReplayHeaders are the response headers replayed with the body, the rest are the upstream's transport headers
+var idempotencyReplayHeaders = []string{fiber.HeaderContentType, fiber.HeaderContentDisposition, fiber.HeaderLocation, "X-Tracked-Jobs", "X-Proxied-By"}
+
+// idempotencyDryRunRoutes are the oracle routes that answer ?dryRun=true without changing anything, under /oracle/:oracleID
+var idempotencyDryRunRoutes = map[string]bool{
+	"/vehicle/delete":            true,
+	"/vehicle/delete/shared":     true,
+	"/vehicle/disconnect":        true,
+	"/vehicle/disconnect/shared": true,
+	"/vehicle/transfer":          true,
+	"/vehicle/transfer/shared":   true,
+}
+
+// IdempotencyRecord is the first response to a request carrying an Idempotency-Key
+type IdempotencyRecord struct {
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key"`
+	Subject  string    `json:"subject,omitempty"`
+	TenantID string    `json:"tenantId,omitempty"`
+	OracleID string    `json:"oracleId"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	// Fingerprint is the hash of the query and body, a request that reuses the key must match it
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+type idempotencyEntry struct {
+	rec      IdempotencyRecord
+	inFlight bool
+}
+
+// IdempotencyController makes retries of mutating requests safe: the first response to an Idempotency-Key on a route
+// is kept for the configured window and replayed to repeats instead of calling the oracle again, so a browser retry or
+// a double click on mint, transfer or claim goes upstream once. Keys are scoped to the caller, tenant and route.
+type IdempotencyController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	window   time.Duration
+	log      *store.JSONL[IdempotencyRecord]
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+	// logged is how many records the log has, compacted once most of them are past the window
+	logged int
+}
+
+func NewIdempotencyController(settings *config.Settings, logger *zerolog.Logger) *IdempotencyController {
+	ic := &IdempotencyController{
+		settings: settings,
+		logger:   logger,
+		window:   settings.GetIdempotencyWindow(),
+		log:      store.NewJSONL[IdempotencyRecord](filepath.Join(settings.GetDataDir(), "idempotency.jsonl")),
+		entries:  map[string]*idempotencyEntry{},
+	}
+	// responses from before a restart are still replayed within their window
+	since := time.Now().Add(-ic.window)
+	err := ic.log.Scan(func(rec IdempotencyRecord) bool {
+		ic.logged++
+		if rec.Time.After(since) {
+			ic.entries[idempotencyScope(rec)] = &idempotencyEntry{rec: rec}
+		}
+		return true
+	})
+	if err != nil {
+		logger.Err(err).Msg("failed to read idempotency records")
+		ic.logged = 0
+	}
+	// down to the responses still replayed, as each keeps a whole response body
+	if ic.logged > len(ic.entries) {
+		ic.compactLocked()
+	}
+	ic.lastSweep = time.Now()
+	return ic
+}
+
+// Middleware replays the stored response for a repeated Idempotency-Key, answers 422 when the key comes back with a
+// different body and 409 while the first request is still running. Requests without the header, and dry runs of the
+// routes that serve them, which change nothing, go through as before.
+// Responses are kept unless the request failed with a 5xx or 429, which a retry is meant to run again.
+// Must run after jwt auth and the oracleID middleware.
+func (ic *IdempotencyController) Middleware(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	}
+	key := strings.Clone(c.Get("Idempotency-Key"))
+	if key == "" || (c.QueryBool("dryRun") && idempotencyDryRunRoutes[stripOraclePrefix(c.Path())]) {
+		return c.Next()
+	}
+	if len(key) > idempotencyKeyMaxLen {
+		return fiber.NewError(fiber.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+	}
+
+	subject, _ := jwtActor(c)
+	oracleID, _ := c.Locals("oracleID").(string)
+	rec := IdempotencyRecord{
+		Time:        time.Now().UTC(),
+		Key:         key,
+		Subject:     subject,
+		TenantID:    strings.Clone(c.Get("Tenant-Id")),
+		OracleID:    oracleID,
+		Method:      c.Method(),
+		Path:        strings.Clone(c.Path()),
+		Fingerprint: requestFingerprint(c),
+	}
+	scope := idempotencyScope(rec)
+
+	ic.mu.Lock()
+	ic.sweepLocked()
+	if e, ok := ic.entries[scope]; ok && (e.inFlight || time.Since(e.rec.Time) <= ic.window) {
+		ic.mu.Unlock()
+		switch {
+		case e.rec.Fingerprint != rec.Fingerprint:
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request")
+		case e.inFlight:
+			c.Set(fiber.HeaderRetryAfter, "1")
+			return fiber.NewError(fiber.StatusConflict, "a request with this Idempotency-Key is still in progress")
+		}
+		for k, v := range e.rec.Headers {
+			c.Set(k, v)
+		}
+		c.Set("Idempotent-Replayed", "true")
+		return c.Status(e.rec.Status).Send(e.rec.Body)
+	}
+	ic.entries[scope] = &idempotencyEntry{rec: rec, inFlight: true}
+	ic.mu.Unlock()
+	stored := false
+	defer func() {
+		// the key is free again for a retry, also when the handler panicked
+		if !stored {
+			ic.mu.Lock()
+			delete(ic.entries, scope)
+			ic.mu.Unlock()
+		}
+	}()
+
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	body := c.Response().Body()
+	if err != nil || status >= fiber.StatusInternalServerError || status == fiber.StatusTooManyRequests || len(body) > idempotencyMaxBody {
+		return err
+	}
+	stored = true
+	rec.Status = status
+	rec.Body = append([]byte(nil), body...)
+	rec.Headers = map[string]string{}
+	for _, h := range idempotencyReplayHeaders {
+		if v := c.GetRespHeader(h); v != "" {
+			rec.Headers[h] = v
+		}
+	}
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.entries[scope] = &idempotencyEntry{rec: rec}
+	// appended under the lock so a compaction can't write the log over it
+	if appendErr := ic.log.Append(rec); appendErr != nil {
+		ic.logger.Err(appendErr).Str("path", rec.Path).Msg("failed to write idempotency record")
+	} else {
+		ic.logged++
+	}
+	return nil
+}
+
+// sweepLocked drops expired responses, at most once a minute, and compacts the log once they're most of it
+func (ic *IdempotencyController) sweepLocked() {
+	now := time.Now()
+	if now.Sub(ic.lastSweep) < time.Minute {
+		return
+	}
+	ic.lastSweep = now
+	kept := 0
+	for scope, e := range ic.entries {
+		switch {
+		case e.inFlight:
+		case now.Sub(e.rec.Time) > ic.window:
+			delete(ic.entries, scope)
+		default:
+			kept++
+		}
+	}
+	if ic.logged > 2*kept {
+		ic.compactLocked()
+	}
+}
+
+// compactLocked rewrites the log with the stored responses still in memory, oldest first
+func (ic *IdempotencyController) compactLocked() {
+	recs := make([]IdempotencyRecord, 0, len(ic.entries))
+	for _, e := range ic.entries {
+		if !e.inFlight {
+			recs = append(recs, e.rec)
+		}
+	}
+	slices.SortFunc(recs, func(a, b IdempotencyRecord) int { return a.Time.Compare(b.Time) })
+	if err := ic.log.Rewrite(recs); err != nil {
+		ic.logger.Err(err).Msg("failed to compact idempotency records")
+		return
+	}
+	ic.logged = len(recs)
+}
+
+func idempotencyScope(rec IdempotencyRecord) string {
+	return strings.Join([]string{rec.Key, rec.Subject, rec.TenantID, rec.OracleID, rec.Method, rec.Path}, "\x00")
+}
+
+// requestFingerprint hashes the query and body of the request. JSON is re-encoded first so key order and whitespace
+// don't make a retry look like a different request.
+func requestFingerprint(c *fiber.Ctx) string {
+	body := c.Body()
+	var doc any
+	// numbers are kept as written, a float64 would make large token ids that differ hash the same
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err == nil && !dec.More() {
+		if canonical, err := json.Marshal(doc); err == nil {
+			body = canonical
+		}
+	}
+	h := sha256.New()
+	h.Write(c.Request().URI().QueryString())
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestIdempotencyController(t *testing.T) {
+	logger := zerolog.Nop()
+	var claims, flaky, deletes atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/pending-vehicles/claim/356938035643809":
+			n := claims.Add(1)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"claim":` + strconv.Itoa(int(n)) + `}`))
+		case "/v1/pending-vehicles/claim/356938035643817":
+			if flaky.Add(1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte(`{}`))
+		case "/v1/vehicle/delete":
+			deletes.Add(1)
+			_, _ = w.Write([]byte(`{}`))
+		case "/v1/tenant/sync-kore":
+			close(started)
+			<-release
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer oracle.Close()
+	u, _ := url.Parse(oracle.URL)
+
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, DataDir: t.TempDir()}
+	proxy := NewGenericProxyController(settings, &logger)
+	newApp := func() *fiber.App {
+		idempotency := NewIdempotencyController(settings, &logger)
+		app := fiber.New()
+		group := app.Group("/oracle/:oracleID", func(c *fiber.Ctx) error {
+			c.Locals("oracleID", c.Params("oracleID"))
+			return c.Next()
+		}, idempotency.Middleware)
+		group.Post("/pending-vehicles/claim/:imei", proxy.Proxy)
+		group.Post("/tenant/sync-kore", proxy.Proxy)
+		group.Post("/vehicle/delete", proxy.Proxy)
+		return app
+	}
+	app := newApp()
+
+	send := func(app *fiber.App, path, tenant, key, body string) (*http.Response, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Tenant-Id", tenant)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	const claim = "/oracle/kaufmann/pending-vehicles/claim/356938035643809"
+
+	resp, first := send(app, claim, "t1", "k1", `{"vin":"1HGCM82633A004352","plate":"AB1"}`)
+	if resp.StatusCode != http.StatusCreated || first != `{"claim":1}` {
+		t.Fatalf("unexpected first response %d %s", resp.StatusCode, first)
+	}
+	// the same request, formatted differently, is replayed
+	resp, again := send(app, claim, "t1", "k1", `{ "plate": "AB1", "vin": "1HGCM82633A004352" }`)
+	if resp.StatusCode != http.StatusCreated || again != first || resp.Header.Get("Idempotent-Replayed") != "true" ||
+		resp.Header.Get("X-Proxied-By") == "" || claims.Load() != 1 {
+		t.Errorf("expected the first response replayed, got %d %s %v after %d claims", resp.StatusCode, again, resp.Header, claims.Load())
+	}
+	if resp, _ := send(app, claim, "t1", "k1", `{"vin":"1HGCM82633A004352","plate":"AB2"}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a different body under the same key rejected, got %d", resp.StatusCode)
+	}
+	// keys are the caller's own, and requests without one run every time
+	send(app, claim, "t2", "k1", `{"vin":"1HGCM82633A004352","plate":"AB1"}`)
+	send(app, claim, "t1", "", `{}`)
+	send(app, claim, "t1", "", `{}`)
+	if claims.Load() != 4 {
+		t.Errorf("expected 4 claims upstream, got %d", claims.Load())
+	}
+
+	// only the routes that serve a dry run skip the key for one, elsewhere dryRun is just another query param
+	send(app, claim+"?dryRun=true", "t1", "k4", `{}`)
+	send(app, claim+"?dryRun=true", "t1", "k4", `{}`)
+	send(app, "/oracle/kaufmann/vehicle/delete?dryRun=true", "t1", "k4", `{}`)
+	send(app, "/oracle/kaufmann/vehicle/delete?dryRun=true", "t1", "k4", `{}`)
+	if claims.Load() != 5 || deletes.Load() != 2 {
+		t.Errorf("expected 1 more claim and 2 dry run deletes upstream, got %d and %d", claims.Load()-4, deletes.Load())
+	}
+	// large numbers that only differ past a float64's precision are different requests
+	send(app, claim, "t1", "k5", `{"tokenId":9007199254740993}`)
+	if resp, _ := send(app, claim, "t1", "k5", `{"tokenId":9007199254740992}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a different token id under the same key rejected, got %d", resp.StatusCode)
+	}
+
+	// a failed upstream call isn't kept, the retry goes through
+	if resp, _ := send(app, "/oracle/kaufmann/pending-vehicles/claim/356938035643817", "t1", "k2", `{}`); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected the upstream failure, got %d", resp.StatusCode)
+	}
+	if resp, _ := send(app, "/oracle/kaufmann/pending-vehicles/claim/356938035643817", "t1", "k2", `{}`); resp.StatusCode != http.StatusOK || flaky.Load() != 2 {
+		t.Errorf("expected the retry sent upstream, got %d after %d calls", resp.StatusCode, flaky.Load())
+	}
+
+	// a repeat while the first is still running
+	done := make(chan int)
+	go func() {
+		resp, _ := send(app, "/oracle/kaufmann/tenant/sync-kore", "t1", "k3", `{}`)
+		done <- resp.StatusCode
+	}()
+	<-started
+	if resp, _ := send(app, "/oracle/kaufmann/tenant/sync-kore", "t1", "k3", `{}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected the repeat refused while running, got %d", resp.StatusCode)
+	}
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("expected the first request through, got %d", status)
+	}
+
+	// kept across a restart, and the responses past the window are dropped from the log
+	log := store.NewJSONL[IdempotencyRecord](filepath.Join(settings.DataDir, "idempotency.jsonl"))
+	_ = log.Append(IdempotencyRecord{Time: time.Now().Add(-48 * time.Hour), Key: "old", OracleID: "kaufmann", Body: []byte(`{}`)})
+	resp, again = send(newApp(), claim, "t1", "k1", `{"vin":"1HGCM82633A004352","plate":"AB1"}`)
+	if again != first || claims.Load() != 6 {
+		t.Errorf("expected the response replayed after a restart, got %d %s", resp.StatusCode, again)
+	}
+	var keys []string
+	_ = log.Scan(func(rec IdempotencyRecord) bool {
+		keys = append(keys, rec.Key)
+		return true
+	})
+	if slices.Contains(keys, "old") || len(keys) != 6 {
+		t.Errorf("expected the log compacted to the 6 stored responses, got %v", keys)
+	}
+}
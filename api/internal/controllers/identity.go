@@ -1,6 +1,12 @@
 package controllers
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
 	"github.com/gofiber/fiber/v2"
@@ -13,17 +19,19 @@ type IdentityController struct {
 	identityAPI service.IdentityAPI
 }
 
-func NewIdentityController(settings *config.Settings, logger *zerolog.Logger) *IdentityController {
+// NewIdentityController takes the identity service shared with the vehicles controller, so they see one cache
+func NewIdentityController(settings *config.Settings, logger *zerolog.Logger, identityAPI service.IdentityAPI) *IdentityController {
 	return &IdentityController{
 		settings:    settings,
 		logger:      logger,
-		identityAPI: service.NewIdentityAPIService(*logger, settings.IdentityAPIURL.String()),
+		identityAPI: identityAPI,
 	}
 }
 
 // GetVehicleByTokenID
 // @Summary Get vehicle information by token ID
-// @Description Retrieves vehicle details from the identity API using the token ID
+// @Description Retrieves vehicle details from the identity API using the token ID. Each SACD also lists its
+// @Description permissions decoded as privilege names.
 // @Tags Identity
 // @Produce json
 // @Param tokenID path string true "Vehicle Token ID"
@@ -43,7 +51,73 @@ func (i *IdentityController) GetVehicleByTokenID(c *fiber.Ctx) error {
 	}
 
 	c.Set("Content-Type", "application/json")
-	return c.Send(data)
+	return c.Send(withDecodedVehicleSACDs(data))
+}
+
+type identityVehiclesReq struct {
+	TokenIDs []json.Number `json:"tokenIds"`
+}
+
+// IdentityVehiclesRes is the vehicles found, by token id, and the token ids the identity api doesn't know
+type IdentityVehiclesRes struct {
+	Vehicles map[string]json.RawMessage `json:"vehicles"`
+	Missing  []uint64                   `json:"missing"`
+}
+
+// GetVehiclesByTokenIDs
+// @Summary Get many vehicles by token ID
+// @Description Looks up vehicles from the identity API in one go, for tables that would otherwise ask per row. Each
+// @Description vehicle has the same fields as /identity/vehicle/{tokenID}. Duplicates are looked up once.
+// @Tags Identity
+// @Accept json
+// @Produce json
+// @Param request body identityVehiclesReq true "token ids"
+// @Success 200 {object} IdentityVehiclesRes
+// @Security     BearerAuth
+// @Router /identity/vehicles [post]
+func (i *IdentityController) GetVehiclesByTokenIDs(c *fiber.Ctx) error {
+	v := &validator{}
+	var req identityVehiclesReq
+	var tokenIDs []uint64
+	if decodeBody(c, v, &req) {
+		maxIDs := i.settings.GetIdentityBatchMaxTokenIDs()
+		switch {
+		case len(req.TokenIDs) == 0:
+			v.add("tokenIds", "is required")
+		case len(req.TokenIDs) > maxIDs:
+			v.add("tokenIds", "can have at most %d token ids", maxIDs)
+		}
+		seen := map[uint64]bool{}
+		for idx, raw := range req.TokenIDs {
+			field := fmt.Sprintf("tokenIds[%d]", idx)
+			v.tokenID(field, raw)
+			id, err := strconv.ParseUint(raw.String(), 10, 64)
+			if err != nil || seen[id] {
+				continue
+			}
+			seen[id] = true
+			tokenIDs = append(tokenIDs, id)
+		}
+	}
+	if !v.ok() {
+		return v.respond(c)
+	}
+
+	found, err := i.identityAPI.GetVehiclesByTokenIDs(tokenIDs)
+	if err != nil {
+		i.logger.Err(err).Int("count", len(tokenIDs)).Msg("Failed to get vehicles by token IDs")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to get vehicle information")
+	}
+
+	res := IdentityVehiclesRes{Vehicles: make(map[string]json.RawMessage, len(found)), Missing: []uint64{}}
+	for _, id := range tokenIDs {
+		if vehicle, ok := found[id]; ok {
+			res.Vehicles[strconv.FormatUint(id, 10)] = withDecodedSACDs(vehicle)
+		} else {
+			res.Missing = append(res.Missing, id)
+		}
+	}
+	return c.JSON(res)
 }
 
 // GetDefinitionByID
@@ -104,6 +178,74 @@ func (i *IdentityController) GetOwnerBy0x(c *fiber.Ctx) error {
 	return c.Send(data)
 }
 
+// ExportOwnerVehicles
+// @Summary Export an owner's whole vehicle inventory
+// @Description Pages through the owner's vehicles on the identity API, up to a configured limit, and returns them
+// @Description flattened to one row per vehicle, for reconciling on-chain ownership with fleet records. All pages are
+// @Description read before anything is written, so a failure part way is an error rather than a cut off file.
+// @Description X-Truncated is true when the owner has more vehicles than the limit.
+// @Tags Identity
+// @Produce json
+// @Produce text/csv
+// @Param owner path string true "Owner Wallet 0x"
+// @Param format query string false "ndjson (default) or csv"
+// @Success 200
+// @Security     BearerAuth
+// @Router /identity/owner/{owner}/all [get]
+func (i *IdentityController) ExportOwnerVehicles(c *fiber.Ctx) error {
+	owner := c.Params("owner")
+	format := c.Query("format", "ndjson")
+	v := &validator{}
+	v.address("owner", owner)
+	if format != "ndjson" && format != "csv" {
+		v.add("format", "must be ndjson or csv")
+	}
+	if !v.ok() {
+		return v.respond(c)
+	}
+
+	vehicles, truncated, err := service.ListOwnerVehicles(i.identityAPI, owner, i.settings.GetIdentityExportMaxVehicles())
+	if err != nil {
+		i.logger.Err(err).Str("owner_0x", owner).Msg("Failed to export owner vehicles")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to get owner information")
+	}
+
+	c.Set("X-Truncated", strconv.FormatBool(truncated))
+	c.Set("X-Total-Count", strconv.Itoa(len(vehicles)))
+	filename := "vehicles-" + strings.ToLower(owner) + "." + format
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+
+	if format == "ndjson" {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		enc := json.NewEncoder(c.Response().BodyWriter())
+		for _, vehicle := range vehicles {
+			if err := enc.Encode(vehicle); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv")
+	w := csv.NewWriter(c.Response().BodyWriter())
+	_ = w.Write([]string{"token_id", "owner", "make", "model", "year", "aftermarket_serial", "aftermarket_owner", "synthetic_token_id", "connection_name"})
+	for _, vehicle := range vehicles {
+		year, syntheticID := "", ""
+		if vehicle.Year != 0 {
+			year = strconv.Itoa(vehicle.Year)
+		}
+		if vehicle.SyntheticTokenID != 0 {
+			syntheticID = strconv.FormatUint(vehicle.SyntheticTokenID, 10)
+		}
+		_ = w.Write([]string{
+			strconv.FormatUint(vehicle.TokenID, 10), vehicle.Owner, vehicle.Make, vehicle.Model, year,
+			vehicle.AftermarketSerial, vehicle.AftermarketOwner, syntheticID, vehicle.ConnectionName,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
 type identityProxyReq struct {
 	Query string `json:"query"`
 }
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestIdentityController_GetVehiclesByTokenIDs(t *testing.T) {
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"v7":{"owner":"0xaaa"},"v8":null},"errors":[{"message":"no vehicle 8"}]}`))
+	}))
+	defer identity.Close()
+
+	u, _ := url.Parse(identity.URL)
+	settings := &config.Settings{IdentityAPIURL: *u, IdentityBatchMaxTokenIDs: 3}
+	logger := zerolog.Nop()
+	ctrl := NewIdentityController(settings, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}))
+	app := fiber.New()
+	app.Post("/identity/vehicles", ctrl.GetVehiclesByTokenIDs)
+
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantMissing []uint64
+	}{
+		{name: "found and missing", body: `{"tokenIds":[7,8,7]}`, wantStatus: http.StatusOK, wantMissing: []uint64{8}},
+		{name: "too many", body: `{"tokenIds":[1,2,3,4]}`, wantStatus: http.StatusBadRequest},
+		{name: "bad id", body: `{"tokenIds":[7,-1]}`, wantStatus: http.StatusBadRequest},
+		{name: "empty", body: `{"tokenIds":[]}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/identity/vehicles", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var res IdentityVehiclesRes
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Vehicles) != 1 || !strings.Contains(string(res.Vehicles["7"]), "0xaaa") {
+				t.Errorf("unexpected vehicles %v", res.Vehicles)
+			}
+			if len(res.Missing) != len(tt.wantMissing) || res.Missing[0] != tt.wantMissing[0] {
+				t.Errorf("expected missing %v, got %v", tt.wantMissing, res.Missing)
+			}
+		})
+	}
+}
+
+func TestIdentityController_GetVehicleByTokenID(t *testing.T) {
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"vehicle":{"owner":"0xaaa","sacds":{"totalCount":120,
+			"nodes":[{"grantee":"0xbbb","permissions":"0x3c"}],"pageInfo":{"hasNextPage":true,"endCursor":"c100"}}}}}`))
+	}))
+	defer identity.Close()
+
+	u, _ := url.Parse(identity.URL)
+	logger := zerolog.Nop()
+	ctrl := NewIdentityController(&config.Settings{IdentityAPIURL: *u}, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}))
+	app := fiber.New()
+	app.Get("/identity/vehicle/:tokenID", ctrl.GetVehicleByTokenID)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/identity/vehicle/7", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Data struct {
+			Vehicle struct {
+				Sacds struct {
+					TotalCount int `json:"totalCount"`
+					Nodes      []struct {
+						Grantee    string   `json:"grantee"`
+						Privileges []string `json:"privileges"`
+					} `json:"nodes"`
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+				} `json:"sacds"`
+			} `json:"vehicle"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	sacds := res.Data.Vehicle.Sacds
+	if len(sacds.Nodes) != 1 || len(sacds.Nodes[0].Privileges) == 0 {
+		t.Errorf("expected the permissions decoded, got %+v", sacds.Nodes)
+	}
+	if !sacds.PageInfo.HasNextPage || sacds.PageInfo.EndCursor != "c100" || sacds.TotalCount != 120 {
+		t.Errorf("expected pageInfo and totalCount passed on, got %+v", sacds)
+	}
+}
+
+var afterPattern = regexp.MustCompile(`after: "(\d+)"`)
+
+func TestIdentityController_ExportOwnerVehicles(t *testing.T) {
+	// 7 vehicles, 2 a page, the cursor being the page number
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req service.GraphQLRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		page := 0
+		if m := afterPattern.FindStringSubmatch(req.Query); m != nil {
+			_, _ = fmt.Sscan(m[1], &page)
+		}
+		var nodes []string
+		for id := page*2 + 1; id <= min(page*2+2, 7); id++ {
+			nodes = append(nodes, fmt.Sprintf(`{"owner":"0xaaa","tokenId":%d,"definition":{"make":"Ford","model":"F-150","year":2022},
+				"aftermarketDevice":null,"syntheticDevice":{"tokenId":%d,"connection":{"name":"Smartcar"}}}`, id, id+100))
+		}
+		_, _ = fmt.Fprintf(w, `{"data":{"vehicles":{"nodes":[%s],"pageInfo":{"endCursor":"%d","hasNextPage":%t}}}}`,
+			strings.Join(nodes, ","), page+1, page*2+2 < 7)
+	}))
+	defer identity.Close()
+
+	logger := zerolog.Nop()
+	owner := "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+
+	tests := []struct {
+		name          string
+		limit         int
+		format        string
+		wantStatus    int
+		wantRows      int
+		wantTruncated string
+	}{
+		{name: "all as ndjson", limit: 100, format: "ndjson", wantStatus: http.StatusOK, wantRows: 7, wantTruncated: "false"},
+		{name: "limited as csv", limit: 5, format: "csv", wantStatus: http.StatusOK, wantRows: 5, wantTruncated: "true"},
+		{name: "bad format", limit: 5, format: "xml", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := &config.Settings{IdentityExportMaxVehicles: tt.limit}
+			ctrl := NewIdentityController(settings, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}))
+			app := fiber.New()
+			app.Get("/identity/owner/:owner/all", ctrl.ExportOwnerVehicles)
+
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/identity/owner/"+owner+"/all?format="+tt.format, nil), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("X-Truncated"); got != tt.wantTruncated {
+				t.Errorf("expected X-Truncated %s, got %s", tt.wantTruncated, got)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			var rows int
+			if tt.format == "csv" {
+				records, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				rows = len(records) - 1
+				if records[1][2] != "Ford" || records[1][7] != "101" || records[1][8] != "Smartcar" {
+					t.Errorf("unexpected row %v", records[1])
+				}
+			} else {
+				dec := json.NewDecoder(strings.NewReader(string(body)))
+				for dec.More() {
+					var v service.OwnerVehicle
+					if err := dec.Decode(&v); err != nil {
+						t.Fatal(err)
+					}
+					rows++
+				}
+			}
+			if rows != tt.wantRows {
+				t.Errorf("expected %d vehicles, got %d", tt.wantRows, rows)
+			}
+		})
+	}
+}
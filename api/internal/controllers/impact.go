@@ -0,0 +1,372 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+// impact sources that can be missing from a summary when their upstream can't be read
+const (
+	impactFleet      = "fleet"
+	impactShareLinks = "shareLinks"
+	impactCustomers  = "customers"
+	impactSacdGrants = "sacdGrants"
+)
+
+// VehicleImpactRes is what a delete, disconnect or transfer would affect, answered to ?dryRun=true instead of
+// submitting it. Nothing is changed. Unavailable names the sources that couldn't be read, so the summary is
+// incomplete rather than wrong.
+type VehicleImpactRes struct {
+	DryRun      bool            `json:"dryRun"`
+	Action      string          `json:"action"`
+	Vehicles    []VehicleImpact `json:"vehicles"`
+	Unavailable []string        `json:"unavailable"`
+}
+
+// VehicleImpact is what hangs off one vehicle. Found is false when the fleet has no minted vehicle for it.
+type VehicleImpact struct {
+	TokenID    uint64            `json:"tokenId,omitempty"`
+	VIN        string            `json:"vin,omitempty"`
+	Found      bool              `json:"found"`
+	Groups     []fleetGroupRef   `json:"groups"`
+	ShareLinks []ImpactShareLink `json:"shareLinks"`
+	Customers  []ImpactCustomer  `json:"customers"`
+	SacdGrants []DecodedSACD     `json:"sacdGrants"`
+}
+
+// ImpactShareLink is a share link that hasn't expired
+type ImpactShareLink struct {
+	ID        string `json:"id"`
+	ExpiresAt string `json:"expires_at"`
+	CreatedBy string `json:"created_by"`
+}
+
+// ImpactCustomer is a customer tenant entitled to the vehicle, or paying for it with a live membership
+type ImpactCustomer struct {
+	ID            string             `json:"id"`
+	Name          string             `json:"name"`
+	Entitled      bool               `json:"entitled"`
+	Source        string             `json:"source,omitempty"`
+	SourceGroupID string             `json:"sourceGroupId,omitempty"`
+	Memberships   []ImpactMembership `json:"memberships"`
+}
+
+type ImpactMembership struct {
+	ID         string `json:"id"`
+	TermMonths int    `json:"termMonths"`
+	ExpiresAt  string `json:"expiresAt"`
+	Status     string `json:"status"`
+}
+
+// impactTarget is a vehicle named in a request, by vin or by token id
+type impactTarget struct {
+	vin     string
+	tokenID string
+}
+
+// dryRunReader reads the vehicles a request names, checking only what a dry run needs
+type dryRunReader func(c *fiber.Ctx) ([]impactTarget, *validator)
+
+// dryRun answers a ?dryRun=true request with its impact, once the vehicles it names check out. The request is marked
+// as one, so the audit log tells it from the mutation.
+func (v *VehiclesController) dryRun(c *fiber.Ctx, action string, read dryRunReader) error {
+	c.Locals(auditDryRunLocal, true)
+	targets, val := read(c)
+	if !val.ok() {
+		return val.respond(c)
+	}
+	return v.previewImpact(c, action, targets)
+}
+
+// previewImpact gathers, for each vehicle, its fleet groups, live share links, customer entitlements and memberships
+// and live SACD grants, and answers with the summary. A source that fails is listed as unavailable and the rest is
+// still answered, the modal is better off with most of the picture than none.
+func (v *VehiclesController) previewImpact(c *fiber.Ctx, action string, targets []impactTarget) error {
+	res := VehicleImpactRes{DryRun: true, Action: action, Vehicles: make([]VehicleImpact, len(targets)), Unavailable: []string{}}
+	unavailable := map[string]bool{}
+	u := GetOracleURL(c, v.settings)
+
+	var tokenIDs []uint64
+	for i, target := range targets {
+		impact := &res.Vehicles[i]
+		*impact = VehicleImpact{VIN: target.vin, Groups: []fleetGroupRef{}, ShareLinks: []ImpactShareLink{}, Customers: []ImpactCustomer{}, SacdGrants: []DecodedSACD{}}
+		item, err := v.impactFleetVehicle(c, u, target)
+		if err != nil {
+			unavailable[impactFleet] = true
+			continue
+		}
+		id, ok := itemTokenID(item)
+		if !ok {
+			continue
+		}
+		impact.Found, impact.TokenID, impact.VIN = true, id, itemString(item, "vin")
+		if raw, err := json.Marshal(item["groups"]); err == nil {
+			_ = json.Unmarshal(raw, &impact.Groups)
+		}
+		if impact.Groups == nil {
+			impact.Groups = []fleetGroupRef{}
+		}
+		tokenIDs = append(tokenIDs, id)
+
+		links, err := v.impactShareLinks(c, u, id)
+		if err != nil {
+			unavailable[impactShareLinks] = true
+		} else {
+			impact.ShareLinks = links
+		}
+	}
+
+	if len(tokenIDs) > 0 {
+		if err := v.impactCustomers(c, u, res.Vehicles); err != nil {
+			v.logger.Warn().Err(err).Msg("dry run: failed to read customer entitlements")
+			unavailable[impactCustomers] = true
+		}
+		found, err := v.identityAPI.GetVehiclesByTokenIDs(tokenIDs)
+		if err != nil {
+			v.logger.Warn().Err(err).Msg("dry run: failed to look up vehicle grants")
+			unavailable[impactSacdGrants] = true
+		}
+		now := time.Now()
+		for i := range res.Vehicles {
+			var identity identityVehicle
+			raw, ok := found[res.Vehicles[i].TokenID]
+			if !ok || json.Unmarshal(raw, &identity) != nil {
+				continue
+			}
+			for _, sacd := range decodeSACDs(identity) {
+				if exp, err := time.Parse(time.RFC3339, sacd.ExpiresAt); err == nil && !exp.After(now) {
+					continue
+				}
+				res.Vehicles[i].SacdGrants = append(res.Vehicles[i].SacdGrants, sacd)
+			}
+		}
+	}
+
+	for _, source := range []string{impactFleet, impactShareLinks, impactCustomers, impactSacdGrants} {
+		if unavailable[source] {
+			res.Unavailable = append(res.Unavailable, source)
+		}
+	}
+	return c.JSON(res)
+}
+
+// impactFleetVehicle is the oracle's fleet vehicle for the target, nil when there's none
+func (v *VehiclesController) impactFleetVehicle(c *fiber.Ctx, u *url.URL, target impactTarget) (map[string]any, error) {
+	if target.tokenID != "" {
+		var item map[string]any
+		found, err := v.impactGet(c, u.JoinPath("/v1/fleet/vehicles", target.tokenID), &item)
+		if !found {
+			return nil, err
+		}
+		return item, nil
+	}
+	// the search matches parts of vins too, the vehicle may be past the first page
+	for skip := 0; skip < fleetScanMaxVehicles; skip += fleetScanPageSize {
+		targetURL := u.JoinPath("/v1/fleet/vehicles")
+		targetURL.RawQuery = url.Values{
+			"search": {target.vin},
+			"skip":   {strconv.Itoa(skip)},
+			"take":   {strconv.Itoa(fleetScanPageSize)},
+		}.Encode()
+		var page struct {
+			Items []map[string]any `json:"items"`
+		}
+		if _, err := v.impactGet(c, targetURL, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if strings.EqualFold(itemString(item, "vin"), target.vin) {
+				return item, nil
+			}
+		}
+		if len(page.Items) < fleetScanPageSize {
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (v *VehiclesController) impactShareLinks(c *fiber.Ctx, u *url.URL, tokenID uint64) ([]ImpactShareLink, error) {
+	var links []ImpactShareLink
+	if _, err := v.impactGet(c, u.JoinPath("/v1/fleet/vehicles", strconv.FormatUint(tokenID, 10), "shares"), &links); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := []ImpactShareLink{}
+	for _, link := range links {
+		if exp, err := time.Parse(time.RFC3339, link.ExpiresAt); err == nil && !exp.After(now) {
+			continue
+		}
+		live = append(live, link)
+	}
+	return live, nil
+}
+
+// impactCustomers adds the customer tenants entitled to each vehicle, or holding a live membership for it. Callers
+// that aren't an operator have no customers, which the oracle answers with 403 or 404.
+func (v *VehiclesController) impactCustomers(c *fiber.Ctx, u *url.URL, vehicles []VehicleImpact) error {
+	var customers []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if found, err := v.impactGet(c, u.JoinPath("/v1/tenancy/customers"), &customers); !found {
+		return err
+	}
+	byToken := map[uint64]*VehicleImpact{}
+	for i := range vehicles {
+		if vehicles[i].Found {
+			byToken[vehicles[i].TokenID] = &vehicles[i]
+		}
+	}
+	// two reads per customer, a few customers at a time. The requests are built up front, the fiber ctx isn't for
+	// other goroutines.
+	type customerReads struct {
+		entitlements, memberships *http.Request
+		held                      map[uint64]*ImpactCustomer
+	}
+	reads := make([]customerReads, len(customers))
+	for i, customer := range customers {
+		var err error
+		if reads[i].entitlements, _, err = newUpstreamRequest(c, fiber.MethodGet, u.JoinPath("/v1/tenancy/customers", customer.ID, "vehicles"), nil); err != nil {
+			return err
+		}
+		if reads[i].memberships, _, err = newUpstreamRequest(c, fiber.MethodGet, u.JoinPath("/v1/tenancy/customers", customer.ID, "memberships"), nil); err != nil {
+			return err
+		}
+	}
+	group := errgroup.Group{}
+	group.SetLimit(4)
+	for i, customer := range customers {
+		r := &reads[i]
+		group.Go(func() error {
+			var entitlements []struct {
+				VehicleTokenID uint64 `json:"vehicleTokenId"`
+				Source         string `json:"source"`
+				SourceGroupID  string `json:"sourceGroupId"`
+			}
+			status, body, err := doUpstream(r.entitlements)
+			if _, err := impactDecode(r.entitlements.URL, status, body, err, &entitlements); err != nil {
+				return err
+			}
+			var memberships struct {
+				Memberships []struct {
+					ImpactMembership
+					VehicleTokenID uint64 `json:"vehicleTokenId"`
+				} `json:"memberships"`
+			}
+			status, body, err = doUpstream(r.memberships)
+			if _, err := impactDecode(r.memberships.URL, status, body, err, &memberships); err != nil {
+				return err
+			}
+
+			r.held = map[uint64]*ImpactCustomer{}
+			entry := func(tokenID uint64) *ImpactCustomer {
+				if r.held[tokenID] == nil {
+					r.held[tokenID] = &ImpactCustomer{ID: customer.ID, Name: customer.Name, Memberships: []ImpactMembership{}}
+				}
+				return r.held[tokenID]
+			}
+			for _, e := range entitlements {
+				if byToken[e.VehicleTokenID] != nil {
+					ic := entry(e.VehicleTokenID)
+					ic.Entitled, ic.Source, ic.SourceGroupID = true, e.Source, e.SourceGroupID
+				}
+			}
+			for _, m := range memberships.Memberships {
+				if byToken[m.VehicleTokenID] != nil && (m.Status == "active" || m.Status == "expiring_soon") {
+					ic := entry(m.VehicleTokenID)
+					ic.Memberships = append(ic.Memberships, m.ImpactMembership)
+				}
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	// in the oracle's order of customers
+	for _, r := range reads {
+		for tokenID, ic := range r.held {
+			byToken[tokenID].Customers = append(byToken[tokenID].Customers, *ic)
+		}
+	}
+	return nil
+}
+
+// impactGet reads a JSON resource from the oracle into dst. A 403 or 404 is not found, not an error.
+func (v *VehiclesController) impactGet(c *fiber.Ctx, targetURL *url.URL, dst any) (bool, error) {
+	status, body, err := upstreamCall(c, fiber.MethodGet, targetURL, nil)
+	return impactDecode(targetURL, status, body, err, dst)
+}
+
+// impactDecode reads the oracle's answer to a GET of targetURL into dst, as impactGet does
+func impactDecode(targetURL *url.URL, status int, body []byte, err error, dst any) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case status == fiber.StatusNotFound || status == fiber.StatusForbidden:
+		return false, nil
+	case status != fiber.StatusOK:
+		return false, fiber.NewError(status, "oracle returned "+strconv.Itoa(status)+" for "+targetURL.Path)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// dryRunTargets reads the vehicles in the list under field of a delete or disconnect body. A dry run is asked for
+// before anything is signed, so only the vins are checked.
+func dryRunTargets(field string) dryRunReader {
+	return func(c *fiber.Ctx) ([]impactTarget, *validator) {
+		v := &validator{}
+		var req map[string]json.RawMessage
+		if !decodeBody(c, v, &req) {
+			return nil, v
+		}
+		var ops []userOperationData
+		if err := json.Unmarshal(req[field], &ops); err != nil {
+			v.add(field, "must be a list of vehicles")
+			return nil, v
+		}
+		vins := make([]string, len(ops))
+		targets := make([]impactTarget, len(ops))
+		for i, op := range ops {
+			vins[i] = op.Vin
+			targets[i] = impactTarget{vin: op.Vin}
+		}
+		v.vins(field, vins)
+		return targets, v
+	}
+}
+
+// dryRunTransferTarget is the vehicle of a transfer body, by its vin
+func dryRunTransferTarget(c *fiber.Ctx) ([]impactTarget, *validator) {
+	v := &validator{}
+	var req userOperationData
+	if decodeBody(c, v, &req) {
+		v.vin("vin", req.Vin)
+	}
+	return []impactTarget{{vin: req.Vin}}, v
+}
+
+// dryRunSharedTarget is the vehicle of a shared account body, by its token id
+func dryRunSharedTarget(c *fiber.Ctx) ([]impactTarget, *validator) {
+	v := &validator{}
+	var req sharedAccountRequest
+	if decodeBody(c, v, &req) {
+		v.tokenID("tokenId", req.TokenID)
+	}
+	return []impactTarget{{tokenID: req.TokenID.String()}}, v
+}
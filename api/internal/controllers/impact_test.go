@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestVehiclesController_DryRun(t *testing.T) {
+	const vehicle = `{"vin":"1HGCM82633A004352","vehicle_token_id":7,"groups":[{"id":"g1","name":"North"}]}`
+	var mutations atomic.Int32
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			mutations.Add(1)
+		}
+		switch r.URL.Path {
+		case "/v1/fleet/vehicles":
+			// a full first page of other vehicles, the search matches parts of vins
+			if r.URL.Query().Get("skip") == "0" {
+				_, _ = w.Write([]byte(`{"items":[` + strings.Repeat(`{"vin":"1HGCM82633A004350"},`, fleetScanPageSize-1) + `{"vin":"1HGCM82633A004350"}]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"items":[` + vehicle + `]}`))
+		case "/v1/fleet/vehicles/7":
+			_, _ = w.Write([]byte(vehicle))
+		case "/v1/fleet/vehicles/7/shares":
+			_, _ = w.Write([]byte(`[{"id":"s1","vehicle_token_id":7,"expires_at":"2999-01-01T00:00:00Z","created_by":"alice"},
+				{"id":"s2","vehicle_token_id":7,"expires_at":"2020-01-01T00:00:00Z","created_by":"bob"}]`))
+		case "/v1/tenancy/customers":
+			_, _ = w.Write([]byte(`[{"id":"c1","name":"Acme"},{"id":"c2","name":"Globex"},{"id":"c3","name":"Initech"}]`))
+		case "/v1/tenancy/customers/c1/vehicles":
+			_, _ = w.Write([]byte(`[{"vehicleTokenId":7,"source":"group","sourceGroupId":"g1"},{"vehicleTokenId":8,"source":"manual"}]`))
+		case "/v1/tenancy/customers/c1/memberships":
+			_, _ = w.Write([]byte(`{"enforced":true,"memberships":[{"id":"m1","vehicleTokenId":7,"termMonths":12,"status":"active"},
+				{"id":"m2","vehicleTokenId":7,"termMonths":1,"status":"canceled"}]}`))
+		case "/v1/tenancy/customers/c2/vehicles", "/v1/tenancy/customers/c3/vehicles":
+			_, _ = w.Write([]byte(`[]`))
+		case "/v1/tenancy/customers/c2/memberships":
+			// paid for, no longer entitled
+			_, _ = w.Write([]byte(`{"memberships":[{"id":"m3","vehicleTokenId":7,"termMonths":12,"status":"expiring_soon"}]}`))
+		case "/v1/tenancy/customers/c3/memberships":
+			_, _ = w.Write([]byte(`{"memberships":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oracle.Close()
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"v7":{"sacds":{"nodes":[
+			{"grantee":"` + testGrantee + `","permissions":"0x3c","expiresAt":"2999-01-01T00:00:00Z"},
+			{"grantee":"0x0000000000000000000000000000000000000001","permissions":"0x3c","expiresAt":"2020-01-01T00:00:00Z"}]}}}}`))
+	}))
+	defer identity.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, DataDir: t.TempDir()}
+	logger := zerolog.Nop()
+	ctrl := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}), nil)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	audit := NewAuditController(settings, &logger)
+	app.Use(audit.Middleware)
+	app.Post("/vehicle/delete", ctrl.SubmitDeleteData)
+	app.Post("/vehicle/disconnect/shared", ctrl.SubmitSharedAccountDisconnect)
+
+	send := func(path, body string) (*http.Response, VehicleImpactRes) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res VehicleImpactRes
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return resp, res
+	}
+
+	// unsigned, as asked for before signing
+	resp, res := send("/vehicle/delete?dryRun=true", `{"vinDeleteData":[{"vin":"1HGCM82633A004352"},{"vin":"5YJSA1E27HF000337"}]}`)
+	if resp.StatusCode != http.StatusOK || !res.DryRun || res.Action != "delete" || len(res.Vehicles) != 2 || len(res.Unavailable) != 0 {
+		t.Fatalf("unexpected dry run %d %+v", resp.StatusCode, res)
+	}
+	impact := res.Vehicles[0]
+	if !impact.Found || impact.TokenID != 7 || len(impact.Groups) != 1 || impact.Groups[0].Name != "North" {
+		t.Errorf("unexpected vehicle %+v", impact)
+	}
+	if len(impact.ShareLinks) != 1 || impact.ShareLinks[0].ID != "s1" {
+		t.Errorf("expected the live share link only, got %+v", impact.ShareLinks)
+	}
+	if len(impact.SacdGrants) != 1 || impact.SacdGrants[0].Grantee != testGrantee {
+		t.Errorf("expected the live grant only, got %+v", impact.SacdGrants)
+	}
+	if len(impact.Customers) != 2 {
+		t.Fatalf("expected 2 customers, got %+v", impact.Customers)
+	}
+	acme, globex := impact.Customers[0], impact.Customers[1]
+	if acme.ID != "c1" || !acme.Entitled || acme.Source != "group" || len(acme.Memberships) != 1 || acme.Memberships[0].ID != "m1" {
+		t.Errorf("unexpected entitled customer %+v", acme)
+	}
+	if globex.ID != "c2" || globex.Entitled || len(globex.Memberships) != 1 {
+		t.Errorf("unexpected paying customer %+v", globex)
+	}
+	if other := res.Vehicles[1]; other.Found || other.VIN != "5YJSA1E27HF000337" {
+		t.Errorf("expected the second vehicle not found, got %+v", other)
+	}
+
+	resp, res = send("/vehicle/disconnect/shared?dryRun=true", `{"tokenId":7}`)
+	if resp.StatusCode != http.StatusOK || res.Action != "disconnect" || !res.Vehicles[0].Found || res.Vehicles[0].VIN != "1HGCM82633A004352" {
+		t.Errorf("unexpected shared dry run %d %+v", resp.StatusCode, res)
+	}
+	if resp, _ := send("/vehicle/delete?dryRun=true", `{"vinDeleteData":[]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a dry run without vehicles rejected, got %d", resp.StatusCode)
+	}
+	if mutations.Load() != 0 {
+		t.Errorf("expected nothing submitted, got %d mutations", mutations.Load())
+	}
+	var audited []AuditRecord
+	_ = audit.log.Scan(func(rec AuditRecord) bool { audited = append(audited, rec); return true })
+	if len(audited) != 3 || !audited[0].DryRun || !audited[1].DryRun || !audited[2].DryRun {
+		t.Errorf("expected the dry runs audited as such, got %+v", audited)
+	}
+}
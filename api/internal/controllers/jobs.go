@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// sseHeartbeat is how often an idle job stream sends a comment, so proxies don't close it
+const sseHeartbeat = 15 * time.Second
+
+// JobsController serves the jobs the BFF tracks for the caller's tenant, see service.JobTracker
+type JobsController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	jobs     *service.JobTracker
+}
+
+func NewJobsController(settings *config.Settings, logger *zerolog.Logger, jobs *service.JobTracker) *JobsController {
+	return &JobsController{settings: settings, logger: logger, jobs: jobs}
+}
+
+type JobsRes struct {
+	Jobs       []service.Job `json:"jobs"`
+	TotalCount int           `json:"totalCount"`
+}
+
+// ListJobs
+// @Summary Tracked jobs
+// @Description Mint, transfer, disconnect and delete jobs submitted through the BFF for the caller's tenant, newest
+// @Description first. The BFF polls each one until it's done. Jobs in awaiting_auth are resumed with the caller's
+// @Description credentials when their submitter lists them.
+// @Tags Jobs
+// @Produce json
+// @Param kind query string false "mint, transfer, disconnect or delete"
+// @Param state query string false "pending, running, succeeded, failed, timed_out or awaiting_auth"
+// @Param tokenId query string false "vehicle token id"
+// @Param vin query string false "vehicle vin"
+// @Param since query string false "RFC3339, jobs changed since"
+// @Success 200 {object} JobsRes
+// @Router /oracle/{oracleID}/jobs [get]
+func (j *JobsController) ListJobs(c *fiber.Ctx) error {
+	filter, err := j.tenantFilter(c)
+	if err != nil {
+		return err
+	}
+	v := &validator{}
+	filter.Kind = service.JobKind(c.Query("kind"))
+	filter.State = service.JobState(c.Query("state"))
+	filter.TokenID = c.Query("tokenId")
+	filter.VIN = c.Query("vin")
+	if raw := c.Query("since"); raw != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, raw); err != nil {
+			v.add("since", "must be an RFC3339 time")
+		}
+	}
+	if !v.ok() {
+		return v.respond(c)
+	}
+	jobs := j.jobs.List(filter)
+	return c.JSON(JobsRes{Jobs: jobs, TotalCount: len(jobs)})
+}
+
+// GetJob
+// @Summary Tracked job
+// @Tags Jobs
+// @Produce json
+// @Param id path string true "job id, as in X-Tracked-Jobs"
+// @Success 200 {object} service.Job
+// @Router /oracle/{oracleID}/jobs/{id} [get]
+func (j *JobsController) GetJob(c *fiber.Ctx) error {
+	filter, err := j.tenantFilter(c)
+	if err != nil {
+		return err
+	}
+	job, ok := j.jobs.Get(c.Params("id"))
+	if !ok || job.OracleID != filter.OracleID || job.TenantID != filter.TenantID {
+		return fiber.NewError(fiber.StatusNotFound, "job not found")
+	}
+	return c.JSON(job)
+}
+
+// StreamJobs
+// @Summary Tracked job changes
+// @Description Server-sent events, one "job" event with the job as data every time one of the tenant's jobs changes.
+// @Description The unfinished jobs are sent first, so a client that reconnects is caught up.
+// @Tags Jobs
+// @Produce text/event-stream
+// @Success 200
+// @Router /oracle/{oracleID}/jobs/stream [get]
+func (j *JobsController) StreamJobs(c *fiber.Ctx) error {
+	filter, err := j.tenantFilter(c)
+	if err != nil {
+		return err
+	}
+	var pending []service.Job
+	for _, job := range j.jobs.List(filter) {
+		if !job.State.Final() {
+			pending = append(pending, job)
+		}
+	}
+	changes, cancel := j.jobs.Subscribe()
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		for _, job := range pending {
+			if writeJobEvent(w, job) != nil {
+				return
+			}
+		}
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case job, ok := <-changes:
+				if !ok {
+					return
+				}
+				if !filter.Matches(job) {
+					continue
+				}
+				if writeJobEvent(w, job) != nil {
+					return
+				}
+			case <-heartbeat.C:
+				// a write error is the client gone
+				if _, err := w.WriteString(": ping\n\n"); err != nil || w.Flush() != nil {
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
+
+func writeJobEvent(w *bufio.Writer, job service.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "id: %s\nevent: job\ndata: %s\n\n", job.ID, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// tenantFilter checks the caller may see the tenant's jobs, and hands the tracker the caller's credentials for
+// their own jobs
+func (j *JobsController) tenantFilter(c *fiber.Ctx) (service.JobFilter, error) {
+	if j.jobs == nil {
+		return service.JobFilter{}, fiber.NewError(fiber.StatusServiceUnavailable, "job tracking is not enabled")
+	}
+	tenantID, err := requireTenantAccess(c, j.settings)
+	if err != nil {
+		return service.JobFilter{}, err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	subject, _ := jwtActor(c)
+	j.jobs.Authorize(oracleID, tenantID, subject, jobCredentials(c))
+	return service.JobFilter{OracleID: oracleID, TenantID: tenantID}, nil
+}
+
+// trackJobs hands the jobs of an accepted submission to the tracker, naming them in X-Tracked-Jobs. Does nothing
+// when tracking isn't enabled or the oracle refused.
+func trackJobs(c *fiber.Ctx, tracker *service.JobTracker, jobs ...service.Job) {
+	if tracker == nil || len(jobs) == 0 || c.Response().StatusCode() >= fiber.StatusMultipleChoices {
+		return
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	subject, _ := jwtActor(c)
+	creds := jobCredentials(c)
+	ids := make([]string, len(jobs))
+	for i, job := range jobs {
+		job.OracleID, job.TenantID, job.Subject = oracleID, creds.TenantID, subject
+		ids[i] = tracker.Track(job, creds).ID
+	}
+	c.Set("X-Tracked-Jobs", strings.Join(ids, ","))
+}
+
+func jobCredentials(c *fiber.Ctx) service.JobCredentials {
+	return service.JobCredentials{
+		Authorization: strings.Clone(c.Get(fiber.HeaderAuthorization)),
+		TenantID:      strings.Clone(c.Get("Tenant-Id")),
+	}
+}
+
+// responseJobID is the oracle's jobId in the response to a submission, empty when there's none
+func responseJobID(c *fiber.Ctx) string {
+	var res struct {
+		JobID string `json:"jobId"`
+	}
+	if json.Unmarshal(c.Response().Body(), &res) != nil {
+		return ""
+	}
+	return res.JobID
+}
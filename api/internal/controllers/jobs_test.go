@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestJobsController(t *testing.T) {
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/permissions":
+			if r.Header.Get("Tenant-Id") == "other" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		case "/v1/vehicle/transfer/shared":
+			_, _ = w.Write([]byte(`{"jobId":"77"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oracle.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	oracleID := settings.GetOracles()[0].OracleID
+	tracker := service.NewJobTracker(logger, service.JobTrackerConfig{
+		StorePath:  filepath.Join(t.TempDir(), "jobs.jsonl"),
+		OracleURLs: map[string]url.URL{oracleID: *u},
+	})
+	vehicles := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, "", service.IdentityCacheConfig{}), tracker)
+	ctrl := NewJobsController(settings, &logger, tracker)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", oracleID)
+		return c.Next()
+	})
+	app.Post("/vehicle/transfer/shared", vehicles.SubmitSharedAccountTransfer)
+	app.Get("/jobs", ctrl.ListJobs)
+	app.Get("/jobs/:id", ctrl.GetJob)
+
+	send := func(method, target, tenant, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Tenant-Id", tenant)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := send(http.MethodPost, "/vehicle/transfer/shared", "t1", `{"tokenId":12,"targetWalletAddress":"`+testGrantee+`"}`)
+	jobID := resp.Header.Get("X-Tracked-Jobs")
+	if resp.StatusCode != http.StatusOK || jobID == "" {
+		t.Fatalf("expected a tracked transfer, got %d %q", resp.StatusCode, jobID)
+	}
+
+	resp = send(http.MethodGet, "/jobs?kind=transfer", "t1", "")
+	var res JobsRes
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.TotalCount != 1 || res.Jobs[0].ID != jobID || res.Jobs[0].OracleJobID != "77" || res.Jobs[0].TokenID != "12" {
+		t.Fatalf("unexpected jobs %+v", res)
+	}
+	if resp := send(http.MethodGet, "/jobs?since=yesterday", "t1", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad since rejected, got %d", resp.StatusCode)
+	}
+
+	if resp := send(http.MethodGet, "/jobs/"+jobID, "t1", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the job, got %d", resp.StatusCode)
+	}
+	if resp := send(http.MethodGet, "/jobs/"+jobID, "t2", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected another tenant's job hidden, got %d", resp.StatusCode)
+	}
+	if resp := send(http.MethodGet, "/jobs", "other", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a tenant without access refused, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,585 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+)
+
+// LifecycleState is a step of a vehicle's life on the oracle. The steps are in the order of lifecycleStates, a vehicle
+// is in the furthest one it reached.
+type LifecycleState string
+
+const (
+	LifecycleUnknown      LifecycleState = "unknown"
+	LifecycleSeen         LifecycleState = "seen"
+	LifecycleClaimed      LifecycleState = "claimed"
+	LifecycleVINMapped    LifecycleState = "vin_mapped"
+	LifecycleVerified     LifecycleState = "verified"
+	LifecycleMinted       LifecycleState = "minted"
+	LifecycleConnected    LifecycleState = "connected"
+	LifecycleDisconnected LifecycleState = "disconnected"
+	LifecycleDeleted      LifecycleState = "deleted"
+)
+
+var lifecycleStates = []LifecycleState{
+	LifecycleSeen, LifecycleClaimed, LifecycleVINMapped, LifecycleVerified,
+	LifecycleMinted, LifecycleConnected, LifecycleDisconnected, LifecycleDeleted,
+}
+
+// lifecycle sources that can be missing from an answer when their upstream can't be read. The vin status ones are
+// also the names of the steps they report on, as used in inProgress and stuck.
+const (
+	lifecyclePending    = "pendingVehicles"
+	lifecycleIdentity   = "identity"
+	lifecycleVerify     = "verify"
+	lifecycleMint       = "mint"
+	lifecycleDisconnect = "disconnect"
+	lifecycleDelete     = "delete"
+	lifecycleJobs       = "jobs"
+)
+
+// lifecycleStatusPaths are the oracle's vin status endpoints, by source
+var lifecycleStatusPaths = map[string]string{
+	lifecycleVerify:     "/v1/vehicle/verify",
+	lifecycleMint:       "/v1/vehicle/mint/status",
+	lifecycleDisconnect: "/v1/vehicle/disconnect/status",
+	lifecycleDelete:     "/v1/vehicle/delete/status",
+}
+
+// lifecycleTargets are the states the steps with a vin status lead to. Mint, disconnect and delete are also the job
+// kinds of the same steps.
+var lifecycleTargets = map[string]LifecycleState{
+	lifecycleVerify:     LifecycleVerified,
+	lifecycleMint:       LifecycleMinted,
+	lifecycleDisconnect: LifecycleDisconnected,
+	lifecycleDelete:     LifecycleDeleted,
+}
+
+// lifecycleActions are what can be done next from each state. Nothing can while a step is in progress.
+var lifecycleActions = map[LifecycleState][]string{
+	LifecycleSeen:         {"claim"},
+	LifecycleClaimed:      {"link_vin"},
+	LifecycleVINMapped:    {"verify"},
+	LifecycleVerified:     {"mint"},
+	LifecycleMinted:       {"transfer", "delete"},
+	LifecycleConnected:    {"disconnect", "transfer", "delete"},
+	LifecycleDisconnected: {"transfer", "delete"},
+}
+
+// VehicleLifecycle is where a vehicle is, combined from the pending vehicles, the verify, mint, disconnect and delete
+// statuses, the fleet record, identity and the tracked jobs. Steps lists every state in order, with when it was
+// reached where a source says so; steps before the furthest one reached count as reached. Stuck is why the vehicle
+// isn't moving on, empty when nothing is wrong.
+type VehicleLifecycle struct {
+	VIN         string          `json:"vin,omitempty"`
+	IMEI        string          `json:"imei,omitempty"`
+	TokenID     uint64          `json:"tokenId,omitempty"`
+	State       LifecycleState  `json:"state"`
+	Steps       []LifecycleStep `json:"steps"`
+	InProgress  string          `json:"inProgress,omitempty"`
+	NextActions []string        `json:"nextActions"`
+	Stuck       string          `json:"stuck,omitempty"`
+}
+
+type LifecycleStep struct {
+	State   LifecycleState `json:"state"`
+	Reached bool           `json:"reached"`
+	At      string         `json:"at,omitempty"`
+}
+
+// VehicleLifecycleRes is one vehicle's lifecycle. Unavailable names the sources that couldn't be read, so the state
+// may be behind rather than wrong.
+type VehicleLifecycleRes struct {
+	VehicleLifecycle
+	Unavailable []string `json:"unavailable"`
+}
+
+// FleetLifecycleRes is the lifecycle of every pending and fleet vehicle. Counts are by state over all of them,
+// before the state and stuck filters.
+type FleetLifecycleRes struct {
+	Truncated   bool                   `json:"truncated"`
+	Counts      map[LifecycleState]int `json:"counts"`
+	Vehicles    []VehicleLifecycle     `json:"vehicles"`
+	Unavailable []string               `json:"unavailable"`
+}
+
+// lifecycleStatus is a vehicle's entry in a vin status response
+type lifecycleStatus struct {
+	VIN     string `json:"vin"`
+	Status  string `json:"status"`
+	Details string `json:"details"`
+}
+
+// succeeded and failed read the status the way the job tracker does, anything else is still running
+func (s lifecycleStatus) succeeded() bool { return strings.EqualFold(s.Status, "success") }
+
+func (s lifecycleStatus) failed() bool {
+	status := strings.ToLower(s.Status)
+	return strings.Contains(status, "fail") || strings.Contains(status, "error")
+}
+
+// pendingVehicle is a device claimed by the tenant and not yet minted, from the oracle's pending vehicles
+type pendingVehicle struct {
+	VIN        string `json:"vin"`
+	IMEI       string `json:"imei"`
+	DeviceType string `json:"deviceType"`
+	FirstSeen  string `json:"firstSeen"`
+}
+
+// lifecycleRecord is what the sources say about one vehicle
+type lifecycleRecord struct {
+	vin       string
+	imei      string
+	pending   bool
+	firstSeen string
+	fleet     map[string]any
+	tokenID   uint64
+	// onChain is only meaningful when identityChecked
+	identityChecked bool
+	onChain         bool
+	identity        identityVehicle
+	statuses        map[string]lifecycleStatus
+	// jobs are newest first
+	jobs []service.Job
+}
+
+// GetVehicleLifecycle
+// @Summary Vehicle lifecycle
+// @Description Where a vehicle is on the way from seen to deleted: seen, claimed, vin_mapped, verified, minted,
+// @Description connected, disconnected, deleted, with the time each step was reached where known, the step in
+// @Description progress, the next allowed actions and why the vehicle is stuck. Sources that can't be read are
+// @Description listed under unavailable and the rest is still answered.
+// @Tags Vehicles
+// @Produce json
+// @Param vin path string true "vehicle VIN"
+// @Success 200 {object} VehicleLifecycleRes
+// @Failure 404 "no source knows the vin"
+// @Router /oracle/{oracleID}/vehicles/{vin}/lifecycle [get]
+func (v *VehiclesController) GetVehicleLifecycle(c *fiber.Ctx) error {
+	vin := strings.ToUpper(c.Params("vin"))
+	val := &validator{}
+	val.vin("vin", vin)
+	if !val.ok() {
+		return val.respond(c)
+	}
+	u := GetOracleURL(c, v.settings)
+	unavailable := map[string]bool{}
+	record := &lifecycleRecord{vin: vin}
+
+	pending, _, err := v.listPendingVehicles(c, u, vin)
+	if err != nil {
+		v.logger.Warn().Err(err).Str("vin", vin).Msg("lifecycle: failed to read pending vehicles")
+		unavailable[lifecyclePending] = true
+	}
+	for _, p := range pending {
+		if strings.EqualFold(p.VIN, vin) {
+			record.pending, record.imei, record.firstSeen = true, p.IMEI, p.FirstSeen
+			break
+		}
+	}
+	item, err := v.impactFleetVehicle(c, u, impactTarget{vin: vin})
+	if err != nil {
+		v.logger.Warn().Err(err).Str("vin", vin).Msg("lifecycle: failed to read the fleet vehicle")
+		unavailable[impactFleet] = true
+	}
+	record.setFleet(item)
+
+	records := []*lifecycleRecord{record}
+	v.completeLifecycles(c, u, records, unavailable)
+	res := VehicleLifecycleRes{VehicleLifecycle: record.resolve(), Unavailable: lifecycleUnavailable(unavailable)}
+	if res.State == LifecycleUnknown && len(res.Unavailable) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "no pending, fleet or job record for vin "+vin)
+	}
+	return c.JSON(res)
+}
+
+// GetFleetLifecycle
+// @Summary Fleet lifecycle
+// @Description The lifecycle of every pending and fleet vehicle, as /vehicles/{vin}/lifecycle has it for one, with
+// @Description counts by state. Claimed devices without a vin are listed by imei. Verify and mint statuses are read
+// @Description for vehicles not minted yet, disconnect statuses for minted ones without a synthetic device and delete
+// @Description statuses for fleet vehicles no longer on chain.
+// @Tags Vehicles
+// @Produce json
+// @Param state query string false "comma separated states to list, eg. verified,minted"
+// @Param stuck query bool false "only list stuck vehicles"
+// @Param search query string false "passed to the pending and fleet vehicle listings"
+// @Success 200 {object} FleetLifecycleRes
+// @Router /oracle/{oracleID}/vehicles/lifecycle [get]
+func (v *VehiclesController) GetFleetLifecycle(c *fiber.Ctx) error {
+	val := &validator{}
+	states := splitList(c.Query("state"))
+	for _, s := range states {
+		if !slices.Contains(lifecycleStates, LifecycleState(s)) && LifecycleState(s) != LifecycleUnknown {
+			val.add("state", "unknown state %q", s)
+		}
+	}
+	if !val.ok() {
+		return val.respond(c)
+	}
+	u := GetOracleURL(c, v.settings)
+	unavailable := map[string]bool{}
+
+	pending, pendingTruncated, pendingErr := v.listPendingVehicles(c, u, c.Query("search"))
+	if pendingErr != nil {
+		v.logger.Warn().Err(pendingErr).Msg("lifecycle: failed to read pending vehicles")
+		unavailable[lifecyclePending] = true
+	}
+	fleet, fleetTruncated, fleetErr := listFleetVehicles(c, v.settings, v.logger)
+	if fleetErr != nil {
+		if pendingErr != nil {
+			return fleetErr
+		}
+		unavailable[impactFleet] = true
+	}
+
+	var records []*lifecycleRecord
+	byKey := map[string]*lifecycleRecord{}
+	record := func(vin, imei string) *lifecycleRecord {
+		key := "vin:" + strings.ToUpper(vin)
+		if vin == "" {
+			key = "imei:" + imei
+		}
+		if byKey[key] == nil {
+			byKey[key] = &lifecycleRecord{vin: strings.ToUpper(vin), imei: imei}
+			records = append(records, byKey[key])
+		}
+		return byKey[key]
+	}
+	for _, p := range pending {
+		r := record(p.VIN, p.IMEI)
+		r.pending, r.firstSeen = true, p.FirstSeen
+	}
+	for _, f := range fleet {
+		record(f.vin, itemString(f.item, "imei")).setFleet(f.item)
+	}
+
+	v.completeLifecycles(c, u, records, unavailable)
+	res := FleetLifecycleRes{
+		Truncated:   pendingTruncated || fleetTruncated,
+		Counts:      map[LifecycleState]int{},
+		Vehicles:    []VehicleLifecycle{},
+		Unavailable: lifecycleUnavailable(unavailable),
+	}
+	for _, r := range records {
+		lc := r.resolve()
+		res.Counts[lc.State]++
+		if (len(states) > 0 && !slices.Contains(states, string(lc.State))) || (c.QueryBool("stuck") && lc.Stuck == "") {
+			continue
+		}
+		res.Vehicles = append(res.Vehicles, lc)
+	}
+	return c.JSON(res)
+}
+
+// completeLifecycles adds identity, the vin statuses and the tracked jobs to records seeded from the pending and fleet
+// vehicles. Statuses are only asked for where they can tell something the other sources don't.
+func (v *VehiclesController) completeLifecycles(c *fiber.Ctx, u *url.URL, records []*lifecycleRecord, unavailable map[string]bool) {
+	var tokenIDs []uint64
+	for _, r := range records {
+		if r.tokenID > 0 {
+			tokenIDs = append(tokenIDs, r.tokenID)
+		}
+	}
+	if len(tokenIDs) > 0 {
+		found, err := v.identityAPI.GetVehiclesByTokenIDs(tokenIDs)
+		if err != nil {
+			v.logger.Warn().Err(err).Int("count", len(tokenIDs)).Msg("lifecycle: failed to look up vehicles on identity")
+			unavailable[lifecycleIdentity] = true
+		}
+		for _, r := range records {
+			if r.tokenID == 0 || err != nil {
+				continue
+			}
+			raw, ok := found[r.tokenID]
+			r.identityChecked = true
+			r.onChain = ok && json.Unmarshal(raw, &r.identity) == nil
+		}
+	}
+
+	// verify and mint tell how far an unminted vehicle got, disconnect whether a minted one without a synthetic
+	// device was connected before, and delete whether a vehicle gone from the chain, or from everywhere, was deleted
+	wanted := map[string]func(r *lifecycleRecord) bool{
+		lifecycleVerify: func(r *lifecycleRecord) bool { return r.tokenID == 0 && r.pending },
+		lifecycleMint:   func(r *lifecycleRecord) bool { return r.tokenID == 0 && r.pending },
+		lifecycleDisconnect: func(r *lifecycleRecord) bool {
+			return r.tokenID > 0 && r.identity.SyntheticDevice == nil
+		},
+		lifecycleDelete: func(r *lifecycleRecord) bool {
+			return (r.tokenID > 0 && r.identityChecked && !r.onChain) || (r.tokenID == 0 && !r.pending)
+		},
+	}
+	for _, source := range []string{lifecycleVerify, lifecycleMint, lifecycleDisconnect, lifecycleDelete} {
+		byVIN := map[string]*lifecycleRecord{}
+		var vins []string
+		for _, r := range records {
+			if r.vin != "" && wanted[source](r) {
+				byVIN[r.vin] = r
+				vins = append(vins, r.vin)
+			}
+		}
+		if len(vins) == 0 {
+			continue
+		}
+		statuses, err := v.lifecycleStatuses(c, u, lifecycleStatusPaths[source], vins)
+		if err != nil {
+			v.logger.Warn().Err(err).Str("source", source).Msg("lifecycle: failed to read vin statuses")
+			unavailable[source] = true
+			continue
+		}
+		for vin, status := range statuses {
+			if r := byVIN[vin]; r != nil {
+				if r.statuses == nil {
+					r.statuses = map[string]lifecycleStatus{}
+				}
+				r.statuses[source] = status
+			}
+		}
+	}
+
+	if v.jobs == nil {
+		return
+	}
+	tenantID, err := requireTenantAccess(c, v.settings)
+	if err != nil {
+		unavailable[lifecycleJobs] = true
+		return
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	byVIN := map[string]*lifecycleRecord{}
+	byToken := map[string]*lifecycleRecord{}
+	for _, r := range records {
+		if r.vin != "" {
+			byVIN[r.vin] = r
+		}
+		if r.tokenID > 0 {
+			byToken[strconv.FormatUint(r.tokenID, 10)] = r
+		}
+	}
+	filter := service.JobFilter{OracleID: oracleID, TenantID: tenantID}
+	if len(records) == 1 && records[0].vin != "" && records[0].tokenID == 0 {
+		filter.VIN = records[0].vin
+	}
+	for _, job := range v.jobs.List(filter) {
+		r := byVIN[strings.ToUpper(job.VIN)]
+		if r == nil && job.TokenID != "" {
+			r = byToken[job.TokenID]
+		}
+		if r != nil {
+			r.jobs = append(r.jobs, job)
+		}
+	}
+}
+
+// lifecycleStatuses reads a vin status endpoint for vins, in chunks sent in parallel, by upper case vin. A chunk that
+// fails fails the lot, a partial answer would read as vehicles without a status.
+func (v *VehiclesController) lifecycleStatuses(c *fiber.Ctx, u *url.URL, path string, vins []string) (map[string]lifecycleStatus, error) {
+	chunks, results, err := sendVINChunks(c, v.settings, u, path, nil, vins)
+	if err != nil {
+		return nil, err
+	}
+	statuses := map[string]lifecycleStatus{}
+	for i, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.status != fiber.StatusOK {
+			return nil, fiber.NewError(r.status, "oracle returned "+strconv.Itoa(r.status)+" for "+path+": "+upstreamMessage(r.body))
+		}
+		var res struct {
+			Statuses []lifecycleStatus `json:"statuses"`
+		}
+		if err := json.Unmarshal(r.body, &res); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadGateway, "unexpected response from "+path+" for "+strings.Join(chunks[i], ","))
+		}
+		for _, s := range res.Statuses {
+			statuses[strings.ToUpper(s.VIN)] = s
+		}
+	}
+	return statuses, nil
+}
+
+// listPendingVehicles pages through the tenant's pending vehicles, up to fleetScanMaxVehicles. The bool says there
+// are more.
+func (v *VehiclesController) listPendingVehicles(c *fiber.Ctx, u *url.URL, search string) ([]pendingVehicle, bool, error) {
+	var vehicles []pendingVehicle
+	for skip := 0; ; skip += fleetScanPageSize {
+		if skip >= fleetScanMaxVehicles {
+			return vehicles, true, nil
+		}
+		targetURL := u.JoinPath("/v1/pending-vehicles")
+		query := url.Values{"skip": {strconv.Itoa(skip)}, "take": {strconv.Itoa(fleetScanPageSize)}}
+		if search != "" {
+			query.Set("search", search)
+		}
+		targetURL.RawQuery = query.Encode()
+		var page struct {
+			Vehicles []pendingVehicle `json:"vehicles"`
+		}
+		if found, err := v.impactGet(c, targetURL, &page); !found {
+			return vehicles, false, err
+		}
+		vehicles = append(vehicles, page.Vehicles...)
+		if len(page.Vehicles) < fleetScanPageSize {
+			return vehicles, false, nil
+		}
+	}
+}
+
+// setFleet adds the oracle's fleet record, nil when there's none
+func (r *lifecycleRecord) setFleet(item map[string]any) {
+	if item == nil {
+		return
+	}
+	r.fleet = item
+	r.tokenID, _ = itemTokenID(item)
+	if r.imei == "" {
+		r.imei = itemString(item, "imei")
+	}
+}
+
+// latestJob is the newest job of the kind, nil when there's none
+func (r *lifecycleRecord) latestJob(kind service.JobKind) *service.Job {
+	for i := range r.jobs {
+		if r.jobs[i].Kind == kind {
+			return &r.jobs[i]
+		}
+	}
+	return nil
+}
+
+// resolve works out the state from what the sources say. Evidence for a step counts for the steps before it, a
+// minted vehicle was verified whether or not the verify status is still around.
+func (r *lifecycleRecord) resolve() VehicleLifecycle {
+	reached := map[LifecycleState]bool{}
+	at := map[LifecycleState]string{}
+	reach := func(state LifecycleState, when string) {
+		reached[state] = true
+		if when != "" && at[state] == "" {
+			at[state] = when
+		}
+	}
+	completed := func(job *service.Job) string {
+		if job == nil || job.CompletedAt == nil {
+			return ""
+		}
+		return job.CompletedAt.UTC().Format(time.RFC3339)
+	}
+	succeeded := func(source string, kind service.JobKind) (bool, string) {
+		if job := r.latestJob(kind); job != nil && job.State == service.JobSucceeded {
+			return true, completed(job)
+		}
+		return r.statuses[source].succeeded(), ""
+	}
+
+	if r.pending {
+		reach(LifecycleSeen, r.firstSeen)
+		reach(LifecycleClaimed, "")
+		if r.vin != "" {
+			reach(LifecycleVINMapped, "")
+		}
+	}
+	if r.statuses[lifecycleVerify].succeeded() {
+		reach(LifecycleVerified, "")
+	}
+	if ok, when := succeeded(lifecycleMint, service.JobMint); ok || r.tokenID > 0 {
+		reach(LifecycleMinted, r.identity.MintedAt)
+		reach(LifecycleMinted, when)
+	}
+	connection := strings.ToLower(itemString(r.fleet, "connection_status"))
+	connectedNow := r.identity.SyntheticDevice != nil
+	if connectedNow || connection == "connected" || connection == "succeeded" || connection == "offline" {
+		reach(LifecycleConnected, "")
+	}
+	// a synthetic device on chain outweighs an older disconnect
+	if ok, when := succeeded(lifecycleDisconnect, service.JobDisconnect); !connectedNow &&
+		(ok || connection == "disconnected" || strings.EqualFold(itemString(r.fleet, "disconnection_status"), "succeeded")) {
+		reach(LifecycleDisconnected, when)
+	}
+	// and so does the vehicle still being on chain over a delete
+	if ok, when := succeeded(lifecycleDelete, service.JobDelete); ok && !r.onChain {
+		reach(LifecycleDeleted, when)
+	}
+
+	lc := VehicleLifecycle{VIN: r.vin, IMEI: r.imei, TokenID: r.tokenID, State: LifecycleUnknown, Steps: make([]LifecycleStep, len(lifecycleStates))}
+	current := -1
+	for i, state := range lifecycleStates {
+		if reached[state] {
+			current = i
+		}
+	}
+	for i, state := range lifecycleStates {
+		lc.Steps[i] = LifecycleStep{State: state, Reached: i <= current, At: at[state]}
+	}
+	if current >= 0 {
+		lc.State = lifecycleStates[current]
+	}
+	pastCurrent := func(step string) bool {
+		target, ok := lifecycleTargets[step]
+		return ok && slices.Index(lifecycleStates, target) > current
+	}
+
+	// jobs first, they are the freshest, then the oracle's statuses, then the fleet record. A transfer leads to no
+	// state, its failure only counts while it's the vehicle's last job.
+	for _, kind := range []service.JobKind{service.JobMint, service.JobTransfer, service.JobDisconnect, service.JobDelete} {
+		job := r.latestJob(kind)
+		if job == nil {
+			continue
+		}
+		open := pastCurrent(string(kind)) || (kind == service.JobTransfer && job.ID == r.jobs[0].ID)
+		switch {
+		case job.State == service.JobAwaitingAuth:
+			lc.Stuck = "the " + string(kind) + " job is waiting for its submitter to sign in again"
+		case !job.State.Final():
+			lc.InProgress = string(kind)
+		case job.State == service.JobTimedOut && open:
+			lc.Stuck = string(kind) + " timed out"
+		case job.State == service.JobFailed && open:
+			lc.Stuck = strings.TrimSpace(string(kind) + " failed: " + job.Detail)
+		}
+		if lc.Stuck != "" || lc.InProgress != "" {
+			break
+		}
+	}
+	if lc.Stuck == "" && lc.InProgress == "" {
+		for _, source := range []string{lifecycleVerify, lifecycleMint, lifecycleDisconnect, lifecycleDelete} {
+			status, ok := r.statuses[source]
+			if !ok || !pastCurrent(source) || status.succeeded() {
+				continue
+			}
+			if status.failed() {
+				lc.Stuck = strings.TrimSpace(source + " failed: " + status.Status + " " + status.Details)
+			} else {
+				lc.InProgress = source
+			}
+			break
+		}
+	}
+	if lc.Stuck == "" && lc.InProgress == "" && connection == "failed" && lc.State == LifecycleMinted {
+		lc.Stuck = "connecting to the vendor failed"
+	}
+
+	lc.NextActions = []string{}
+	if lc.InProgress == "" {
+		lc.NextActions = append(lc.NextActions, lifecycleActions[lc.State]...)
+	}
+	return lc
+}
+
+// lifecycleUnavailable lists the unavailable sources in a fixed order
+func lifecycleUnavailable(unavailable map[string]bool) []string {
+	list := []string{}
+	for _, source := range []string{lifecyclePending, impactFleet, lifecycleIdentity, lifecycleVerify, lifecycleMint, lifecycleDisconnect, lifecycleDelete, lifecycleJobs} {
+		if unavailable[source] {
+			list = append(list, source)
+		}
+	}
+	return list
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestVehiclesController_Lifecycle(t *testing.T) {
+	const (
+		pendingVIN   = "1HGCM82633A004352"
+		connectedVIN = "5YJSA1E27HF000337"
+		droppedVIN   = "WVWZZZ1JZXW00000N"
+	)
+	statuses := map[string]map[string]string{
+		"/v1/vehicle/verify":            {pendingVIN: `"status":"Success"`},
+		"/v1/vehicle/mint/status":       {pendingVIN: `"status":"Failure","details":"out of gas"`},
+		"/v1/vehicle/disconnect/status": {droppedVIN: `"status":"Success"`},
+	}
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		search := r.URL.Query().Get("search")
+		switch r.URL.Path {
+		case "/v1/permissions":
+		case "/v1/pending-vehicles":
+			var items []string
+			for _, item := range []string{
+				`{"vin":"` + pendingVIN + `","imei":"356938035643809","firstSeen":"2026-01-02T00:00:00Z"}`,
+				`{"vin":"","imei":"356938035643817","firstSeen":"2026-01-03T00:00:00Z"}`,
+			} {
+				if strings.Contains(item, search) {
+					items = append(items, item)
+				}
+			}
+			_, _ = w.Write([]byte(`{"vehicles":[` + strings.Join(items, ",") + `]}`))
+		case "/v1/fleet/vehicles":
+			var items []string
+			for _, item := range []string{
+				`{"vin":"` + connectedVIN + `","imei":"356938035643825","vehicle_token_id":7,"connection_status":"connected"}`,
+				`{"vin":"` + droppedVIN + `","vehicle_token_id":8,"connection_status":"never"}`,
+			} {
+				if strings.Contains(item, search) {
+					items = append(items, item)
+				}
+			}
+			_, _ = w.Write([]byte(`{"items":[` + strings.Join(items, ",") + `]}`))
+		case "/v1/vehicle/verify", "/v1/vehicle/mint/status", "/v1/vehicle/disconnect/status", "/v1/vehicle/delete/status":
+			var items []string
+			for _, vin := range strings.Split(r.URL.Query().Get("vins"), ",") {
+				if status, ok := statuses[r.URL.Path][vin]; ok {
+					items = append(items, `{"vin":"`+vin+`",`+status+`}`)
+				}
+			}
+			_, _ = w.Write([]byte(`{"statuses":[` + strings.Join(items, ",") + `]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oracle.Close()
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{
+			"v7":{"mintedAt":"2026-02-01T00:00:00Z","syntheticDevice":{"connection":{"name":"Ruptela"}}},
+			"v8":{"mintedAt":"2026-02-02T00:00:00Z","syntheticDevice":null}}}`))
+	}))
+	defer identity.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	oracleID := settings.GetOracles()[0].OracleID
+	tracker := service.NewJobTracker(logger, service.JobTrackerConfig{
+		StorePath:  filepath.Join(t.TempDir(), "jobs.jsonl"),
+		OracleURLs: map[string]url.URL{oracleID: *u},
+	})
+	tracker.Track(service.Job{Kind: service.JobTransfer, OracleID: oracleID, TenantID: "t1", TokenID: "7", OracleJobID: "1"}, service.JobCredentials{})
+	ctrl := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, identity.URL, service.IdentityCacheConfig{}), tracker)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", oracleID)
+		return c.Next()
+	})
+	app.Get("/vehicles/lifecycle", ctrl.GetFleetLifecycle)
+	app.Get("/vehicles/:vin/lifecycle", ctrl.GetVehicleLifecycle)
+
+	get := func(path string, res any) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Tenant-Id", "t1")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = json.NewDecoder(resp.Body).Decode(res)
+		return resp.StatusCode
+	}
+
+	var fleet FleetLifecycleRes
+	if status := get("/vehicles/lifecycle", &fleet); status != http.StatusOK || len(fleet.Vehicles) != 4 || len(fleet.Unavailable) != 0 {
+		t.Fatalf("unexpected fleet lifecycle %d %+v", status, fleet)
+	}
+	byKey := map[string]VehicleLifecycle{}
+	for _, lc := range fleet.Vehicles {
+		byKey[lc.VIN+lc.IMEI] = lc
+	}
+
+	stuck := byKey[pendingVIN+"356938035643809"]
+	if stuck.State != LifecycleVerified || stuck.Stuck != "mint failed: Failure out of gas" || !slices.Equal(stuck.NextActions, []string{"mint"}) {
+		t.Errorf("expected the failed mint stuck at verified, got %+v", stuck)
+	}
+	if seen := stuck.Steps[0]; seen.State != LifecycleSeen || !seen.Reached || seen.At != "2026-01-02T00:00:00Z" {
+		t.Errorf("expected when the device was first seen, got %+v", seen)
+	}
+	if claimed := byKey["356938035643817"]; claimed.State != LifecycleClaimed || !slices.Equal(claimed.NextActions, []string{"link_vin"}) {
+		t.Errorf("expected the device without a vin claimed, got %+v", claimed)
+	}
+	connected := byKey[connectedVIN+"356938035643825"]
+	if connected.State != LifecycleConnected || connected.InProgress != "transfer" || len(connected.NextActions) != 0 {
+		t.Errorf("expected the connected vehicle mid transfer, got %+v", connected)
+	}
+	if minted := connected.Steps[4]; minted.State != LifecycleMinted || minted.At != "2026-02-01T00:00:00Z" || !connected.Steps[3].Reached {
+		t.Errorf("expected the mint date and the steps before it reached, got %+v", connected.Steps)
+	}
+	dropped := byKey[droppedVIN]
+	if dropped.State != LifecycleDisconnected || dropped.Stuck != "" || !slices.Equal(dropped.NextActions, []string{"transfer", "delete"}) {
+		t.Errorf("expected the vehicle disconnected, got %+v", dropped)
+	}
+	if fleet.Counts[LifecycleConnected] != 1 || fleet.Counts[LifecycleClaimed] != 1 {
+		t.Errorf("unexpected counts %v", fleet.Counts)
+	}
+
+	fleet = FleetLifecycleRes{}
+	if get("/vehicles/lifecycle?stuck=true", &fleet); len(fleet.Vehicles) != 1 || fleet.Vehicles[0].VIN != pendingVIN || fleet.Counts[LifecycleVerified] != 1 {
+		t.Errorf("expected only the stuck vehicle listed, got %+v", fleet)
+	}
+	if status := get("/vehicles/lifecycle?state=parked", &fleet); status != http.StatusBadRequest {
+		t.Errorf("expected an unknown state rejected, got %d", status)
+	}
+
+	var one VehicleLifecycleRes
+	if status := get("/vehicles/"+strings.ToLower(connectedVIN)+"/lifecycle", &one); status != http.StatusOK ||
+		one.State != LifecycleConnected || one.TokenID != 7 || one.InProgress != "transfer" {
+		t.Errorf("unexpected vehicle lifecycle %d %+v", status, one)
+	}
+	if status := get("/vehicles/WVWZZZ1JZXW000001/lifecycle", &one); status != http.StatusNotFound {
+		t.Errorf("expected an unknown vin not found, got %d", status)
+	}
+	if status := get("/vehicles/nope/lifecycle", &one); status != http.StatusBadRequest {
+		t.Errorf("expected a bad vin rejected, got %d", status)
+	}
+}
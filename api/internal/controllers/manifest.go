@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// csvColumn is a column of an uploaded CSV, found by any of its names in a header row, or by its position when there's
+// no header. Names are compared without case, spaces, dashes or underscores.
+type csvColumn struct {
+	names    []string
+	required bool
+}
+
+// readCSVManifest reads an uploaded CSV into a record per line, keyed by the first name of each column, and the
+// "line N" each was read from for error fields. The first line is a header when any of its cells names a column.
+// Blank lines are skipped.
+func readCSVManifest(body []byte, v *validator, columns []csvColumn) ([]map[string]string, []string) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	index := make([]int, len(columns))
+	for i := range index {
+		index[i] = i
+	}
+	var records []map[string]string
+	var fields []string
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.add("body", "must be valid CSV: %s", err.Error())
+			return nil, nil
+		}
+		line, _ := r.FieldPos(0)
+		if first && isCSVHeader(record, columns) {
+			for i, col := range columns {
+				index[i] = slices.IndexFunc(record, func(cell string) bool {
+					return slices.Contains(col.names, normalizeColumn(cell))
+				})
+				if index[i] < 0 && col.required {
+					v.add("body", "the CSV header has no %s column", col.names[0])
+				}
+			}
+			if !v.ok() {
+				return nil, nil
+			}
+			continue
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		rec := make(map[string]string, len(columns))
+		for i, col := range columns {
+			if index[i] >= 0 && index[i] < len(record) {
+				rec[col.names[0]] = strings.TrimSpace(record[index[i]])
+			}
+		}
+		records = append(records, rec)
+		fields = append(fields, "line "+strconv.Itoa(line))
+	}
+	return records, fields
+}
+
+func isCSVHeader(record []string, columns []csvColumn) bool {
+	for _, cell := range record {
+		for _, col := range columns {
+			if slices.Contains(col.names, normalizeColumn(cell)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func normalizeColumn(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(strings.TrimSpace(name)))
+}
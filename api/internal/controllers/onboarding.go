@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// onboardingMaxVehicles caps a manifest. Every vehicle takes several oracle calls and a wait for its first signal,
+// and may hold the run for the owner's signature, so a bigger fleet is onboarded in a few runs that can be followed,
+// signed and resumed on their own.
+const onboardingMaxVehicles = 1000
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// OnboardingController runs the onboarding pipeline over a manifest of vehicles, see service.OnboardingPipeline
+type OnboardingController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	pipeline *service.OnboardingPipeline
+}
+
+func NewOnboardingController(settings *config.Settings, logger *zerolog.Logger, pipeline *service.OnboardingPipeline) *OnboardingController {
+	return &OnboardingController{settings: settings, logger: logger, pipeline: pipeline}
+}
+
+type OnboardingRequest struct {
+	// CountryCode the VINs are decoded and verified for, USA by default
+	CountryCode string `json:"countryCode"`
+	// Sacd is passed through with every mint, as on POST /vehicle/mint
+	Sacd     json.RawMessage            `json:"sacd"`
+	Vehicles []OnboardingRequestVehicle `json:"vehicles"`
+}
+
+type OnboardingRequestVehicle struct {
+	VIN   string `json:"vin"`
+	IMEI  string `json:"imei"`
+	Plate string `json:"plate"`
+	// Group is the id of the fleet group the vehicle is added to
+	Group string `json:"group"`
+	// Definition skips decoding the VIN
+	Definition string `json:"definition"`
+}
+
+type OnboardingSignRequest struct {
+	Signatures []service.OnboardingSignature `json:"signatures"`
+}
+
+type OnboardingsRes struct {
+	Onboardings []service.Onboarding `json:"onboardings"`
+}
+
+// StartOnboarding
+// @Summary Onboard a fleet from a manifest
+// @Description Takes every vehicle in the manifest through linking its VIN to its IMEI, decoding the VIN, verification,
+// @Description minting and setting its plate and group, in the background. The manifest is JSON, or a text/csv upload
+// @Description with vin, imei, plate, group and definition columns in that order or named in a header row, with the
+// @Description country code as a query param. Every row is checked first and nothing runs if any is invalid. The run
+// @Description stops only for mint data the owner must sign, see the signatures endpoint.
+// @Tags Vehicles
+// @Accept json,text/csv
+// @Produce json
+// @Param countryCode query string false "for CSV uploads, USA by default"
+// @Success 202 {object} service.Onboarding
+// @Failure 400 {object} ValidationErrorRes
+// @Router /oracle/{oracleID}/onboarding [post]
+func (o *OnboardingController) StartOnboarding(c *fiber.Ctx) error {
+	tenantID, err := o.tenant(c)
+	if err != nil {
+		return err
+	}
+	v := &validator{}
+	req := parseOnboardingManifest(c, v)
+	if !v.ok() {
+		return v.respond(c)
+	}
+	vehicles := make([]service.OnboardingVehicle, len(req.Vehicles))
+	for i, item := range req.Vehicles {
+		vehicles[i] = service.OnboardingVehicle{
+			VIN: strings.ToUpper(item.VIN), IMEI: item.IMEI, Plate: item.Plate, Group: item.Group, Definition: item.Definition,
+		}
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	subject, _ := jwtActor(c)
+	run := o.pipeline.Start(service.Onboarding{
+		OracleID: oracleID, TenantID: tenantID, Subject: subject, CountryCode: req.CountryCode, Sacd: req.Sacd, Vehicles: vehicles,
+	}, jobCredentials(c))
+	return c.Status(fiber.StatusAccepted).JSON(run)
+}
+
+// ListOnboardings
+// @Summary Onboarding runs
+// @Description The tenant's onboarding runs newest first, with vehicle counts by stage and status but not the vehicles
+// @Tags Vehicles
+// @Produce json
+// @Success 200 {object} OnboardingsRes
+// @Router /oracle/{oracleID}/onboarding [get]
+func (o *OnboardingController) ListOnboardings(c *fiber.Ctx) error {
+	tenantID, err := o.tenant(c)
+	if err != nil {
+		return err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	runs := o.pipeline.List(oracleID, tenantID)
+	if runs == nil {
+		runs = []service.Onboarding{}
+	}
+	return c.JSON(OnboardingsRes{Onboardings: runs})
+}
+
+// GetOnboarding
+// @Summary Onboarding run
+// @Description The run with the progress of every vehicle. Vehicles awaiting a signature carry the typedData to sign.
+// @Tags Vehicles
+// @Produce json
+// @Param id path string true "onboarding id"
+// @Param stage query string false "only vehicles in this stage: link, decode, verify, mint, fleet or done"
+// @Param status query string false "only vehicles with this status: pending, running, awaiting_signature, succeeded or failed"
+// @Success 200 {object} service.Onboarding
+// @Router /oracle/{oracleID}/onboarding/{id} [get]
+func (o *OnboardingController) GetOnboarding(c *fiber.Ctx) error {
+	run, err := o.run(c)
+	if err != nil {
+		return err
+	}
+	stage, status := service.OnboardingStage(c.Query("stage")), service.OnboardingStatus(c.Query("status"))
+	if stage != "" || status != "" {
+		vehicles := []service.OnboardingVehicle{}
+		for _, v := range run.Vehicles {
+			if (stage == "" || v.Stage == stage) && (status == "" || v.Status == status) {
+				vehicles = append(vehicles, v)
+			}
+		}
+		run.Vehicles = vehicles
+	}
+	return c.JSON(run)
+}
+
+// SignOnboarding
+// @Summary Sign the mint data of an onboarding
+// @Description The owner's signatures of the typedData of vehicles awaiting_signature. Their mints are submitted and
+// @Description the run carries on.
+// @Tags Vehicles
+// @Accept json
+// @Produce json
+// @Param id path string true "onboarding id"
+// @Success 202 {object} service.Onboarding
+// @Failure 400 {object} ValidationErrorRes
+// @Failure 409 "no vehicle awaits these signatures"
+// @Router /oracle/{oracleID}/onboarding/{id}/signatures [post]
+func (o *OnboardingController) SignOnboarding(c *fiber.Ctx) error {
+	if _, err := o.run(c); err != nil {
+		return err
+	}
+	v := &validator{}
+	var req OnboardingSignRequest
+	if decodeBody(c, v, &req) {
+		vins := make([]string, len(req.Signatures))
+		for i, s := range req.Signatures {
+			vins[i] = s.VIN
+			v.hex(fmt.Sprintf("signatures[%d].signature", i), s.Signature)
+		}
+		v.vins("signatures", vins)
+	}
+	if !v.ok() {
+		return v.respond(c)
+	}
+	subject, _ := jwtActor(c)
+	run, err := o.pipeline.Sign(c.Params("id"), subject, jobCredentials(c), req.Signatures)
+	if errors.Is(err, service.ErrNothingToSign) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).JSON(run)
+}
+
+// ResumeOnboarding
+// @Summary Resume an onboarding
+// @Description Retries the failed vehicles from the stage they failed in and carries on with the rest, with the
+// @Description caller's credentials. For runs interrupted by a restart or an expired token.
+// @Tags Vehicles
+// @Produce json
+// @Param id path string true "onboarding id"
+// @Success 202 {object} service.Onboarding
+// @Failure 409 "still running"
+// @Router /oracle/{oracleID}/onboarding/{id}/resume [post]
+func (o *OnboardingController) ResumeOnboarding(c *fiber.Ctx) error {
+	if _, err := o.run(c); err != nil {
+		return err
+	}
+	subject, _ := jwtActor(c)
+	run, err := o.pipeline.Resume(c.Params("id"), subject, jobCredentials(c))
+	if errors.Is(err, service.ErrOnboardingRunning) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).JSON(run)
+}
+
+func (o *OnboardingController) tenant(c *fiber.Ctx) (string, error) {
+	if o.pipeline == nil {
+		return "", fiber.NewError(fiber.StatusServiceUnavailable, "onboarding is not enabled")
+	}
+	return requireTenantAccess(c, o.settings)
+}
+
+// run is the onboarding in the path, if it's the caller's tenant's
+func (o *OnboardingController) run(c *fiber.Ctx) (service.Onboarding, error) {
+	tenantID, err := o.tenant(c)
+	if err != nil {
+		return service.Onboarding{}, err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	run, ok := o.pipeline.Get(c.Params("id"))
+	if !ok || run.OracleID != oracleID || run.TenantID != tenantID {
+		return service.Onboarding{}, fiber.NewError(fiber.StatusNotFound, "onboarding not found")
+	}
+	return run, nil
+}
+
+// onboardingColumns are the columns of a CSV manifest, in this order without a header
+var onboardingColumns = []csvColumn{
+	{names: []string{"vin"}, required: true},
+	{names: []string{"imei"}, required: true},
+	{names: []string{"plate", "licenseplate", "patente"}},
+	{names: []string{"group", "groupid", "fleetgroup"}},
+	{names: []string{"definition", "definitionid", "devicedefinitionid"}},
+}
+
+// parseOnboardingManifest reads the manifest, JSON or CSV, and checks every vehicle. Errors name the JSON path, or
+// the line of the CSV.
+func parseOnboardingManifest(c *fiber.Ctx, v *validator) OnboardingRequest {
+	var req OnboardingRequest
+	var fields []string
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), "text/csv") {
+		var records []map[string]string
+		records, fields = readCSVManifest(c.Body(), v, onboardingColumns)
+		req.CountryCode = c.Query("countryCode")
+		for _, rec := range records {
+			req.Vehicles = append(req.Vehicles, OnboardingRequestVehicle{
+				VIN: rec["vin"], IMEI: rec["imei"], Plate: rec["plate"], Group: rec["group"], Definition: rec["definition"],
+			})
+		}
+	} else if decodeBody(c, v, &req) {
+		for i := range req.Vehicles {
+			fields = append(fields, fmt.Sprintf("vehicles[%d]", i))
+		}
+	}
+	if !v.ok() {
+		return req
+	}
+	if req.CountryCode == "" {
+		req.CountryCode = "USA"
+	}
+	if req.CountryCode = strings.ToUpper(req.CountryCode); !countryCodePattern.MatchString(req.CountryCode) {
+		v.add("countryCode", "must be an ISO 3166 alpha-3 code")
+	}
+	switch {
+	case len(req.Vehicles) == 0:
+		v.add("vehicles", "at least one vehicle is required")
+		return req
+	case len(req.Vehicles) > onboardingMaxVehicles:
+		v.add("vehicles", "at most %d vehicles", onboardingMaxVehicles)
+		return req
+	}
+
+	vins := make(map[string]string, len(req.Vehicles))
+	imeis := make(map[string]string, len(req.Vehicles))
+	for i, item := range req.Vehicles {
+		v.vin(fields[i]+".vin", item.VIN)
+		v.imei(fields[i]+".imei", item.IMEI)
+		if first, dup := vins[strings.ToUpper(item.VIN)]; dup && item.VIN != "" {
+			v.add(fields[i]+".vin", "duplicate of %s", first)
+		} else {
+			vins[strings.ToUpper(item.VIN)] = fields[i]
+		}
+		if first, dup := imeis[item.IMEI]; dup && item.IMEI != "" {
+			v.add(fields[i]+".imei", "duplicate of %s", first)
+		} else {
+			imeis[item.IMEI] = fields[i]
+		}
+	}
+	return req
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestOnboardingController(t *testing.T) {
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer oracle.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	oracleID := settings.GetOracles()[0].OracleID
+	urls := map[string]url.URL{oracleID: *u}
+	dir := t.TempDir()
+	jobs := service.NewJobTracker(logger, service.JobTrackerConfig{StorePath: filepath.Join(dir, "jobs.jsonl"), OracleURLs: urls})
+	pipeline := service.NewOnboardingPipeline(logger, service.OnboardingConfig{
+		StorePath: filepath.Join(dir, "onboarding.jsonl"), OracleURLs: urls,
+		Backoff: time.Millisecond, VerifyPoll: time.Millisecond, VerifyTimeout: 20 * time.Millisecond,
+	}, jobs)
+	ctrl := NewOnboardingController(settings, &logger, pipeline)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", oracleID)
+		return c.Next()
+	})
+	app.Post("/onboarding", ctrl.StartOnboarding)
+	app.Get("/onboarding/:id", ctrl.GetOnboarding)
+
+	send := func(method, target, contentType, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Tenant-Id", "t1")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// every bad row is reported, by line, and nothing runs
+	resp := send(http.MethodPost, "/onboarding?countryCode=us", "text/csv",
+		"imei,vin,patente\n356938035643809,1HGCM82633A004352,AB123CD\n356938035643809,1hgcm82633a004352,\n1,2\n")
+	var invalid ValidationErrorRes
+	_ = json.NewDecoder(resp.Body).Decode(&invalid)
+	fields := map[string]bool{}
+	for _, e := range invalid.Errors {
+		fields[e.Field] = true
+	}
+	if resp.StatusCode != http.StatusBadRequest || !fields["countryCode"] || !fields["line 3.vin"] || !fields["line 3.imei"] ||
+		!fields["line 4.vin"] || !fields["line 4.imei"] || fields["line 2.vin"] {
+		t.Fatalf("expected the bad lines reported, got %d %+v", resp.StatusCode, invalid.Errors)
+	}
+	if resp := send(http.MethodPost, "/onboarding", "text/csv", "plate,group\nAB123CD,g1\n"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a header without vin and imei rejected, got %d", resp.StatusCode)
+	}
+
+	// columns in order without a header
+	resp = send(http.MethodPost, "/onboarding", "text/csv", "1hgcm82633a004352,356938035643809,AB123CD,g1,honda_accord_2003\n")
+	var run service.Onboarding
+	_ = json.NewDecoder(resp.Body).Decode(&run)
+	if resp.StatusCode != http.StatusAccepted || run.CountryCode != "USA" || len(run.Vehicles) != 1 ||
+		run.Vehicles[0].VIN != "1HGCM82633A004352" || run.Vehicles[0].Plate != "AB123CD" || run.Vehicles[0].Group != "g1" {
+		t.Fatalf("expected the run started, got %d %+v", resp.StatusCode, run)
+	}
+	resp = send(http.MethodGet, "/onboarding/"+run.ID+"?status=awaiting_signature", "", "")
+	var filtered service.Onboarding
+	_ = json.NewDecoder(resp.Body).Decode(&filtered)
+	if resp.StatusCode != http.StatusOK || filtered.ID != run.ID || len(filtered.Vehicles) != 0 {
+		t.Errorf("expected no vehicle awaiting a signature, got %d %+v", resp.StatusCode, filtered.Vehicles)
+	}
+
+	// let the run stop writing to its store before the temp dir goes
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(2 * time.Millisecond) {
+		if got, _ := pipeline.Get(run.ID); got.State != service.OnboardingRunRunning {
+			return
+		}
+	}
+	t.Error("expected the run to stop")
+}
@@ -40,43 +40,100 @@ func (gp *GenericProxyController) Proxy(c *fiber.Ctx) error {
 	targetURL.RawQuery = string(c.Request().URI().QueryString())
 	body := c.Body()
 	if len(body) > 0 {
-		return ProxyRequest(c, targetURL, body, gp.logger)
+		return ProxyRequest(c, targetURL, body, gp.logger, developerAuthHeader(c))
 	}
 
-	return ProxyRequest(c, targetURL, nil, gp.logger)
+	return ProxyRequest(c, targetURL, nil, gp.logger, developerAuthHeader(c))
 }
 
-// TrackingProxy forwards tracking requests directly to the Kaufmann oracle API.
-// These are public endpoints (no JWT), the backend validates via share link UUID.
-func (gp *GenericProxyController) TrackingProxy(c *fiber.Ctx) error {
-	u := gp.settings.KaufmannOracleAPIURL
+// ProxyRequest forwards a request to the target URL and returns the response. uses the method from the original request
+// It handles all HTTP methods (GET, POST, PUT, PATCH, DELETE) based on the original request
+// If authHeader is not empty, it will be added as an Authorization header to the request
+func ProxyRequest(c *fiber.Ctx, targetURL *url.URL, requestBody []byte, logger *zerolog.Logger, authHeader ...string) error {
+	req, tenantID, err := newUpstreamRequest(c, c.Method(), targetURL, requestBody, authHeader...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create request",
+		})
+	}
 
-	fullPath := string(c.Request().URI().Path())
-	targetURL := u.JoinPath("/v1" + fullPath)
-	targetURL.RawQuery = string(c.Request().URI().QueryString())
+	// Perform the request
+	client := newUpstreamClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Err(err).Msg("Failed to send request to: " + targetURL.String())
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to send request",
+		})
+	}
+	defer resp.Body.Close()
+	defer client.CloseIdleConnections() // not sure if this was causing random issues
 
-	body := c.Body()
-	if len(body) > 0 {
-		return ProxyRequest(c, targetURL, body, gp.logger)
+	// Read response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read response",
+		})
 	}
-	return ProxyRequest(c, targetURL, nil, gp.logger)
+	logger.Info().Msgf("%s Proxied request to %s with Tenant: %s", c.Method(), targetURL, tenantID)
+
+	// Set headers to match the original response
+	for k, val := range resp.Header {
+		if len(val) > 0 {
+			c.Set(k, val[0])
+		}
+	}
+	// Mark this response as having traversed the b2b proxy. Lets clients distinguish
+	// upstream-passthrough 404s from "this b2b proxy doesn't know about that path" 404s.
+	c.Set("X-Proxied-By", "b2b-fleet-mgr-api")
+	c.Status(resp.StatusCode)
+
+	// return the exact same JSON response
+	return c.Send(body)
 }
 
-// ProxyRequest forwards a request to the target URL and returns the response. uses the method from the original request
-// It handles all HTTP methods (GET, POST, PUT, PATCH, DELETE) based on the original request
-// If authHeader is not empty, it will be added as an Authorization header to the request
-func ProxyRequest(c *fiber.Ctx, targetURL *url.URL, requestBody []byte, logger *zerolog.Logger, authHeader ...string) error {
-	// Create request with the original HTTP method
+// upstreamCall makes a request to targetURL with the caller's headers, same as ProxyRequest, but hands the
+// response back instead of writing it to c. Used when the BFF needs to look at upstream data before answering.
+func upstreamCall(c *fiber.Ctx, method string, targetURL *url.URL, requestBody []byte, authHeader ...string) (int, []byte, error) {
+	req, _, err := newUpstreamRequest(c, method, targetURL, requestBody, authHeader...)
+	if err != nil {
+		return 0, nil, err
+	}
+	return doUpstream(req)
+}
+
+// doUpstream sends a request built by newUpstreamRequest and reads the response. It doesn't touch the fiber ctx, so
+// requests built up front can be sent from other goroutines.
+func doUpstream(req *http.Request) (int, []byte, error) {
+	// the caller may accept gzip, we don't want it here as we need to read the body
+	req.Header.Del("Accept-Encoding")
+
+	client := newUpstreamClient()
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// newUpstreamRequest builds the outgoing request, copying the caller's headers. Returns the Tenant-Id, if any, for logging.
+func newUpstreamRequest(c *fiber.Ctx, method string, targetURL *url.URL, requestBody []byte, authHeader ...string) (*http.Request, string, error) {
 	var reqBody io.Reader
 	if len(requestBody) > 0 {
 		reqBody = bytes.NewBuffer(requestBody)
 	}
 
-	req, err := http.NewRequest(c.Method(), targetURL.String(), reqBody)
+	req, err := http.NewRequest(method, targetURL.String(), reqBody)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create request",
-		})
+		return nil, "", err
 	}
 
 	req.Header.Set("Accept", "application/json")
@@ -116,45 +173,15 @@ func ProxyRequest(c *fiber.Ctx, targetURL *url.URL, requestBody []byte, logger *
 	if len(requestBody) > 0 && req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	return req, tenantID, nil
+}
 
-	// Perform the request
-	client := &http.Client{
+func newUpstreamClient() *http.Client {
+	return &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: true, // WARNING: disables cert verification
 			},
 		},
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		logger.Err(err).Msg("Failed to send request to: " + targetURL.String())
-		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
-			"error": "Failed to send request",
-		})
-	}
-	defer resp.Body.Close()
-	defer client.CloseIdleConnections() // not sure if this was causing random issues
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read response",
-		})
-	}
-	logger.Info().Msgf("%s Proxied request to %s with Tenant: %s", c.Method(), targetURL, tenantID)
-
-	// Set headers to match the original response
-	for k, val := range resp.Header {
-		if len(val) > 0 {
-			c.Set(k, val[0])
-		}
-	}
-	// Mark this response as having traversed the b2b proxy. Lets clients distinguish
-	// upstream-passthrough 404s from "this b2b proxy doesn't know about that path" 404s.
-	c.Set("X-Proxied-By", "b2b-fleet-mgr-api")
-	c.Status(resp.StatusCode)
-
-	// return the exact same JSON response
-	return c.Send(body)
 }
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// RecoveryController lists the multi-step operations left half done and resumes or rolls them back, see
+// service.Recovery
+type RecoveryController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	recovery *service.Recovery
+}
+
+func NewRecoveryController(settings *config.Settings, logger *zerolog.Logger, recovery *service.Recovery) *RecoveryController {
+	return &RecoveryController{settings: settings, logger: logger, recovery: recovery}
+}
+
+type RecoveryChainsRes struct {
+	Chains []service.Chain `json:"chains"`
+}
+
+// ListRecoveryChains
+// @Summary Multi-step operations to recover
+// @Description The tenant's shared account deletes, and onboarding vehicles left half onboarded, with their steps, the
+// @Description actions they offer and their trail. Failed and stalled ones by default. The disconnect a failed
+// @Description delete chained is looked up on the oracle first.
+// @Tags Vehicles
+// @Produce json
+// @Param state query string false "running, succeeded, failed, stalled, rolled_back or all, failed and stalled by default"
+// @Param kind query string false "onboarding or shared_delete"
+// @Success 200 {object} RecoveryChainsRes
+// @Router /oracle/{oracleID}/recovery [get]
+func (r *RecoveryController) ListRecoveryChains(c *fiber.Ctx) error {
+	filter, err := r.filter(c)
+	if err != nil {
+		return err
+	}
+	v := &validator{}
+	state, kind := c.Query("state"), service.ChainKind(c.Query("kind"))
+	if !slices.Contains([]string{"", "all", "running", "succeeded", "failed", "stalled", "rolled_back"}, state) {
+		v.add("state", "must be one of running, succeeded, failed, stalled, rolled_back or all")
+	}
+	if kind != "" && kind != service.ChainOnboarding && kind != service.ChainSharedDelete {
+		v.add("kind", "must be onboarding or shared_delete")
+	}
+	if !v.ok() {
+		return v.respond(c)
+	}
+	r.recovery.Inspect(c.Context(), filter.OracleID, filter.TenantID, jobCredentials(c))
+
+	filter.Kind = kind
+	res := RecoveryChainsRes{Chains: []service.Chain{}}
+	switch state {
+	case "":
+		res.Chains = append(res.Chains, r.listState(filter, service.ChainFailed)...)
+		res.Chains = append(res.Chains, r.listState(filter, service.ChainStalled)...)
+	case "all":
+		res.Chains = append(res.Chains, r.recovery.List(filter)...)
+	default:
+		res.Chains = append(res.Chains, r.listState(filter, service.ChainState(state))...)
+	}
+	return c.JSON(res)
+}
+
+// GetRecoveryChain
+// @Summary A multi-step operation
+// @Description One operation with its steps, actions and trail
+// @Tags Vehicles
+// @Produce json
+// @Param id path string true "chain id"
+// @Success 200 {object} service.Chain
+// @Failure 404 "unknown operation"
+// @Router /oracle/{oracleID}/recovery/{id} [get]
+func (r *RecoveryController) GetRecoveryChain(c *fiber.Ctx) error {
+	chain, err := r.chain(c)
+	if err != nil {
+		return err
+	}
+	if chain.State == service.ChainFailed && chain.Kind == service.ChainSharedDelete {
+		r.recovery.Inspect(c.Context(), chain.OracleID, chain.TenantID, jobCredentials(c))
+		chain, _ = r.recovery.Get(chain.ID)
+	}
+	return c.JSON(chain)
+}
+
+// ResumeRecoveryChain
+// @Summary Resume a failed or stalled operation
+// @Description Carries the operation on from where it stopped, with the caller's credentials: a failed shared delete
+// @Description is submitted again, one whose job waits for credentials gets the caller's, and an onboarding vehicle
+// @Description is retried by its onboarding. The calls made are recorded in the trail.
+// @Tags Vehicles
+// @Produce json
+// @Param id path string true "chain id"
+// @Success 202 {object} service.Chain
+// @Failure 409 "the operation doesn't offer resume, or is busy"
+// @Failure 502 "the oracle refused, see the trail"
+// @Router /oracle/{oracleID}/recovery/{id}/resume [post]
+func (r *RecoveryController) ResumeRecoveryChain(c *fiber.Ctx) error {
+	chain, err := r.chain(c)
+	if err != nil {
+		return err
+	}
+	subject, _ := jwtActor(c)
+	chain, err = r.recovery.Resume(c.Context(), chain.ID, subject, jobCredentials(c))
+	if err != nil {
+		return r.actionError(c, chain, err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(chain)
+}
+
+// RollbackRecoveryChain
+// @Summary Roll back a half onboarded vehicle
+// @Description Resets the onboarding of a vehicle that failed or stalled before it was minted, so the device is
+// @Description pending again, with the caller's credentials. force=true uses the oracle's forced reset, for devices
+// @Description the reset refuses. Shared deletes can't be rolled back. The calls made are recorded in the trail.
+// @Tags Vehicles
+// @Produce json
+// @Param id path string true "chain id"
+// @Param force query bool false "force the reset"
+// @Success 200 {object} service.Chain
+// @Failure 409 "the operation doesn't offer rollback, or is busy"
+// @Failure 502 "the oracle refused, see the trail"
+// @Router /oracle/{oracleID}/recovery/{id}/rollback [post]
+func (r *RecoveryController) RollbackRecoveryChain(c *fiber.Ctx) error {
+	chain, err := r.chain(c)
+	if err != nil {
+		return err
+	}
+	subject, _ := jwtActor(c)
+	chain, err = r.recovery.Rollback(c.Context(), chain.ID, subject, jobCredentials(c), c.QueryBool("force"))
+	if err != nil {
+		return r.actionError(c, chain, err)
+	}
+	return c.JSON(chain)
+}
+
+// actionError answers a resume or rollback that didn't go through. A refused compensating call is answered with the
+// chain, whose trail has the call.
+func (r *RecoveryController) actionError(c *fiber.Ctx, chain service.Chain, err error) error {
+	switch {
+	case errors.Is(err, service.ErrCompensationFailed):
+		r.logger.Warn().Err(err).Str("chainId", chain.ID).Msg("recovery action refused by the oracle")
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"code": fiber.StatusBadGateway, "message": err.Error(), "chain": chain})
+	case errors.Is(err, service.ErrChainAction), errors.Is(err, service.ErrOnboardingRunning):
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	case errors.Is(err, service.ErrChainNotFound), errors.Is(err, service.ErrOnboardingNotFound):
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return err
+}
+
+func (r *RecoveryController) filter(c *fiber.Ctx) (service.ChainFilter, error) {
+	if r.recovery == nil {
+		return service.ChainFilter{}, fiber.NewError(fiber.StatusServiceUnavailable, "recovery is not enabled")
+	}
+	tenantID, err := requireTenantAccess(c, r.settings)
+	if err != nil {
+		return service.ChainFilter{}, err
+	}
+	oracleID, _ := c.Locals("oracleID").(string)
+	return service.ChainFilter{OracleID: oracleID, TenantID: tenantID}, nil
+}
+
+// chain is the chain in the path, if it's the caller's tenant's
+func (r *RecoveryController) chain(c *fiber.Ctx) (service.Chain, error) {
+	filter, err := r.filter(c)
+	if err != nil {
+		return service.Chain{}, err
+	}
+	chain, ok := r.recovery.Get(c.Params("id"))
+	if !ok || chain.OracleID != filter.OracleID || chain.TenantID != filter.TenantID {
+		return service.Chain{}, fiber.NewError(fiber.StatusNotFound, "operation not found")
+	}
+	return chain, nil
+}
+
+func (r *RecoveryController) listState(filter service.ChainFilter, state service.ChainState) []service.Chain {
+	filter.State = state
+	return r.recovery.List(filter)
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestRecoveryController(t *testing.T) {
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/permissions":
+		case "/v1/vehicle/disconnect/status":
+			_, _ = w.Write([]byte(`{"statuses":[]}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"message":"burn queue full"}`))
+		}
+	}))
+	defer oracle.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	oracleID := settings.GetOracles()[0].OracleID
+	urls := map[string]url.URL{oracleID: *u}
+	dir := t.TempDir()
+	// a shared delete whose burn failed before the BFF restarted
+	now := time.Now()
+	_ = store.NewJSONL[service.Job](filepath.Join(dir, "jobs.jsonl")).Append(service.Job{
+		ID: "job-1", Kind: service.JobDelete, OracleID: oracleID, TenantID: "t1", TokenID: "7", VIN: "1HGCM82633A004352",
+		State: service.JobFailed, Detail: "burn reverted", CreatedAt: now, UpdatedAt: now,
+	})
+	jobs := service.NewJobTracker(logger, service.JobTrackerConfig{StorePath: filepath.Join(dir, "jobs.jsonl"), OracleURLs: urls})
+	pipeline := service.NewOnboardingPipeline(logger, service.OnboardingConfig{
+		StorePath: filepath.Join(dir, "onboarding.jsonl"), OracleURLs: urls,
+	}, jobs)
+	recovery := service.NewRecovery(logger, service.RecoveryConfig{StorePath: filepath.Join(dir, "recovery.jsonl"), OracleURLs: urls}, jobs, pipeline)
+	recovery.Sync()
+
+	ctrl := NewRecoveryController(settings, &logger, recovery)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", oracleID)
+		return c.Next()
+	})
+	app.Get("/recovery", ctrl.ListRecoveryChains)
+	app.Get("/recovery/:id", ctrl.GetRecoveryChain)
+	app.Post("/recovery/:id/resume", ctrl.ResumeRecoveryChain)
+	app.Post("/recovery/:id/rollback", ctrl.RollbackRecoveryChain)
+
+	send := func(method, target, tenantID string, res any) int {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Tenant-Id", tenantID)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = json.NewDecoder(resp.Body).Decode(res)
+		return resp.StatusCode
+	}
+
+	var list RecoveryChainsRes
+	if status := send(http.MethodGet, "/recovery", "t1", &list); status != http.StatusOK || len(list.Chains) != 1 ||
+		list.Chains[0].Kind != service.ChainSharedDelete || list.Chains[0].State != service.ChainFailed {
+		t.Fatalf("expected the failed delete listed, got %d %+v", status, list)
+	}
+	id := list.Chains[0].ID
+	if send(http.MethodGet, "/recovery", "t2", &list); len(list.Chains) != 0 {
+		t.Errorf("expected another tenant's chains hidden, got %+v", list.Chains)
+	}
+	if status := send(http.MethodGet, "/recovery/"+id, "t2", &struct{}{}); status != http.StatusNotFound {
+		t.Errorf("expected another tenant's chain not found, got %d", status)
+	}
+	if status := send(http.MethodGet, "/recovery?state=running", "t1", &list); status != http.StatusOK || len(list.Chains) != 0 {
+		t.Errorf("expected no running chains, got %d %+v", status, list.Chains)
+	}
+	if status := send(http.MethodGet, "/recovery?kind=transfer", "t1", &struct{}{}); status != http.StatusBadRequest {
+		t.Errorf("expected an unknown kind rejected, got %d", status)
+	}
+
+	if status := send(http.MethodPost, "/recovery/"+id+"/rollback", "t1", &struct{}{}); status != http.StatusConflict {
+		t.Errorf("expected a delete rollback refused, got %d", status)
+	}
+	var refused struct {
+		Chain service.Chain `json:"chain"`
+	}
+	status := send(http.MethodPost, "/recovery/"+id+"/resume", "t1", &refused)
+	if trail := refused.Chain.Trail; status != http.StatusBadGateway || len(trail) == 0 || len(trail[len(trail)-1].Calls) != 1 ||
+		trail[len(trail)-1].Calls[0].Error == "" {
+		t.Errorf("expected the refused delete answered with its trail, got %d %+v", status, refused.Chain)
+	}
+}
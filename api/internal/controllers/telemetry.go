@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultHistoryPoints = 300
+	maxHistoryPoints     = 2000
+	defaultHistoryRange  = 24 * time.Hour
+)
+
+// defaultTelemetrySignals is what the signal endpoints return when no signals are asked for
+var defaultTelemetrySignals = []string{
+	"speed",
+	"powertrainTransmissionTravelledDistance",
+	"powertrainFuelSystemRelativeLevel",
+	"powertrainTractionBatteryStateOfChargeCurrent",
+	"lowVoltageBatteryCurrentVoltage",
+}
+
+// historyIntervals are the bucket sizes history is downsampled to, so charts get a steady axis rather than
+// whatever range/points works out to
+var historyIntervals = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// TelemetryController reads vehicle signals from telemetry-api directly, with a privilege token exchanged by the
+// BFF, rather than through the oracle. The oracle is still asked whether the caller may see the vehicle.
+type TelemetryController struct {
+	settings  *config.Settings
+	logger    *zerolog.Logger
+	telemetry service.TelemetryAPI
+}
+
+// NewTelemetryController takes the telemetry service, nil when no developer license is configured in which case the
+// endpoints answer 503
+func NewTelemetryController(settings *config.Settings, logger *zerolog.Logger, telemetry service.TelemetryAPI) *TelemetryController {
+	return &TelemetryController{settings: settings, logger: logger, telemetry: telemetry}
+}
+
+// LatestSignalsRes is the latest value of each signal
+type LatestSignalsRes struct {
+	TokenID  uint64                         `json:"tokenId"`
+	LastSeen *time.Time                     `json:"lastSeen"`
+	Signals  map[string]service.SignalValue `json:"signals"`
+}
+
+// SignalHistoryRes is the signal history, one point per interval. Values are keyed signal_agg, eg. speed_max.
+type SignalHistoryRes struct {
+	TokenID  uint64                 `json:"tokenId"`
+	From     time.Time              `json:"from"`
+	To       time.Time              `json:"to"`
+	Interval string                 `json:"interval"`
+	Signals  []string               `json:"signals"`
+	Points   []service.HistoryPoint `json:"points"`
+}
+
+// GetLatestSignals
+// @Summary Latest vehicle signals
+// @Description Latest value of each signal, read from telemetry-api. Location signals are not served.
+// @Tags Telemetry
+// @Produce json
+// @Param tokenID path int true "vehicle token id"
+// @Param signals query string false "comma separated signal names, eg. speed,powertrainTransmissionTravelledDistance"
+// @Success 200 {object} LatestSignalsRes
+// @Router /oracle/{oracleID}/vehicles/{tokenID}/signals [get]
+func (t *TelemetryController) GetLatestSignals(c *fiber.Ctx) error {
+	v := &validator{}
+	tokenID := t.parseTokenID(c, v)
+	signals := parseSignalNames(v, c.Query("signals"))
+	if !v.ok() {
+		return v.respond(c)
+	}
+	if err := t.checkAccess(c, tokenID); err != nil {
+		return err
+	}
+
+	latest, err := t.telemetry.GetLatestSignals(c.Context(), tokenID, signals)
+	if err != nil {
+		return t.telemetryError(tokenID, err)
+	}
+	return c.JSON(LatestSignalsRes{TokenID: tokenID, LastSeen: latest.LastSeen, Signals: latest.Signals})
+}
+
+// GetSignalHistory
+// @Summary Vehicle signal history
+// @Description Signals aggregated over time buckets between from and to, read from telemetry-api. The bucket size
+// @Description is picked so there are at most points buckets; an explicit interval is only honoured when coarser.
+// @Tags Telemetry
+// @Produce json
+// @Param tokenID path int true "vehicle token id"
+// @Param signals query string false "comma separated signals, each optionally with an aggregation, eg. speed:max,powertrainFuelSystemRelativeLevel"
+// @Param agg query string false "aggregation for signals without one: avg (default), max, min or last"
+// @Param from query string false "RFC3339, defaults to 24h before to"
+// @Param to query string false "RFC3339, defaults to now"
+// @Param interval query string false "bucket size, eg. 15m or 1h"
+// @Param points query int false "most buckets to return, default 300, at most 2000"
+// @Success 200 {object} SignalHistoryRes
+// @Router /oracle/{oracleID}/vehicles/{tokenID}/signals/history [get]
+func (t *TelemetryController) GetSignalHistory(c *fiber.Ctx) error {
+	v := &validator{}
+	tokenID := t.parseTokenID(c, v)
+	q := service.HistoryQuery{}
+
+	defaultAgg := service.AggAvg
+	if raw := c.Query("agg"); raw != "" {
+		agg, err := service.ParseAggregation(raw)
+		if err != nil {
+			v.add("agg", "must be avg, max, min or last")
+		}
+		defaultAgg = agg
+	}
+	q.Signals = parseSignalAggs(v, c.Query("signals"), defaultAgg)
+
+	q.To = time.Now().UTC().Truncate(time.Second)
+	if raw := c.Query("to"); raw != "" {
+		to, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			v.add("to", "must be an RFC3339 time")
+		}
+		q.To = to
+	}
+	q.From = q.To.Add(-defaultHistoryRange)
+	if raw := c.Query("from"); raw != "" {
+		from, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			v.add("from", "must be an RFC3339 time")
+		}
+		q.From = from
+	}
+	if !q.From.Before(q.To) {
+		v.add("from", "must be before to")
+	} else if q.To.Sub(q.From) > t.settings.GetTelemetryMaxRange() {
+		v.add("from", "range can be at most %d days", int(t.settings.GetTelemetryMaxRange().Hours()/24))
+	}
+
+	points := defaultHistoryPoints
+	if raw := c.Query("points"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxHistoryPoints {
+			v.add("points", "must be between 1 and %d", maxHistoryPoints)
+		}
+		points = n
+	}
+	var requested time.Duration
+	if raw := c.Query("interval"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < time.Second || d%time.Second != 0 {
+			v.add("interval", "must be a whole number of seconds, eg. 30s, 15m or 1h")
+		}
+		requested = d
+	}
+	if !v.ok() {
+		return v.respond(c)
+	}
+	q.Interval = historyInterval(q.To.Sub(q.From), points, requested)
+
+	if err := t.checkAccess(c, tokenID); err != nil {
+		return err
+	}
+	history, err := t.telemetry.GetSignalHistory(c.Context(), tokenID, q)
+	if err != nil {
+		return t.telemetryError(tokenID, err)
+	}
+
+	keys := make([]string, len(q.Signals))
+	for i, s := range q.Signals {
+		keys[i] = s.Key()
+	}
+	return c.JSON(SignalHistoryRes{
+		TokenID:  tokenID,
+		From:     q.From,
+		To:       q.To,
+		Interval: service.FormatInterval(q.Interval),
+		Signals:  keys,
+		Points:   history,
+	})
+}
+
+func (t *TelemetryController) parseTokenID(c *fiber.Ctx, v *validator) uint64 {
+	tokenID, err := strconv.ParseUint(c.Params("tokenID"), 10, 64)
+	if err != nil || tokenID == 0 {
+		v.add("tokenID", "must be a positive integer")
+	}
+	return tokenID
+}
+
+// checkAccess asks the oracle for the vehicle with the caller's credentials: our privilege token can read any vehicle
+// that granted us access, the caller may only see their fleet's
+func (t *TelemetryController) checkAccess(c *fiber.Ctx, tokenID uint64) error {
+	if t.telemetry == nil {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "telemetry is not configured")
+	}
+	u := GetOracleURL(c, t.settings)
+	status, _, err := upstreamCall(c, fiber.MethodGet, u.JoinPath(fmt.Sprintf("/v1/fleet/vehicles/%d", tokenID)), nil)
+	if err != nil {
+		t.logger.Err(err).Uint64("tokenId", tokenID).Msg("failed to check vehicle access")
+		return fiber.NewError(fiber.StatusBadGateway, "failed to check vehicle access")
+	}
+	switch status {
+	case fiber.StatusOK:
+		return nil
+	case fiber.StatusUnauthorized:
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	case fiber.StatusForbidden, fiber.StatusNotFound:
+		// the same answer either way, so token ids outside the fleet can't be probed
+		return fiber.NewError(fiber.StatusNotFound, "vehicle not found")
+	}
+	return fiber.NewError(fiber.StatusBadGateway, "failed to check vehicle access")
+}
+
+func (t *TelemetryController) telemetryError(tokenID uint64, err error) error {
+	var exchangeErr *service.PrivilegeExchangeError
+	switch {
+	case errors.As(err, &exchangeErr) && exchangeErr.StatusCode < fiber.StatusInternalServerError:
+		return fiber.NewError(fiber.StatusForbidden, "vehicle has not granted data access to this app")
+	case errors.Is(err, service.ErrBadRequest):
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	t.logger.Err(err).Uint64("tokenId", tokenID).Msg("telemetry query failed")
+	return fiber.NewError(fiber.StatusBadGateway, "failed to read vehicle telemetry")
+}
+
+func parseSignalNames(v *validator, raw string) []string {
+	if raw == "" {
+		return defaultTelemetrySignals
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if !service.ValidSignalName(name) {
+			v.add("signals", "unsupported signal %q", name)
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 && v.ok() {
+		v.add("signals", "is required")
+	}
+	return names
+}
+
+// parseSignalAggs reads signals like speed:max,speed:min,powertrainFuelSystemRelativeLevel
+func parseSignalAggs(v *validator, raw string, defaultAgg service.Aggregation) []service.SignalAgg {
+	if raw == "" {
+		raw = strings.Join(defaultTelemetrySignals, ",")
+	}
+	var out []service.SignalAgg
+	seen := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, aggRaw, hasAgg := strings.Cut(part, ":")
+		s := service.SignalAgg{Name: name, Agg: defaultAgg}
+		if hasAgg {
+			agg, err := service.ParseAggregation(aggRaw)
+			if err != nil {
+				v.add("signals", "unknown aggregation %q for %s", aggRaw, name)
+				continue
+			}
+			s.Agg = agg
+		}
+		if !service.ValidSignalName(name) {
+			v.add("signals", "unsupported signal %q", name)
+			continue
+		}
+		if seen[s.Key()] {
+			continue
+		}
+		seen[s.Key()] = true
+		out = append(out, s)
+	}
+	if len(out) == 0 && v.ok() {
+		v.add("signals", "is required")
+	}
+	return out
+}
+
+// historyInterval is the smallest standard bucket giving at most points buckets over the range, or the requested
+// interval when that's coarser. Past a day buckets are whole days.
+func historyInterval(rng time.Duration, points int, requested time.Duration) time.Duration {
+	minimum := (rng + time.Duration(points) - 1) / time.Duration(points)
+	interval := time.Duration(0)
+	for _, step := range historyIntervals {
+		if step >= minimum {
+			interval = step
+			break
+		}
+	}
+	if interval == 0 {
+		day := 24 * time.Hour
+		interval = (minimum + day - 1) / day * day
+	}
+	if requested > interval {
+		return requested
+	}
+	return interval
+}
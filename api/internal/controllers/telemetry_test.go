@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+type stubTelemetry struct {
+	history service.HistoryQuery
+	calls   int
+}
+
+func (s *stubTelemetry) GetLatestSignals(_ context.Context, tokenID uint64, signals []string) (*service.LatestSignals, error) {
+	s.calls++
+	if tokenID == 403 {
+		return nil, &service.PrivilegeExchangeError{TokenID: tokenID, StatusCode: http.StatusForbidden}
+	}
+	res := &service.LatestSignals{Signals: map[string]service.SignalValue{}}
+	for _, sig := range signals {
+		res.Signals[sig] = service.SignalValue{Value: 1}
+	}
+	return res, nil
+}
+
+func (s *stubTelemetry) GetSignalHistory(_ context.Context, _ uint64, q service.HistoryQuery) ([]service.HistoryPoint, error) {
+	s.calls++
+	s.history = q
+	return []service.HistoryPoint{}, nil
+}
+
+func TestTelemetryController(t *testing.T) {
+	// the oracle knows vehicles 7 and 403
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/fleet/vehicles/7", "/v1/fleet/vehicles/403":
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oracle.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	telemetry := &stubTelemetry{}
+	ctrl := NewTelemetryController(settings, &logger, telemetry)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	app.Get("/vehicles/:tokenID/signals", ctrl.GetLatestSignals)
+	app.Get("/vehicles/:tokenID/signals/history", ctrl.GetSignalHistory)
+
+	tests := []struct {
+		name         string
+		target       string
+		wantStatus   int
+		wantCall     bool
+		wantInterval time.Duration
+		wantSignals  []string
+	}{
+		{name: "latest", target: "/vehicles/7/signals?signals=speed", wantStatus: http.StatusOK, wantCall: true},
+		{name: "latest location refused", target: "/vehicles/7/signals?signals=currentLocationCoordinates", wantStatus: http.StatusBadRequest},
+		{name: "not in the fleet", target: "/vehicles/8/signals", wantStatus: http.StatusNotFound},
+		{name: "not granted", target: "/vehicles/403/signals", wantStatus: http.StatusForbidden, wantCall: true},
+		{name: "bad token id", target: "/vehicles/abc/signals", wantStatus: http.StatusBadRequest},
+		{
+			name:         "history default range",
+			target:       "/vehicles/7/signals/history?signals=speed:max,speed",
+			wantStatus:   http.StatusOK,
+			wantCall:     true,
+			wantInterval: 5 * time.Minute, // 24h over 300 points
+			wantSignals:  []string{"speed_max", "speed_avg"},
+		},
+		{
+			name:         "history week downsampled",
+			target:       "/vehicles/7/signals/history?signals=speed&agg=min&from=2026-10-01T00:00:00Z&to=2026-10-08T00:00:00Z&points=100",
+			wantStatus:   http.StatusOK,
+			wantCall:     true,
+			wantInterval: 3 * time.Hour,
+			wantSignals:  []string{"speed_min"},
+		},
+		{
+			name:         "history coarser interval honoured",
+			target:       "/vehicles/7/signals/history?signals=speed&from=2026-10-01T00:00:00Z&to=2026-10-02T00:00:00Z&interval=2h",
+			wantStatus:   http.StatusOK,
+			wantCall:     true,
+			wantInterval: 2 * time.Hour,
+		},
+		{name: "history range too wide", target: "/vehicles/7/signals/history?from=2025-01-01T00:00:00Z&to=2026-01-01T00:00:00Z", wantStatus: http.StatusBadRequest},
+		{name: "history bad agg", target: "/vehicles/7/signals/history?signals=speed:median", wantStatus: http.StatusBadRequest},
+		{name: "history too many points", target: "/vehicles/7/signals/history?points=5000", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := telemetry.calls
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, tt.target, nil), -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if called := telemetry.calls != before; called != tt.wantCall {
+				t.Fatalf("telemetry called = %v, want %v", called, tt.wantCall)
+			}
+			if tt.wantInterval == 0 {
+				return
+			}
+			if telemetry.history.Interval != tt.wantInterval {
+				t.Errorf("expected interval %s, got %s", tt.wantInterval, telemetry.history.Interval)
+			}
+			var res SignalHistoryRes
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantSignals != nil && len(res.Signals) != len(tt.wantSignals) {
+				t.Fatalf("expected signals %v, got %v", tt.wantSignals, res.Signals)
+			}
+			for i, want := range tt.wantSignals {
+				if res.Signals[i] != want {
+					t.Errorf("expected signals %v, got %v", tt.wantSignals, res.Signals)
+				}
+			}
+		})
+	}
+}
+
+func TestTelemetryController_NotConfigured(t *testing.T) {
+	logger := zerolog.Nop()
+	ctrl := NewTelemetryController(&config.Settings{}, &logger, nil)
+	app := fiber.New()
+	app.Get("/vehicles/:tokenID/signals", ctrl.GetLatestSignals)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/vehicles/7/signals", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,499 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// share link ids are UUIDs minted by the oracle
+var shareIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// shareInfoTTL is how long a good share lookup is reused. Kept short so a revoked link stops working quickly.
+const shareInfoTTL = 30 * time.Second
+
+// trackingInfoFields are the share fields the public tracking page is allowed to see
+var trackingInfoFields = []string{"vehicle_token_id", "vin", "make", "model", "year", "license_plate", "expires_at"}
+
+// segments are trips: these are the fields of a segment, the signals within are checked separately
+var trackingSegmentFields = map[string]bool{"start": true, "end": true, "isOngoing": true, "signals": true, "duration": true}
+
+// trip start and end points are locations, so they're only shown when the share covers location
+const locationSignal = "currentLocationCoordinates"
+
+const (
+	// shareAccessMaxPerShare is the most views kept for one share, the newest
+	shareAccessMaxPerShare = 1000
+	// shareAccessCompactEvery is how often views past their retention are dropped from the log
+	shareAccessCompactEvery = time.Hour
+)
+
+// TrackingController is the public vehicle tracking gateway. Share links are unauthenticated, so rather than
+// proxying blindly it checks the share exists and is live, limits the telemetry-api queries to what the share
+// covers, strips anything else from responses and records every access to a live share.
+type TrackingController struct {
+	settings  *config.Settings
+	logger    *zerolog.Logger
+	accessLog *store.JSONL[ShareAccess]
+
+	mu     sync.Mutex
+	shares map[string]shareLookup
+
+	accessMu sync.Mutex
+	// accesses is what the access log keeps of each share, oldest first
+	accesses    map[string][]ShareAccess
+	logged      int
+	lastCompact time.Time
+}
+
+// ShareAccess is one view of a shared vehicle
+type ShareAccess struct {
+	Time           time.Time `json:"time"`
+	ShareID        string    `json:"shareId"`
+	VehicleTokenID int64     `json:"vehicleTokenId,omitempty"`
+	Route          string    `json:"route"`
+	Status         int       `json:"status"`
+	IP             string    `json:"ip"`
+	UserAgent      string    `json:"userAgent"`
+}
+
+// shareLookup caches the outcome of asking the oracle about a share: either the share or the status it answered.
+type shareLookup struct {
+	share   *trackingShare
+	status  int
+	expires time.Time
+}
+
+type trackingShare struct {
+	VehicleTokenID int64      `json:"vehicle_token_id"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	// Signals optionally narrows what this particular share exposes
+	Signals []string `json:"signals,omitempty"`
+
+	raw map[string]any
+}
+
+// NewTrackingController loads the access log, down to the views within retention and the newest
+// shareAccessMaxPerShare of each share.
+func NewTrackingController(settings *config.Settings, logger *zerolog.Logger) *TrackingController {
+	t := &TrackingController{
+		settings:  settings,
+		logger:    logger,
+		accessLog: store.NewJSONL[ShareAccess](filepath.Join(settings.GetDataDir(), "share_access.jsonl")),
+		shares:    map[string]shareLookup{},
+		accesses:  map[string][]ShareAccess{},
+	}
+	err := t.accessLog.Scan(func(rec ShareAccess) bool {
+		t.logged++
+		t.accesses[rec.ShareID] = append(t.accesses[rec.ShareID], rec)
+		return true
+	})
+	if err != nil {
+		logger.Err(err).Msg("failed to read share access log")
+		t.logged = 0
+	}
+	t.compactAccessesLocked(time.Now())
+	return t
+}
+
+// GetShare
+// @Summary Public share link info
+// @Description Returns the vehicle a live share link points at, limited to the fields the tracking page shows
+// @Tags Tracking
+// @Produce json
+// @Param shareID path string true "share link id"
+// @Success 200
+// @Failure 404 "unknown share"
+// @Failure 410 "expired share"
+// @Router /tracking/{shareID} [get]
+func (t *TrackingController) GetShare(c *fiber.Ctx) error {
+	share, err := t.resolveShare(c, "info")
+	if err != nil {
+		return err
+	}
+	out := map[string]any{}
+	for _, k := range trackingInfoFields {
+		if v, ok := share.raw[k]; ok {
+			out[k] = v
+		}
+	}
+	return c.JSON(out)
+}
+
+// Telemetry
+// @Summary Public share link telemetry
+// @Description Runs a telemetry-api signalsLatest or signals query for the shared vehicle. Body is the raw GraphQL query.
+// @Tags Tracking
+// @Accept plain
+// @Produce json
+// @Param shareID path string true "share link id"
+// @Success 200
+// @Router /tracking/{shareID}/telemetry [post]
+func (t *TrackingController) Telemetry(c *fiber.Ctx) error {
+	return t.queryProxy(c, "telemetry", map[string]bool{"signalsLatest": true, "signals": true})
+}
+
+// Trips
+// @Summary Public share link trips
+// @Description Runs a telemetry-api segments query for the shared vehicle. Body is the raw GraphQL query.
+// @Tags Tracking
+// @Accept plain
+// @Produce json
+// @Param shareID path string true "share link id"
+// @Success 200
+// @Router /tracking/{shareID}/trips [post]
+func (t *TrackingController) Trips(c *fiber.Ctx) error {
+	return t.queryProxy(c, "trips", map[string]bool{"segments": true})
+}
+
+// GetShareAccessLog
+// @Summary Who viewed a shared vehicle
+// @Description Lists recorded accesses to a share link, newest first. The oracle decides whether the caller may see the share.
+// @Description Views are kept for TRACKING_ACCESS_RETENTION_DAYS, the newest 1000 of each share.
+// @Tags Tracking
+// @Produce json
+// @Param shareID path string true "share link id"
+// @Param limit query int false "max records, default 100"
+// @Success 200
+// @Security     BearerAuth
+// @Router /oracle/{oracleID}/fleet/vehicles/shares/{shareID}/access [get]
+func (t *TrackingController) GetShareAccessLog(c *fiber.Ctx) error {
+	shareID := c.Params("shareID")
+	if !shareIDPattern.MatchString(shareID) {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid share id")
+	}
+	// ask the oracle for the share with the caller's credentials, if they can't see it they can't see who viewed it
+	u := GetOracleURL(c, t.settings)
+	status, body, err := upstreamCall(c, fiber.MethodGet, u.JoinPath("/v1/fleet/vehicles/shares", shareID), nil)
+	if err != nil {
+		t.logger.Err(err).Msg("failed to check share with oracle")
+		return fiber.NewError(fiber.StatusBadGateway, "failed to check share")
+	}
+	if status != fiber.StatusOK {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Status(status).Send(body)
+	}
+
+	limit := c.QueryInt("limit", 100)
+	t.accessMu.Lock()
+	accesses := t.accesses[shareID]
+	// newest first
+	out := make([]ShareAccess, 0, max(0, min(limit, len(accesses))))
+	for i := len(accesses) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, accesses[i])
+	}
+	t.accessMu.Unlock()
+	return c.JSON(out)
+}
+
+func (t *TrackingController) queryProxy(c *fiber.Ctx, route string, roots map[string]bool) error {
+	share, err := t.resolveShare(c, route)
+	if err != nil {
+		return err
+	}
+	signals := t.coveredSignals(share)
+
+	fields, err := parseGQLQuery(string(c.Body()))
+	if err == nil {
+		err = t.validateQuery(fields, roots, share, signals)
+	}
+	if err != nil {
+		t.record(c, route, share.VehicleTokenID, fiber.StatusBadRequest)
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	u := t.settings.KaufmannOracleAPIURL
+	targetURL := u.JoinPath("/v1" + c.Path())
+	// we rewrite the response, so it must come back uncompressed
+	c.Request().Header.Del(fiber.HeaderAcceptEncoding)
+	if err := ProxyRequest(c, targetURL, c.Body(), t.logger); err != nil {
+		return err
+	}
+	t.record(c, route, share.VehicleTokenID, c.Response().StatusCode())
+	if c.Response().StatusCode() != fiber.StatusOK {
+		return nil
+	}
+
+	var resp map[string]any
+	if err := json.Unmarshal(c.Response().Body(), &resp); err != nil {
+		// not something we can vet, don't pass it on
+		return fiber.NewError(fiber.StatusBadGateway, "unexpected telemetry response")
+	}
+	stripUncoveredSignals(resp, signals)
+	return c.JSON(resp)
+}
+
+// resolveShare validates the share id, then looks it up, answering unknown and expired shares from cache.
+func (t *TrackingController) resolveShare(c *fiber.Ctx, route string) (*trackingShare, error) {
+	// fiber reuses the memory behind params, copy before keeping it as a cache key
+	shareID := strings.Clone(c.Params("shareID"))
+	if !shareIDPattern.MatchString(shareID) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid share id")
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	cached, ok := t.shares[shareID]
+	t.mu.Unlock()
+
+	if !ok || now.After(cached.expires) {
+		cached = t.lookupShare(c, shareID)
+		t.mu.Lock()
+		if len(t.shares) > 10_000 {
+			// plenty for real traffic, this only trips when someone is enumerating ids
+			t.shares = map[string]shareLookup{}
+		}
+		t.shares[shareID] = cached
+		t.mu.Unlock()
+	}
+
+	if cached.share != nil && cached.share.ExpiresAt != nil && now.After(*cached.share.ExpiresAt) {
+		cached.status = fiber.StatusGone
+	}
+	if cached.status != fiber.StatusOK {
+		// only live shares are recorded, anyone can ask for any id
+		switch cached.status {
+		case fiber.StatusNotFound:
+			return nil, fiber.NewError(fiber.StatusNotFound, "share not found")
+		case fiber.StatusGone:
+			return nil, fiber.NewError(fiber.StatusGone, "share expired")
+		}
+		return nil, fiber.NewError(fiber.StatusBadGateway, "failed to look up share")
+	}
+	if route == "info" {
+		t.record(c, route, cached.share.VehicleTokenID, fiber.StatusOK)
+	}
+	return cached.share, nil
+}
+
+func (t *TrackingController) lookupShare(c *fiber.Ctx, shareID string) shareLookup {
+	u := t.settings.KaufmannOracleAPIURL
+	status, body, err := upstreamCall(c, fiber.MethodGet, u.JoinPath("/v1/tracking", shareID), nil)
+	if err != nil {
+		t.logger.Err(err).Msg("failed to look up share with oracle")
+		// don't cache our own failure to reach the oracle
+		return shareLookup{status: fiber.StatusBadGateway}
+	}
+
+	switch status {
+	case fiber.StatusOK:
+		share := &trackingShare{}
+		if err := json.Unmarshal(body, share); err != nil || share.VehicleTokenID == 0 {
+			t.logger.Error().Msg("oracle returned an unreadable share")
+			return shareLookup{status: fiber.StatusBadGateway}
+		}
+		_ = json.Unmarshal(body, &share.raw)
+		return shareLookup{share: share, status: status, expires: time.Now().Add(shareInfoTTL)}
+	case fiber.StatusNotFound, fiber.StatusGone:
+		return shareLookup{status: status, expires: time.Now().Add(t.settings.GetTrackingNegativeCacheTTL())}
+	}
+	t.logger.Warn().Int("status", status).Msg("unexpected status looking up share")
+	return shareLookup{status: fiber.StatusBadGateway}
+}
+
+// coveredSignals is the configured set, narrowed to the share's own list when it has one
+func (t *TrackingController) coveredSignals(share *trackingShare) map[string]bool {
+	signals := map[string]bool{}
+	for _, s := range t.settings.GetTrackingAllowedSignals() {
+		signals[s] = true
+	}
+	if len(share.Signals) == 0 {
+		return signals
+	}
+	narrowed := map[string]bool{}
+	for _, s := range share.Signals {
+		if signals[s] {
+			narrowed[s] = true
+		}
+	}
+	return narrowed
+}
+
+func (t *TrackingController) validateQuery(fields []gqlField, roots map[string]bool, share *trackingShare, signals map[string]bool) error {
+	if len(fields) != 1 {
+		return fmt.Errorf("exactly one query field expected")
+	}
+	root := fields[0]
+	if !roots[root.Name] {
+		return fmt.Errorf("query %s is not allowed here", root.Name)
+	}
+	tokenID, _ := root.Args["tokenId"].(string)
+	if tokenID != strconv.FormatInt(share.VehicleTokenID, 10) {
+		return fmt.Errorf("tokenId does not match the shared vehicle")
+	}
+
+	if root.Name != "signalsLatest" {
+		if err := t.validateRange(root.Args); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range root.Fields {
+		switch root.Name {
+		case "segments":
+			if !trackingSegmentFields[f.Name] {
+				return fmt.Errorf("field %s is not allowed", f.Name)
+			}
+			if (f.Name == "start" || f.Name == "end") && !signals[locationSignal] {
+				return fmt.Errorf("trip locations are not covered by this share")
+			}
+		case "signals":
+			if f.Name != "timestamp" && !signals[f.Name] {
+				return fmt.Errorf("signal %s is not covered by this share", f.Name)
+			}
+		default:
+			if f.Name != "lastSeen" && !signals[f.Name] {
+				return fmt.Errorf("signal %s is not covered by this share", f.Name)
+			}
+		}
+	}
+
+	if reqs, ok := root.Args["signalRequests"]; ok {
+		list, _ := reqs.([]any)
+		for _, r := range list {
+			obj, _ := r.(map[string]any)
+			name, _ := obj["name"].(string)
+			if !signals[name] {
+				return fmt.Errorf("signal %s is not covered by this share", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *TrackingController) validateRange(args map[string]any) error {
+	fromStr, _ := args["from"].(string)
+	toStr, _ := args["to"].(string)
+	from, err := time.Parse(time.RFC3339, fromStr)
+	if err != nil {
+		return fmt.Errorf("from must be an RFC3339 time")
+	}
+	to, err := time.Parse(time.RFC3339, toStr)
+	if err != nil {
+		return fmt.Errorf("to must be an RFC3339 time")
+	}
+	if !to.After(from) {
+		return fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from) > t.settings.GetTrackingMaxRange() {
+		return fmt.Errorf("time range is longer than %s", t.settings.GetTrackingMaxRange())
+	}
+	if from.Before(time.Now().Add(-t.settings.GetTrackingMaxRange())) {
+		return fmt.Errorf("from is further back than %s", t.settings.GetTrackingMaxRange())
+	}
+	return nil
+}
+
+// record logs an access to a live share
+func (t *TrackingController) record(c *fiber.Ctx, route string, tokenID int64, status int) {
+	rec := ShareAccess{
+		Time:           time.Now().UTC(),
+		ShareID:        strings.Clone(c.Params("shareID")),
+		VehicleTokenID: tokenID,
+		Route:          route,
+		Status:         status,
+		IP:             strings.Clone(c.IP()),
+		UserAgent:      strings.Clone(c.Get(fiber.HeaderUserAgent)),
+	}
+	t.accessMu.Lock()
+	defer t.accessMu.Unlock()
+	accesses := append(t.accesses[rec.ShareID], rec)
+	t.accesses[rec.ShareID] = accesses[max(0, len(accesses)-shareAccessMaxPerShare):]
+	// appended under the lock so a compaction can't write the log over it
+	if err := t.accessLog.Append(rec); err != nil {
+		t.logger.Err(err).Msg("failed to record share access")
+	} else {
+		t.logged++
+	}
+	if rec.Time.Sub(t.lastCompact) >= shareAccessCompactEvery {
+		t.compactAccessesLocked(rec.Time)
+	}
+}
+
+// compactAccessesLocked drops the views past retention and beyond shareAccessMaxPerShare of each share, and
+// rewrites the log when it holds more than what's left
+func (t *TrackingController) compactAccessesLocked(now time.Time) {
+	t.lastCompact = now
+	cutoff := now.Add(-t.settings.GetTrackingAccessRetention())
+	var kept []ShareAccess
+	for shareID, accesses := range t.accesses {
+		accesses = accesses[max(0, len(accesses)-shareAccessMaxPerShare):]
+		i, _ := slices.BinarySearchFunc(accesses, cutoff, func(a ShareAccess, at time.Time) int { return a.Time.Compare(at) })
+		if accesses = accesses[i:]; len(accesses) == 0 {
+			delete(t.accesses, shareID)
+			continue
+		}
+		t.accesses[shareID] = accesses
+		kept = append(kept, accesses...)
+	}
+	if t.logged <= len(kept) {
+		return
+	}
+	slices.SortFunc(kept, func(a, b ShareAccess) int { return a.Time.Compare(b.Time) })
+	if err := t.accessLog.Rewrite(kept); err != nil {
+		t.logger.Err(err).Msg("failed to compact share access log")
+		return
+	}
+	t.logged = len(kept)
+}
+
+// stripUncoveredSignals removes anything the share doesn't cover from a telemetry-api response, in case the
+// upstream answers with more than was asked for.
+func stripUncoveredSignals(resp map[string]any, signals map[string]bool) {
+	delete(resp, "extensions")
+	data, _ := resp["data"].(map[string]any)
+	if latest, ok := data["signalsLatest"].(map[string]any); ok {
+		for k := range latest {
+			if k != "lastSeen" && !signals[k] {
+				delete(latest, k)
+			}
+		}
+	}
+	if rows, ok := data["signals"].([]any); ok {
+		for _, row := range rows {
+			if m, ok := row.(map[string]any); ok {
+				for k := range m {
+					if k != "timestamp" && !signals[k] {
+						delete(m, k)
+					}
+				}
+			}
+		}
+	}
+	if segments, ok := data["segments"].([]any); ok {
+		for _, seg := range segments {
+			m, ok := seg.(map[string]any)
+			if !ok {
+				continue
+			}
+			for k := range m {
+				if !trackingSegmentFields[k] || ((k == "start" || k == "end") && !signals[locationSignal]) {
+					delete(m, k)
+				}
+			}
+			aggs, _ := m["signals"].([]any)
+			kept := make([]any, 0, len(aggs))
+			for _, a := range aggs {
+				if agg, ok := a.(map[string]any); ok {
+					if name, _ := agg["name"].(string); signals[name] {
+						kept = append(kept, agg)
+					}
+				}
+			}
+			if _, has := m["signals"]; has {
+				m["signals"] = kept
+			}
+		}
+	}
+}
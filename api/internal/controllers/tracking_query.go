@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// gqlField is one field of a parsed GraphQL selection set. Argument values are kept as written: a string
+// or enum becomes a string, lists become []any and input objects map[string]any.
+type gqlField struct {
+	Name   string
+	Args   map[string]any
+	Fields []gqlField
+}
+
+var errGQLSyntax = errors.New("malformed query")
+
+// parseGQLQuery parses the small subset of GraphQL the public tracking page sends: a single anonymous or
+// named query with inline arguments. Variables, fragments, directives, aliases, mutations and subscriptions
+// are rejected rather than interpreted, so what we validate is exactly what telemetry-api will run.
+func parseGQLQuery(q string) ([]gqlField, error) {
+	toks, err := tokenizeGQL(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+
+	if p.peek() == "query" {
+		p.next()
+		if isGQLName(p.peek()) {
+			p.next()
+		}
+	}
+	fields, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("%w: unexpected %q after query", errGQLSyntax, p.peek())
+	}
+	return fields, nil
+}
+
+type gqlParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *gqlParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *gqlParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *gqlParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		return fmt.Errorf("%w: expected %q, got %q", errGQLSyntax, tok, got)
+	}
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for p.peek() != "}" {
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	p.next()
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: empty selection", errGQLSyntax)
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	name := p.next()
+	if !isGQLName(name) {
+		return gqlField{}, fmt.Errorf("%w: unexpected %q", errGQLSyntax, name)
+	}
+	f := gqlField{Name: name}
+	switch p.peek() {
+	case ":":
+		return f, fmt.Errorf("%w: aliases are not supported", errGQLSyntax)
+	case "@", "...":
+		return f, fmt.Errorf("%w: directives and fragments are not supported", errGQLSyntax)
+	}
+	if p.peek() == "(" {
+		p.next()
+		f.Args = map[string]any{}
+		for p.peek() != ")" {
+			arg := p.next()
+			if !isGQLName(arg) {
+				return f, fmt.Errorf("%w: bad argument %q", errGQLSyntax, arg)
+			}
+			if err := p.expect(":"); err != nil {
+				return f, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return f, err
+			}
+			f.Args[arg] = v
+		}
+		p.next()
+	}
+	if p.peek() == "{" {
+		sub, err := p.selectionSet()
+		if err != nil {
+			return f, err
+		}
+		f.Fields = sub
+	}
+	return f, nil
+}
+
+func (p *gqlParser) value() (any, error) {
+	tok := p.next()
+	switch {
+	case tok == "[":
+		var list []any
+		for p.peek() != "]" {
+			if p.peek() == "" {
+				return nil, fmt.Errorf("%w: unterminated list", errGQLSyntax)
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+	case tok == "{":
+		obj := map[string]any{}
+		for p.peek() != "}" {
+			key := p.next()
+			if !isGQLName(key) {
+				return nil, fmt.Errorf("%w: bad object key %q", errGQLSyntax, key)
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = v
+		}
+		p.next()
+		return obj, nil
+	case strings.HasPrefix(tok, `"`):
+		return strings.Trim(tok, `"`), nil
+	case tok == "$":
+		return nil, fmt.Errorf("%w: variables are not supported", errGQLSyntax)
+	case tok == "" || strings.ContainsAny(tok, "(){}[]:"):
+		return nil, fmt.Errorf("%w: unexpected %q", errGQLSyntax, tok)
+	}
+	// number, boolean or enum
+	return tok, nil
+}
+
+// tokenizeGQL splits a query into names, numbers, quoted strings and punctuators. Commas and comments are
+// insignificant in GraphQL and dropped.
+func tokenizeGQL(q string) ([]string, error) {
+	var toks []string
+	r := []rune(q)
+	for i := 0; i < len(r); {
+		ch := r[i]
+		switch {
+		case unicode.IsSpace(ch) || ch == ',' || ch == '\uFEFF':
+			i++
+		case ch == '#':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case ch == '"':
+			j := i + 1
+			for j < len(r) && r[j] != '"' {
+				if r[j] == '\\' || r[j] == '\n' {
+					return nil, fmt.Errorf("%w: escapes and multi-line strings are not supported", errGQLSyntax)
+				}
+				j++
+			}
+			if j >= len(r) {
+				return nil, fmt.Errorf("%w: unterminated string", errGQLSyntax)
+			}
+			toks = append(toks, string(r[i:j+1]))
+			i = j + 1
+		case strings.ContainsRune("{}()[]:!$=@", ch):
+			toks = append(toks, string(ch))
+			i++
+		case ch == '.':
+			if i+2 < len(r) && r[i+1] == '.' && r[i+2] == '.' {
+				toks = append(toks, "...")
+				i += 3
+				continue
+			}
+			return nil, fmt.Errorf("%w: unexpected '.'", errGQLSyntax)
+		case ch == '_' || ch == '-' || unicode.IsLetter(ch) || unicode.IsDigit(ch):
+			j := i + 1
+			for j < len(r) && (r[j] == '_' || r[j] == '.' || r[j] == '-' || r[j] == '+' || unicode.IsLetter(r[j]) || unicode.IsDigit(r[j])) {
+				j++
+			}
+			toks = append(toks, string(r[i:j]))
+			i = j
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", errGQLSyntax, ch)
+		}
+	}
+	return toks, nil
+}
+
+func isGQLName(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	for i, ch := range tok {
+		if ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (i > 0 && ch >= '0' && ch <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
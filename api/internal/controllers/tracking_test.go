@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+const testShareID = "0b7c9a3e-2f4d-4e1a-9c55-7d1e2a3b4c5d"
+
+func newTrackingTestApp(t *testing.T, oracle http.HandlerFunc) *fiber.App {
+	t.Helper()
+	logger := zerolog.Nop()
+	srv := httptest.NewServer(oracle)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, DataDir: t.TempDir()}
+	ctrl := NewTrackingController(settings, &logger)
+	app := fiber.New()
+	app.Get("/tracking/:shareID", ctrl.GetShare)
+	app.Post("/tracking/:shareID/telemetry", ctrl.Telemetry)
+	app.Post("/tracking/:shareID/trips", ctrl.Trips)
+	return app
+}
+
+func shareHandler(lookups *int, telemetry string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/tracking/"+testShareID:
+			*lookups++
+			_, _ = w.Write([]byte(`{"vehicle_token_id": 42, "vin": "1HGCM82633A004352", "created_by": "0xabc", "expires_at": "` +
+				time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`))
+		case strings.HasSuffix(r.URL.Path, "/telemetry"), strings.HasSuffix(r.URL.Path, "/trips"):
+			_, _ = w.Write([]byte(telemetry))
+		default:
+			*lookups++
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func TestTrackingController_GetShare(t *testing.T) {
+	lookups := 0
+	app := newTrackingTestApp(t, shareHandler(&lookups, ""))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/tracking/"+testShareID, nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&got)
+	if got["vin"] != "1HGCM82633A004352" {
+		t.Errorf("expected vin to be passed through, got %v", got)
+	}
+	if _, ok := got["created_by"]; ok {
+		t.Errorf("created_by should be stripped, got %v", got)
+	}
+
+	if resp, _ := app.Test(httptest.NewRequest(http.MethodGet, "/tracking/not-a-uuid", nil), -1); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed share id, got %d", resp.StatusCode)
+	}
+}
+
+func TestTrackingController_NegativeCache(t *testing.T) {
+	lookups := 0
+	app := newTrackingTestApp(t, shareHandler(&lookups, ""))
+
+	unknown := "/tracking/11111111-2222-3333-4444-555555555555"
+	for i := 0; i < 3; i++ {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, unknown, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", resp.StatusCode)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected the oracle to be asked once, was asked %d times", lookups)
+	}
+}
+
+func TestTrackingController_Telemetry(t *testing.T) {
+	lookups := 0
+	upstream := `{"data":{"signalsLatest":{"speed":{"value":12},"vin":{"value":"secret"}}}}`
+	app := newTrackingTestApp(t, shareHandler(&lookups, upstream))
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "covered signals", query: `{ signalsLatest(tokenId: 42) { speed { value } isIgnitionOn { value } } }`, wantStatus: http.StatusOK},
+		{name: "other vehicle", query: `{ signalsLatest(tokenId: 43) { speed { value } } }`, wantStatus: http.StatusBadRequest},
+		{name: "uncovered signal", query: `{ signalsLatest(tokenId: 42) { vinVC { vin } } }`, wantStatus: http.StatusBadRequest},
+		{name: "alias", query: `{ speed: signalsLatest(tokenId: 42) { speed { value } } }`, wantStatus: http.StatusBadRequest},
+		{name: "mutation", query: `mutation { doThing }`, wantStatus: http.StatusBadRequest},
+		{name: "range too long", query: `{ signals(tokenId: 42, interval: "3s", from: "2020-01-01T00:00:00Z", to: "2020-03-01T00:00:00Z") { speed(agg: AVG) } }`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/tracking/"+testShareID+"/telemetry", strings.NewReader(tt.query))
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected %d, got %d: %s", tt.wantStatus, resp.StatusCode, body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				if strings.Contains(string(body), "secret") {
+					t.Errorf("uncovered signal was not stripped: %s", body)
+				}
+			}
+		})
+	}
+}
+
+func TestTrackingController_Trips(t *testing.T) {
+	lookups := 0
+	upstream := `{"data":{"segments":[{"isOngoing":false,"signals":[{"name":"speed","agg":"AVG","value":40},{"name":"vin","agg":"LAST","value":1}]}]}}`
+	app := newTrackingTestApp(t, shareHandler(&lookups, upstream))
+
+	now := time.Now().UTC()
+	query := `{
+  segments(
+    tokenId: 42
+    from: "` + now.Add(-7*24*time.Hour).Format(time.RFC3339) + `"
+    to: "` + now.Format(time.RFC3339) + `"
+    mechanism: frequencyAnalysis
+    limit: 20
+    config: { minSegmentDurationSeconds: 240 }
+    signalRequests: [
+      { name: "speed", agg: AVG }
+    ]
+  ) {
+    start { value {latitude longitude} timestamp }
+    isOngoing
+    signals { name agg value }
+  }
+}`
+	req := httptest.NewRequest(http.MethodPost, "/tracking/"+testShareID+"/trips", strings.NewReader(query))
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if strings.Contains(string(body), `"vin"`) {
+		t.Errorf("uncovered segment signal was not stripped: %s", body)
+	}
+
+	bad := strings.Replace(query, `{ name: "speed", agg: AVG }`, `{ name: "vin", agg: LAST }`, 1)
+	req = httptest.NewRequest(http.MethodPost, "/tracking/"+testShareID+"/trips", strings.NewReader(bad))
+	if resp, _ := app.Test(req, -1); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an uncovered signal request, got %d", resp.StatusCode)
+	}
+}
+
+func TestTrackingController_AccessLog(t *testing.T) {
+	lookups := 0
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/fleet/vehicles/shares/"+testShareID {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		shareHandler(&lookups, "")(w, r)
+	}))
+	defer oracle.Close()
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, DataDir: t.TempDir(), TrackingAccessRetentionDays: 30}
+	logger := zerolog.Nop()
+
+	// views past retention are dropped from the log on load
+	log := store.NewJSONL[ShareAccess](filepath.Join(settings.DataDir, "share_access.jsonl"))
+	_ = log.Append(ShareAccess{Time: time.Now().Add(-40 * 24 * time.Hour), ShareID: testShareID, Route: "info", Status: http.StatusOK})
+	_ = log.Append(ShareAccess{Time: time.Now().Add(-time.Hour), ShareID: testShareID, Route: "info", Status: http.StatusOK})
+	ctrl := NewTrackingController(settings, &logger)
+	logged := 0
+	_ = log.Scan(func(ShareAccess) bool {
+		logged++
+		return true
+	})
+	if logged != 1 {
+		t.Errorf("expected the log compacted to 1 view, got %d", logged)
+	}
+
+	app := fiber.New()
+	app.Get("/tracking/:shareID", ctrl.GetShare)
+	app.Get("/shares/:shareID/access", func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	}, ctrl.GetShareAccessLog)
+	// unknown ids, asked or answered from the cache, aren't recorded
+	for range 2 {
+		_, _ = app.Test(httptest.NewRequest(http.MethodGet, "/tracking/11111111-2222-3333-4444-555555555555", nil), -1)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/tracking/"+testShareID, nil)
+	req.Header.Set("User-Agent", "viewer")
+	_, _ = app.Test(req, -1)
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/shares/"+testShareID+"/access", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accesses []ShareAccess
+	_ = json.NewDecoder(resp.Body).Decode(&accesses)
+	if resp.StatusCode != http.StatusOK || len(accesses) != 2 || accesses[0].UserAgent != "viewer" || accesses[0].VehicleTokenID != 42 {
+		t.Errorf("expected the live share's 2 views, newest first, got %d %+v", resp.StatusCode, accesses)
+	}
+	if len(ctrl.accesses) != 1 {
+		t.Errorf("expected only the live share recorded, got %v", ctrl.accesses)
+	}
+}
@@ -0,0 +1,387 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gofiber/fiber/v2"
+)
+
+// FieldError is one problem with a request, Field is the JSON path or query param it was found at
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrorRes is ErrorRes plus the problems found, returned as a 400 before anything reaches the oracle
+type ValidationErrorRes struct {
+	Code    int          `json:"code"`
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors"`
+}
+
+// validator collects field errors so a caller gets all of them at once rather than one per round trip
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) add(field, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) ok() bool {
+	return len(v.errs) == 0
+}
+
+// respond writes the 400. The message repeats the first error so UIs that only show message still say something useful.
+func (v *validator) respond(c *fiber.Ctx) error {
+	msg := "invalid request"
+	if len(v.errs) > 0 {
+		msg = v.errs[0].Field + ": " + v.errs[0].Message
+		if len(v.errs) > 1 {
+			msg += fmt.Sprintf(" (and %d more)", len(v.errs)-1)
+		}
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(ValidationErrorRes{
+		Code:    fiber.StatusBadRequest,
+		Message: msg,
+		Errors:  v.errs,
+	})
+}
+
+func (v *validator) vin(field, vin string) {
+	if err := checkVIN(vin); err != nil {
+		v.add(field, "%s", err.Error())
+	}
+}
+
+func (v *validator) imei(field, imei string) {
+	if err := checkIMEI(imei); err != nil {
+		v.add(field, "%s", err.Error())
+	}
+}
+
+func (v *validator) address(field, addr string) {
+	if err := checkAddress(addr); err != nil {
+		v.add(field, "%s", err.Error())
+	}
+}
+
+func (v *validator) tokenID(field string, id json.Number) {
+	if id == "" {
+		v.add(field, "is required")
+		return
+	}
+	if n, err := strconv.ParseUint(id.String(), 10, 64); err != nil || n == 0 {
+		v.add(field, "must be a positive integer")
+	}
+}
+
+func (v *validator) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "is required")
+	}
+}
+
+func (v *validator) hex(field, value string) {
+	if !hexPattern.MatchString(value) {
+		v.add(field, "must be 0x prefixed hex")
+	}
+}
+
+// vins checks a list of VINs, reporting duplicates against the first occurrence
+func (v *validator) vins(field string, vins []string) {
+	if len(vins) == 0 {
+		v.add(field, "at least one VIN is required")
+		return
+	}
+	seen := make(map[string]int, len(vins))
+	for i, vin := range vins {
+		f := fmt.Sprintf("%s[%d]", field, i)
+		v.vin(f, vin)
+		key := strings.ToUpper(vin)
+		if first, dup := seen[key]; dup {
+			v.add(f, "duplicate of %s[%d]", field, first)
+			continue
+		}
+		seen[key] = i
+	}
+}
+
+var (
+	hexPattern  = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+	imeiPattern = regexp.MustCompile(`^[0-9]{15}$`)
+)
+
+// vinValues maps the VIN alphabet to the values used for the check digit, I, O and Q aren't allowed
+var vinValues = map[rune]int{
+	'A': 1, 'B': 2, 'C': 3, 'D': 4, 'E': 5, 'F': 6, 'G': 7, 'H': 8,
+	'J': 1, 'K': 2, 'L': 3, 'M': 4, 'N': 5, 'P': 7, 'R': 9,
+	'S': 2, 'T': 3, 'U': 4, 'V': 5, 'W': 6, 'X': 7, 'Y': 8, 'Z': 9,
+}
+
+var vinWeights = [17]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// checkVIN validates a 17 character VIN. The check digit in position 9 is only mandatory for vehicles built for
+// North America (WMI starting 1-5), elsewhere manufacturers often put something else there, so only those are
+// held to it.
+func checkVIN(vin string) error {
+	vin = strings.ToUpper(vin)
+	if len(vin) != 17 {
+		return fmt.Errorf("VIN must be 17 characters, got %d", len(vin))
+	}
+	sum := 0
+	for i, r := range vin {
+		val, ok := vinValues[r]
+		if r >= '0' && r <= '9' {
+			val, ok = int(r-'0'), true
+		}
+		if !ok {
+			return fmt.Errorf("VIN contains invalid character %q", r)
+		}
+		sum += val * vinWeights[i]
+	}
+	if vin[0] < '1' || vin[0] > '5' {
+		return nil
+	}
+	want := byte('0' + sum%11)
+	if sum%11 == 10 {
+		want = 'X'
+	}
+	if vin[8] != want {
+		return fmt.Errorf("VIN check digit is %c, expected %c", vin[8], want)
+	}
+	return nil
+}
+
+// checkIMEI validates a 15 digit IMEI with its Luhn check digit
+func checkIMEI(imei string) error {
+	if !imeiPattern.MatchString(imei) {
+		return fmt.Errorf("IMEI must be 15 digits")
+	}
+	sum := 0
+	for i := 0; i < 15; i++ {
+		d := int(imei[i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	if sum%10 != 0 {
+		return fmt.Errorf("IMEI check digit is invalid")
+	}
+	return nil
+}
+
+// checkAddress validates a 0x address. All lower or all upper case addresses carry no checksum, mixed case ones
+// must match their EIP-55 checksum, which catches most typos.
+func checkAddress(addr string) error {
+	if !common.IsHexAddress(addr) || !strings.HasPrefix(addr, "0x") {
+		return fmt.Errorf("must be a 0x prefixed 20 byte address")
+	}
+	hexPart := addr[2:]
+	if hexPart == strings.ToLower(hexPart) || hexPart == strings.ToUpper(hexPart) {
+		return nil
+	}
+	if common.HexToAddress(addr).Hex() != addr {
+		return fmt.Errorf("address checksum is invalid")
+	}
+	return nil
+}
+
+// splitVINs splits a comma separated vins query param, trimming blanks
+func splitVINs(raw string) []string {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// dedupeVINs drops repeated VINs from a query list, keeping the first spelling. Unlike a request body there's
+// nothing to submit twice here, so repeats are dropped instead of rejected.
+func dedupeVINs(vins []string) []string {
+	seen := make(map[string]bool, len(vins))
+	out := make([]string, 0, len(vins))
+	for _, v := range vins {
+		if key := strings.ToUpper(v); !seen[key] {
+			seen[key] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// decodeBody decodes a JSON request body for validation. The body forwarded to the oracle is the original bytes,
+// the decoded copy is only looked at.
+func decodeBody(c *fiber.Ctx, v *validator, dst any) bool {
+	dec := json.NewDecoder(bytes.NewReader(c.Body()))
+	dec.UseNumber()
+	if err := dec.Decode(dst); err != nil {
+		v.add("body", "must be valid JSON: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// vinsQuery validates the vins query param shared by the lifecycle GETs and returns it de-duplicated, ready to encode
+func vinsQuery(c *fiber.Ctx, v *validator) url.Values {
+	vins := dedupeVINs(splitVINs(c.Query("vins", "")))
+	v.vins("vins", vins)
+	return url.Values{"vins": {strings.Join(vins, ",")}}
+}
+
+// the lifecycle request bodies, only the fields we check. Anything else is passed through untouched.
+
+type verifyRequest struct {
+	Vins []struct {
+		Vin         string `json:"vin"`
+		CountryCode string `json:"countryCode"`
+		Definition  string `json:"definition"`
+	} `json:"vins"`
+}
+
+type mintRequest struct {
+	VinMintingData []struct {
+		Vin       string          `json:"vin"`
+		TypedData json.RawMessage `json:"typedData"`
+		Signature string          `json:"signature"`
+	} `json:"vinMintingData"`
+	Sacd []struct {
+		Grantee string `json:"grantee"`
+	} `json:"sacd"`
+}
+
+type userOperationData struct {
+	Vin           string          `json:"vin"`
+	Imei          string          `json:"imei"`
+	UserOperation json.RawMessage `json:"userOperation"`
+	Hash          string          `json:"hash"`
+	Signature     string          `json:"signature"`
+}
+
+type sharedAccountRequest struct {
+	TokenID             json.Number `json:"tokenId"`
+	TargetWalletAddress string      `json:"targetWalletAddress"`
+}
+
+func validateVerifyRequest(c *fiber.Ctx) *validator {
+	v := &validator{}
+	var req verifyRequest
+	if !decodeBody(c, v, &req) {
+		return v
+	}
+	vins := make([]string, len(req.Vins))
+	for i, item := range req.Vins {
+		vins[i] = item.Vin
+		v.required(fmt.Sprintf("vins[%d].countryCode", i), item.CountryCode)
+		v.required(fmt.Sprintf("vins[%d].definition", i), item.Definition)
+	}
+	v.vins("vins", vins)
+	return v
+}
+
+func validateMintRequest(c *fiber.Ctx) *validator {
+	v := &validator{}
+	var req mintRequest
+	if !decodeBody(c, v, &req) {
+		return v
+	}
+	vins := make([]string, len(req.VinMintingData))
+	for i, item := range req.VinMintingData {
+		vins[i] = item.Vin
+		// unsigned items are the server-owner case, where the oracle signs itself
+		if hasTypedData := len(item.TypedData) > 0 && string(item.TypedData) != "null"; hasTypedData {
+			v.hex(fmt.Sprintf("vinMintingData[%d].signature", i), item.Signature)
+		}
+	}
+	v.vins("vinMintingData", vins)
+	for i, s := range req.Sacd {
+		v.address(fmt.Sprintf("sacd[%d].grantee", i), s.Grantee)
+	}
+	return v
+}
+
+func validateUserOperations(v *validator, field string, ops []userOperationData) {
+	vins := make([]string, len(ops))
+	for i, op := range ops {
+		vins[i] = op.Vin
+		validateUserOperation(v, fmt.Sprintf("%s[%d].", field, i), op)
+	}
+	v.vins(field, vins)
+}
+
+// validateUserOperation checks a signed user operation, prefix is the path to it for field names
+func validateUserOperation(v *validator, prefix string, op userOperationData) {
+	if op.Imei != "" {
+		v.imei(prefix+"imei", op.Imei)
+	}
+	if len(op.UserOperation) == 0 || string(op.UserOperation) == "null" {
+		v.add(prefix+"userOperation", "is required")
+	}
+	v.hex(prefix+"hash", op.Hash)
+	v.hex(prefix+"signature", op.Signature)
+}
+
+func validateDisconnectRequest(c *fiber.Ctx) *validator {
+	v := &validator{}
+	var req struct {
+		VinDisconnectData []userOperationData `json:"vinDisconnectData"`
+	}
+	if decodeBody(c, v, &req) {
+		validateUserOperations(v, "vinDisconnectData", req.VinDisconnectData)
+	}
+	return v
+}
+
+func validateDeleteRequest(c *fiber.Ctx) *validator {
+	v := &validator{}
+	var req struct {
+		VinDeleteData []userOperationData `json:"vinDeleteData"`
+	}
+	if decodeBody(c, v, &req) {
+		validateUserOperations(v, "vinDeleteData", req.VinDeleteData)
+	}
+	return v
+}
+
+func validateTransferRequest(c *fiber.Ctx) *validator {
+	v := &validator{}
+	var req userOperationData
+	if decodeBody(c, v, &req) {
+		v.vin("vin", req.Vin)
+		v.required("imei", req.Imei)
+		validateUserOperation(v, "", req)
+	}
+	return v
+}
+
+func validateSharedTransferRequest(c *fiber.Ctx) *validator {
+	v := &validator{}
+	var req sharedAccountRequest
+	if decodeBody(c, v, &req) {
+		v.tokenID("tokenId", req.TokenID)
+		v.address("targetWalletAddress", req.TargetWalletAddress)
+	}
+	return v
+}
+
+func validateSharedTokenRequest(c *fiber.Ctx) *validator {
+	v := &validator{}
+	var req sharedAccountRequest
+	if decodeBody(c, v, &req) {
+		v.tokenID("tokenId", req.TokenID)
+	}
+	return v
+}
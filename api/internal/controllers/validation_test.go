@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestCheckVIN(t *testing.T) {
+	tests := []struct {
+		vin     string
+		wantErr bool
+	}{
+		{vin: "1HGCM82633A004352"},
+		{vin: "1hgcm82633a004352"},
+		{vin: "1HGCM82643A004352", wantErr: true}, // wrong check digit
+		{vin: "WVWZZZ1JZXW000001"},                // no check digit outside North America
+		{vin: "1HGCM82633A00435", wantErr: true},
+		{vin: "1HGCM82633A0O4352", wantErr: true},
+		{vin: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkVIN(tt.vin); (err != nil) != tt.wantErr {
+			t.Errorf("checkVIN(%q) error = %v, wantErr %v", tt.vin, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckIMEI(t *testing.T) {
+	tests := []struct {
+		imei    string
+		wantErr bool
+	}{
+		{imei: "490154203237518"},
+		{imei: "490154203237519", wantErr: true},
+		{imei: "49015420323751", wantErr: true},
+		{imei: "49015420323751a", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkIMEI(tt.imei); (err != nil) != tt.wantErr {
+			t.Errorf("checkIMEI(%q) error = %v, wantErr %v", tt.imei, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"},
+		{addr: "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"},
+		{addr: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD", wantErr: true},
+		{addr: "5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", wantErr: true},
+		{addr: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeA", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkAddress(tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("checkAddress(%q) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLifecycleValidation(t *testing.T) {
+	var upstreamCalls int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"query":"` + r.URL.RawQuery + `"}`))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u}
+	logger := zerolog.Nop()
+	ctrl := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, "", service.IdentityCacheConfig{}), nil)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	app.Get("/vehicle/mint", ctrl.GetVehiclesMintData)
+	app.Get("/vehicle/transfer", ctrl.GetTransferData)
+	app.Post("/vehicle/delete", ctrl.SubmitDeleteData)
+	app.Post("/vehicle/transfer/shared", ctrl.SubmitSharedAccountTransfer)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantFields []string
+	}{
+		{
+			name:       "mint query deduped and escaped",
+			method:     http.MethodGet,
+			target:     "/vehicle/mint?vins=1HGCM82633A004352,1hgcm82633a004352",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "mint bad vin and owner",
+			method:     http.MethodGet,
+			target:     "/vehicle/mint?vins=1HGCM82643A004352&owner_address=0xnope",
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"vins[0]", "owner_address"},
+		},
+		{
+			name:       "transfer query injection",
+			method:     http.MethodGet,
+			target:     "/vehicle/transfer?imei=490154203237518%26admin%3Dtrue&targetWalletAddress=0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed",
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"imei"},
+		},
+		{
+			name:   "delete duplicate vins",
+			method: http.MethodPost,
+			target: "/vehicle/delete",
+			body: `{"vinDeleteData":[
+				{"vin":"1HGCM82633A004352","imei":"490154203237518","userOperation":{},"hash":"0x01","signature":"0x02"},
+				{"vin":"1HGCM82633A004352","userOperation":{},"hash":"0x01"}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"vinDeleteData[1].signature", "vinDeleteData[1]"},
+		},
+		{
+			name:       "shared transfer negative token",
+			method:     http.MethodPost,
+			target:     "/vehicle/transfer/shared",
+			body:       `{"tokenId":-4,"targetWalletAddress":"0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"tokenId"},
+		},
+		{
+			name:       "shared transfer ok",
+			method:     http.MethodPost,
+			target:     "/vehicle/transfer/shared",
+			body:       `{"tokenId":4,"targetWalletAddress":"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}`,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := upstreamCalls
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus != http.StatusBadRequest {
+				return
+			}
+			if upstreamCalls != before {
+				t.Errorf("invalid request reached the oracle")
+			}
+			var res ValidationErrorRes
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]bool{}
+			for _, e := range res.Errors {
+				got[e.Field] = true
+			}
+			for _, f := range tt.wantFields {
+				if !got[f] {
+					t.Errorf("expected an error for %s, got %+v", f, res.Errors)
+				}
+			}
+		})
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/vehicle/mint?vins=1HGCM82633A004352,1hgcm82633a004352", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var echoed struct{ Query string }
+	_ = json.NewDecoder(resp.Body).Decode(&echoed)
+	if echoed.Query != "vins=1HGCM82633A004352" {
+		t.Errorf("expected the deduped vins to be forwarded, got %q", echoed.Query)
+	}
+}
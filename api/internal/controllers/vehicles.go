@@ -1,7 +1,11 @@
 package controllers
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"sync"
 
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
 	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
@@ -13,13 +17,36 @@ type VehiclesController struct {
 	settings    *config.Settings
 	logger      *zerolog.Logger
 	identityAPI service.IdentityAPI
+
+	// jobs follows mint, transfer, disconnect and delete jobs once submitted, nil when job tracking is off
+	jobs *service.JobTracker
+
+	// commands is the history of device commands and checks the confirmations of destructive ones
+	commands *deviceCommands
+
+	// transferJobs is the vehicle of each shared account transfer job, so its cached identity can be dropped while
+	// the transfer is polled
+	mu           sync.Mutex
+	transferJobs map[string]string
 }
 
-func NewVehiclesController(settings *config.Settings, logger *zerolog.Logger) *VehiclesController {
+// NewVehiclesController takes the identity service, whose cached vehicles are invalidated as transfers, disconnects
+// and deletes go through, and the job tracker the submitted jobs are handed to, which may be nil
+func NewVehiclesController(settings *config.Settings, logger *zerolog.Logger, identityAPI service.IdentityAPI, jobs *service.JobTracker) *VehiclesController {
+	key, err := commandConfirmationKey(settings)
+	if err != nil {
+		// tokens still work, as long as the replica that handed them out checks them
+		logger.Err(err).Msg("failed to read the command confirmation key, using one for this process only")
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+	}
 	return &VehiclesController{
-		settings:    settings,
-		logger:      logger,
-		identityAPI: service.NewIdentityAPIService(*logger, settings.IdentityAPIURL.String()),
+		settings:     settings,
+		logger:       logger,
+		identityAPI:  identityAPI,
+		jobs:         jobs,
+		commands:     newDeviceCommands(logger, settings.GetDataDir(), key, settings.GetCommandHistoryRetention()),
+		transferJobs: map[string]string{},
 	}
 }
 
@@ -64,15 +91,18 @@ func (v *VehiclesController) RegisterVehicle(c *fiber.Ctx) error {
 }
 
 func (v *VehiclesController) GetVehiclesVerificationStatus(c *fiber.Ctx) error {
-	vins := c.Query("vins", "")
-	u := GetOracleURL(c, v.settings)
-
-	targetURL := u.JoinPath("/v1/vehicle/verify")
-	targetURL.RawQuery = fmt.Sprintf("vins=%s", vins)
-	return ProxyRequest(c, targetURL, nil, v.logger)
+	val := &validator{}
+	query := vinsQuery(c, val)
+	if !val.ok() {
+		return val.respond(c)
+	}
+	return proxyVINList(c, v.settings, v.logger, "/v1/vehicle/verify", query, "statuses")
 }
 
 func (v *VehiclesController) SubmitVehiclesVerification(c *fiber.Ctx) error {
+	if val := validateVerifyRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/verify")
@@ -80,41 +110,72 @@ func (v *VehiclesController) SubmitVehiclesVerification(c *fiber.Ctx) error {
 }
 
 func (v *VehiclesController) GetVehiclesMintData(c *fiber.Ctx) error {
-	vins := c.Query("vins", "")
-	ownerAddress := c.Query("owner_address", "")
-	u := GetOracleURL(c, v.settings)
-
-	targetURL := u.JoinPath("/v1/vehicle/mint")
-	targetURL.RawQuery = fmt.Sprintf("vins=%s&owner_address=%s", vins, ownerAddress)
-	return ProxyRequest(c, targetURL, nil, v.logger)
+	val := &validator{}
+	query := vinsQuery(c, val)
+	if ownerAddress := c.Query("owner_address", ""); ownerAddress != "" {
+		val.address("owner_address", ownerAddress)
+		query.Set("owner_address", ownerAddress)
+	}
+	if !val.ok() {
+		return val.respond(c)
+	}
+	return proxyVINList(c, v.settings, v.logger, "/v1/vehicle/mint", query, "vinMintingData")
 }
 
 func (v *VehiclesController) GetVehiclesMintStatus(c *fiber.Ctx) error {
-	vins := c.Query("vins", "")
-	u := GetOracleURL(c, v.settings)
-
-	targetURL := u.JoinPath("/v1/vehicle/mint/status")
-	targetURL.RawQuery = fmt.Sprintf("vins=%s", vins)
-	return ProxyRequest(c, targetURL, nil, v.logger)
+	val := &validator{}
+	query := vinsQuery(c, val)
+	if !val.ok() {
+		return val.respond(c)
+	}
+	return proxyVINList(c, v.settings, v.logger, "/v1/vehicle/mint/status", query, "statuses")
 }
 
 func (v *VehiclesController) SubmitVehiclesMintData(c *fiber.Ctx) error {
+	if val := validateMintRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/mint")
-	return ProxyRequest(c, targetURL, c.Body(), v.logger)
+	if err := ProxyRequest(c, targetURL, c.Body(), v.logger); err != nil {
+		return err
+	}
+	// one job per vehicle, the mint status is per vin
+	var req mintRequest
+	if json.Unmarshal(c.Body(), &req) == nil {
+		oracleJobID := responseJobID(c)
+		jobs := make([]service.Job, len(req.VinMintingData))
+		for i, item := range req.VinMintingData {
+			jobs[i] = service.Job{Kind: service.JobMint, VIN: item.Vin, OracleJobID: oracleJobID}
+		}
+		trackJobs(c, v.jobs, jobs...)
+	}
+	return nil
 }
 
 func (v *VehiclesController) GetDisconnectData(c *fiber.Ctx) error {
-	vins := c.Query("vins", "")
+	val := &validator{}
+	query := vinsQuery(c, val)
+	if !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/disconnect")
-	targetURL.RawQuery = fmt.Sprintf("vins=%s", vins)
+	targetURL.RawQuery = query.Encode()
 	return ProxyRequest(c, targetURL, nil, v.logger)
 }
 
+// SubmitDisconnectData submits the signed disconnects. With ?dryRun=true it only answers what they would affect,
+// see previewImpact.
 func (v *VehiclesController) SubmitDisconnectData(c *fiber.Ctx) error {
+	if c.QueryBool("dryRun") {
+		return v.dryRun(c, "disconnect", dryRunTargets("vinDisconnectData"))
+	}
+	if val := validateDisconnectRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/disconnect")
@@ -122,24 +183,35 @@ func (v *VehiclesController) SubmitDisconnectData(c *fiber.Ctx) error {
 }
 
 func (v *VehiclesController) GetDisconnectStatus(c *fiber.Ctx) error {
-	vins := c.Query("vins", "")
-	u := GetOracleURL(c, v.settings)
-
-	targetURL := u.JoinPath("/v1/vehicle/disconnect/status")
-	targetURL.RawQuery = fmt.Sprintf("vins=%s", vins)
-	return ProxyRequest(c, targetURL, nil, v.logger)
+	val := &validator{}
+	query := vinsQuery(c, val)
+	if !val.ok() {
+		return val.respond(c)
+	}
+	return proxyVINList(c, v.settings, v.logger, "/v1/vehicle/disconnect/status", query, "statuses")
 }
 
 func (v *VehiclesController) GetDeleteData(c *fiber.Ctx) error {
-	vins := c.Query("vins", "")
+	val := &validator{}
+	query := vinsQuery(c, val)
+	if !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/delete")
-	targetURL.RawQuery = fmt.Sprintf("vins=%s", vins)
+	targetURL.RawQuery = query.Encode()
 	return ProxyRequest(c, targetURL, nil, v.logger)
 }
 
+// SubmitDeleteData submits the signed deletes. With ?dryRun=true it only answers what they would affect.
 func (v *VehiclesController) SubmitDeleteData(c *fiber.Ctx) error {
+	if c.QueryBool("dryRun") {
+		return v.dryRun(c, "delete", dryRunTargets("vinDeleteData"))
+	}
+	if val := validateDeleteRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/delete")
@@ -147,12 +219,12 @@ func (v *VehiclesController) SubmitDeleteData(c *fiber.Ctx) error {
 }
 
 func (v *VehiclesController) GetDeleteStatus(c *fiber.Ctx) error {
-	vins := c.Query("vins", "")
-	u := GetOracleURL(c, v.settings)
-
-	targetURL := u.JoinPath("/v1/vehicle/delete/status")
-	targetURL.RawQuery = fmt.Sprintf("vins=%s", vins)
-	return ProxyRequest(c, targetURL, nil, v.logger)
+	val := &validator{}
+	query := vinsQuery(c, val)
+	if !val.ok() {
+		return val.respond(c)
+	}
+	return proxyVINList(c, v.settings, v.logger, "/v1/vehicle/delete/status", query, "statuses")
 }
 
 func (v *VehiclesController) GetPendingVehicleTelemetry(c *fiber.Ctx) error {
@@ -179,63 +251,163 @@ func (v *VehiclesController) ResetOnboarding(c *fiber.Ctx) error {
 func (v *VehiclesController) GetTransferData(c *fiber.Ctx) error {
 	imei := c.Query("imei", "")
 	targetWallet := c.Query("targetWalletAddress", "")
+	val := &validator{}
+	val.imei("imei", imei)
+	val.address("targetWalletAddress", targetWallet)
+	if !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/transfer")
-	targetURL.RawQuery = fmt.Sprintf("imei=%s&targetWalletAddress=%s", imei, targetWallet)
+	targetURL.RawQuery = url.Values{"imei": {imei}, "targetWalletAddress": {targetWallet}}.Encode()
 	return ProxyRequest(c, targetURL, nil, v.logger)
 }
 
+// SubmitTransferData submits the signed transfer. With ?dryRun=true it only answers what it would affect.
 func (v *VehiclesController) SubmitTransferData(c *fiber.Ctx) error {
+	if c.QueryBool("dryRun") {
+		return v.dryRun(c, "transfer", dryRunTransferTarget)
+	}
+	if val := validateTransferRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/transfer")
-	return ProxyRequest(c, targetURL, c.Body(), v.logger)
+	if err := ProxyRequest(c, targetURL, c.Body(), v.logger); err != nil {
+		return err
+	}
+	var req userOperationData
+	if jobID := responseJobID(c); jobID != "" && json.Unmarshal(c.Body(), &req) == nil {
+		trackJobs(c, v.jobs, service.Job{Kind: service.JobTransfer, OracleJobID: jobID, VIN: req.Vin})
+	}
+	return nil
 }
 
 func (v *VehiclesController) GetTransferStatus(c *fiber.Ctx) error {
 	jobID := c.Query("jobId", "")
+	val := &validator{}
+	val.required("jobId", jobID)
+	if !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/transfer/status")
-	targetURL.RawQuery = fmt.Sprintf("jobId=%s", jobID)
+	targetURL.RawQuery = url.Values{"jobId": {jobID}}.Encode()
+	// the owner changes somewhere while the transfer is polled, don't let a lookup in between cache the old one
+	v.mu.Lock()
+	tokenID, ok := v.transferJobs[jobID]
+	v.mu.Unlock()
+	if ok {
+		v.identityAPI.InvalidateVehicle(tokenID)
+	}
 	return ProxyRequest(c, targetURL, nil, v.logger)
 }
 
 // SubmitSharedAccountTransfer forwards the server-signed transfer request to the kaufmann
 // oracle endpoint that signs on behalf of a shared kernel account using the tenant signer.
 // Body: { tokenId, targetWalletAddress }. Response: { jobId }.
+// With ?dryRun=true nothing is submitted, the response is what it would affect.
 func (v *VehiclesController) SubmitSharedAccountTransfer(c *fiber.Ctx) error {
+	if c.QueryBool("dryRun") {
+		return v.dryRun(c, "transfer", dryRunSharedTarget)
+	}
+	if val := validateSharedTransferRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/transfer/shared")
-	return ProxyRequest(c, targetURL, c.Body(), v.logger)
+	if err := ProxyRequest(c, targetURL, c.Body(), v.logger); err != nil {
+		return err
+	}
+	tokenID := v.invalidateSharedVehicle(c)
+	if jobID := responseJobID(c); tokenID != "" && jobID != "" {
+		v.mu.Lock()
+		if len(v.transferJobs) > 10_000 {
+			// transfers are polled for minutes, older jobs are long done
+			v.transferJobs = map[string]string{}
+		}
+		v.transferJobs[jobID] = tokenID
+		v.mu.Unlock()
+		trackJobs(c, v.jobs, service.Job{Kind: service.JobTransfer, OracleJobID: jobID, TokenID: tokenID})
+	}
+	return nil
 }
 
 // SubmitSharedAccountDisconnect forwards the server-signed disconnect request to the kaufmann
 // oracle endpoint that burns the synthetic device on behalf of a shared kernel account using
 // the tenant signer. Body: { tokenId }. Response: { jobId }.
+// With ?dryRun=true nothing is submitted, the response is what it would affect.
 func (v *VehiclesController) SubmitSharedAccountDisconnect(c *fiber.Ctx) error {
+	if c.QueryBool("dryRun") {
+		return v.dryRun(c, "disconnect", dryRunSharedTarget)
+	}
+	if val := validateSharedTokenRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/disconnect/shared")
-	return ProxyRequest(c, targetURL, c.Body(), v.logger)
+	if err := ProxyRequest(c, targetURL, c.Body(), v.logger); err != nil {
+		return err
+	}
+	v.trackSharedJob(c, service.JobDisconnect, v.invalidateSharedVehicle(c))
+	return nil
 }
 
 // SubmitSharedAccountDelete forwards the server-signed delete request to the kaufmann oracle
 // endpoint that burns the vehicle NFT (auto-chaining the disconnect) on behalf of a shared
 // kernel account using the tenant signer. Body: { tokenId }. Response: { jobId }.
+// With ?dryRun=true nothing is submitted, the response is what it would affect.
 func (v *VehiclesController) SubmitSharedAccountDelete(c *fiber.Ctx) error {
+	if c.QueryBool("dryRun") {
+		return v.dryRun(c, "delete", dryRunSharedTarget)
+	}
+	if val := validateSharedTokenRequest(c); !val.ok() {
+		return val.respond(c)
+	}
 	u := GetOracleURL(c, v.settings)
 
 	targetURL := u.JoinPath("/v1/vehicle/delete/shared")
-	return ProxyRequest(c, targetURL, c.Body(), v.logger)
+	if err := ProxyRequest(c, targetURL, c.Body(), v.logger); err != nil {
+		return err
+	}
+	v.trackSharedJob(c, service.JobDelete, v.invalidateSharedVehicle(c))
+	return nil
 }
 
-func (v *VehiclesController) SubmitCommand(c *fiber.Ctx) error {
-	imei := c.Params("imei", "")
+// invalidateSharedVehicle drops the cached identity of the vehicle in a shared account request once the oracle has
+// accepted it. Returns the vehicle's token id, empty when the oracle refused.
+func (v *VehiclesController) invalidateSharedVehicle(c *fiber.Ctx) string {
+	if c.Response().StatusCode() >= fiber.StatusMultipleChoices {
+		return ""
+	}
+	var req sharedAccountRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil || req.TokenID == "" {
+		return ""
+	}
+	v.identityAPI.InvalidateVehicle(req.TokenID.String())
+	return req.TokenID.String()
+}
 
+// trackSharedJob tracks a shared account disconnect or delete. Their status is polled by vin, which the request
+// doesn't have, so it's read from the fleet vehicle.
+func (v *VehiclesController) trackSharedJob(c *fiber.Ctx, kind service.JobKind, tokenID string) {
+	if v.jobs == nil || tokenID == "" {
+		return
+	}
+	job := service.Job{Kind: kind, OracleJobID: responseJobID(c), TokenID: tokenID}
 	u := GetOracleURL(c, v.settings)
-	targetURL := u.JoinPath(fmt.Sprintf("/v1/pending-vehicle/command/%s", imei))
-	return ProxyRequest(c, targetURL, c.Body(), v.logger)
+	vehicleStatus, vehicleBody, err := upstreamCall(c, fiber.MethodGet, u.JoinPath("/v1/fleet/vehicles", tokenID), nil)
+	var vehicle map[string]any
+	if err == nil && vehicleStatus == fiber.StatusOK && json.Unmarshal(vehicleBody, &vehicle) == nil {
+		job.VIN = itemString(vehicle, "vin")
+	}
+	if job.VIN == "" {
+		v.logger.Warn().Str("tokenId", tokenID).Msg("no vin for shared account job, polling it by job id")
+	}
+	trackJobs(c, v.jobs, job)
 }
@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+// VINChunkError is a chunk of a VIN list lookup the oracle didn't answer
+type VINChunkError struct {
+	VINs    []string `json:"vins"`
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+}
+
+// proxyVINList proxies a GET that takes a comma separated vins query param to path. Short lists go through as one
+// request. Longer ones are split into chunks of VIN_CHUNK_SIZE, requested in parallel, and the lists under field of
+// the responses are merged into one, in the order the vins were asked for. A chunk that fails fails the response,
+// with the status of the first failed chunk: callers read the list as the status of every vin, and a vin missing from
+// it must not pass for one that went through. The failed chunks are listed under chunkErrors, next to what the other
+// chunks answered.
+func proxyVINList(c *fiber.Ctx, s *config.Settings, logger *zerolog.Logger, path string, query url.Values, field string) error {
+	u := GetOracleURL(c, s)
+	vins := splitVINs(query.Get("vins"))
+	if len(vins) <= s.GetVinChunkSize() {
+		targetURL := u.JoinPath(path)
+		targetURL.RawQuery = query.Encode()
+		return ProxyRequest(c, targetURL, nil, logger)
+	}
+
+	chunks, results, err := sendVINChunks(c, s, u, path, query, vins)
+	if err != nil {
+		return err
+	}
+
+	merged := map[string]json.RawMessage{}
+	items := []json.RawMessage{}
+	var chunkErrors []VINChunkError
+	for i, r := range results {
+		var res map[string]json.RawMessage
+		var list []json.RawMessage
+		switch {
+		case r.err != nil:
+			logger.Err(r.err).Str("path", path).Int("chunk", i).Msg("failed to send vin chunk request")
+			chunkErrors = append(chunkErrors, VINChunkError{VINs: chunks[i], Status: fiber.StatusBadGateway, Message: "failed to send request"})
+			continue
+		case r.status < fiber.StatusOK || r.status >= fiber.StatusMultipleChoices:
+			chunkErrors = append(chunkErrors, VINChunkError{VINs: chunks[i], Status: r.status, Message: upstreamMessage(r.body)})
+			continue
+		case json.Unmarshal(r.body, &res) != nil || json.Unmarshal(res[field], &list) != nil:
+			chunkErrors = append(chunkErrors, VINChunkError{VINs: chunks[i], Status: fiber.StatusBadGateway, Message: "unexpected response"})
+			continue
+		}
+		for k, v := range res {
+			if _, ok := merged[k]; !ok {
+				merged[k] = v
+			}
+		}
+		items = append(items, list...)
+	}
+	c.Set("X-Proxied-By", "b2b-fleet-mgr-api")
+	sortByVIN(items, vins)
+	if merged[field], err = json.Marshal(items); err != nil {
+		return err
+	}
+	if len(chunkErrors) == 0 {
+		return c.JSON(merged)
+	}
+
+	failed := 0
+	for _, ce := range chunkErrors {
+		failed += len(ce.VINs)
+	}
+	first := chunkErrors[0]
+	merged["code"], _ = json.Marshal(first.Status)
+	merged["message"], _ = json.Marshal(fmt.Sprintf("%d of %d vins weren't answered: %s", failed, len(vins),
+		cmp.Or(first.Message, http.StatusText(first.Status))))
+	if merged["chunkErrors"], err = json.Marshal(chunkErrors); err != nil {
+		return err
+	}
+	return c.Status(first.Status).JSON(merged)
+}
+
+// vinChunkResult is the oracle's answer to one chunk of a VIN list lookup
+type vinChunkResult struct {
+	status int
+	body   []byte
+	err    error
+}
+
+// sendVINChunks splits vins into chunks of VIN_CHUNK_SIZE and GETs path for each, with the chunk as the vins query
+// param, VIN_CHUNK_CONCURRENCY at a time. The results are in the order of the chunks.
+func sendVINChunks(c *fiber.Ctx, s *config.Settings, u *url.URL, path string, query url.Values, vins []string) ([][]string, []vinChunkResult, error) {
+	// requests are built here, the goroutines below only send them
+	chunks := slices.Collect(slices.Chunk(vins, s.GetVinChunkSize()))
+	reqs := make([]*http.Request, len(chunks))
+	for i, chunk := range chunks {
+		q := maps.Clone(query)
+		if q == nil {
+			q = url.Values{}
+		}
+		q.Set("vins", strings.Join(chunk, ","))
+		targetURL := u.JoinPath(path)
+		targetURL.RawQuery = q.Encode()
+		req, _, err := newUpstreamRequest(c, fiber.MethodGet, targetURL, nil)
+		if err != nil {
+			return nil, nil, fiber.NewError(fiber.StatusInternalServerError, "failed to create request")
+		}
+		reqs[i] = req
+	}
+	results := make([]vinChunkResult, len(chunks))
+	var group errgroup.Group
+	group.SetLimit(s.GetVinChunkConcurrency())
+	for i, req := range reqs {
+		group.Go(func() error {
+			results[i].status, results[i].body, results[i].err = doUpstream(req)
+			return nil
+		})
+	}
+	_ = group.Wait()
+	return chunks, results, nil
+}
+
+// sortByVIN puts items, objects with a vin, in the order of vins. Items with a vin not in the list go last.
+func sortByVIN(items []json.RawMessage, vins []string) {
+	position := make(map[string]int, len(vins))
+	for i, vin := range vins {
+		position[strings.ToUpper(vin)] = i
+	}
+	type positioned struct {
+		item json.RawMessage
+		at   int
+	}
+	sorted := make([]positioned, len(items))
+	for i, item := range items {
+		sorted[i] = positioned{item: item, at: len(vins)}
+		var v struct {
+			VIN string `json:"vin"`
+		}
+		if json.Unmarshal(item, &v) == nil {
+			if at, ok := position[strings.ToUpper(v.VIN)]; ok {
+				sorted[i].at = at
+			}
+		}
+	}
+	slices.SortStableFunc(sorted, func(a, b positioned) int { return a.at - b.at })
+	for i, p := range sorted {
+		items[i] = p.item
+	}
+}
+
+// upstreamMessage is the error message of an upstream response, or the start of its body
+func upstreamMessage(body []byte) string {
+	var res struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(body, &res) == nil && (res.Message != "" || res.Error != "") {
+		return cmp.Or(res.Message, res.Error)
+	}
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 200 {
+		msg = msg[:200]
+	}
+	return msg
+}
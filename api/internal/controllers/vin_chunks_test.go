@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+func TestProxyVINList(t *testing.T) {
+	var calls atomic.Int32
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		vins := strings.Split(r.URL.Query().Get("vins"), ",")
+		switch {
+		case len(vins) > 2:
+			w.WriteHeader(http.StatusRequestURITooLong)
+		case r.URL.Path == "/v1/vehicle/mint/status", slices.Contains(vins, "WVWZZZ1JZXW000003"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"message":"busy"}`))
+		default:
+			// answered out of order
+			var statuses []map[string]string
+			for _, vin := range slices.Backward(vins) {
+				statuses = append(statuses, map[string]string{"vin": vin, "status": "Success"})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"statuses": statuses, "checkedAt": "now"})
+		}
+	}))
+	defer oracle.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	settings := &config.Settings{KaufmannOracleAPIURL: *u, VinChunkSize: 2, VinChunkConcurrency: 2}
+	logger := zerolog.Nop()
+	ctrl := NewVehiclesController(settings, &logger, service.NewIdentityAPIService(logger, "", service.IdentityCacheConfig{}), nil)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("oracleID", settings.GetOracles()[0].OracleID)
+		return c.Next()
+	})
+	app.Get("/vehicle/verify", ctrl.GetVehiclesVerificationStatus)
+	app.Get("/vehicle/mint/status", ctrl.GetVehiclesMintStatus)
+
+	type result struct {
+		Statuses []struct {
+			VIN string `json:"vin"`
+		} `json:"statuses"`
+		CheckedAt   string          `json:"checkedAt"`
+		Message     string          `json:"message"`
+		ChunkErrors []VINChunkError `json:"chunkErrors"`
+	}
+	get := func(path string) (int, result) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res result
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+	vins := "WVWZZZ1JZXW000001,WVWZZZ1JZXW000002,WVWZZZ1JZXW000003,WVWZZZ1JZXW000004,WVWZZZ1JZXW000005"
+
+	status, res := get("/vehicle/verify?vins=" + vins)
+	var got []string
+	for _, s := range res.Statuses {
+		got = append(got, s.VIN)
+	}
+	// the onboarding flow takes any 2xx list as the status of every vin, so a failed chunk fails the whole answer
+	if status != http.StatusServiceUnavailable || res.Message != "2 of 5 vins weren't answered: busy" {
+		t.Errorf("expected the failed chunk to fail the response, got %d %q", status, res.Message)
+	}
+	if strings.Join(got, ",") != "WVWZZZ1JZXW000001,WVWZZZ1JZXW000002,WVWZZZ1JZXW000005" || res.CheckedAt != "now" {
+		t.Errorf("expected the answered chunks merged in order, got %v", res)
+	}
+	if len(res.ChunkErrors) != 1 || res.ChunkErrors[0].Status != http.StatusServiceUnavailable || res.ChunkErrors[0].Message != "busy" ||
+		strings.Join(res.ChunkErrors[0].VINs, ",") != "WVWZZZ1JZXW000003,WVWZZZ1JZXW000004" {
+		t.Errorf("expected the failed chunk reported, got %+v", res.ChunkErrors)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 chunks, got %d calls", calls.Load())
+	}
+
+	// a short list goes through as is
+	status, res = get("/vehicle/verify?vins=WVWZZZ1JZXW000001,WVWZZZ1JZXW000002")
+	if status != http.StatusOK || len(res.Statuses) != 2 || res.Statuses[0].VIN != "WVWZZZ1JZXW000002" || res.ChunkErrors != nil {
+		t.Errorf("expected the upstream response, got %d %+v", status, res)
+	}
+
+	status, res = get("/vehicle/mint/status?vins=" + vins)
+	if status != http.StatusServiceUnavailable || len(res.ChunkErrors) != 3 {
+		t.Errorf("expected every chunk failed, got %d %+v", status, res)
+	}
+}
@@ -0,0 +1,141 @@
+// Package logging masks personal data before it reaches the logs. The Writer sits under zerolog and rewrites each
+// log line, so call sites don't have to remember to redact what they log.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	emailPattern   = regexp.MustCompile(`[A-Za-z0-9._+-]+(?:@|%40)[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	vinPattern     = regexp.MustCompile(`(?i)\b[A-HJ-NPR-Z0-9]{17}\b`)
+	addressPattern = regexp.MustCompile(`\b0x([0-9a-fA-F]{4})[0-9a-fA-F]{32}([0-9a-fA-F]{4})\b`)
+	hasLetter      = regexp.MustCompile(`[A-Za-z]`)
+	hasDigit       = regexp.MustCompile(`[0-9]`)
+)
+
+// Redactor masks configured query params and JSON fields, and anything shaped like an email, VIN or wallet
+// address wherever it appears in a string.
+type Redactor struct {
+	fields  map[string]bool
+	queryRe *regexp.Regexp
+}
+
+func NewRedactor(settings *config.Settings) *Redactor {
+	r := &Redactor{fields: map[string]bool{}}
+	for _, f := range settings.GetLogRedactFields() {
+		r.fields[strings.ToLower(f)] = true
+	}
+	params := settings.GetLogRedactQueryParams()
+	quoted := make([]string, len(params))
+	for i, p := range params {
+		quoted[i] = regexp.QuoteMeta(p)
+	}
+	r.queryRe = regexp.MustCompile(`(?i)([?&](?:` + strings.Join(quoted, "|") + `)=)[^&#\s"]*`)
+	return r
+}
+
+// String masks a free text value: query params first, then emails, VINs and addresses wherever they appear,
+// path segments included.
+func (r *Redactor) String(s string) string {
+	s = r.queryRe.ReplaceAllString(s, "${1}"+redacted)
+	s = emailPattern.ReplaceAllString(s, "[EMAIL]")
+	s = vinPattern.ReplaceAllStringFunc(s, maskVIN)
+	// keep the ends of an address, enough to tell two apart when debugging
+	s = addressPattern.ReplaceAllString(s, "0x${1}…${2}")
+	return s
+}
+
+// maskVIN keeps the last 4 characters. A 17 character id without both letters and digits is most likely not a VIN.
+func maskVIN(s string) string {
+	if !hasLetter.MatchString(s) || !hasDigit.MatchString(s) {
+		return s
+	}
+	return strings.Repeat("*", 13) + s[13:]
+}
+
+// Value redacts a decoded JSON value. Strings holding a JSON document, eg. a logged request body, are decoded and
+// redacted field by field too.
+func (r *Redactor) Value(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if r.fields[strings.ToLower(k)] {
+				t[k] = redacted
+				continue
+			}
+			t[k] = r.Value(val)
+		}
+		return t
+	case []any:
+		for i, val := range t {
+			t[i] = r.Value(val)
+		}
+		return t
+	case string:
+		trimmed := strings.TrimSpace(t)
+		if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			if doc, err := decode([]byte(trimmed)); err == nil {
+				if out, err := encode(r.Value(doc)); err == nil {
+					return strings.TrimSuffix(string(out), "\n")
+				}
+			}
+		}
+		return r.String(t)
+	}
+	return v
+}
+
+// Writer redacts each zerolog line before passing it on
+type Writer struct {
+	out io.Writer
+	r   *Redactor
+}
+
+func NewWriter(out io.Writer, r *Redactor) *Writer {
+	return &Writer{out: out, r: r}
+}
+
+// Write expects one JSON object per call, which is how zerolog writes. Anything else is redacted as plain text.
+func (w *Writer) Write(p []byte) (int, error) {
+	var line []byte
+	if doc, err := decode(p); err == nil {
+		line, _ = encode(w.r.Value(doc))
+	}
+	if line == nil {
+		line = []byte(w.r.String(string(p)))
+	}
+	if _, err := w.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func decode(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// encode is json.Marshal without the html escaping, which would turn every & in a logged URL into \u0026
+func encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
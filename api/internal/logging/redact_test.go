@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/config"
+	"github.com/rs/zerolog"
+)
+
+func TestWriter_Prod(t *testing.T) {
+	const (
+		vin    = "1HGCM82633A004352"
+		email  = "jane.doe@example.com"
+		wallet = "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+	)
+	settings := &config.Settings{Environment: "prod"}
+	if !settings.RedactLogs() {
+		t.Fatal("expected redaction to default on in prod")
+	}
+	var buf bytes.Buffer
+	logger := zerolog.New(NewWriter(&buf, NewRedactor(settings)))
+
+	logger.Info().Str("url", "https://oracle/v1/vehicle/mint?vins="+vin+",1hgcm82633a004353&owner_address="+wallet+"&page=2").Msg("proxying")
+	logger.Info().Str("path", "/v1/vehicle/"+strings.ToLower(vin)).Msg("proxying")
+	logger.Info().Str("path", "/v1/accounts/"+strings.Replace(email, "@", "%40", 1)).Msg("lookup")
+	logger.Err(errors.New("no account for "+email)).Str("wallet", wallet).Int("tokenId", 42).Send()
+	logger.Debug().RawJSON("body", []byte(`{"vinMintingData":[{"vin":"`+vin+`","typedData":{}}],"note":"`+email+`"}`)).Msg("body")
+	logger.Debug().Str("body", `{"email":"`+email+`","nested":{"VIN":"`+vin+`"}}`).Msg("body as text")
+	logger.Warn().Msgf("vehicle %s owned by %s", vin, wallet)
+
+	out := buf.String()
+	for _, leak := range []string{vin, strings.ToLower(vin), email, "jane.doe", wallet, `"tokenId":42`} {
+		if strings.Contains(out, leak) {
+			t.Errorf("%q leaked into the logs:\n%s", leak, out)
+		}
+	}
+	for _, keep := range []string{"page=2", "4352", "0x5aAe…eAed", "proxying"} {
+		if !strings.Contains(out, keep) {
+			t.Errorf("expected %q to survive redaction:\n%s", keep, out)
+		}
+	}
+}
+
+func TestRedactLogs(t *testing.T) {
+	tests := []struct {
+		env, setting string
+		want         bool
+	}{
+		{env: "prod", want: true},
+		{env: "prod", setting: "false", want: false},
+		{env: "dev", want: false},
+		{env: "dev", setting: "true", want: true},
+	}
+	for _, tt := range tests {
+		s := &config.Settings{Environment: tt.env, LogRedaction: tt.setting}
+		if got := s.RedactLogs(); got != tt.want {
+			t.Errorf("RedactLogs() env %s setting %q = %v, want %v", tt.env, tt.setting, got, tt.want)
+		}
+	}
+}
+
+func TestRedactor_String(t *testing.T) {
+	r := NewRedactor(&config.Settings{LogRedactQueryParams: "plate"})
+	tests := []struct {
+		in, want string
+	}{
+		{in: "/v1/pending-vehicles?search=jane&plate=ABC123&take=10", want: "/v1/pending-vehicles?search=[REDACTED]&plate=[REDACTED]&take=10"},
+		{in: "order 12345678901234567 done", want: "order 12345678901234567 done"},
+		{in: "tx 0x" + strings.Repeat("ab", 32), want: "tx 0x" + strings.Repeat("ab", 32)},
+	}
+	for _, tt := range tests {
+		if got := r.String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
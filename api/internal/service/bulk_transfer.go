@@ -0,0 +1,450 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+// BulkRowState is where a row of a bulk transfer is. Succeeded and failed come from the row's tracked job.
+type BulkRowState string
+
+const (
+	BulkRowPending BulkRowState = "pending"
+	// BulkRowSubmitting is a row whose transfer is being posted. One left so by a restart may or may not have been
+	// accepted, so resuming leaves it alone unless asked to retry it.
+	BulkRowSubmitting BulkRowState = "submitting"
+	BulkRowSubmitted  BulkRowState = "submitted"
+	BulkRowSucceeded  BulkRowState = "succeeded"
+	BulkRowFailed     BulkRowState = "failed"
+)
+
+// BulkRunState is where a bulk transfer is as a whole
+type BulkRunState string
+
+const (
+	BulkRunRunning BulkRunState = "running"
+	// BulkRunInterrupted is a run that stopped with rows left to submit, as the BFF restarted or the oracle refused
+	// the submitter's credentials. Resuming it submits what's left.
+	BulkRunInterrupted BulkRunState = "interrupted"
+	// BulkRunSubmitted is a run with every row submitted or failed. Submitted rows finish as their jobs do.
+	BulkRunSubmitted BulkRunState = "submitted"
+)
+
+var (
+	ErrBulkTransferNotFound = errors.New("bulk transfer not found")
+	ErrBulkTransferRunning  = errors.New("bulk transfer is already running")
+	ErrNothingToResume      = errors.New("every row has succeeded or is still in flight")
+)
+
+// BulkTransferRow is one vehicle of a bulk transfer
+type BulkTransferRow struct {
+	// Row is the 1 based position in the upload
+	Row                 int          `json:"row"`
+	TokenID             string       `json:"tokenId"`
+	TargetWalletAddress string       `json:"targetWalletAddress"`
+	State               BulkRowState `json:"state"`
+	// JobID is the tracker's job for the transfer, see JobTracker
+	JobID       string    `json:"jobId,omitempty"`
+	OracleJobID string    `json:"oracleJobId,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Attempts    int       `json:"attempts"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// BulkTransfer is a run of shared account transfers from an uploaded list. Rows is left out of listings.
+type BulkTransfer struct {
+	ID        string               `json:"id"`
+	OracleID  string               `json:"oracleId"`
+	TenantID  string               `json:"tenantId,omitempty"`
+	Subject   string               `json:"subject,omitempty"`
+	State     BulkRunState         `json:"state"`
+	Detail    string               `json:"detail,omitempty"`
+	Counts    map[BulkRowState]int `json:"counts"`
+	Rows      []BulkTransferRow    `json:"rows,omitempty"`
+	CreatedAt time.Time            `json:"createdAt"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+}
+
+// BulkTransferConfig configures the runner. Zero values take the defaults.
+type BulkTransferConfig struct {
+	// StorePath is the JSONL file runs are recorded in, and reloaded from on start
+	StorePath string
+	// OracleURLs are the oracle base urls by oracle id
+	OracleURLs map[string]url.URL
+	// Concurrency is how many transfers are submitted at once, default 4
+	Concurrency int
+	// Pace is the least time between two submissions, default 500ms, so a run doesn't crowd out the tenant's signer
+	Pace time.Duration
+	// OnSubmitted is called with the token id of every transfer the oracle accepted
+	OnSubmitted func(tokenID string)
+	// Retention is how long a run is kept once every row was submitted, default 30 days
+	Retention time.Duration
+}
+
+// BulkTransferRunner submits shared account transfers for a list of vehicles in the background and hands each
+// accepted one to the job tracker. Every row's progress is recorded, so a run interrupted by a restart is resumed
+// where it stopped rather than from the top.
+type BulkTransferRunner struct {
+	logger zerolog.Logger
+	config BulkTransferConfig
+	jobs   *JobTracker
+	store  *runStore[BulkTransfer, BulkTransferRow]
+	client *http.Client
+	now    func() time.Time
+
+	mu   sync.Mutex
+	runs map[string]*bulkRun
+}
+
+type bulkRun struct {
+	run     BulkTransfer
+	running bool
+}
+
+// NewBulkTransferRunner loads the runs in the store. Runs that were going when the BFF stopped are interrupted, those
+// submitted more than Retention ago are dropped, and the store is compacted down to the latest state of the rest.
+func NewBulkTransferRunner(logger zerolog.Logger, config BulkTransferConfig, jobs *JobTracker) *BulkTransferRunner {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 4
+	}
+	if config.Pace <= 0 {
+		config.Pace = 500 * time.Millisecond
+	}
+	if config.Retention <= 0 {
+		config.Retention = 30 * 24 * time.Hour
+	}
+	r := &BulkTransferRunner{
+		logger: logger,
+		config: config,
+		jobs:   jobs,
+		store:  newRunStore[BulkTransfer](config.StorePath, func(row BulkTransferRow) int { return row.Row }),
+		client: &http.Client{Timeout: 30 * time.Second},
+		now:    time.Now,
+		runs:   map[string]*bulkRun{},
+	}
+	stored, err := r.store.load()
+	for id, sr := range stored {
+		run := sr.Run
+		run.Rows = sr.Rows
+		r.runs[id] = &bulkRun{run: run}
+	}
+	if err != nil {
+		logger.Err(err).Msg("failed to load bulk transfers")
+	}
+	for _, br := range r.runs {
+		if br.run.State == BulkRunRunning {
+			br.run.State = BulkRunInterrupted
+			br.run.Detail = "the BFF restarted, resume to submit the remaining rows"
+		}
+		for i, row := range br.run.Rows {
+			if row.State == BulkRowSubmitting {
+				br.run.Rows[i].Error = "the BFF restarted while submitting, check the vehicle's owner before retrying it"
+			}
+		}
+	}
+	if err == nil {
+		r.compactLocked(1)
+	}
+	return r
+}
+
+// Start records a new run of run.Rows and submits them in the background with creds
+func (r *BulkTransferRunner) Start(run BulkTransfer, creds JobCredentials) BulkTransfer {
+	now := r.now()
+	run.ID = newJobID()
+	run.State = BulkRunRunning
+	run.CreatedAt, run.UpdatedAt = now, now
+	rows := make([]BulkTransferRow, len(run.Rows))
+	for i, row := range run.Rows {
+		rows[i] = BulkTransferRow{
+			Row: i + 1, TokenID: row.TokenID, TargetWalletAddress: row.TargetWalletAddress, State: BulkRowPending, UpdatedAt: now,
+		}
+	}
+	run.Rows = rows
+
+	r.mu.Lock()
+	br := &bulkRun{run: run, running: true}
+	r.runs[run.ID] = br
+	r.storeRunLocked(br)
+	for _, row := range run.Rows {
+		r.storeRowLocked(run.ID, row)
+	}
+	r.compactLocked(2)
+	res := r.snapshotLocked(br)
+	r.mu.Unlock()
+
+	go r.execute(run.ID, creds)
+	return res
+}
+
+// Resume submits the rows of an interrupted or finished run that haven't succeeded and aren't in flight, failed ones
+// included, with the caller's creds. Rows left submitting by a restart are only submitted again with
+// retrySubmitting, once the caller has checked they weren't transferred. Submitted rows awaiting credentials are
+// picked up by the job tracker.
+func (r *BulkTransferRunner) Resume(id, subject string, creds JobCredentials, retrySubmitting bool) (BulkTransfer, error) {
+	r.mu.Lock()
+	br, ok := r.runs[id]
+	if !ok {
+		r.mu.Unlock()
+		return BulkTransfer{}, ErrBulkTransferNotFound
+	}
+	if br.running {
+		r.mu.Unlock()
+		return BulkTransfer{}, ErrBulkTransferRunning
+	}
+	r.syncLocked(br)
+	now := r.now()
+	retry := 0
+	for i, row := range br.run.Rows {
+		if row.State == BulkRowPending || row.State == BulkRowFailed || (row.State == BulkRowSubmitting && retrySubmitting) {
+			br.run.Rows[i].State = BulkRowPending
+			br.run.Rows[i].UpdatedAt = now
+			r.storeRowLocked(id, br.run.Rows[i])
+			retry++
+		}
+	}
+	run := br.run
+	if retry == 0 {
+		r.mu.Unlock()
+		r.jobs.Authorize(run.OracleID, run.TenantID, subject, creds)
+		return r.snapshot(id), ErrNothingToResume
+	}
+	br.running = true
+	br.run.State = BulkRunRunning
+	br.run.Detail = ""
+	br.run.UpdatedAt = now
+	r.storeRunLocked(br)
+	res := r.snapshotLocked(br)
+	r.mu.Unlock()
+
+	r.jobs.Authorize(run.OracleID, run.TenantID, subject, creds)
+	go r.execute(id, creds)
+	return res, nil
+}
+
+// Get returns a run with its rows
+func (r *BulkTransferRunner) Get(id string) (BulkTransfer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	br, ok := r.runs[id]
+	if !ok {
+		return BulkTransfer{}, false
+	}
+	r.syncLocked(br)
+	return r.snapshotLocked(br), true
+}
+
+// List returns the runs of a tenant, without their rows, newest first
+func (r *BulkTransferRunner) List(oracleID, tenantID string) []BulkTransfer {
+	r.mu.Lock()
+	var runs []BulkTransfer
+	for _, br := range r.runs {
+		if br.run.OracleID != oracleID || br.run.TenantID != tenantID {
+			continue
+		}
+		r.syncLocked(br)
+		run := r.snapshotLocked(br)
+		run.Rows = nil
+		runs = append(runs, run)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(runs, func(a, b BulkTransfer) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return runs
+}
+
+func (r *BulkTransferRunner) snapshot(id string) BulkTransfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.snapshotLocked(r.runs[id])
+}
+
+// snapshotLocked copies a run for the caller, counting its rows
+func (r *BulkTransferRunner) snapshotLocked(br *bulkRun) BulkTransfer {
+	run := br.run
+	run.Rows = slices.Clone(br.run.Rows)
+	run.Counts = map[BulkRowState]int{}
+	for _, row := range run.Rows {
+		run.Counts[row.State]++
+	}
+	return run
+}
+
+// syncLocked settles submitted rows whose jobs have finished
+func (r *BulkTransferRunner) syncLocked(br *bulkRun) {
+	for i, row := range br.run.Rows {
+		if row.State != BulkRowSubmitted || row.JobID == "" {
+			continue
+		}
+		job, ok := r.jobs.Get(row.JobID)
+		if !ok || !job.State.Final() {
+			continue
+		}
+		row.State, row.Error = BulkRowSucceeded, ""
+		if job.State != JobSucceeded {
+			row.State, row.Error = BulkRowFailed, strings.TrimSpace(string(job.State)+" "+job.Detail)
+		}
+		row.UpdatedAt = r.now()
+		br.run.Rows[i] = row
+		r.storeRowLocked(br.run.ID, row)
+	}
+}
+
+// execute submits the pending rows of a run, a few at a time and no faster than the pace. A refusal of the
+// credentials stops the run, as every following row would be refused too.
+func (r *BulkTransferRunner) execute(id string, creds JobCredentials) {
+	r.mu.Lock()
+	run := r.runs[id].run
+	var pending []BulkTransferRow
+	for _, row := range run.Rows {
+		if row.State == BulkRowPending {
+			pending = append(pending, row)
+		}
+	}
+	r.mu.Unlock()
+
+	group, ctx := errgroup.WithContext(context.Background())
+	group.SetLimit(r.config.Concurrency)
+	pace := time.NewTicker(r.config.Pace)
+	defer pace.Stop()
+submit:
+	for _, row := range pending {
+		select {
+		case <-ctx.Done():
+			break submit
+		case <-pace.C:
+		}
+		group.Go(func() error {
+			if ctx.Err() != nil {
+				// stopped by another row, this one is left pending
+				return nil
+			}
+			row = r.submitting(run.ID, row)
+			// a transfer already posted is seen through, its outcome has to be recorded either way
+			oracleJobID, err := r.submit(context.WithoutCancel(ctx), run, row, creds)
+			r.submitted(run, row, oracleJobID, creds, err)
+			if errors.Is(err, errJobUnauthorized) {
+				return err
+			}
+			return nil
+		})
+	}
+	err := group.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	br := r.runs[id]
+	br.running = false
+	br.run.State, br.run.Detail = BulkRunSubmitted, ""
+	if err != nil {
+		br.run.State = BulkRunInterrupted
+		br.run.Detail = "the oracle refused the submitter's credentials, resume to submit the remaining rows"
+	}
+	br.run.UpdatedAt = r.now()
+	r.storeRunLocked(br)
+	r.compactLocked(2)
+}
+
+// submit asks the oracle for the shared account transfer of a row, returning its job id
+func (r *BulkTransferRunner) submit(ctx context.Context, run BulkTransfer, row BulkTransferRow, creds JobCredentials) (string, error) {
+	base, ok := r.config.OracleURLs[run.OracleID]
+	if !ok {
+		return "", errors.New("unknown oracle " + run.OracleID)
+	}
+	body := map[string]any{"tokenId": json.Number(row.TokenID), "targetWalletAddress": row.TargetWalletAddress}
+	var res struct {
+		JobID string `json:"jobId"`
+	}
+	if err := oracleJSON(ctx, r.client, http.MethodPost, base.JoinPath("/v1/vehicle/transfer/shared"), creds, body, &res); err != nil {
+		return "", err
+	}
+	return res.JobID, nil
+}
+
+// submitting records a row as being posted, before it is, so a restart in between doesn't submit it twice
+func (r *BulkTransferRunner) submitting(id string, row BulkTransferRow) BulkTransferRow {
+	row.State, row.Error = BulkRowSubmitting, ""
+	row.Attempts++
+	row.UpdatedAt = r.now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[id].run.Rows[row.Row-1] = row
+	r.storeRowLocked(id, row)
+	return row
+}
+
+// submitted records the outcome of a row's submission, tracking the job the oracle accepted
+func (r *BulkTransferRunner) submitted(run BulkTransfer, row BulkTransferRow, oracleJobID string, creds JobCredentials, err error) {
+	row.UpdatedAt = r.now()
+	switch {
+	case errors.Is(err, errJobUnauthorized):
+		row.State, row.Error = BulkRowPending, err.Error()
+	case err != nil:
+		row.State, row.Error = BulkRowFailed, err.Error()
+	default:
+		row.State, row.Error, row.OracleJobID = BulkRowSubmitted, "", oracleJobID
+		if r.config.OnSubmitted != nil {
+			r.config.OnSubmitted(row.TokenID)
+		}
+		job := Job{Kind: JobTransfer, OracleID: run.OracleID, TenantID: run.TenantID, Subject: run.Subject,
+			OracleJobID: oracleJobID, TokenID: row.TokenID}
+		row.JobID = r.jobs.Track(job, creds).ID
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	br := r.runs[run.ID]
+	br.run.Rows[row.Row-1] = row
+	br.run.UpdatedAt = row.UpdatedAt
+	r.storeRowLocked(run.ID, row)
+}
+
+// compactLocked drops the runs submitted more than Retention ago, and rewrites the store with the rest once it holds
+// more than factor times the records they take, see runStore.compact
+func (r *BulkTransferRunner) compactLocked(factor int) {
+	cutoff := r.now().Add(-r.config.Retention)
+	runs := make([]storedRun[BulkTransfer, BulkTransferRow], 0, len(r.runs))
+	for id, br := range r.runs {
+		if !br.running && br.run.State == BulkRunSubmitted && br.run.UpdatedAt.Before(cutoff) {
+			delete(r.runs, id)
+			continue
+		}
+		runs = append(runs, storedRun[BulkTransfer, BulkTransferRow]{ID: id, Run: bulkTransferHeader(br.run), Rows: br.run.Rows})
+	}
+	slices.SortFunc(runs, func(a, b storedRun[BulkTransfer, BulkTransferRow]) int {
+		return a.Run.CreatedAt.Compare(b.Run.CreatedAt)
+	})
+	if err := r.store.compact(runs, factor); err != nil {
+		r.logger.Err(err).Msg("failed to compact bulk transfers")
+	}
+}
+
+func (r *BulkTransferRunner) storeRunLocked(br *bulkRun) {
+	if err := r.store.appendRun(br.run.ID, bulkTransferHeader(br.run)); err != nil {
+		r.logger.Err(err).Str("bulkTransferId", br.run.ID).Msg("failed to store bulk transfer")
+	}
+}
+
+func (r *BulkTransferRunner) storeRowLocked(id string, row BulkTransferRow) {
+	if err := r.store.appendRow(id, row); err != nil {
+		r.logger.Err(err).Str("bulkTransferId", id).Int("row", row.Row).Msg("failed to store bulk transfer row")
+	}
+}
+
+// bulkTransferHeader is the run without its rows, as stored
+func bulkTransferHeader(run BulkTransfer) BulkTransfer {
+	run.Rows, run.Counts = nil, nil
+	return run
+}
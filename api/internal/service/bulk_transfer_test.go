@@ -0,0 +1,161 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestBulkTransferRunner(t *testing.T) {
+	var submissions atomic.Int32
+	var refuse, reject atomic.Bool
+	reject.Store(true)
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			TokenID json.Number `json:"tokenId"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case refuse.Load():
+			w.WriteHeader(http.StatusUnauthorized)
+		case req.TokenID == "3" && reject.Load():
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"code":400,"message":"vehicle is not owned by the account"}`))
+		case req.TokenID == "5":
+			// not this account's vehicle to move, which says nothing about the other rows
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"code":403,"message":"vehicle belongs to another tenant"}`))
+		default:
+			submissions.Add(1)
+			_, _ = w.Write([]byte(`{"jobId":"job-` + req.TokenID.String() + `"}`))
+		}
+	}))
+	defer oracle.Close()
+	u, _ := url.Parse(oracle.URL)
+	urls := map[string]url.URL{"kaufmann": *u}
+	dir := t.TempDir()
+	jobs := NewJobTracker(zerolog.Nop(), JobTrackerConfig{StorePath: filepath.Join(dir, "jobs.jsonl"), OracleURLs: urls})
+	var invalidated atomic.Int32
+	config := BulkTransferConfig{
+		StorePath:   filepath.Join(dir, "bulk_transfers.jsonl"),
+		OracleURLs:  urls,
+		Concurrency: 2,
+		Pace:        time.Millisecond,
+		OnSubmitted: func(string) { invalidated.Add(1) },
+	}
+	runner := NewBulkTransferRunner(zerolog.Nop(), config, jobs)
+	creds := JobCredentials{Authorization: "Bearer token", TenantID: "t1"}
+	wait := func(r *BulkTransferRunner, id string) BulkTransfer {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if run, _ := r.Get(id); run.State != BulkRunRunning {
+				return run
+			}
+		}
+		t.Fatal("bulk transfer didn't finish")
+		return BulkTransfer{}
+	}
+	var rows []BulkTransferRow
+	for _, id := range []string{"1", "2", "3", "4"} {
+		rows = append(rows, BulkTransferRow{TokenID: id, TargetWalletAddress: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"})
+	}
+
+	run := runner.Start(BulkTransfer{OracleID: "kaufmann", TenantID: "t1", Subject: "alice", Rows: rows}, creds)
+	if run.State != BulkRunRunning || run.Counts[BulkRowPending] != 4 {
+		t.Fatalf("unexpected new run %+v", run)
+	}
+	run = wait(runner, run.ID)
+	if run.State != BulkRunSubmitted || run.Counts[BulkRowSubmitted] != 3 || run.Counts[BulkRowFailed] != 1 {
+		t.Fatalf("unexpected finished run %+v", run)
+	}
+	if failed := run.Rows[2]; failed.Error != "oracle returned 400: vehicle is not owned by the account" {
+		t.Errorf("expected the oracle's message on the failed row, got %q", failed.Error)
+	}
+	if job, ok := jobs.Get(run.Rows[0].JobID); !ok || job.OracleJobID != "job-1" || job.Subject != "alice" {
+		t.Errorf("expected the transfer tracked, got %+v", job)
+	}
+	if invalidated.Load() != 3 {
+		t.Errorf("expected 3 vehicles invalidated, got %d", invalidated.Load())
+	}
+
+	// a finished job settles its row
+	jobs.polled(run.Rows[0].JobID, JobSucceeded, "completed", nil)
+	if run, _ = runner.Get(run.ID); run.Rows[0].State != BulkRowSucceeded {
+		t.Errorf("expected the first row succeeded, got %+v", run.Rows[0])
+	}
+
+	// after a restart the run is reloaded with its rows, and resuming retries only the failed row
+	reject.Store(false)
+	reloaded := NewBulkTransferRunner(zerolog.Nop(), config, jobs)
+	if again, _ := reloaded.Get(run.ID); len(again.Rows) != 4 || again.Rows[0].State != BulkRowSucceeded || again.Rows[2].State != BulkRowFailed {
+		t.Fatalf("unexpected reloaded run %+v", again)
+	}
+	before := submissions.Load()
+	if _, err := reloaded.Resume(run.ID, "alice", creds, false); err != nil {
+		t.Fatal(err)
+	}
+	run = wait(reloaded, run.ID)
+	if submissions.Load() != before+1 || run.Rows[2].State != BulkRowSubmitted || run.Rows[2].Attempts != 2 {
+		t.Errorf("expected only row 3 submitted again, got %d submissions and %+v", submissions.Load()-before, run.Rows[2])
+	}
+	if _, err := reloaded.Resume(run.ID, "alice", creds, false); err != ErrNothingToResume {
+		t.Errorf("expected nothing to resume, got %v", err)
+	}
+
+	// a forbidden vehicle fails its row only
+	forbidden := wait(runner, runner.Start(BulkTransfer{OracleID: "kaufmann", TenantID: "t1",
+		Rows: append([]BulkTransferRow{{TokenID: "5", TargetWalletAddress: rows[0].TargetWalletAddress}}, rows[:2]...)}, creds).ID)
+	if forbidden.State != BulkRunSubmitted || forbidden.Rows[0].State != BulkRowFailed || forbidden.Counts[BulkRowSubmitted] != 2 {
+		t.Errorf("expected only the forbidden row failed, got %+v", forbidden)
+	}
+
+	// a row the BFF stopped while submitting may have gone through, it's only submitted again when asked to
+	_ = runner.store.appendRow(forbidden.ID, BulkTransferRow{Row: 2, TokenID: "1",
+		TargetWalletAddress: rows[0].TargetWalletAddress, State: BulkRowSubmitting, Attempts: 1})
+	reloaded = NewBulkTransferRunner(zerolog.Nop(), config, jobs)
+	if again, _ := reloaded.Get(forbidden.ID); again.Rows[1].State != BulkRowSubmitting || again.Rows[1].Error == "" {
+		t.Fatalf("expected the row left submitting, got %+v", again.Rows[1])
+	}
+	before = submissions.Load()
+	if _, err := reloaded.Resume(forbidden.ID, "alice", creds, false); err != nil {
+		t.Fatal(err)
+	}
+	if again := wait(reloaded, forbidden.ID); submissions.Load() != before || again.Rows[1].State != BulkRowSubmitting {
+		t.Errorf("expected the submitting row left alone, got %d submissions and %+v", submissions.Load()-before, again.Rows[1])
+	}
+	if _, err := reloaded.Resume(forbidden.ID, "alice", creds, true); err != nil {
+		t.Fatal(err)
+	}
+	if again := wait(reloaded, forbidden.ID); submissions.Load() != before+1 || again.Rows[1].State != BulkRowSubmitted || again.Rows[1].Attempts != 2 {
+		t.Errorf("expected the submitting row retried, got %d submissions and %+v", submissions.Load()-before, again.Rows[1])
+	}
+
+	// refused credentials stop a run with the remaining rows pending
+	refuse.Store(true)
+	stopped := wait(runner, runner.Start(BulkTransfer{OracleID: "kaufmann", TenantID: "t1", Rows: rows}, creds).ID)
+	if stopped.State != BulkRunInterrupted || stopped.Counts[BulkRowPending] != 4 {
+		t.Errorf("expected an interrupted run, got %+v", stopped)
+	}
+	if listed := runner.List("kaufmann", "t1"); len(listed) != 3 || listed[0].ID != stopped.ID || listed[0].Rows != nil {
+		t.Errorf("unexpected listing %+v", listed)
+	}
+
+	// past their retention the submitted runs are dropped, and the store is compacted down to the interrupted one
+	config.Retention = time.Nanosecond
+	later := NewBulkTransferRunner(zerolog.Nop(), config, jobs)
+	if listed := later.List("kaufmann", "t1"); len(listed) != 1 || listed[0].ID != stopped.ID {
+		t.Errorf("expected only the interrupted run kept, got %+v", listed)
+	}
+	records := 0
+	_ = later.store.store.Scan(func(runRecord[BulkTransfer, BulkTransferRow]) bool { records++; return true })
+	if records != 5 {
+		t.Errorf("expected the header and 4 rows stored, got %d records", records)
+	}
+}
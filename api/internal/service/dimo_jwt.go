@@ -1,25 +1,46 @@
 package service
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/DIMO-Network/shared"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// developerJWTCacheFor is how long a JWT is handed out for, 5 minutes short of its 1 hour expiry
+	developerJWTCacheFor = 55 * time.Minute
+	// developerJWTRefreshAhead is how long before the cached JWT runs out the background refresh replaces it, so
+	// callers never wait on a registration
+	developerJWTRefreshAhead = 10 * time.Minute
+	// developerJWTRetry is the wait after a failed background refresh
+	developerJWTRetry = time.Minute
+	// developerJWTLifetime is the exp of the JWTs we sign
+	developerJWTLifetime = time.Hour
+	defaultKeyRotation   = 90 * 24 * time.Hour
+	defaultKeyOverlap    = time.Hour
 )
 
 // DIMOJWTService handles DIMO developer JWT authentication
 type DIMOJWTService interface {
 	GetDeveloperJWT() (string, error)
 	RefreshJWT() (string, error)
+	// Start refreshes the JWT in the background ahead of its expiry, and rotates the signing key when it is due,
+	// until ctx is done
+	Start(ctx context.Context)
+	// RotateKey registers a new signing key now, which takes over signing once the overlap has passed.
+	// ErrKeyStoreReadOnly when the keys come from a secret, which is where they are rotated then.
+	RotateKey() error
 }
 
 type dimoJWTService struct {
@@ -28,8 +49,22 @@ type dimoJWTService struct {
 	clientSecret string
 	httpClient   shared.HTTPClientWrapper
 	logger       zerolog.Logger
+
+	// mu guards the cached JWT, refreshGroup makes concurrent refreshes share one key registration
+	mu           sync.RWMutex
 	cachedJWT    string
 	jwtExpiry    time.Time
+	refreshGroup singleflight.Group
+
+	// keysMu guards the signing keys, loaded from keyStore on first use. Sorted by activation, the last active
+	// one signs and any after it are waiting out the overlap.
+	keysMu      sync.Mutex
+	keyStore    SigningKeyStore
+	keys        []*signingKey
+	keysLoaded  bool
+	readOnly    bool
+	rotateEvery time.Duration
+	overlap     time.Duration
 }
 
 // DIMOJWTConfig holds configuration for DIMO JWT service
@@ -38,6 +73,12 @@ type DIMOJWTConfig struct {
 	ClientID     string
 	ClientSecret string
 	Timeout      time.Duration
+	// KeyStore holds the signing keys, in memory only when nil
+	KeyStore SigningKeyStore
+	// RotateEvery is the signing key's scheduled lifetime, RotationOverlap how long a new key is registered before
+	// it signs. Default 90 days and 1 hour.
+	RotateEvery     time.Duration
+	RotationOverlap time.Duration
 }
 
 // NewDIMOJWTService creates a new DIMO JWT service
@@ -54,111 +95,260 @@ func NewDIMOJWTService(logger zerolog.Logger, config DIMOJWTConfig) DIMOJWTServi
 
 	httpClient, _ := shared.NewHTTPClientWrapper("", "", timeout, headers, false, shared.WithRetry(3))
 
+	keyStore := config.KeyStore
+	if keyStore == nil {
+		keyStore = &memoryKeyStore{}
+	}
+	rotateEvery := config.RotateEvery
+	if rotateEvery == 0 {
+		rotateEvery = defaultKeyRotation
+	}
+	overlap := config.RotationOverlap
+	if overlap == 0 {
+		overlap = defaultKeyOverlap
+	}
+	// a key rotated into a store that can't keep it is gone on the next restart, while DIMO only knows the new one
+	_, readOnly := keyStore.(*staticKeyStore)
+	if readOnly {
+		logger.Info().Msg("DIMO developer JWT signing keys come from a secret, rotate them by updating the secret")
+	}
+
 	return &dimoJWTService{
 		apiURL:       config.APIURL,
 		clientID:     config.ClientID,
 		clientSecret: config.ClientSecret,
 		httpClient:   httpClient,
 		logger:       logger,
+		keyStore:     keyStore,
+		readOnly:     readOnly,
+		rotateEvery:  rotateEvery,
+		overlap:      overlap,
 	}
 }
 
 // GetDeveloperJWT retrieves a valid JWT token, refreshing if necessary
 func (d *dimoJWTService) GetDeveloperJWT() (string, error) {
 	// Check if we have a valid cached JWT
-	if d.cachedJWT != "" && time.Now().Before(d.jwtExpiry) {
-		return d.cachedJWT, nil
+	d.mu.RLock()
+	token, expiry := d.cachedJWT, d.jwtExpiry
+	d.mu.RUnlock()
+	if token != "" && time.Now().Before(expiry) {
+		return token, nil
 	}
 
 	// Generate new JWT
 	return d.RefreshJWT()
 }
 
-// RefreshJWT generates a new JWT token
+// RefreshJWT generates a new JWT token. Callers arriving while a refresh is in flight get its result.
 func (d *dimoJWTService) RefreshJWT() (string, error) {
-	d.logger.Info().Msg("Generating new DIMO developer JWT")
-
-	// Generate ECDSA key pair
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	token, err, _ := d.refreshGroup.Do("refresh", func() (any, error) {
+		return d.generateJWT()
+	})
 	if err != nil {
-		d.logger.Err(err).Msg("Failed to generate ECDSA key pair")
-		return "", fmt.Errorf("failed to generate key pair: %w", err)
+		return "", err
 	}
+	return token.(string), nil
+}
 
-	// Get public key in compressed format
-	publicKeyBytes := elliptic.MarshalCompressed(elliptic.P256(), privateKey.X, privateKey.Y)
-	publicKeyHex := hex.EncodeToString(publicKeyBytes)
+// Start keeps the cached JWT fresh, refreshing developerJWTRefreshAhead before it runs out
+func (d *dimoJWTService) Start(ctx context.Context) {
+	go func() {
+		for {
+			d.mu.RLock()
+			wait := time.Until(d.jwtExpiry.Add(-developerJWTRefreshAhead))
+			d.mu.RUnlock()
+
+			timer := time.NewTimer(max(wait, 0))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if err := d.rotateIfDue(time.Now()); err != nil {
+				d.logger.Err(err).Msg("Scheduled rotation of DIMO developer JWT signing key failed")
+			}
+			if _, err := d.RefreshJWT(); err != nil {
+				d.logger.Err(err).Msg("Background refresh of DIMO developer JWT failed, retrying")
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(developerJWTRetry):
+				}
+			}
+		}
+	}()
+}
+
+// generateJWT does the work of RefreshJWT, only ever run by one caller at a time
+func (d *dimoJWTService) generateJWT() (string, error) {
+	d.logger.Info().Msg("Generating new DIMO developer JWT")
 
-	// Create JWT payload
 	now := time.Now()
-	payload := map[string]interface{}{
+	key, err := d.signingKey(now)
+	if err != nil {
+		d.logger.Err(err).Msg("Failed to get a registered signing key")
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
 		"iss": d.clientID,
 		"sub": d.clientID,
 		"aud": d.apiURL,
 		"iat": now.Unix(),
-		"exp": now.Add(1 * time.Hour).Unix(), // 1 hour expiry
+		"exp": now.Add(developerJWTLifetime).Unix(),
 		"jti": generateJTI(),
+	})
+	token.Header["kid"] = key.kid()
+	signed, err := token.SignedString(key.key)
+	if err != nil {
+		d.logger.Err(err).Msg("Failed to sign JWT")
+		return "", fmt.Errorf("failed to sign JWT: %w", err)
 	}
 
-	// Create JWT header
-	header := map[string]interface{}{
-		"alg": "ES256",
-		"typ": "JWT",
-		"kid": publicKeyHex,
-	}
-
-	// Encode header and payload
-	headerBytes, _ := json.Marshal(header)
-	payloadBytes, _ := json.Marshal(payload)
+	// Cache the JWT
+	d.mu.Lock()
+	d.cachedJWT = signed
+	d.jwtExpiry = now.Add(developerJWTCacheFor)
+	d.mu.Unlock()
 
-	headerB64 := base64.RawURLEncoding.EncodeToString(headerBytes)
-	payloadB64 := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	d.logger.Info().Str("kid", key.kid()).Msg("Successfully generated and cached DIMO developer JWT")
+	return signed, nil
+}
 
-	// Create signing input
-	signingInput := headerB64 + "." + payloadB64
+// signingKey returns the key to sign with, loading the keys on first use and creating and registering one if there
+// are none. Keys superseded by a newer active one are dropped.
+func (d *dimoJWTService) signingKey(now time.Time) (*signingKey, error) {
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
 
-	// Sign the JWT
-	signature, err := d.signJWT(signingInput, privateKey)
-	if err != nil {
-		d.logger.Err(err).Msg("Failed to sign JWT")
-		return "", fmt.Errorf("failed to sign JWT: %w", err)
+	if err := d.loadKeys(now); err != nil {
+		return nil, err
+	}
+	changed := false
+	if len(d.keys) == 0 {
+		key, err := newSigningKey(now, now)
+		if err != nil {
+			return nil, err
+		}
+		d.logger.Info().Str("kid", key.kid()).Msg("No DIMO developer JWT signing key found, created one")
+		d.keys = []*signingKey{key}
+		changed = true
+	}
+	// a key that failed to register earlier, or came from a secret without a record of registration
+	for _, k := range d.keys {
+		if !k.registered() {
+			if err := d.registerPublicKey(k.kid()); err != nil {
+				d.logger.Err(err).Msg("Failed to register public key with DIMO")
+				return nil, fmt.Errorf("failed to register public key: %w", err)
+			}
+			k.registeredAt = now
+			changed = true
+		}
 	}
 
-	signatureB64 := base64.RawURLEncoding.EncodeToString(signature)
-	jwt := signingInput + "." + signatureB64
+	active := 0
+	for i, k := range d.keys {
+		if !k.activateAt.After(now) {
+			active = i
+		}
+	}
+	if active > 0 {
+		d.logger.Info().Str("kid", d.keys[active].kid()).Msg("Rotated DIMO developer JWT signing key")
+		d.keys = d.keys[active:]
+		changed = true
+	}
+	if changed {
+		d.saveKeys()
+	}
+	return d.keys[0], nil
+}
 
-	// Register the public key with DIMO
-	if err := d.registerPublicKey(publicKeyHex); err != nil {
-		d.logger.Err(err).Msg("Failed to register public key with DIMO")
-		return "", fmt.Errorf("failed to register public key: %w", err)
+// RotateKey creates and registers a new key that starts signing after the overlap. The current key keeps signing
+// meanwhile, so nothing verifying our JWTs sees a key it hasn't had time to learn about.
+func (d *dimoJWTService) RotateKey() error {
+	if d.readOnly {
+		return ErrKeyStoreReadOnly
 	}
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
+	return d.rotateLocked(time.Now())
+}
 
-	// Cache the JWT
-	d.cachedJWT = jwt
-	d.jwtExpiry = now.Add(55 * time.Minute) // Cache for 55 minutes (5 min buffer)
+// rotateIfDue rotates once the newest key is older than rotateEvery. Keys from a secret are never due.
+func (d *dimoJWTService) rotateIfDue(now time.Time) error {
+	if d.readOnly {
+		return nil
+	}
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
 
-	d.logger.Info().Msg("Successfully generated and cached DIMO developer JWT")
-	return jwt, nil
+	if err := d.loadKeys(now); err != nil {
+		return err
+	}
+	if len(d.keys) == 0 {
+		// nothing to rotate yet, the first refresh creates the key
+		return nil
+	}
+	if newest := d.keys[len(d.keys)-1]; now.Sub(newest.createdAt) < d.rotateEvery {
+		return nil
+	}
+	return d.rotateLocked(now)
 }
 
-// signJWT signs the JWT using ECDSA
-func (d *dimoJWTService) signJWT(signingInput string, privateKey *ecdsa.PrivateKey) ([]byte, error) {
-	hash := sha256.Sum256([]byte(signingInput))
-
-	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash[:])
+func (d *dimoJWTService) rotateLocked(now time.Time) error {
+	if err := d.loadKeys(now); err != nil {
+		return err
+	}
+	if n := len(d.keys); n > 0 && d.keys[n-1].activateAt.After(now) {
+		d.logger.Info().Msg("DIMO developer JWT signing key rotation already in progress")
+		return nil
+	}
+	key, err := newSigningKey(now, now.Add(d.overlap))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if err := d.registerPublicKey(key.kid()); err != nil {
+		return fmt.Errorf("failed to register public key: %w", err)
+	}
+	key.registeredAt = now
+	d.keys = append(d.keys, key)
+	d.saveKeys()
+	d.logger.Info().Str("kid", key.kid()).Time("activateAt", key.activateAt).
+		Msg("Registered new DIMO developer JWT signing key")
+	return nil
+}
 
-	// Convert to DER format
-	signature := make([]byte, 64)
-	rBytes := r.Bytes()
-	sBytes := s.Bytes()
-
-	copy(signature[32-len(rBytes):32], rBytes)
-	copy(signature[64-len(sBytes):64], sBytes)
+// loadKeys reads the keys from the store once. A key without a creation time starts its rotation schedule now.
+func (d *dimoJWTService) loadKeys(now time.Time) error {
+	if d.keysLoaded {
+		return nil
+	}
+	keys, err := d.keyStore.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	for _, k := range keys {
+		if k.createdAt.IsZero() {
+			k.createdAt = now
+		}
+	}
+	d.keys = keys
+	d.keysLoaded = true
+	return nil
+}
 
-	return signature, nil
+// saveKeys persists the keys. Failing to is not fatal: the key in memory is registered and keeps working, the
+// worst case is registering another key after a restart.
+func (d *dimoJWTService) saveKeys() {
+	err := d.keyStore.Save(d.keys)
+	if errors.Is(err, ErrKeyStoreReadOnly) {
+		d.logger.Warn().Msg("DIMO developer JWT signing keys changed but the key store is read-only, update the secret to keep them")
+	} else if err != nil {
+		d.logger.Err(err).Msg("Failed to save DIMO developer JWT signing keys")
+	}
 }
 
 // registerPublicKey registers the public key with DIMO
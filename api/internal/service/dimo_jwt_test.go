@@ -0,0 +1,272 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+// newFakeRegistration stands in for DIMO's /developer/register-key, counting registrations
+func newFakeRegistration(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var registrations atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ClientID  string `json:"client_id"`
+			PublicKey string `json:"public_key"`
+		}
+		if r.URL.Path != "/developer/register-key" || json.NewDecoder(r.Body).Decode(&body) != nil || body.PublicKey == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		registrations.Add(1)
+		// slow enough that concurrent callers pile up behind the first refresh
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &registrations
+}
+
+func TestDIMOJWTService_ConcurrentCallersShareOneRefresh(t *testing.T) {
+	srv, registrations := newFakeRegistration(t)
+	svc := NewDIMOJWTService(zerolog.Nop(), DIMOJWTConfig{APIURL: srv.URL, ClientID: "0xclient"})
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 20)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jwt, err := svc.GetDeveloperJWT()
+			if err != nil {
+				t.Error(err)
+			}
+			tokens[i] = jwt
+		}(i)
+	}
+	wg.Wait()
+
+	if n := registrations.Load(); n != 1 {
+		t.Errorf("expected one key registration, got %d", n)
+	}
+	for _, jwt := range tokens {
+		if jwt == "" || jwt != tokens[0] {
+			t.Fatalf("expected every caller to get the same JWT")
+		}
+	}
+}
+
+func TestDIMOJWTService_BackgroundRefresh(t *testing.T) {
+	srv, registrations := newFakeRegistration(t)
+	svc := NewDIMOJWTService(zerolog.Nop(), DIMOJWTConfig{APIURL: srv.URL, ClientID: "0xclient"}).(*dimoJWTService)
+
+	first, err := svc.GetDeveloperJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pretend the JWT is about to enter the refresh window
+	svc.mu.Lock()
+	svc.jwtExpiry = time.Now().Add(developerJWTRefreshAhead + 20*time.Millisecond)
+	svc.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc.Start(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		svc.mu.RLock()
+		refreshed := svc.cachedJWT != first
+		svc.mu.RUnlock()
+		if refreshed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := registrations.Load(); n != 1 {
+		t.Fatalf("expected the background refresh to reuse the key, got %d registrations", n)
+	}
+	second, err := svc.GetDeveloperJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Errorf("expected a refreshed JWT")
+	}
+}
+
+// kidOf parses a JWT with the public key of the store's signing key, returning its kid
+func kidOf(t *testing.T, token string, store SigningKeyStore) string {
+	t.Helper()
+	keys, err := store.Load()
+	if err != nil || len(keys) == 0 {
+		t.Fatalf("expected stored keys, got %v", err)
+	}
+	parsed, err := jwt.Parse(token, func(tok *jwt.Token) (any, error) {
+		for _, k := range keys {
+			if k.kid() == tok.Header["kid"] {
+				return &k.key.PublicKey, nil
+			}
+		}
+		return nil, errors.New("unknown kid")
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	if err != nil {
+		t.Fatalf("JWT doesn't verify with a stored key: %v", err)
+	}
+	return parsed.Header["kid"].(string)
+}
+
+func TestDIMOJWTService_PersistentKey(t *testing.T) {
+	srv, registrations := newFakeRegistration(t)
+	store := NewFileKeyStore(filepath.Join(t.TempDir(), "keys", "signing.pem"))
+	cfg := DIMOJWTConfig{APIURL: srv.URL, ClientID: "0xclient", KeyStore: store}
+
+	svc := NewDIMOJWTService(zerolog.Nop(), cfg)
+	var kid string
+	for i := 0; i < 3; i++ {
+		token, err := svc.RefreshJWT()
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil || claims["aud"] != srv.URL {
+			t.Fatalf("unexpected claims %v: %v", claims, err)
+		}
+		k := kidOf(t, token, store)
+		if kid != "" && k != kid {
+			t.Errorf("expected the key to be reused across refreshes")
+		}
+		kid = k
+	}
+
+	// a restart picks up the same, already registered key
+	token, err := NewDIMOJWTService(zerolog.Nop(), cfg).RefreshJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kidOf(t, token, store) != kid {
+		t.Errorf("expected the stored key after a restart")
+	}
+	if n := registrations.Load(); n != 1 {
+		t.Errorf("expected a single registration, got %d", n)
+	}
+}
+
+func TestDIMOJWTService_Rotation(t *testing.T) {
+	srv, registrations := newFakeRegistration(t)
+	store := NewFileKeyStore(filepath.Join(t.TempDir(), "signing.pem"))
+	svc := NewDIMOJWTService(zerolog.Nop(), DIMOJWTConfig{
+		APIURL: srv.URL, ClientID: "0xclient", KeyStore: store,
+		RotateEvery: 24 * time.Hour, RotationOverlap: 200 * time.Millisecond,
+	}).(*dimoJWTService)
+
+	token, err := svc.RefreshJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKid := kidOf(t, token, store)
+
+	// not due yet
+	if err := svc.rotateIfDue(time.Now()); err != nil || registrations.Load() != 1 {
+		t.Fatalf("expected no rotation before it's due, err %v", err)
+	}
+	svc.keysMu.Lock()
+	svc.keys[0].createdAt = time.Now().Add(-25 * time.Hour)
+	svc.keysMu.Unlock()
+	if err := svc.rotateIfDue(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := registrations.Load(); n != 2 {
+		t.Fatalf("expected the new key to be registered, got %d registrations", n)
+	}
+	// a second trigger during the overlap doesn't start another rotation
+	if err := svc.RotateKey(); err != nil || registrations.Load() != 2 {
+		t.Fatalf("expected the rotation in progress to be reused, err %v", err)
+	}
+
+	// during the overlap the old key keeps signing
+	token, err = svc.RefreshJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kidOf(t, token, store) != oldKid {
+		t.Errorf("expected the old key to sign during the overlap")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	token, err = svc.RefreshJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kidOf(t, token, store) == oldKid {
+		t.Errorf("expected the new key to sign after the overlap")
+	}
+	keys, _ := store.Load()
+	if len(keys) != 1 {
+		t.Errorf("expected the retired key to be dropped from the store, got %d keys", len(keys))
+	}
+}
+
+func TestDIMOJWTService_RegistrationFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	store := NewFileKeyStore(filepath.Join(t.TempDir(), "signing.pem"))
+	svc := NewDIMOJWTService(zerolog.Nop(), DIMOJWTConfig{APIURL: srv.URL, ClientID: "0xclient", KeyStore: store})
+
+	if _, err := svc.GetDeveloperJWT(); err == nil {
+		t.Fatal("expected an error while the key can't be registered")
+	}
+	// the unregistered key was never handed out, so nothing was saved
+	if keys, _ := store.Load(); len(keys) != 0 {
+		t.Errorf("expected no stored key, got %d", len(keys))
+	}
+}
+
+func TestDIMOJWTService_StaticKey(t *testing.T) {
+	srv, registrations := newFakeRegistration(t)
+	// a key made with openssl and registered by whoever made the secret, no lifecycle headers
+	key, err := newSigningKey(time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key.key)
+	store := NewStaticKeyStore(string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+	cfg := DIMOJWTConfig{APIURL: srv.URL, ClientID: "0xclient", KeyStore: store, RotateEvery: time.Nanosecond}
+
+	// every boot signs with it straight away
+	for i := 0; i < 2; i++ {
+		svc := NewDIMOJWTService(zerolog.Nop(), cfg).(*dimoJWTService)
+		token, err := svc.RefreshJWT()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kidOf(t, token, store) != key.kid() {
+			t.Errorf("expected the secret's key to sign")
+		}
+		// rotating would lose the new key on the next restart
+		if err := svc.rotateIfDue(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.RotateKey(); !errors.Is(err, ErrKeyStoreReadOnly) {
+			t.Errorf("expected rotation refused, got %v", err)
+		}
+	}
+	if n := registrations.Load(); n != 0 {
+		t.Errorf("expected the secret's key taken as registered, got %d registrations", n)
+	}
+}
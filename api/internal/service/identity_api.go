@@ -5,10 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/DIMO-Network/shared"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 var ErrBadRequest = errors.New("bad request")
@@ -18,25 +24,76 @@ type IdentityAPI interface {
 	GetVehicleByTokenID(id string) ([]byte, error)
 	GetOwnerBy0x(owner string, first int, after string) ([]byte, error)
 	Query(graphqlQuery string) ([]byte, error)
+	// InvalidateVehicle drops the cached vehicle, call it when ownership changes, eg. after a transfer
+	InvalidateVehicle(tokenID string)
+	// GetVehiclesByTokenIDs returns the vehicles found, by token id, in as few requests as it can
+	GetVehiclesByTokenIDs(tokenIDs []uint64) (map[uint64]json.RawMessage, error)
+	// GetVehicleEarnings returns the rewards of each vehicle found, by token id, batched like GetVehiclesByTokenIDs
+	GetVehicleEarnings(tokenIDs []uint64) (map[uint64]VehicleEarnings, error)
+}
+
+// IdentityCacheConfig sets how long lookups are cached. Entries are fresh for the TTL, then served for Stale more
+// while they're refetched in the background. Zero values take the defaults.
+type IdentityCacheConfig struct {
+	// Size is the most entries kept, least recently used go first. Default 5000.
+	Size int
+	// Vehicles carry ownership, which changes. Default fresh for 1m, stale for 10m more.
+	VehicleTTL   time.Duration
+	VehicleStale time.Duration
+	// Definitions hardly ever change. Default fresh for 24h, stale for 7d more.
+	DefinitionTTL   time.Duration
+	DefinitionStale time.Duration
+	// Earnings are paid out weekly. Default fresh for 1h, stale for 24h more.
+	EarningsTTL   time.Duration
+	EarningsStale time.Duration
 }
 
 type identityAPIService struct {
 	apiURL     string
 	httpClient shared.HTTPClientWrapper
 	logger     zerolog.Logger
+
+	cacheConfig IdentityCacheConfig
+	cache       *lruCache
+	fetches     singleflight.Group
+	// batches holds a slot per batched vehicle query in flight
+	batches chan struct{}
 }
 
-func NewIdentityAPIService(logger zerolog.Logger, identityAPIURL string) IdentityAPI {
+func NewIdentityAPIService(logger zerolog.Logger, identityAPIURL string, cacheConfig IdentityCacheConfig) IdentityAPI {
 	h := map[string]string{}
 	h["Content-Type"] = "application/json"
 	hcw, _ := shared.NewHTTPClientWrapper("", "", 10*time.Second, h, false, shared.WithRetry(3))
 
-	// Initialize cache with a default expiration time of 10 minutes and cleanup interval of 15 minutes
+	if cacheConfig.Size <= 0 {
+		cacheConfig.Size = 5000
+	}
+	if cacheConfig.VehicleTTL <= 0 {
+		cacheConfig.VehicleTTL = time.Minute
+	}
+	if cacheConfig.VehicleStale <= 0 {
+		cacheConfig.VehicleStale = 10 * time.Minute
+	}
+	if cacheConfig.DefinitionTTL <= 0 {
+		cacheConfig.DefinitionTTL = 24 * time.Hour
+	}
+	if cacheConfig.DefinitionStale <= 0 {
+		cacheConfig.DefinitionStale = 7 * 24 * time.Hour
+	}
+	if cacheConfig.EarningsTTL <= 0 {
+		cacheConfig.EarningsTTL = time.Hour
+	}
+	if cacheConfig.EarningsStale <= 0 {
+		cacheConfig.EarningsStale = 24 * time.Hour
+	}
 
 	return &identityAPIService{
-		httpClient: hcw,
-		apiURL:     identityAPIURL,
-		logger:     logger,
+		httpClient:  hcw,
+		apiURL:      identityAPIURL,
+		logger:      logger,
+		cacheConfig: cacheConfig,
+		cache:       newLRUCache(cacheConfig.Size),
+		batches:     make(chan struct{}, vehicleBatchConcurrency),
 	}
 }
 
@@ -52,12 +109,7 @@ func (i *identityAPIService) GetDefinitionByID(id string) ([]byte, error) {
   	}
 }`
 
-	body, err := i.Query(graphqlQuery)
-	if err != nil {
-		return nil, err
-	}
-
-	return body, nil
+	return i.cached("definition", "definition:"+id, i.cacheConfig.DefinitionTTL, i.cacheConfig.DefinitionStale, graphqlQuery)
 }
 
 func (i *identityAPIService) GetOwnerBy0x(owner string, first int, after string) ([]byte, error) {
@@ -110,16 +162,183 @@ func (i *identityAPIService) GetOwnerBy0x(owner string, first int, after string)
 
 }
 
-func (i *identityAPIService) GetVehicleByTokenID(id string) ([]byte, error) {
-	// GraphQL query
-	graphqlQuery := `{
-      vehicle(tokenId: ` + id + `) {
+// ownerPageSize is the largest page the identity api serves
+const ownerPageSize = 100
+
+// OwnerVehicle is a vehicle of an owner's inventory, flattened from the identity api's owner query
+type OwnerVehicle struct {
+	TokenID           uint64 `json:"tokenId"`
+	Owner             string `json:"owner"`
+	Make              string `json:"make"`
+	Model             string `json:"model"`
+	Year              int    `json:"year"`
+	AftermarketSerial string `json:"aftermarketSerial,omitempty"`
+	AftermarketOwner  string `json:"aftermarketOwner,omitempty"`
+	SyntheticTokenID  uint64 `json:"syntheticTokenId,omitempty"`
+	ConnectionName    string `json:"connectionName,omitempty"`
+}
+
+// ListOwnerVehicles follows the owner query's cursor until the inventory ends or limit vehicles have been read.
+// truncated says the owner has more than limit.
+func ListOwnerVehicles(api IdentityAPI, owner string, limit int) (vehicles []OwnerVehicle, truncated bool, err error) {
+	after := ""
+	for {
+		body, err := api.GetOwnerBy0x(owner, min(ownerPageSize, limit-len(vehicles)), after)
+		if err != nil {
+			return nil, false, err
+		}
+		var page struct {
+			Data *struct {
+				Vehicles struct {
+					Nodes []struct {
+						Owner             string `json:"owner"`
+						TokenID           uint64 `json:"tokenId"`
+						AftermarketDevice *struct {
+							Serial string `json:"serial"`
+							Owner  string `json:"owner"`
+						} `json:"aftermarketDevice"`
+						SyntheticDevice *struct {
+							TokenID    uint64 `json:"tokenId"`
+							Connection *struct {
+								Name string `json:"name"`
+							} `json:"connection"`
+						} `json:"syntheticDevice"`
+						Definition *struct {
+							Make  string `json:"make"`
+							Model string `json:"model"`
+							Year  int    `json:"year"`
+						} `json:"definition"`
+					} `json:"nodes"`
+					PageInfo struct {
+						EndCursor   string `json:"endCursor"`
+						HasNextPage bool   `json:"hasNextPage"`
+					} `json:"pageInfo"`
+				} `json:"vehicles"`
+			} `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, false, fmt.Errorf("unexpected identity api response: %w", err)
+		}
+		if page.Data == nil {
+			if len(page.Errors) > 0 {
+				return nil, false, fmt.Errorf("identity api: %s", page.Errors[0].Message)
+			}
+			return nil, false, errors.New("identity api returned no data")
+		}
+
+		for _, n := range page.Data.Vehicles.Nodes {
+			v := OwnerVehicle{TokenID: n.TokenID, Owner: n.Owner}
+			if n.Definition != nil {
+				v.Make, v.Model, v.Year = n.Definition.Make, n.Definition.Model, n.Definition.Year
+			}
+			if n.AftermarketDevice != nil {
+				v.AftermarketSerial, v.AftermarketOwner = n.AftermarketDevice.Serial, n.AftermarketDevice.Owner
+			}
+			if n.SyntheticDevice != nil {
+				v.SyntheticTokenID = n.SyntheticDevice.TokenID
+				if n.SyntheticDevice.Connection != nil {
+					v.ConnectionName = n.SyntheticDevice.Connection.Name
+				}
+			}
+			vehicles = append(vehicles, v)
+		}
+		pageInfo := page.Data.Vehicles.PageInfo
+		if !pageInfo.HasNextPage || pageInfo.EndCursor == "" {
+			return vehicles, false, nil
+		}
+		if len(vehicles) >= limit {
+			return vehicles[:limit], true, nil
+		}
+		after = pageInfo.EndCursor
+	}
+}
+
+// sacdPageSize is the most SACDs read per page when a vehicle has more than a vehicle lookup returns
+const sacdPageSize = 100
+
+// SACD is one of a vehicle's grants as the identity api has it, permissions being the hex mask
+type SACD struct {
+	Grantee     string `json:"grantee"`
+	Permissions string `json:"permissions"`
+	ExpiresAt   string `json:"expiresAt"`
+}
+
+// ListVehicleSACDs follows a vehicle's SACD cursor from after until the grants end or limit have been read.
+// truncated says the vehicle has more than limit.
+func ListVehicleSACDs(api IdentityAPI, tokenID uint64, after string, limit int) (sacds []SACD, truncated bool, err error) {
+	for {
+		body, err := api.Query(fmt.Sprintf(`{
+      vehicle(tokenId: %d) {
+        sacds(first: %d, after: %q) {
+          nodes {
+            grantee
+            permissions
+            expiresAt
+          }
+          pageInfo {
+            hasNextPage
+            endCursor
+          }
+        }
+      }
+    }`, tokenID, min(sacdPageSize, limit-len(sacds)), after))
+		if err != nil {
+			return nil, false, err
+		}
+		var page struct {
+			Data *struct {
+				Vehicle *struct {
+					Sacds struct {
+						Nodes    []SACD `json:"nodes"`
+						PageInfo struct {
+							EndCursor   string `json:"endCursor"`
+							HasNextPage bool   `json:"hasNextPage"`
+						} `json:"pageInfo"`
+					} `json:"sacds"`
+				} `json:"vehicle"`
+			} `json:"data"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, false, fmt.Errorf("unexpected identity api response: %w", err)
+		}
+		if page.Data == nil || page.Data.Vehicle == nil {
+			if len(page.Errors) > 0 {
+				return nil, false, fmt.Errorf("identity api: %s", page.Errors[0].Message)
+			}
+			return nil, false, errors.New("identity api returned no vehicle")
+		}
+
+		sacds = append(sacds, page.Data.Vehicle.Sacds.Nodes...)
+		pageInfo := page.Data.Vehicle.Sacds.PageInfo
+		if !pageInfo.HasNextPage || pageInfo.EndCursor == "" {
+			return sacds, false, nil
+		}
+		if len(sacds) >= limit {
+			return sacds[:limit], true, nil
+		}
+		after = pageInfo.EndCursor
+	}
+}
+
+// vehicleFields is what a vehicle lookup returns, single or batched
+const vehicleFields = `{
         id
         owner
     sacds(first:20) {
       nodes {
         grantee
         permissions
+        expiresAt
+      }
+      pageInfo {
+        hasNextPage
+        endCursor
       }
     }
     earnings {
@@ -138,15 +357,262 @@ func (i *identityAPIService) GetVehicleByTokenID(id string) ([]byte, error) {
           model
           year
         }
-      }
+      }`
+
+// vehicleBatchSize is the most vehicles asked for in one aliased query, identity api limits query complexity
+const vehicleBatchSize = 50
+
+// vehicleBatchConcurrency is the most batched vehicle queries in flight at once
+const vehicleBatchConcurrency = 4
+
+func (i *identityAPIService) GetVehicleByTokenID(id string) ([]byte, error) {
+	return i.cached("vehicle", vehicleCacheKey(id), i.cacheConfig.VehicleTTL, i.cacheConfig.VehicleStale, vehicleQuery(id))
+}
+
+func vehicleQuery(id string) string {
+	return `{
+      vehicle(tokenId: ` + id + `) ` + vehicleFields + `
     }`
+}
 
-	body, err := i.Query(graphqlQuery)
+// GetVehiclesByTokenIDs looks up many vehicles at once. Cached vehicles come from the cache, the rest are fetched
+// with aliased queries of up to vehicleBatchSize vehicles, a few at a time. Vehicles the identity api doesn't know
+// are left out of the result.
+func (i *identityAPIService) GetVehiclesByTokenIDs(tokenIDs []uint64) (map[uint64]json.RawMessage, error) {
+	return i.lookupVehicles(vehicleLookup{
+		queryType: "vehicle",
+		fields:    vehicleFields,
+		ttl:       i.cacheConfig.VehicleTTL,
+		staleFor:  i.cacheConfig.VehicleStale,
+	}, tokenIDs)
+}
+
+// vehicleLookup is a set of vehicle fields looked up and cached per vehicle, under <queryType>:<tokenId>
+type vehicleLookup struct {
+	queryType string
+	fields    string
+	ttl       time.Duration
+	staleFor  time.Duration
+}
+
+func (l vehicleLookup) key(tokenID string) string {
+	if n, err := strconv.ParseUint(tokenID, 10, 64); err == nil {
+		tokenID = strconv.FormatUint(n, 10)
+	}
+	return l.queryType + ":" + tokenID
+}
+
+func (l vehicleLookup) query(tokenID string) string {
+	return `{
+      vehicle(tokenId: ` + tokenID + `) ` + l.fields + `
+    }`
+}
+
+// lookupVehicles serves what it can from the cache and fetches the rest in batches. Stale vehicles are served as
+// they are and revalidated in batches in the background.
+func (i *identityAPIService) lookupVehicles(l vehicleLookup, tokenIDs []uint64) (map[uint64]json.RawMessage, error) {
+	res := make(map[uint64]json.RawMessage, len(tokenIDs))
+	var misses, stale []uint64
+	for _, id := range tokenIDs {
+		value, state, refresh := i.cache.get(l.key(strconv.FormatUint(id, 10)))
+		switch state {
+		case cacheMiss:
+			misses = append(misses, id)
+			continue
+		case cacheStale:
+			identityCacheRequests.WithLabelValues(l.queryType, "stale").Inc()
+			if refresh {
+				stale = append(stale, id)
+			}
+		default:
+			identityCacheRequests.WithLabelValues(l.queryType, "hit").Inc()
+		}
+		var cached struct {
+			Data struct {
+				Vehicle json.RawMessage `json:"vehicle"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(value, &cached) == nil {
+			res[id] = cached.Data.Vehicle
+		}
+	}
+	identityCacheRequests.WithLabelValues(l.queryType, "miss").Add(float64(len(misses)))
+
+	if len(stale) > 0 {
+		go func() {
+			if _, err := i.fetchVehicleBatches(l, stale); err != nil {
+				i.logger.Warn().Err(err).Int("vehicles", len(stale)).Msg("failed to revalidate identity cache entries, serving stale")
+				for _, id := range stale {
+					i.cache.refreshFailed(l.key(strconv.FormatUint(id, 10)))
+				}
+			}
+		}()
+	}
+
+	found, err := i.fetchVehicleBatches(l, misses)
 	if err != nil {
 		return nil, err
 	}
+	maps.Copy(res, found)
+	return res, nil
+}
 
-	return body, nil
+// fetchVehicleBatches fetches the vehicles in batches of vehicleBatchSize. Batches from every lookup, in the
+// foreground or revalidating, share the batches limit.
+func (i *identityAPIService) fetchVehicleBatches(l vehicleLookup, tokenIDs []uint64) (map[uint64]json.RawMessage, error) {
+	res := make(map[uint64]json.RawMessage, len(tokenIDs))
+	var mu sync.Mutex
+	group := errgroup.Group{}
+	for start := 0; start < len(tokenIDs); start += vehicleBatchSize {
+		chunk := tokenIDs[start:min(start+vehicleBatchSize, len(tokenIDs))]
+		group.Go(func() error {
+			i.batches <- struct{}{}
+			defer func() { <-i.batches }()
+			found, err := i.fetchVehicleBatch(l, chunk)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			maps.Copy(res, found)
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// fetchVehicleBatch runs one aliased query, v<tokenId>: vehicle(tokenId: <tokenId>), caching each vehicle found as if
+// it had been looked up on its own
+func (i *identityAPIService) fetchVehicleBatch(l vehicleLookup, tokenIDs []uint64) (map[uint64]json.RawMessage, error) {
+	epochs := make(map[uint64]uint64, len(tokenIDs))
+	var query strings.Builder
+	query.WriteString("{")
+	for _, id := range tokenIDs {
+		idStr := strconv.FormatUint(id, 10)
+		epochs[id] = i.cache.epoch(l.key(idStr))
+		query.WriteString("\n  v" + idStr + ": vehicle(tokenId: " + idStr + ") " + l.fields)
+	}
+	query.WriteString("\n}")
+
+	body, err := i.Query(query.String())
+	if err != nil {
+		return nil, err
+	}
+	// unknown vehicles come back as null with an error each, only a response without any data is a failure
+	var gqlRes struct {
+		Data   map[string]json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &gqlRes); err != nil {
+		return nil, fmt.Errorf("unexpected identity api response: %w", err)
+	}
+	if gqlRes.Data == nil && len(gqlRes.Errors) > 0 {
+		return nil, fmt.Errorf("identity api: %s", gqlRes.Errors[0].Message)
+	}
+
+	found := map[uint64]json.RawMessage{}
+	for _, id := range tokenIDs {
+		idStr := strconv.FormatUint(id, 10)
+		v, ok := gqlRes.Data["v"+idStr]
+		if !ok || string(v) == "null" {
+			// eg. the vehicle was burned since it was cached
+			i.cache.invalidate(l.key(idStr))
+			continue
+		}
+		found[id] = v
+		single, err := json.Marshal(map[string]any{"data": map[string]json.RawMessage{"vehicle": v}})
+		if err == nil {
+			i.cache.set(l.key(idStr), epochs[id], single, l.ttl, l.staleFor)
+		}
+	}
+	return found, nil
+}
+
+func (i *identityAPIService) InvalidateVehicle(tokenID string) {
+	i.cache.invalidate(vehicleCacheKey(tokenID))
+}
+
+func vehicleCacheKey(tokenID string) string {
+	if n, err := strconv.ParseUint(tokenID, 10, 64); err == nil {
+		tokenID = strconv.FormatUint(n, 10)
+	}
+	return "vehicle:" + tokenID
+}
+
+// cached answers a query from the cache, fetching on a miss. A stale entry is returned as is while one caller
+// refetches it in the background; concurrent misses for a key share one fetch.
+func (i *identityAPIService) cached(queryType, key string, ttl, staleFor time.Duration, graphqlQuery string) ([]byte, error) {
+	if value, ok := i.fromCache(queryType, key, ttl, staleFor, graphqlQuery); ok {
+		return value, nil
+	}
+	identityCacheRequests.WithLabelValues(queryType, "miss").Inc()
+	return i.fetch(key, ttl, staleFor, graphqlQuery)
+}
+
+// fromCache returns a fresh or stale entry, starting the revalidation of a stale one. Misses are left to the caller,
+// and to count.
+func (i *identityAPIService) fromCache(queryType, key string, ttl, staleFor time.Duration, graphqlQuery string) ([]byte, bool) {
+	value, state, refresh := i.cache.get(key)
+	switch state {
+	case cacheFresh:
+		identityCacheRequests.WithLabelValues(queryType, "hit").Inc()
+		return value, true
+	case cacheStale:
+		identityCacheRequests.WithLabelValues(queryType, "stale").Inc()
+		if refresh {
+			go func() {
+				if _, err := i.fetch(key, ttl, staleFor, graphqlQuery); err != nil {
+					i.logger.Warn().Err(err).Str("key", key).Msg("failed to revalidate identity cache entry, serving stale")
+					i.cache.refreshFailed(key)
+				}
+			}()
+		}
+		return value, true
+	}
+	return nil, false
+}
+
+func (i *identityAPIService) fetch(key string, ttl, staleFor time.Duration, graphqlQuery string) ([]byte, error) {
+	body, err, _ := i.fetches.Do(key, func() (any, error) {
+		epoch := i.cache.epoch(key)
+		body, err := i.Query(graphqlQuery)
+		if err != nil {
+			return nil, err
+		}
+		if cacheableResponse(body) {
+			i.cache.set(key, epoch, body, ttl, staleFor)
+		} else {
+			// eg. the vehicle was burned, stop serving what we had
+			i.cache.invalidate(key)
+		}
+		return body, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body.([]byte), nil
+}
+
+// cacheableResponse is a GraphQL response with data and no errors, eg. not a vehicle that isn't minted yet
+func cacheableResponse(body []byte) bool {
+	var res struct {
+		Data   map[string]json.RawMessage `json:"data"`
+		Errors []json.RawMessage          `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || len(res.Errors) > 0 || len(res.Data) == 0 {
+		return false
+	}
+	for _, v := range res.Data {
+		if string(v) == "null" {
+			return false
+		}
+	}
+	return true
 }
 
 func (i *identityAPIService) Query(graphqlQuery string) ([]byte, error) {
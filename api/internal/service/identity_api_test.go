@@ -0,0 +1,214 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+// newFakeIdentityAPI answers vehicle lookups with owner, which can be changed, and refuses vehicle 404
+func newFakeIdentityAPI(t *testing.T, owner *atomic.Value) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req GraphQLRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if strings.Contains(req.Query, "tokenId: 404") {
+			_, _ = w.Write([]byte(`{"data":{"vehicle":null},"errors":[{"message":"no vehicle"}]}`))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"data":{"vehicle":{"owner":%q}}}`, owner.Load())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestIdentityAPIService_Cache(t *testing.T) {
+	var owner atomic.Value
+	owner.Store("0xaaa")
+	srv, calls := newFakeIdentityAPI(t, &owner)
+	svc := NewIdentityAPIService(zerolog.Nop(), srv.URL, IdentityCacheConfig{Size: 2}).(*identityAPIService)
+	now := time.Now()
+	svc.cache.now = func() time.Time { return now }
+
+	lookup := func(id string) string {
+		t.Helper()
+		body, err := svc.GetVehicleByTokenID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	hits := testutil.ToFloat64(identityCacheRequests.WithLabelValues("vehicle", "hit"))
+
+	lookup("7")
+	lookup("007")
+	if calls.Load() != 1 {
+		t.Errorf("expected the second lookup from cache, got %d calls", calls.Load())
+	}
+	if got := testutil.ToFloat64(identityCacheRequests.WithLabelValues("vehicle", "hit")) - hits; got != 1 {
+		t.Errorf("expected 1 hit counted, got %v", got)
+	}
+
+	// stale: the old owner is served while it's refetched
+	owner.Store("0xbbb")
+	now = now.Add(2 * time.Minute)
+	if body := lookup("7"); !strings.Contains(body, "0xaaa") {
+		t.Errorf("expected the stale entry, got %s", body)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(lookup("7"), "0xbbb") {
+		if time.Now().After(deadline) {
+			t.Fatal("stale entry was never revalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected one revalidation, got %d calls", calls.Load()-1)
+	}
+
+	// a transfer drops the entry straight away
+	owner.Store("0xccc")
+	svc.InvalidateVehicle("7")
+	if body := lookup("7"); !strings.Contains(body, "0xccc") {
+		t.Errorf("expected the new owner after invalidation, got %s", body)
+	}
+
+	// past the stale window it's a miss
+	now = now.Add(time.Hour)
+	before := calls.Load()
+	lookup("7")
+	if calls.Load() != before+1 {
+		t.Error("expected an expired entry to be refetched")
+	}
+
+	// errors aren't cached
+	before = calls.Load()
+	lookup("404")
+	lookup("404")
+	if calls.Load() != before+2 {
+		t.Error("expected a missing vehicle not to be cached")
+	}
+
+	// the least recently used entry goes first
+	lookup("8")
+	lookup("9")
+	before = calls.Load()
+	lookup("7")
+	if calls.Load() != before+1 {
+		t.Error("expected vehicle 7 to have been evicted")
+	}
+}
+
+func TestLRUCache_InvalidateDuringFetch(t *testing.T) {
+	c := newLRUCache(10)
+	epoch := c.epoch("k")
+	c.invalidate("k")
+	c.set("k", epoch, []byte("old"), time.Minute, time.Minute)
+	if _, state, _ := c.get("k"); state != cacheMiss {
+		t.Error("a fetch started before an invalidation must not be cached")
+	}
+
+	c.set("k", c.epoch("k"), []byte("new"), time.Minute, time.Minute)
+	if v, state, _ := c.get("k"); state != cacheFresh || string(v) != "new" {
+		t.Errorf("expected the new value, got %q %v", v, state)
+	}
+
+	// nor once the invalidations are cleared out, whether the key was invalidated during the fetch or not
+	invalidated, untouched := c.epoch("i"), c.epoch("u")
+	c.invalidate("i")
+	for i := range 10_001 {
+		c.invalidate("other-" + strconv.Itoa(i))
+	}
+	c.set("i", invalidated, []byte("old"), time.Minute, time.Minute)
+	c.set("u", untouched, []byte("old"), time.Minute, time.Minute)
+	if _, state, _ := c.get("i"); state != cacheMiss {
+		t.Error("a fetch started before an invalidation must not be cached after a clear out")
+	}
+	if _, state, _ := c.get("u"); state != cacheMiss {
+		t.Error("a fetch started before a clear out must not be cached")
+	}
+	c.set("u", c.epoch("u"), []byte("new"), time.Minute, time.Minute)
+	if v, state, _ := c.get("u"); state != cacheFresh || string(v) != "new" {
+		t.Errorf("expected a fetch after the clear out cached, got %q %v", v, state)
+	}
+}
+
+var vehicleAliasPattern = regexp.MustCompile(`v(\d+): vehicle\(tokenId: \d+\)`)
+
+func TestIdentityAPIService_GetVehiclesByTokenIDs(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req GraphQLRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		data := map[string]any{}
+		var errs []map[string]string
+		for _, m := range vehicleAliasPattern.FindAllStringSubmatch(req.Query, -1) {
+			if m[1] == "404" {
+				data["v"+m[1]] = nil
+				errs = append(errs, map[string]string{"message": "no vehicle"})
+				continue
+			}
+			data["v"+m[1]] = map[string]string{"id": m[1]}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data, "errors": errs})
+	}))
+	defer srv.Close()
+	svc := NewIdentityAPIService(zerolog.Nop(), srv.URL, IdentityCacheConfig{}).(*identityAPIService)
+	var now atomic.Int64
+	now.Store(time.Now().UnixNano())
+	svc.cache.now = func() time.Time { return time.Unix(0, now.Load()) }
+
+	ids := []uint64{404}
+	for id := uint64(1); id <= 120; id++ {
+		ids = append(ids, id)
+	}
+	found, err := svc.GetVehiclesByTokenIDs(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 120 || found[404] != nil || string(found[77]) != `{"id":"77"}` {
+		t.Errorf("unexpected result, %d found", len(found))
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 121 vehicles in 3 requests, got %d", calls.Load())
+	}
+
+	// everything found is now cached, for batches and single lookups alike
+	if _, err := svc.GetVehiclesByTokenIDs([]uint64{5, 404}); err != nil {
+		t.Fatal(err)
+	}
+	body, err := svc.GetVehicleByTokenID("6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 4 || !strings.Contains(string(body), `"vehicle":{"id":"6"}`) {
+		t.Errorf("expected only the missing vehicle refetched, got %d calls and %s", calls.Load(), body)
+	}
+
+	// stale vehicles are served and revalidated in batches too, not one query each
+	now.Add(int64(2 * time.Minute))
+	found, err = svc.GetVehiclesByTokenIDs(ids)
+	if err != nil || len(found) != 120 {
+		t.Fatalf("expected the stale vehicles served, got %d: %v", len(found), err)
+	}
+	for deadline := time.Now().Add(time.Second); calls.Load() < 8 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := calls.Load(); n != 8 {
+		t.Errorf("expected the missing vehicle fetched and 120 stale ones revalidated in 3 requests, got %d calls", n-4)
+	}
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// identityCacheRequests counts identity lookups by query type and how the cache answered: hit, stale (served while
+// revalidating) or miss
+var identityCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "identity_api_cache_requests_total",
+	Help: "Identity API lookups by query type and cache result (hit, stale, miss)",
+}, []string{"query", "result"})
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	cacheStale
+)
+
+// lruCache is a size bounded LRU where each entry is fresh for a while, then served stale for a while longer while
+// it's refetched, then gone
+type lruCache struct {
+	mu      sync.Mutex
+	maxSize int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+	// epochs marks each invalidation of a key with a new seq, so a fetch that started before an invalidation doesn't
+	// put the old value back. Keys without one are at floor, the seq when epochs was last cleared.
+	epochs map[string]uint64
+	floor  uint64
+	seq    uint64
+	now    func() time.Time
+}
+
+type lruEntry struct {
+	key        string
+	value      []byte
+	freshUntil time.Time
+	staleUntil time.Time
+	refreshing bool
+}
+
+func newLRUCache(maxSize int) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		epochs:  map[string]uint64{},
+		now:     time.Now,
+	}
+}
+
+// get returns the value and whether it is fresh or stale. A stale get claims the refresh: refresh is true for the
+// first caller only, who should refetch and set.
+func (l *lruCache) get(key string) (value []byte, state cacheState, refresh bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, cacheMiss, false
+	}
+	e := el.Value.(*lruEntry)
+	now := l.now()
+	if !now.Before(e.staleUntil) {
+		l.removeLocked(el)
+		return nil, cacheMiss, false
+	}
+	l.order.MoveToFront(el)
+	if now.Before(e.freshUntil) {
+		return e.value, cacheFresh, false
+	}
+	refresh = !e.refreshing
+	e.refreshing = true
+	return e.value, cacheStale, refresh
+}
+
+// epoch is read before fetching and handed back to set
+func (l *lruCache) epoch(key string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epochLocked(key)
+}
+
+func (l *lruCache) epochLocked(key string) uint64 {
+	if epoch, ok := l.epochs[key]; ok {
+		return epoch
+	}
+	return l.floor
+}
+
+// set stores a value fresh for ttl then stale for staleFor, unless the key was invalidated since epoch was read
+func (l *lruCache) set(key string, epoch uint64, value []byte, ttl, staleFor time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.epochLocked(key) != epoch {
+		return
+	}
+	now := l.now()
+	e := &lruEntry{key: key, value: value, freshUntil: now.Add(ttl), staleUntil: now.Add(ttl + staleFor)}
+	if el, ok := l.entries[key]; ok {
+		el.Value = e
+		l.order.MoveToFront(el)
+		return
+	}
+	l.entries[key] = l.order.PushFront(e)
+	for l.order.Len() > l.maxSize {
+		l.removeLocked(l.order.Back())
+	}
+}
+
+// refreshFailed lets the next stale get try again
+func (l *lruCache) refreshFailed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[key]; ok {
+		el.Value.(*lruEntry).refreshing = false
+	}
+}
+
+func (l *lruCache) invalidate(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[key]; ok {
+		l.removeLocked(el)
+	}
+	if len(l.epochs) > 10_000 {
+		// raising the floor past every epoch handed out drops the fetches in flight, for any key, rather than let one
+		// that read its epoch before an invalidation match again
+		l.floor = l.seq
+		l.epochs = map[string]uint64{}
+	}
+	l.seq++
+	l.epochs[key] = l.seq
+}
+
+func (l *lruCache) removeLocked(el *list.Element) {
+	l.order.Remove(el)
+	delete(l.entries, el.Value.(*lruEntry).key)
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// earningsFields reads a vehicle's lifetime earnings and its last 104 weeks, about two years, of history
+const earningsFields = `{
+    earnings {
+      totalTokens
+      history(first: 104) {
+        nodes {
+          week
+          beginningTime
+          endTime
+          streakTokens
+          aftermarketDeviceTokens
+          syntheticDeviceTokens
+        }
+      }
+    }
+  }`
+
+// tokenDecimals is the DIMO token's precision, every amount is a whole number of 1e-18 tokens
+const tokenDecimals = 18
+
+// TokenAmount is an exact amount of DIMO tokens. The identity api sends them as decimal strings or numbers, with up
+// to 18 decimals, which a float64 can't hold or add up without losing some. The zero value is no tokens.
+type TokenAmount struct {
+	r *big.Rat
+}
+
+// ParseTokenAmount reads a decimal amount, eg. "12.000000000000000001"
+func ParseTokenAmount(s string) (TokenAmount, error) {
+	if s == "" {
+		return TokenAmount{}, nil
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return TokenAmount{}, fmt.Errorf("invalid token amount %q", s)
+	}
+	return TokenAmount{r: r}, nil
+}
+
+// Add returns the exact sum, leaving t and o as they are
+func (t TokenAmount) Add(o TokenAmount) TokenAmount {
+	sum := new(big.Rat)
+	if t.r != nil {
+		sum.Set(t.r)
+	}
+	if o.r != nil {
+		sum.Add(sum, o.r)
+	}
+	return TokenAmount{r: sum}
+}
+
+// String is the amount in decimal, without trailing zeros, eg. "110.5"
+func (t TokenAmount) String() string {
+	if t.r == nil {
+		return "0"
+	}
+	s := t.r.FloatString(tokenDecimals)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// MarshalJSON writes the amount as a decimal string, as the identity api does, so no client parses it into a float
+func (t TokenAmount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *TokenAmount) UnmarshalJSON(b []byte) error {
+	var raw json.Number
+	if err := json.Unmarshal(b, &raw); err != nil {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("invalid token amount %s", b)
+		}
+		raw = json.Number(s)
+	}
+	amount, err := ParseTokenAmount(string(raw))
+	if err != nil {
+		return err
+	}
+	*t = amount
+	return nil
+}
+
+// VehicleEarnings is a vehicle's lifetime rewards and its most recent weeks of them, newest first
+type VehicleEarnings struct {
+	TotalTokens TokenAmount    `json:"totalTokens"`
+	History     []EarningsWeek `json:"history"`
+}
+
+// EarningsWeek is one weekly reward, split by what earned it
+type EarningsWeek struct {
+	Week                    int         `json:"week"`
+	BeginningTime           time.Time   `json:"beginningTime"`
+	EndTime                 time.Time   `json:"endTime"`
+	StreakTokens            TokenAmount `json:"streakTokens"`
+	AftermarketDeviceTokens TokenAmount `json:"aftermarketDeviceTokens"`
+	SyntheticDeviceTokens   TokenAmount `json:"syntheticDeviceTokens"`
+}
+
+// Tokens is the week's reward in total
+func (w EarningsWeek) Tokens() TokenAmount {
+	return w.StreakTokens.Add(w.AftermarketDeviceTokens).Add(w.SyntheticDeviceTokens)
+}
+
+func (i *identityAPIService) GetVehicleEarnings(tokenIDs []uint64) (map[uint64]VehicleEarnings, error) {
+	found, err := i.lookupVehicles(vehicleLookup{
+		queryType: "earnings",
+		fields:    earningsFields,
+		ttl:       i.cacheConfig.EarningsTTL,
+		staleFor:  i.cacheConfig.EarningsStale,
+	}, tokenIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[uint64]VehicleEarnings, len(found))
+	for id, raw := range found {
+		var v struct {
+			Earnings *struct {
+				TotalTokens TokenAmount `json:"totalTokens"`
+				History     struct {
+					Nodes []EarningsWeek `json:"nodes"`
+				} `json:"history"`
+			} `json:"earnings"`
+		}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("unexpected earnings of vehicle %d: %w", id, err)
+		}
+		earnings := VehicleEarnings{History: []EarningsWeek{}}
+		if v.Earnings != nil {
+			earnings.TotalTokens = v.Earnings.TotalTokens
+			earnings.History = append(earnings.History, v.Earnings.History.Nodes...)
+		}
+		res[id] = earnings
+	}
+	return res, nil
+}
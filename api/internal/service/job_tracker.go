@@ -0,0 +1,563 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+// JobKind is the vehicle operation a job runs on the oracle
+type JobKind string
+
+const (
+	JobMint       JobKind = "mint"
+	JobTransfer   JobKind = "transfer"
+	JobDisconnect JobKind = "disconnect"
+	JobDelete     JobKind = "delete"
+)
+
+// JobState is where a tracked job is. Succeeded, failed and timed_out are final.
+type JobState string
+
+const (
+	JobPending   JobState = "pending"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobTimedOut  JobState = "timed_out"
+	// JobAwaitingAuth is a job the tracker has no valid credentials to poll for, after a restart or once the
+	// submitter's token expired. It's picked up again when its submitter next asks for their jobs.
+	JobAwaitingAuth JobState = "awaiting_auth"
+)
+
+// Final says the job won't change any more
+func (s JobState) Final() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobTimedOut
+}
+
+// Job is an oracle job the BFF follows on the submitter's behalf. Transfers are polled by the oracle's job id, the
+// others by VIN, as that's how their status endpoints are keyed. A mint of several vehicles is a job per vehicle.
+type Job struct {
+	ID          string     `json:"id"`
+	OracleJobID string     `json:"oracleJobId,omitempty"`
+	Kind        JobKind    `json:"kind"`
+	OracleID    string     `json:"oracleId"`
+	TenantID    string     `json:"tenantId,omitempty"`
+	Subject     string     `json:"subject,omitempty"`
+	TokenID     string     `json:"tokenId,omitempty"`
+	VIN         string     `json:"vin,omitempty"`
+	State       JobState   `json:"state"`
+	Detail      string     `json:"detail,omitempty"`
+	Polls       int        `json:"polls"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	// ResumedAt is when the job last came back from awaiting_auth, its timeout counts from then
+	ResumedAt *time.Time `json:"resumedAt,omitempty"`
+}
+
+// pollingSince is when the tracker last got credentials to poll the job with, at submission or since
+func (j Job) pollingSince() time.Time {
+	if j.ResumedAt != nil {
+		return *j.ResumedAt
+	}
+	return j.CreatedAt
+}
+
+// JobCredentials are the submitter's headers the oracle is polled with. They are kept in memory only.
+type JobCredentials struct {
+	Authorization string
+	TenantID      string
+}
+
+// JobFilter narrows List, empty fields match everything
+type JobFilter struct {
+	OracleID string
+	TenantID string
+	Kind     JobKind
+	State    JobState
+	TokenID  string
+	VIN      string
+	Since    time.Time
+}
+
+// Matches says the job is one the filter lets through
+func (f JobFilter) Matches(j Job) bool {
+	switch {
+	case f.OracleID != "" && j.OracleID != f.OracleID,
+		f.TenantID != "" && j.TenantID != f.TenantID,
+		f.Kind != "" && j.Kind != f.Kind,
+		f.State != "" && j.State != f.State,
+		f.TokenID != "" && j.TokenID != f.TokenID,
+		f.VIN != "" && !strings.EqualFold(j.VIN, f.VIN),
+		!f.Since.IsZero() && j.UpdatedAt.Before(f.Since):
+		return false
+	}
+	return true
+}
+
+// JobTrackerConfig configures the tracker. Zero durations take the defaults.
+type JobTrackerConfig struct {
+	// StorePath is the JSONL file job changes are appended to, and jobs reloaded from on start
+	StorePath string
+	// OracleURLs are the oracle base urls by oracle id
+	OracleURLs map[string]url.URL
+	// PollInterval is the first wait between polls, doubling up to MaxPollInterval. Default 5s and 1m.
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	// Timeout is how long a job may be polled before it's given up on, counted from when it last got credentials,
+	// so time spent awaiting them doesn't count. Default 30m.
+	Timeout time.Duration
+	// Retention is how long finished jobs are kept, in memory and, from the next start, in the store, and how long
+	// a job awaits credentials before it's given up on. Default 7 days.
+	Retention time.Duration
+}
+
+// JobTracker records the jobs the BFF submits and polls the oracle until each one is done, so losing the browser
+// tab doesn't lose the job. Every change is appended to the store and pushed to subscribers.
+type JobTracker struct {
+	logger zerolog.Logger
+	config JobTrackerConfig
+	store  *store.JSONL[Job]
+	client *http.Client
+	now    func() time.Time
+
+	mu       sync.Mutex
+	jobs     map[string]*trackedJob
+	subs     map[chan Job]struct{}
+	inFlight map[string]bool
+}
+
+type trackedJob struct {
+	job      Job
+	creds    *JobCredentials
+	interval time.Duration
+	nextPoll time.Time
+}
+
+// errJobUnauthorized is the oracle refusing the submitter's credentials
+var errJobUnauthorized = errors.New("oracle refused the job's credentials")
+
+// NewJobTracker loads the jobs in the store. Unfinished ones wait for their submitter's credentials, see
+// JobAwaitingAuth. Call Start to begin polling.
+func NewJobTracker(logger zerolog.Logger, config JobTrackerConfig) *JobTracker {
+	if config.PollInterval <= 0 {
+		config.PollInterval = 5 * time.Second
+	}
+	if config.MaxPollInterval <= 0 {
+		config.MaxPollInterval = time.Minute
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Minute
+	}
+	if config.Retention <= 0 {
+		config.Retention = 7 * 24 * time.Hour
+	}
+	t := &JobTracker{
+		logger:   logger,
+		config:   config,
+		store:    store.NewJSONL[Job](config.StorePath),
+		client:   &http.Client{Timeout: 15 * time.Second},
+		now:      time.Now,
+		jobs:     map[string]*trackedJob{},
+		subs:     map[chan Job]struct{}{},
+		inFlight: map[string]bool{},
+	}
+	// the store has every change, the last one of a job wins
+	records := 0
+	err := t.store.Scan(func(j Job) bool {
+		records++
+		t.jobs[j.ID] = &trackedJob{job: j, interval: config.PollInterval}
+		return true
+	})
+	if err != nil {
+		logger.Err(err).Msg("failed to load tracked jobs")
+		return t
+	}
+	t.pruneLocked()
+	for _, tj := range t.jobs {
+		if !tj.job.State.Final() {
+			tj.job.State = JobAwaitingAuth
+		}
+	}
+	// down to the jobs kept, in their latest state, so the store doesn't grow with every poll forever
+	if records > len(t.jobs) {
+		jobs := make([]Job, 0, len(t.jobs))
+		for _, tj := range t.jobs {
+			jobs = append(jobs, tj.job)
+		}
+		slices.SortFunc(jobs, func(a, b Job) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+		if err := t.store.Rewrite(jobs); err != nil {
+			logger.Err(err).Msg("failed to compact tracked jobs")
+		}
+	}
+	return t
+}
+
+// pruneLocked drops the jobs that finished more than Retention ago
+func (t *JobTracker) pruneLocked() {
+	cutoff := t.now().Add(-t.config.Retention)
+	for id, tj := range t.jobs {
+		if tj.job.State.Final() && tj.job.UpdatedAt.Before(cutoff) && !t.inFlight[id] {
+			delete(t.jobs, id)
+		}
+	}
+}
+
+// Start polls due jobs every second until ctx is done
+func (t *JobTracker) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.pollDue(ctx)
+			}
+		}
+	}()
+}
+
+// Track records a job just submitted, to be polled with creds
+func (t *JobTracker) Track(job Job, creds JobCredentials) Job {
+	now := t.now()
+	if job.ID == "" {
+		job.ID = newJobID()
+	}
+	job.State = JobPending
+	job.CreatedAt, job.UpdatedAt = now, now
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jobs[job.ID] = &trackedJob{job: job, creds: &creds, interval: t.config.PollInterval, nextPoll: now}
+	t.changedLocked(job)
+	return job
+}
+
+// Authorize hands fresh credentials to the unfinished jobs of subject in the tenant, resuming those awaiting them
+func (t *JobTracker) Authorize(oracleID, tenantID, subject string, creds JobCredentials) {
+	if creds.Authorization == "" {
+		return
+	}
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tj := range t.jobs {
+		j := tj.job
+		if j.State.Final() || j.OracleID != oracleID || j.TenantID != tenantID || j.Subject != subject {
+			continue
+		}
+		tj.creds = &creds
+		if j.State == JobAwaitingAuth {
+			tj.job.State = JobRunning
+			tj.job.Detail = ""
+			tj.job.UpdatedAt = now
+			tj.job.ResumedAt = &now
+			tj.interval = t.config.PollInterval
+			tj.nextPoll = now
+			t.changedLocked(tj.job)
+		}
+	}
+}
+
+// Get returns a job by id
+func (t *JobTracker) Get(id string) (Job, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tj, ok := t.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return tj.job, true
+}
+
+// List returns the jobs matching the filter, newest first
+func (t *JobTracker) List(filter JobFilter) []Job {
+	t.mu.Lock()
+	jobs := make([]Job, 0, len(t.jobs))
+	for _, tj := range t.jobs {
+		if filter.Matches(tj.job) {
+			jobs = append(jobs, tj.job)
+		}
+	}
+	t.mu.Unlock()
+	slices.SortFunc(jobs, func(a, b Job) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return jobs
+}
+
+// Subscribe returns a channel of job changes. A subscriber that doesn't keep up misses changes rather than holding
+// the tracker up. Call cancel when done.
+func (t *JobTracker) Subscribe() (<-chan Job, func()) {
+	ch := make(chan Job, 64)
+	t.mu.Lock()
+	t.subs[ch] = struct{}{}
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.subs[ch]; ok {
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// pollDue drops the jobs past retention, then polls every job whose next poll is due, a few at a time, and waits for
+// them
+func (t *JobTracker) pollDue(ctx context.Context) {
+	now := t.now()
+	type due struct {
+		job   Job
+		creds JobCredentials
+	}
+	var jobs []due
+	t.mu.Lock()
+	t.pruneLocked()
+	for id, tj := range t.jobs {
+		if tj.job.State.Final() || t.inFlight[id] {
+			continue
+		}
+		if tj.job.State == JobAwaitingAuth {
+			// the clock is stopped while nobody can poll the job, unless nobody comes back for it at all
+			if now.Sub(tj.job.UpdatedAt) > t.config.Retention {
+				t.finishLocked(tj, JobTimedOut, fmt.Sprintf("nobody signed in to follow it for %s", t.config.Retention))
+			}
+			continue
+		}
+		if now.Sub(tj.job.pollingSince()) > t.config.Timeout {
+			t.finishLocked(tj, JobTimedOut, fmt.Sprintf("not done after %s", t.config.Timeout))
+			continue
+		}
+		if now.Before(tj.nextPoll) {
+			continue
+		}
+		if tj.creds == nil {
+			t.updateLocked(tj, JobAwaitingAuth, "waiting for the submitter to sign in again")
+			continue
+		}
+		t.inFlight[id] = true
+		jobs = append(jobs, due{job: tj.job, creds: *tj.creds})
+	}
+	t.mu.Unlock()
+
+	group := errgroup.Group{}
+	group.SetLimit(4)
+	for _, d := range jobs {
+		group.Go(func() error {
+			state, detail, err := t.check(ctx, d.job, d.creds)
+			t.polled(d.job.ID, state, detail, err)
+			return nil
+		})
+	}
+	_ = group.Wait()
+}
+
+// polled records the outcome of a poll and schedules the next one
+func (t *JobTracker) polled(id string, state JobState, detail string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inFlight, id)
+	tj, ok := t.jobs[id]
+	if !ok {
+		return
+	}
+	tj.job.Polls++
+	switch {
+	case errors.Is(err, errJobUnauthorized):
+		tj.creds = nil
+		t.updateLocked(tj, JobAwaitingAuth, "waiting for the submitter to sign in again")
+		return
+	case err != nil:
+		t.logger.Warn().Err(err).Str("jobId", id).Msg("failed to poll job status")
+	case state.Final():
+		t.finishLocked(tj, state, detail)
+		return
+	case state != tj.job.State || detail != tj.job.Detail:
+		t.updateLocked(tj, state, detail)
+		tj.interval = t.config.PollInterval
+		tj.nextPoll = t.now().Add(tj.interval)
+		return
+	}
+	tj.interval = min(2*tj.interval, t.config.MaxPollInterval)
+	tj.nextPoll = t.now().Add(tj.interval)
+}
+
+func (t *JobTracker) finishLocked(tj *trackedJob, state JobState, detail string) {
+	now := t.now()
+	tj.job.CompletedAt = &now
+	t.updateLocked(tj, state, detail)
+}
+
+func (t *JobTracker) updateLocked(tj *trackedJob, state JobState, detail string) {
+	tj.job.State = state
+	tj.job.Detail = detail
+	tj.job.UpdatedAt = t.now()
+	t.changedLocked(tj.job)
+}
+
+// changedLocked stores a job's new state and tells the subscribers
+func (t *JobTracker) changedLocked(j Job) {
+	if err := t.store.Append(j); err != nil {
+		t.logger.Err(err).Str("jobId", j.ID).Msg("failed to store job")
+	}
+	for ch := range t.subs {
+		select {
+		case ch <- j:
+		default:
+		}
+	}
+}
+
+// check asks the oracle how the job is doing
+func (t *JobTracker) check(ctx context.Context, j Job, creds JobCredentials) (JobState, string, error) {
+	base, ok := t.config.OracleURLs[j.OracleID]
+	if !ok {
+		return JobFailed, "unknown oracle " + j.OracleID, nil
+	}
+	// a job without a vin, eg. a shared account delete whose vehicle couldn't be read, is polled as the river job it
+	// is, which is what the transfer status endpoint reads
+	if j.Kind == JobTransfer || j.VIN == "" {
+		if j.OracleJobID == "" {
+			return JobFailed, "no vin or oracle job id to poll", nil
+		}
+		target := base.JoinPath("/v1/vehicle/transfer/status")
+		target.RawQuery = url.Values{"jobId": {j.OracleJobID}}.Encode()
+		var res struct {
+			IsSuccessful bool     `json:"isSuccessful"`
+			State        string   `json:"state"`
+			Errors       []string `json:"errors"`
+		}
+		if err := t.getJSON(ctx, target, creds, &res); err != nil {
+			return "", "", err
+		}
+		switch {
+		case res.IsSuccessful:
+			return JobSucceeded, res.State, nil
+		case res.State == "discarded" || res.State == "cancelled":
+			return JobFailed, strings.Join(append([]string{res.State}, res.Errors...), ": "), nil
+		}
+		return JobRunning, res.State, nil
+	}
+
+	target := base.JoinPath("/v1/vehicle", string(j.Kind), "status")
+	target.RawQuery = url.Values{"vins": {j.VIN}}.Encode()
+	var res struct {
+		Statuses []struct {
+			VIN     string `json:"vin"`
+			Status  string `json:"status"`
+			Details string `json:"details"`
+		} `json:"statuses"`
+	}
+	if err := t.getJSON(ctx, target, creds, &res); err != nil {
+		return "", "", err
+	}
+	for _, s := range res.Statuses {
+		if !strings.EqualFold(s.VIN, j.VIN) {
+			continue
+		}
+		detail := strings.TrimSpace(s.Status + " " + s.Details)
+		switch status := strings.ToLower(s.Status); {
+		case status == "success":
+			return JobSucceeded, detail, nil
+		case strings.Contains(status, "fail") || strings.Contains(status, "error"):
+			return JobFailed, detail, nil
+		}
+		return JobRunning, detail, nil
+	}
+	return JobRunning, "no status yet", nil
+}
+
+func (t *JobTracker) getJSON(ctx context.Context, target *url.URL, creds JobCredentials, v any) error {
+	return oracleJSON(ctx, t.client, http.MethodGet, target, creds, nil, v)
+}
+
+// oracleJSON calls the oracle with the submitter's credentials, sending body as JSON when there is one, and decodes
+// the response into v. A 401 is errJobUnauthorized, any other non 2xx an error with the oracle's message. A 403 is
+// about the one vehicle or call, not the credentials, so it fails just that.
+func oracleJSON(ctx context.Context, client *http.Client, method string, target *url.URL, creds JobCredentials, body, v any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", creds.Authorization)
+	if creds.TenantID != "" {
+		req.Header.Set("Tenant-Id", creds.TenantID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	resBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return errJobUnauthorized
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("oracle returned %d: %s", resp.StatusCode, oracleMessage(resBody))
+	}
+	if len(bytes.TrimSpace(resBody)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(resBody, v); err != nil {
+		return fmt.Errorf("unexpected response from %s: %w", target.Path, err)
+	}
+	return nil
+}
+
+// oracleMessage is the message of an oracle error response, or the start of the body when it isn't one
+func oracleMessage(body []byte) string {
+	var res struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &res) == nil && res.Message != "" {
+		return res.Message
+	}
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 200 {
+		msg = msg[:200]
+	}
+	return msg
+}
+
+func newJobID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
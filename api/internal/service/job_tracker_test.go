@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/rs/zerolog"
+)
+
+func TestJobTracker(t *testing.T) {
+	var transferDone, unauthorized atomic.Bool
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthorized.Load() || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/vehicle/transfer/status":
+			_ = json.NewEncoder(w).Encode(map[string]any{"isSuccessful": transferDone.Load(), "state": "running"})
+		case "/v1/vehicle/delete/status":
+			_, _ = w.Write([]byte(`{"statuses":[{"vin":"` + r.URL.Query().Get("vins") + `","status":"Failure","details":"burn reverted"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oracle.Close()
+	u, _ := url.Parse(oracle.URL)
+	storePath := filepath.Join(t.TempDir(), "jobs.jsonl")
+	config := JobTrackerConfig{
+		StorePath:       storePath,
+		OracleURLs:      map[string]url.URL{"kaufmann": *u},
+		PollInterval:    time.Second,
+		MaxPollInterval: 4 * time.Second,
+	}
+	tracker := NewJobTracker(zerolog.Nop(), config)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+	changes, cancel := tracker.Subscribe()
+	defer cancel()
+
+	creds := JobCredentials{Authorization: "Bearer token", TenantID: "t1"}
+	transfer := tracker.Track(Job{Kind: JobTransfer, OracleID: "kaufmann", TenantID: "t1", Subject: "alice", OracleJobID: "42"}, creds)
+	del := tracker.Track(Job{Kind: JobDelete, OracleID: "kaufmann", TenantID: "t1", Subject: "alice", VIN: "1HGCM82633A004352"}, creds)
+	if transfer.State != JobPending || (<-changes).ID != transfer.ID || (<-changes).ID != del.ID {
+		t.Fatal("expected both jobs announced as pending")
+	}
+
+	ctx := context.Background()
+	tracker.pollDue(ctx)
+	if job, _ := tracker.Get(transfer.ID); job.State != JobRunning || job.Polls != 1 {
+		t.Errorf("expected the transfer running, got %+v", job)
+	}
+	if job, _ := tracker.Get(del.ID); job.State != JobFailed || job.Detail != "Failure burn reverted" || job.CompletedAt == nil {
+		t.Errorf("expected the delete failed, got %+v", job)
+	}
+
+	// unchanged, the wait doubles
+	now = now.Add(time.Second)
+	tracker.pollDue(ctx)
+	now = now.Add(time.Second)
+	tracker.pollDue(ctx)
+	if job, _ := tracker.Get(transfer.ID); job.Polls != 2 {
+		t.Errorf("expected the second wait to be longer, got %d polls", job.Polls)
+	}
+
+	// the token expired, the job waits for its submitter
+	unauthorized.Store(true)
+	now = now.Add(4 * time.Second)
+	tracker.pollDue(ctx)
+	if job, _ := tracker.Get(transfer.ID); job.State != JobAwaitingAuth {
+		t.Fatalf("expected awaiting_auth, got %+v", job)
+	}
+	unauthorized.Store(false)
+	tracker.Authorize("kaufmann", "t1", "bob", creds)
+	if job, _ := tracker.Get(transfer.ID); job.State != JobAwaitingAuth {
+		t.Error("another user's credentials must not be used")
+	}
+	tracker.Authorize("kaufmann", "t1", "alice", creds)
+	transferDone.Store(true)
+	tracker.pollDue(ctx)
+	if job, _ := tracker.Get(transfer.ID); job.State != JobSucceeded {
+		t.Errorf("expected the transfer done, got %+v", job)
+	}
+
+	if jobs := tracker.List(JobFilter{TenantID: "t1", State: JobSucceeded}); len(jobs) != 1 || jobs[0].ID != transfer.ID {
+		t.Errorf("unexpected filtered list %+v", jobs)
+	}
+
+	// after a restart the jobs come back from the store, unfinished ones without credentials
+	running := tracker.Track(Job{Kind: JobMint, OracleID: "kaufmann", TenantID: "t1", VIN: "1HGCM82633A004352"}, creds)
+	abandoned := tracker.Track(Job{Kind: JobMint, OracleID: "kaufmann", TenantID: "t1", Subject: "carol", VIN: "1HGCM82633A004353"}, creds)
+	reloaded := NewJobTracker(zerolog.Nop(), config)
+	if job, _ := reloaded.Get(transfer.ID); job.State != JobSucceeded {
+		t.Errorf("expected the finished transfer reloaded, got %+v", job)
+	}
+	if job, _ := reloaded.Get(running.ID); job.State != JobAwaitingAuth {
+		t.Errorf("expected the unfinished mint awaiting auth, got %+v", job)
+	}
+
+	// the store was compacted to a line per job on load
+	lines := 0
+	_ = store.NewJSONL[Job](storePath).Scan(func(Job) bool { lines++; return true })
+	if lines != 4 {
+		t.Errorf("expected four compacted jobs, got %d lines", lines)
+	}
+
+	// the time awaiting credentials doesn't count, signing in again an hour later gives the mint its full timeout
+	reloaded.now = func() time.Time { return now.Add(time.Hour) }
+	reloaded.Authorize("kaufmann", "t1", "", creds)
+	reloaded.pollDue(ctx)
+	if job, _ := reloaded.Get(running.ID); job.State != JobRunning || job.ResumedAt == nil {
+		t.Errorf("expected the resumed mint running, got %+v", job)
+	}
+	reloaded.now = func() time.Time { return now.Add(time.Hour + 31*time.Minute) }
+	reloaded.pollDue(ctx)
+	if job, _ := reloaded.Get(running.ID); job.State != JobTimedOut {
+		t.Errorf("expected the mint timed out after its timeout, got %+v", job)
+	}
+	if job, _ := reloaded.Get(abandoned.ID); job.State != JobAwaitingAuth {
+		t.Errorf("expected the other mint still awaiting auth, got %+v", job)
+	}
+
+	// and a job nobody comes back for is given up on after the retention
+	reloaded.now = func() time.Time { return now.Add(8 * 24 * time.Hour) }
+	reloaded.pollDue(ctx)
+	if job, _ := reloaded.Get(abandoned.ID); job.State != JobTimedOut {
+		t.Errorf("expected the abandoned mint timed out, got %+v", job)
+	}
+
+	// finished jobs are dropped once past retention, the next load leaves them out of the store
+	reloaded.now = func() time.Time { return now.Add(16 * 24 * time.Hour) }
+	reloaded.pollDue(ctx)
+	if jobs := reloaded.List(JobFilter{}); len(jobs) != 0 {
+		t.Errorf("expected the jobs pruned, got %+v", jobs)
+	}
+}
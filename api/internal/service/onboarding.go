@@ -0,0 +1,951 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+// OnboardingStage is a step of onboarding a vehicle, in the order they run
+type OnboardingStage string
+
+const (
+	// StageLink ties the VIN to the device's IMEI
+	StageLink OnboardingStage = "link"
+	// StageDecode decodes the VIN to a device definition, skipped when the manifest has one
+	StageDecode OnboardingStage = "decode"
+	// StageVerify submits the vehicle for verification and waits for it to pass
+	StageVerify OnboardingStage = "verify"
+	// StageMint reads the mint data, waits for the owner's signature when the oracle can't sign, submits the mint
+	// and waits for its job
+	StageMint OnboardingStage = "mint"
+	// StageFleet sets the plate and group of the minted vehicle
+	StageFleet OnboardingStage = "fleet"
+	StageDone  OnboardingStage = "done"
+)
+
+// OnboardingStages are the stages in the order a vehicle goes through them
+var OnboardingStages = []OnboardingStage{StageLink, StageDecode, StageVerify, StageMint, StageFleet}
+
+// OnboardingStatus is where a vehicle is in its stage
+type OnboardingStatus string
+
+const (
+	OnboardingPending           OnboardingStatus = "pending"
+	OnboardingRunning           OnboardingStatus = "running"
+	OnboardingAwaitingSignature OnboardingStatus = "awaiting_signature"
+	OnboardingSucceeded         OnboardingStatus = "succeeded"
+	OnboardingFailed            OnboardingStatus = "failed"
+	// OnboardingRolledBack is a vehicle whose onboarding was undone on the oracle after it failed, see Recovery. It's
+	// not resumed.
+	OnboardingRolledBack OnboardingStatus = "rolled_back"
+)
+
+// OnboardingRunState is where an onboarding is as a whole
+type OnboardingRunState string
+
+const (
+	OnboardingRunRunning OnboardingRunState = "running"
+	// OnboardingRunAwaitingSignature is a run that went as far as it can, some vehicles wait for the owner to sign
+	// their mint data
+	OnboardingRunAwaitingSignature OnboardingRunState = "awaiting_signature"
+	// OnboardingRunInterrupted is a run stopped by a restart or refused credentials, resuming it carries on
+	OnboardingRunInterrupted OnboardingRunState = "interrupted"
+	// OnboardingRunDone is a run with every vehicle succeeded or failed
+	OnboardingRunDone OnboardingRunState = "done"
+)
+
+var (
+	ErrOnboardingNotFound = errors.New("onboarding not found")
+	ErrOnboardingRunning  = errors.New("onboarding is already running")
+	ErrNothingToSign      = errors.New("no vehicle of the onboarding awaits these signatures")
+)
+
+// onboardingBatch is how many vehicles go in one verify or mint request
+const onboardingBatch = 25
+
+// OnboardingVehicle is one row of the manifest and its progress
+type OnboardingVehicle struct {
+	// Row is the 1 based position in the manifest
+	Row        int    `json:"row"`
+	VIN        string `json:"vin"`
+	IMEI       string `json:"imei"`
+	Plate      string `json:"plate,omitempty"`
+	Group      string `json:"group,omitempty"`
+	Definition string `json:"definition,omitempty"`
+
+	Stage  OnboardingStage  `json:"stage"`
+	Status OnboardingStatus `json:"status"`
+	// Attempts are the tries at the current stage
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	// TypedData is the mint data the owner signs, while awaiting_signature
+	TypedData json.RawMessage `json:"typedData,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	// JobID is the tracker's job for the mint, see JobTracker
+	JobID   string `json:"jobId,omitempty"`
+	TokenID string `json:"tokenId,omitempty"`
+	// Warnings are fleet details that couldn't be applied to a vehicle that was onboarded nonetheless
+	Warnings  []string  `json:"warnings,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Onboarding is a run of the onboarding pipeline over a manifest. Vehicles is left out of listings.
+type Onboarding struct {
+	ID          string `json:"id"`
+	OracleID    string `json:"oracleId"`
+	TenantID    string `json:"tenantId,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	CountryCode string `json:"countryCode"`
+	// Sacd is passed through on every mint
+	Sacd      json.RawMessage          `json:"sacd,omitempty"`
+	State     OnboardingRunState       `json:"state"`
+	Detail    string                   `json:"detail,omitempty"`
+	Stages    map[OnboardingStage]int  `json:"stages"`
+	Counts    map[OnboardingStatus]int `json:"counts"`
+	Vehicles  []OnboardingVehicle      `json:"vehicles,omitempty"`
+	CreatedAt time.Time                `json:"createdAt"`
+	UpdatedAt time.Time                `json:"updatedAt"`
+}
+
+// OnboardingSignature is the owner's signature of a vehicle's mint data
+type OnboardingSignature struct {
+	VIN       string `json:"vin"`
+	Signature string `json:"signature"`
+}
+
+// OnboardingConfig configures the pipeline. Zero values take the defaults.
+type OnboardingConfig struct {
+	// StorePath is the JSONL file runs are recorded in, and reloaded from on start
+	StorePath string
+	// OracleURLs are the oracle base urls by oracle id
+	OracleURLs map[string]url.URL
+	// DefinitionsURL is the device definitions api VINs are decoded with, using the developer JWT. Without either
+	// only vehicles with a definition in the manifest get past decoding.
+	DefinitionsURL url.URL
+	DeveloperJWT   DIMOJWTService
+	// Concurrency is how many requests a stage makes at once, by stage, default 4
+	Concurrency map[OnboardingStage]int
+	// Attempts is how many times a stage is tried for a vehicle before it fails, default 3, waiting Backoff after the
+	// first failure and doubling, default 2s
+	Attempts int
+	Backoff  time.Duration
+	// VerifyPoll is the wait between verification status checks, default 5s, given up on after VerifyTimeout,
+	// default 5m
+	VerifyPoll    time.Duration
+	VerifyTimeout time.Duration
+	// Retention is how long a run is kept once it's done, default 30 days
+	Retention time.Duration
+}
+
+// OnboardingPipeline takes a manifest of vehicles through linking, decoding, verification, minting and fleet setup
+// in the background, each stage with its own concurrency and retries. It only stops for the owner's signature of
+// mint data the oracle can't sign itself. Progress is recorded per vehicle, so a restart carries on where it stopped.
+type OnboardingPipeline struct {
+	logger zerolog.Logger
+	config OnboardingConfig
+	jobs   *JobTracker
+	store  *runStore[Onboarding, OnboardingVehicle]
+	client *http.Client
+	now    func() time.Time
+
+	mu   sync.Mutex
+	runs map[string]*onboardingRun
+}
+
+type onboardingRun struct {
+	run     Onboarding
+	running bool
+	// rerun asks the running pass to go again, for signatures that arrived while it ran
+	rerun bool
+	creds JobCredentials
+}
+
+// NewOnboardingPipeline loads the runs in the store. Runs that were going when the BFF stopped are interrupted, and
+// their vehicles restart the stage they were in, bar mints already submitted. Runs done more than Retention ago are
+// dropped, and the store is compacted down to the latest state of the rest.
+func NewOnboardingPipeline(logger zerolog.Logger, config OnboardingConfig, jobs *JobTracker) *OnboardingPipeline {
+	if config.Attempts <= 0 {
+		config.Attempts = 3
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 2 * time.Second
+	}
+	if config.VerifyPoll <= 0 {
+		config.VerifyPoll = 5 * time.Second
+	}
+	if config.VerifyTimeout <= 0 {
+		config.VerifyTimeout = 5 * time.Minute
+	}
+	if config.Retention <= 0 {
+		config.Retention = 30 * 24 * time.Hour
+	}
+	p := &OnboardingPipeline{
+		logger: logger,
+		config: config,
+		jobs:   jobs,
+		store:  newRunStore[Onboarding](config.StorePath, func(v OnboardingVehicle) int { return v.Row }),
+		client: &http.Client{Timeout: 30 * time.Second},
+		now:    time.Now,
+		runs:   map[string]*onboardingRun{},
+	}
+	stored, err := p.store.load()
+	for id, sr := range stored {
+		run := sr.Run
+		run.Vehicles = sr.Rows
+		p.runs[id] = &onboardingRun{run: run}
+	}
+	if err != nil {
+		logger.Err(err).Msg("failed to load onboardings")
+	}
+	for _, or := range p.runs {
+		if or.run.State != OnboardingRunRunning {
+			continue
+		}
+		or.run.State = OnboardingRunInterrupted
+		or.run.Detail = "the BFF restarted, resume to carry on"
+		for i, v := range or.run.Vehicles {
+			if v.Status == OnboardingRunning && !(v.Stage == StageMint && v.JobID != "") {
+				or.run.Vehicles[i].Status = OnboardingPending
+			}
+		}
+	}
+	if err == nil {
+		p.compactLocked(1)
+	}
+	return p
+}
+
+// Start records a new run of run.Vehicles and takes them through the pipeline in the background with creds
+func (p *OnboardingPipeline) Start(run Onboarding, creds JobCredentials) Onboarding {
+	now := p.now()
+	run.ID = newJobID()
+	run.State = OnboardingRunRunning
+	run.CreatedAt, run.UpdatedAt = now, now
+	vehicles := make([]OnboardingVehicle, len(run.Vehicles))
+	for i, v := range run.Vehicles {
+		vehicles[i] = OnboardingVehicle{
+			Row: i + 1, VIN: v.VIN, IMEI: v.IMEI, Plate: v.Plate, Group: v.Group, Definition: v.Definition,
+			Stage: StageLink, Status: OnboardingPending, UpdatedAt: now,
+		}
+	}
+	run.Vehicles = vehicles
+
+	p.mu.Lock()
+	or := &onboardingRun{run: run, running: true, creds: creds}
+	p.runs[run.ID] = or
+	p.storeRunLocked(or)
+	for _, v := range run.Vehicles {
+		p.storeVehicleLocked(run.ID, v)
+	}
+	p.compactLocked(2)
+	res := p.snapshotLocked(or)
+	p.mu.Unlock()
+
+	go p.execute(run.ID)
+	return res
+}
+
+// Sign records the owner's signatures of mint data and submits those mints
+func (p *OnboardingPipeline) Sign(id, subject string, creds JobCredentials, signatures []OnboardingSignature) (Onboarding, error) {
+	bySig := make(map[string]string, len(signatures))
+	for _, s := range signatures {
+		bySig[strings.ToUpper(s.VIN)] = s.Signature
+	}
+	p.mu.Lock()
+	or, ok := p.runs[id]
+	if !ok {
+		p.mu.Unlock()
+		return Onboarding{}, ErrOnboardingNotFound
+	}
+	signed := 0
+	for i, v := range or.run.Vehicles {
+		sig, ok := bySig[strings.ToUpper(v.VIN)]
+		if !ok || v.Stage != StageMint || v.Status != OnboardingAwaitingSignature {
+			continue
+		}
+		v.Signature, v.Status, v.Error, v.UpdatedAt = sig, OnboardingPending, "", p.now()
+		or.run.Vehicles[i] = v
+		p.storeVehicleLocked(id, v)
+		signed++
+	}
+	if signed == 0 {
+		p.mu.Unlock()
+		return Onboarding{}, ErrNothingToSign
+	}
+	res := p.continueLocked(or, creds)
+	p.mu.Unlock()
+	p.jobs.Authorize(res.OracleID, res.TenantID, subject, creds)
+	return res, nil
+}
+
+// Resume retries the failed vehicles from the stage they failed in and carries on with the rest, with the caller's
+// creds. Given vins, only those of the failed vehicles are retried.
+func (p *OnboardingPipeline) Resume(id, subject string, creds JobCredentials, vins ...string) (Onboarding, error) {
+	p.mu.Lock()
+	or, ok := p.runs[id]
+	if !ok {
+		p.mu.Unlock()
+		return Onboarding{}, ErrOnboardingNotFound
+	}
+	if or.running {
+		p.mu.Unlock()
+		return Onboarding{}, ErrOnboardingRunning
+	}
+	for i, v := range or.run.Vehicles {
+		if v.Status == OnboardingFailed && (len(vins) == 0 || slices.ContainsFunc(vins, func(vin string) bool {
+			return strings.EqualFold(vin, v.VIN)
+		})) {
+			v.Status, v.Attempts, v.UpdatedAt = OnboardingPending, 0, p.now()
+			or.run.Vehicles[i] = v
+			p.storeVehicleLocked(id, v)
+		}
+	}
+	res := p.continueLocked(or, creds)
+	p.mu.Unlock()
+	p.jobs.Authorize(res.OracleID, res.TenantID, subject, creds)
+	return res, nil
+}
+
+// RollBack records that the vehicle in row of the run had its onboarding undone on the oracle. The run can't be
+// running, its pass could be at the vehicle.
+func (p *OnboardingPipeline) RollBack(id string, row int, detail string) (OnboardingVehicle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	or, ok := p.runs[id]
+	if !ok || row < 1 || row > len(or.run.Vehicles) {
+		return OnboardingVehicle{}, ErrOnboardingNotFound
+	}
+	if or.running {
+		return OnboardingVehicle{}, ErrOnboardingRunning
+	}
+	v := or.run.Vehicles[row-1]
+	v.Status, v.Error, v.TypedData, v.UpdatedAt = OnboardingRolledBack, detail, nil, p.now()
+	or.run.Vehicles[row-1] = v
+	or.run.UpdatedAt = v.UpdatedAt
+	p.storeVehicleLocked(id, v)
+	return v, nil
+}
+
+// continueLocked runs the pipeline again, or has the running pass go again once it's through
+func (p *OnboardingPipeline) continueLocked(or *onboardingRun, creds JobCredentials) Onboarding {
+	or.creds = creds
+	or.run.State, or.run.Detail, or.run.UpdatedAt = OnboardingRunRunning, "", p.now()
+	p.storeRunLocked(or)
+	if or.running {
+		or.rerun = true
+	} else {
+		or.running = true
+		go p.execute(or.run.ID)
+	}
+	return p.snapshotLocked(or)
+}
+
+// Get returns a run with its vehicles
+func (p *OnboardingPipeline) Get(id string) (Onboarding, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	or, ok := p.runs[id]
+	if !ok {
+		return Onboarding{}, false
+	}
+	return p.snapshotLocked(or), true
+}
+
+// List returns the runs of a tenant, without their vehicles, newest first
+func (p *OnboardingPipeline) List(oracleID, tenantID string) []Onboarding {
+	p.mu.Lock()
+	var runs []Onboarding
+	for _, or := range p.runs {
+		if or.run.OracleID == oracleID && or.run.TenantID == tenantID {
+			run := p.snapshotLocked(or)
+			run.Vehicles = nil
+			runs = append(runs, run)
+		}
+	}
+	p.mu.Unlock()
+	slices.SortFunc(runs, func(a, b Onboarding) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return runs
+}
+
+// Runs returns every run with its vehicles, for the recovery of the vehicles left half onboarded
+func (p *OnboardingPipeline) Runs() []Onboarding {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	runs := make([]Onboarding, 0, len(p.runs))
+	for _, or := range p.runs {
+		runs = append(runs, p.snapshotLocked(or))
+	}
+	return runs
+}
+
+// snapshotLocked copies a run for the caller, counting its vehicles by stage and status
+func (p *OnboardingPipeline) snapshotLocked(or *onboardingRun) Onboarding {
+	run := or.run
+	run.Vehicles = slices.Clone(or.run.Vehicles)
+	run.Stages = map[OnboardingStage]int{}
+	run.Counts = map[OnboardingStatus]int{}
+	for _, v := range run.Vehicles {
+		run.Stages[v.Stage]++
+		run.Counts[v.Status]++
+	}
+	return run
+}
+
+// execute takes the run's vehicles as far as they can go, stage by stage, and goes again if signatures came in
+// meanwhile. Refused credentials interrupt the run, as every following request would be refused too.
+func (p *OnboardingPipeline) execute(id string) {
+	for {
+		err := p.pass(id)
+
+		p.mu.Lock()
+		or := p.runs[id]
+		if err == nil && or.rerun {
+			or.rerun = false
+			p.mu.Unlock()
+			continue
+		}
+		or.running, or.rerun = false, false
+		run := p.snapshotLocked(or)
+		switch {
+		case err != nil:
+			or.run.State = OnboardingRunInterrupted
+			or.run.Detail = "the oracle refused the submitter's credentials, resume to carry on"
+		case run.Counts[OnboardingAwaitingSignature] > 0:
+			or.run.State = OnboardingRunAwaitingSignature
+			or.run.Detail = fmt.Sprintf("%d vehicles await the owner's signature of their mint data",
+				run.Counts[OnboardingAwaitingSignature])
+		default:
+			or.run.State, or.run.Detail = OnboardingRunDone, ""
+		}
+		or.run.UpdatedAt = p.now()
+		p.storeRunLocked(or)
+		p.compactLocked(2)
+		p.mu.Unlock()
+		return
+	}
+}
+
+// pass runs every stage once over the vehicles ready for it, in order, so a vehicle goes through as many as it can
+func (p *OnboardingPipeline) pass(id string) error {
+	ctx := context.Background()
+	for _, stage := range OnboardingStages {
+		var err error
+		switch stage {
+		case StageVerify, StageMint:
+			err = p.runStage(ctx, id, stage, onboardingBatch, p.batchStep(stage))
+		default:
+			err = p.runStage(ctx, id, stage, 1, p.vehicleStep(stage))
+		}
+		if err != nil {
+			return err
+		}
+		if stage == StageMint {
+			p.waitForMints(ctx, id)
+		}
+	}
+	return nil
+}
+
+// stepResult is the outcome of a stage for one vehicle: advanced to the next stage, failed, or left in the stage with
+// status, eg. awaiting its signature or its mint job
+type stepResult struct {
+	status  OnboardingStatus
+	err     error
+	update  func(v *OnboardingVehicle)
+	advance bool
+	// retrying is a failure that will be tried again
+	retrying bool
+}
+
+// runStage runs step over the pending vehicles in stage, size at a time and as many at once as the stage allows
+func (p *OnboardingPipeline) runStage(ctx context.Context, id string, stage OnboardingStage, size int,
+	step func(ctx context.Context, run Onboarding, creds JobCredentials, vehicles []OnboardingVehicle) []stepResult) error {
+	p.mu.Lock()
+	or := p.runs[id]
+	run, creds := or.run, or.creds
+	var ready []OnboardingVehicle
+	for i, v := range or.run.Vehicles {
+		if v.Stage == stage && v.Status == OnboardingPending {
+			or.run.Vehicles[i].Status = OnboardingRunning
+			ready = append(ready, or.run.Vehicles[i])
+		}
+	}
+	p.mu.Unlock()
+
+	limit := p.config.Concurrency[stage]
+	if limit <= 0 {
+		limit = 4
+	}
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(limit)
+	for batch := range slices.Chunk(ready, size) {
+		group.Go(func() error {
+			for attempt := 1; ; attempt++ {
+				results := step(ctx, run, creds, batch)
+				for _, r := range results {
+					if errors.Is(r.err, errJobUnauthorized) {
+						for i, r := range results {
+							p.stepped(id, batch[i], r)
+						}
+						return r.err
+					}
+				}
+				// the vehicles that failed are tried again, until they're out of attempts
+				var again []OnboardingVehicle
+				for i, r := range results {
+					if r.err != nil && attempt < p.config.Attempts {
+						r.retrying = true
+						again = append(again, batch[i])
+					}
+					p.stepped(id, batch[i], r)
+				}
+				if len(again) == 0 {
+					return nil
+				}
+				batch = again
+				select {
+				case <-ctx.Done():
+					for _, v := range batch {
+						p.stepped(id, v, stepResult{status: OnboardingPending})
+					}
+					return nil
+				case <-time.After(p.config.Backoff << (attempt - 1)):
+				}
+			}
+		})
+	}
+	return group.Wait()
+}
+
+// stepped records the outcome of a stage for a vehicle
+func (p *OnboardingPipeline) stepped(id string, v OnboardingVehicle, r stepResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	or := p.runs[id]
+	v = or.run.Vehicles[v.Row-1]
+	v.Attempts++
+	v.UpdatedAt = p.now()
+	if r.update != nil {
+		r.update(&v)
+	}
+	switch {
+	case errors.Is(r.err, errJobUnauthorized):
+		v.Status, v.Error = OnboardingPending, r.err.Error()
+	case r.err != nil && r.retrying:
+		v.Error = r.err.Error()
+	case r.err != nil:
+		v.Status, v.Error = OnboardingFailed, r.err.Error()
+	case r.advance:
+		v.Stage, v.Status, v.Attempts, v.Error = nextStage(v.Stage), OnboardingPending, 0, ""
+		if v.Stage == StageDone {
+			v.Status = OnboardingSucceeded
+		}
+	default:
+		v.Status, v.Error = r.status, ""
+	}
+	or.run.Vehicles[v.Row-1] = v
+	or.run.UpdatedAt = v.UpdatedAt
+	p.storeVehicleLocked(id, v)
+}
+
+func nextStage(stage OnboardingStage) OnboardingStage {
+	i := slices.Index(OnboardingStages, stage)
+	if i < 0 || i == len(OnboardingStages)-1 {
+		return StageDone
+	}
+	return OnboardingStages[i+1]
+}
+
+// vehicleStep is the stage's work for a single vehicle
+func (p *OnboardingPipeline) vehicleStep(stage OnboardingStage) func(context.Context, Onboarding, JobCredentials, []OnboardingVehicle) []stepResult {
+	return func(ctx context.Context, run Onboarding, creds JobCredentials, vehicles []OnboardingVehicle) []stepResult {
+		results := make([]stepResult, len(vehicles))
+		for i, v := range vehicles {
+			switch stage {
+			case StageLink:
+				results[i] = p.link(ctx, run, creds, v)
+			case StageDecode:
+				results[i] = p.decode(ctx, run, v)
+			case StageFleet:
+				results[i] = p.fleet(ctx, run, creds, v)
+			}
+		}
+		return results
+	}
+}
+
+func (p *OnboardingPipeline) batchStep(stage OnboardingStage) func(context.Context, Onboarding, JobCredentials, []OnboardingVehicle) []stepResult {
+	if stage == StageVerify {
+		return p.verify
+	}
+	return p.mint
+}
+
+func (p *OnboardingPipeline) oracle(run Onboarding) (url.URL, error) {
+	base, ok := p.config.OracleURLs[run.OracleID]
+	if !ok {
+		return url.URL{}, errors.New("unknown oracle " + run.OracleID)
+	}
+	return base, nil
+}
+
+func (p *OnboardingPipeline) link(ctx context.Context, run Onboarding, creds JobCredentials, v OnboardingVehicle) stepResult {
+	base, err := p.oracle(run)
+	if err != nil {
+		return stepResult{err: err}
+	}
+	var res json.RawMessage
+	err = oracleJSON(ctx, p.client, http.MethodPost, base.JoinPath("/v1/pending-vehicle/vin-to-imei", v.IMEI), creds,
+		map[string]string{"vin": v.VIN}, &res)
+	return stepResult{err: err, advance: err == nil}
+}
+
+func (p *OnboardingPipeline) decode(ctx context.Context, run Onboarding, v OnboardingVehicle) stepResult {
+	if v.Definition != "" {
+		return stepResult{advance: true}
+	}
+	if p.config.DeveloperJWT == nil || p.config.DefinitionsURL.Host == "" {
+		return stepResult{err: errors.New("the VIN can't be decoded here, give the vehicle's definition in the manifest")}
+	}
+	jwt, err := p.config.DeveloperJWT.GetDeveloperJWT()
+	if err != nil {
+		return stepResult{err: fmt.Errorf("developer authentication unavailable: %w", err)}
+	}
+	var res struct {
+		DeviceDefinitionID string `json:"deviceDefinitionId"`
+	}
+	err = oracleJSON(ctx, p.client, http.MethodPost, p.config.DefinitionsURL.JoinPath("/device-definitions/decode-vin"),
+		JobCredentials{Authorization: "Bearer " + jwt}, map[string]string{"vin": v.VIN, "countryCode": run.CountryCode}, &res)
+	switch {
+	case errors.Is(err, errJobUnauthorized):
+		// the developer JWT, not the submitter's credentials
+		return stepResult{err: errors.New("the definitions api refused the developer JWT")}
+	case err != nil:
+		return stepResult{err: err}
+	case res.DeviceDefinitionID == "":
+		return stepResult{err: errors.New("the VIN could not be decoded")}
+	}
+	definition := strings.ToLower(res.DeviceDefinitionID)
+	return stepResult{advance: true, update: func(v *OnboardingVehicle) { v.Definition = definition }}
+}
+
+// verify submits a batch for verification and polls until every vehicle in it has passed or failed
+func (p *OnboardingPipeline) verify(ctx context.Context, run Onboarding, creds JobCredentials, vehicles []OnboardingVehicle) []stepResult {
+	results := make([]stepResult, len(vehicles))
+	fail := func(err error) []stepResult {
+		for i := range results {
+			results[i] = stepResult{err: err}
+		}
+		return results
+	}
+	base, err := p.oracle(run)
+	if err != nil {
+		return fail(err)
+	}
+	type verifyItem struct {
+		VIN         string `json:"vin"`
+		CountryCode string `json:"countryCode"`
+		Definition  string `json:"definition"`
+	}
+	items := make([]verifyItem, len(vehicles))
+	vins := make([]string, len(vehicles))
+	for i, v := range vehicles {
+		items[i] = verifyItem{VIN: v.VIN, CountryCode: run.CountryCode, Definition: v.Definition}
+		vins[i] = v.VIN
+	}
+	var submitted json.RawMessage
+	if err := oracleJSON(ctx, p.client, http.MethodPost, base.JoinPath("/v1/vehicle/verify"), creds,
+		map[string]any{"vins": items}, &submitted); err != nil {
+		return fail(err)
+	}
+
+	target := base.JoinPath("/v1/vehicle/verify")
+	target.RawQuery = url.Values{"vins": {strings.Join(vins, ",")}}.Encode()
+	deadline := p.now().Add(p.config.VerifyTimeout)
+	for {
+		statuses, err := p.vinStatuses(ctx, target, creds)
+		if err != nil {
+			return fail(err)
+		}
+		waiting := false
+		for i, v := range vehicles {
+			s, ok := statuses[strings.ToUpper(v.VIN)]
+			switch status := strings.ToLower(s.Status); {
+			case ok && status == "success":
+				results[i] = stepResult{advance: true}
+			case ok && (strings.Contains(status, "fail") || strings.Contains(status, "error")):
+				results[i] = stepResult{err: errors.New(strings.TrimSpace("verification failed: " + s.Details))}
+			default:
+				waiting = true
+				results[i] = stepResult{err: errors.New("verification timed out")}
+			}
+		}
+		if !waiting || p.now().After(deadline) {
+			return results
+		}
+		select {
+		case <-ctx.Done():
+			return fail(ctx.Err())
+		case <-time.After(p.config.VerifyPoll):
+		}
+	}
+}
+
+type vinStatus struct {
+	VIN     string `json:"vin"`
+	Status  string `json:"status"`
+	Details string `json:"details"`
+}
+
+func (p *OnboardingPipeline) vinStatuses(ctx context.Context, target *url.URL, creds JobCredentials) (map[string]vinStatus, error) {
+	var res struct {
+		Statuses []vinStatus `json:"statuses"`
+	}
+	if err := oracleJSON(ctx, p.client, http.MethodGet, target, creds, nil, &res); err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]vinStatus, len(res.Statuses))
+	for _, s := range res.Statuses {
+		statuses[strings.ToUpper(s.VIN)] = s
+	}
+	return statuses, nil
+}
+
+// mint submits the mints of a batch. Vehicles signed by their owner are submitted with their signature, the others
+// get their mint data read first: what the oracle can sign is submitted straight away, the rest waits for the
+// owner's signature.
+func (p *OnboardingPipeline) mint(ctx context.Context, run Onboarding, creds JobCredentials, vehicles []OnboardingVehicle) []stepResult {
+	results := make([]stepResult, len(vehicles))
+	base, err := p.oracle(run)
+	if err != nil {
+		for i := range results {
+			results[i] = stepResult{err: err}
+		}
+		return results
+	}
+	type mintItem struct {
+		VIN       string          `json:"vin"`
+		TypedData json.RawMessage `json:"typedData,omitempty"`
+		Signature string          `json:"signature,omitempty"`
+	}
+	var unread []int
+	for i, v := range vehicles {
+		if v.Signature == "" {
+			unread = append(unread, i)
+		}
+	}
+	if len(unread) > 0 {
+		vins := make([]string, len(unread))
+		for j, i := range unread {
+			vins[j] = vehicles[i].VIN
+		}
+		target := base.JoinPath("/v1/vehicle/mint")
+		target.RawQuery = url.Values{"vins": {strings.Join(vins, ",")}}.Encode()
+		var res struct {
+			VinMintingData []mintItem `json:"vinMintingData"`
+		}
+		err := oracleJSON(ctx, p.client, http.MethodGet, target, creds, nil, &res)
+		data := map[string]mintItem{}
+		for _, item := range res.VinMintingData {
+			data[strings.ToUpper(item.VIN)] = item
+		}
+		for _, i := range unread {
+			item, ok := data[strings.ToUpper(vehicles[i].VIN)]
+			switch {
+			case err != nil:
+				results[i] = stepResult{err: err}
+			case !ok:
+				results[i] = stepResult{err: errors.New("no mint data for the vehicle")}
+			case len(item.TypedData) > 0 && string(item.TypedData) != "null":
+				typedData := item.TypedData
+				results[i] = stepResult{status: OnboardingAwaitingSignature, update: func(v *OnboardingVehicle) {
+					v.TypedData = typedData
+				}}
+			}
+		}
+	}
+
+	// the signed ones, and the ones the oracle signs itself
+	var items []mintItem
+	var submit []int
+	for i, v := range vehicles {
+		if results[i].err != nil || results[i].status == OnboardingAwaitingSignature {
+			continue
+		}
+		items = append(items, mintItem{VIN: v.VIN, TypedData: v.TypedData, Signature: v.Signature})
+		submit = append(submit, i)
+	}
+	if len(items) == 0 {
+		return results
+	}
+	body := map[string]any{"vinMintingData": items}
+	if len(run.Sacd) > 0 {
+		body["sacd"] = run.Sacd
+	}
+	var res struct {
+		JobID string `json:"jobId"`
+	}
+	err = oracleJSON(ctx, p.client, http.MethodPost, base.JoinPath("/v1/vehicle/mint"), creds, body, &res)
+	for _, i := range submit {
+		if err != nil {
+			results[i] = stepResult{err: err}
+			continue
+		}
+		job := p.jobs.Track(Job{Kind: JobMint, OracleID: run.OracleID, TenantID: run.TenantID, Subject: run.Subject,
+			VIN: vehicles[i].VIN, OracleJobID: res.JobID}, creds)
+		results[i] = stepResult{status: OnboardingRunning, update: func(v *OnboardingVehicle) {
+			v.JobID, v.TypedData = job.ID, nil
+		}}
+	}
+	return results
+}
+
+// waitForMints waits for the run's submitted mints to finish, moving the minted vehicles on to the fleet stage
+func (p *OnboardingPipeline) waitForMints(ctx context.Context, id string) {
+	for {
+		waiting := false
+		p.mu.Lock()
+		or := p.runs[id]
+		for i, v := range or.run.Vehicles {
+			if v.Stage != StageMint || v.Status != OnboardingRunning || v.JobID == "" {
+				continue
+			}
+			job, ok := p.jobs.Get(v.JobID)
+			switch {
+			case !ok:
+				v.Status, v.Error = OnboardingFailed, "the mint job is no longer tracked"
+			case job.State == JobSucceeded:
+				v.Stage, v.Status, v.Attempts, v.Error = StageFleet, OnboardingPending, 0, ""
+			case job.State.Final():
+				v.Status, v.Error = OnboardingFailed, strings.TrimSpace("mint "+string(job.State)+": "+job.Detail)
+			default:
+				waiting = true
+				continue
+			}
+			v.UpdatedAt = p.now()
+			or.run.Vehicles[i] = v
+			p.storeVehicleLocked(id, v)
+		}
+		p.mu.Unlock()
+		if !waiting {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.config.VerifyPoll):
+		}
+	}
+}
+
+// fleet finds the minted vehicle in the fleet and sets its plate and group. Either failing is a warning, the vehicle
+// is onboarded regardless.
+func (p *OnboardingPipeline) fleet(ctx context.Context, run Onboarding, creds JobCredentials, v OnboardingVehicle) stepResult {
+	if v.Plate == "" && v.Group == "" {
+		return stepResult{advance: true}
+	}
+	base, err := p.oracle(run)
+	if err != nil {
+		return stepResult{err: err}
+	}
+	tokenID := v.TokenID
+	if tokenID == "" {
+		target := base.JoinPath("/v1/fleet/vehicles")
+		target.RawQuery = url.Values{"search": {v.VIN}, "skip": {"0"}, "take": {"10"}}.Encode()
+		var page struct {
+			Items []struct {
+				VIN     string      `json:"vin"`
+				TokenID json.Number `json:"vehicle_token_id"`
+			} `json:"items"`
+		}
+		if err := oracleJSON(ctx, p.client, http.MethodGet, target, creds, nil, &page); err != nil {
+			return stepResult{err: err}
+		}
+		for _, item := range page.Items {
+			if strings.EqualFold(item.VIN, v.VIN) && item.TokenID != "" {
+				tokenID = item.TokenID.String()
+			}
+		}
+		if tokenID == "" {
+			// the fleet may not have caught up with the mint yet
+			return stepResult{err: errors.New("the minted vehicle isn't in the fleet yet")}
+		}
+	}
+
+	var warnings []string
+	var res json.RawMessage
+	if v.Plate != "" {
+		err := oracleJSON(ctx, p.client, http.MethodPatch, base.JoinPath("/v1/fleet/vehicles", tokenID, "license-plate"),
+			creds, map[string]string{"license_plate": v.Plate}, &res)
+		if errors.Is(err, errJobUnauthorized) {
+			return stepResult{err: err}
+		}
+		if err != nil {
+			warnings = append(warnings, "plate not set: "+err.Error())
+		}
+	}
+	if v.Group != "" {
+		err := oracleJSON(ctx, p.client, http.MethodPost, base.JoinPath("/v1/fleet/vehicles", tokenID, "group", v.Group),
+			creds, nil, &res)
+		if errors.Is(err, errJobUnauthorized) {
+			return stepResult{err: err}
+		}
+		if err != nil {
+			warnings = append(warnings, "group not set: "+err.Error())
+		}
+	}
+	return stepResult{advance: true, update: func(v *OnboardingVehicle) {
+		v.TokenID, v.Warnings = tokenID, warnings
+	}}
+}
+
+// compactLocked drops the runs done more than Retention ago, and rewrites the store with the rest once it holds more
+// than factor times the records they take, see runStore.compact
+func (p *OnboardingPipeline) compactLocked(factor int) {
+	cutoff := p.now().Add(-p.config.Retention)
+	runs := make([]storedRun[Onboarding, OnboardingVehicle], 0, len(p.runs))
+	for id, or := range p.runs {
+		if !or.running && or.run.State == OnboardingRunDone && or.run.UpdatedAt.Before(cutoff) {
+			delete(p.runs, id)
+			continue
+		}
+		runs = append(runs, storedRun[Onboarding, OnboardingVehicle]{ID: id, Run: onboardingHeader(or.run), Rows: or.run.Vehicles})
+	}
+	slices.SortFunc(runs, func(a, b storedRun[Onboarding, OnboardingVehicle]) int {
+		return a.Run.CreatedAt.Compare(b.Run.CreatedAt)
+	})
+	if err := p.store.compact(runs, factor); err != nil {
+		p.logger.Err(err).Msg("failed to compact onboardings")
+	}
+}
+
+func (p *OnboardingPipeline) storeRunLocked(or *onboardingRun) {
+	if err := p.store.appendRun(or.run.ID, onboardingHeader(or.run)); err != nil {
+		p.logger.Err(err).Str("onboardingId", or.run.ID).Msg("failed to store onboarding")
+	}
+}
+
+func (p *OnboardingPipeline) storeVehicleLocked(id string, v OnboardingVehicle) {
+	if err := p.store.appendRow(id, v); err != nil {
+		p.logger.Err(err).Str("onboardingId", id).Int("row", v.Row).Msg("failed to store onboarding vehicle")
+	}
+}
+
+// onboardingHeader is the run without its vehicles, as stored
+func onboardingHeader(run Onboarding) Onboarding {
+	run.Vehicles, run.Stages, run.Counts = nil, nil, nil
+	return run
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestOnboardingPipeline(t *testing.T) {
+	const (
+		serverSigned = "1HGCM82633A004352"
+		ownerSigned  = "5YJSA1E26HF000337"
+	)
+	tokenIDs := map[string]string{serverSigned: "101", ownerSigned: "102"}
+	var mu sync.Mutex
+	calls := map[string]int{}
+	var mints []string
+	var verifyPolls atomic.Int32
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.Method + " " + r.URL.Path
+		calls[key]++
+		switch {
+		case key == "POST /v1/pending-vehicle/vin-to-imei/356938035643809" && calls[key] == 1:
+			// a blip, retried
+			w.WriteHeader(http.StatusBadGateway)
+		case key == "GET /v1/vehicle/verify":
+			status := "Pending"
+			if verifyPolls.Add(1) > 1 {
+				status = "Success"
+			}
+			var statuses []map[string]string
+			for _, vin := range strings.Split(r.URL.Query().Get("vins"), ",") {
+				statuses = append(statuses, map[string]string{"vin": vin, "status": status})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"statuses": statuses})
+		case key == "GET /v1/vehicle/mint":
+			_, _ = w.Write([]byte(`{"vinMintingData":[{"vin":"` + serverSigned + `","typedData":null},
+				{"vin":"` + ownerSigned + `","typedData":{"primaryType":"MintVehicleWithDeviceDefinitionSign"}}]}`))
+		case key == "POST /v1/vehicle/mint":
+			var req struct {
+				VinMintingData []struct {
+					VIN       string `json:"vin"`
+					Signature string `json:"signature"`
+				} `json:"vinMintingData"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			for _, item := range req.VinMintingData {
+				mints = append(mints, item.VIN+":"+item.Signature)
+			}
+			_, _ = w.Write([]byte(`{"jobId":"mint-1"}`))
+		case key == "GET /v1/fleet/vehicles":
+			vin := r.URL.Query().Get("search")
+			_, _ = w.Write([]byte(`{"items":[{"vin":"` + vin + `","vehicle_token_id":` + tokenIDs[vin] + `}]}`))
+		case key == "PATCH /v1/fleet/vehicles/101/license-plate":
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"message":"plate already in use"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer oracle.Close()
+	definitions := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer dev-jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"deviceDefinitionId":"Tesla_Model_S_2017"}`))
+	}))
+	defer definitions.Close()
+
+	u, _ := url.Parse(oracle.URL)
+	d, _ := url.Parse(definitions.URL)
+	urls := map[string]url.URL{"kaufmann": *u}
+	dir := t.TempDir()
+	jobs := NewJobTracker(zerolog.Nop(), JobTrackerConfig{StorePath: filepath.Join(dir, "jobs.jsonl"), OracleURLs: urls})
+	config := OnboardingConfig{
+		StorePath:      filepath.Join(dir, "onboarding.jsonl"),
+		OracleURLs:     urls,
+		DefinitionsURL: *d,
+		DeveloperJWT:   stubDeveloperJWT{},
+		Backoff:        time.Millisecond,
+		VerifyPoll:     time.Millisecond,
+	}
+	pipeline := NewOnboardingPipeline(zerolog.Nop(), config, jobs)
+	creds := JobCredentials{Authorization: "Bearer token", TenantID: "t1"}
+
+	run := pipeline.Start(Onboarding{OracleID: "kaufmann", TenantID: "t1", Subject: "alice", CountryCode: "USA", Vehicles: []OnboardingVehicle{
+		{VIN: serverSigned, IMEI: "356938035643809", Plate: "ABC123", Group: "g1", Definition: "honda_accord_2003"},
+		{VIN: ownerSigned, IMEI: "356938035643817", Group: "g1"},
+	}}, creds)
+	waitFor := func(what string, cond func(Onboarding) bool) Onboarding {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(2 * time.Millisecond) {
+			if got, _ := pipeline.Get(run.ID); cond(got) {
+				return got
+			}
+		}
+		got, _ := pipeline.Get(run.ID)
+		t.Fatalf("timed out waiting for %s: %+v", what, got)
+		return Onboarding{}
+	}
+	// the mint job the oracle runs, finished here by hand
+	finishMint := func(row int) {
+		t.Helper()
+		got := waitFor("the mint job", func(o Onboarding) bool { return o.Vehicles[row].JobID != "" })
+		jobs.polled(got.Vehicles[row].JobID, JobSucceeded, "Success", nil)
+	}
+
+	finishMint(0)
+	run = waitFor("the signature", func(o Onboarding) bool { return o.State == OnboardingRunAwaitingSignature })
+	minted, waiting := run.Vehicles[0], run.Vehicles[1]
+	if minted.Stage != StageDone || minted.Status != OnboardingSucceeded || minted.TokenID != "101" ||
+		len(minted.Warnings) != 1 || !strings.Contains(minted.Warnings[0], "plate already in use") {
+		t.Errorf("expected the server signed vehicle onboarded with a plate warning, got %+v", minted)
+	}
+	if waiting.Stage != StageMint || waiting.Status != OnboardingAwaitingSignature || waiting.Definition != "tesla_model_s_2017" ||
+		!strings.Contains(string(waiting.TypedData), "MintVehicleWithDeviceDefinitionSign") {
+		t.Errorf("expected the owner's vehicle decoded and awaiting its signature, got %+v", waiting)
+	}
+	if calls["POST /v1/pending-vehicle/vin-to-imei/356938035643809"] != 2 {
+		t.Errorf("expected the failed link retried, got %d calls", calls["POST /v1/pending-vehicle/vin-to-imei/356938035643809"])
+	}
+
+	if _, err := pipeline.Sign(run.ID, "alice", creds, []OnboardingSignature{{VIN: serverSigned, Signature: "0x01"}}); err != ErrNothingToSign {
+		t.Errorf("expected a signature for a minted vehicle refused, got %v", err)
+	}
+	if _, err := pipeline.Sign(run.ID, "alice", creds, []OnboardingSignature{{VIN: ownerSigned, Signature: "0xabcd"}}); err != nil {
+		t.Fatal(err)
+	}
+	finishMint(1)
+	run = waitFor("the run to finish", func(o Onboarding) bool { return o.State == OnboardingRunDone })
+	if run.Counts[OnboardingSucceeded] != 2 || run.Vehicles[1].TokenID != "102" {
+		t.Errorf("expected both vehicles onboarded, got %+v", run)
+	}
+	mu.Lock()
+	if len(mints) != 2 || mints[0] != serverSigned+":" || mints[1] != ownerSigned+":0xabcd" {
+		t.Errorf("unexpected mints %v", mints)
+	}
+	mu.Unlock()
+
+	// a restart reloads the run as it was
+	reloaded := NewOnboardingPipeline(zerolog.Nop(), config, jobs)
+	if again, _ := reloaded.Get(run.ID); again.State != OnboardingRunDone || len(again.Vehicles) != 2 || again.Vehicles[1].Stage != StageDone {
+		t.Errorf("unexpected reloaded run %+v", again)
+	}
+}
+
+func TestOnboardingPipeline_DecodeWithoutDeveloperJWT(t *testing.T) {
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer oracle.Close()
+	u, _ := url.Parse(oracle.URL)
+	urls := map[string]url.URL{"kaufmann": *u}
+	dir := t.TempDir()
+	jobs := NewJobTracker(zerolog.Nop(), JobTrackerConfig{StorePath: filepath.Join(dir, "jobs.jsonl"), OracleURLs: urls})
+	pipeline := NewOnboardingPipeline(zerolog.Nop(), OnboardingConfig{
+		StorePath: filepath.Join(dir, "onboarding.jsonl"), OracleURLs: urls, Backoff: time.Millisecond,
+	}, jobs)
+
+	run := pipeline.Start(Onboarding{OracleID: "kaufmann", TenantID: "t1", CountryCode: "USA", Vehicles: []OnboardingVehicle{
+		{VIN: "1HGCM82633A004352", IMEI: "356938035643809"},
+	}}, JobCredentials{Authorization: "Bearer token"})
+	for deadline := time.Now().Add(5 * time.Second); run.State == OnboardingRunRunning && time.Now().Before(deadline); {
+		time.Sleep(2 * time.Millisecond)
+		run, _ = pipeline.Get(run.ID)
+	}
+	if v := run.Vehicles[0]; run.State != OnboardingRunDone || v.Stage != StageDecode || v.Status != OnboardingFailed ||
+		v.Attempts != 3 || !strings.Contains(v.Error, "definition in the manifest") {
+		t.Errorf("expected decoding failed after 3 attempts, got %+v", run)
+	}
+}
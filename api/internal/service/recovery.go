@@ -0,0 +1,705 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/rs/zerolog"
+)
+
+// ChainKind is a multi-step operation on a vehicle that Recovery follows
+type ChainKind string
+
+const (
+	// ChainOnboarding is a vehicle of an onboarding run, linked, decoded, verified and minted in turn, see
+	// OnboardingPipeline. The pipeline records its own steps, a vehicle only becomes a chain once it's left half
+	// onboarded: past linking, and failed or stalled.
+	ChainOnboarding ChainKind = "onboarding"
+	// ChainSharedDelete is a shared account delete, which the oracle runs as a disconnect then a burn. Every delete
+	// job the tracker follows is one.
+	ChainSharedDelete ChainKind = "shared_delete"
+)
+
+// ChainState is where a chain is as a whole
+type ChainState string
+
+const (
+	ChainRunning   ChainState = "running"
+	ChainSucceeded ChainState = "succeeded"
+	ChainFailed    ChainState = "failed"
+	// ChainStalled is a chain that stopped without failing: its onboarding was interrupted, a step made no progress for
+	// RecoveryConfig.StallAfter, or its job waits for credentials
+	ChainStalled    ChainState = "stalled"
+	ChainRolledBack ChainState = "rolled_back"
+)
+
+// ChainStepState is where a step of a chain is
+type ChainStepState string
+
+const (
+	StepPending   ChainStepState = "pending"
+	StepRunning   ChainStepState = "running"
+	StepSucceeded ChainStepState = "succeeded"
+	StepFailed    ChainStepState = "failed"
+	// StepUnknown is a step the oracle ran as part of another, whose outcome it didn't report with it
+	StepUnknown ChainStepState = "unknown"
+	// StepCompensated is a step a rollback undid
+	StepCompensated ChainStepState = "compensated"
+)
+
+// ChainAction is what can be done about a failed or stalled chain
+type ChainAction string
+
+const (
+	// ChainResume carries on from the step that failed or stalled
+	ChainResume ChainAction = "resume"
+	// ChainRollback undoes the steps that went through, only onboardings not minted yet can be
+	ChainRollback ChainAction = "rollback"
+)
+
+// chain event actions besides resume and rollback
+const (
+	chainRecorded = "recorded"
+	chainObserved = "observed"
+)
+
+var (
+	ErrChainNotFound = errors.New("operation not found")
+	// ErrChainAction is an action the chain doesn't offer in its state, or one already running
+	ErrChainAction = errors.New("action not allowed")
+	// ErrCompensationFailed is the oracle refusing a resume or rollback call, recorded in the chain's trail
+	ErrCompensationFailed = errors.New("compensating call failed")
+)
+
+type ChainStep struct {
+	Name   string         `json:"name"`
+	State  ChainStepState `json:"state"`
+	Detail string         `json:"detail,omitempty"`
+}
+
+// ChainCall is an oracle call a recovery action made. Error is empty when it went through.
+type ChainCall struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ChainEvent is an entry of a chain's trail: recorded, observed when the BFF saw its state change, resume or
+// rollback. Subject is who acted, empty for what the BFF observed.
+type ChainEvent struct {
+	At      time.Time   `json:"at"`
+	Subject string      `json:"subject,omitempty"`
+	Action  string      `json:"action"`
+	Detail  string      `json:"detail,omitempty"`
+	Calls   []ChainCall `json:"calls,omitempty"`
+}
+
+// Chain is a multi-step operation on one vehicle, with its steps, the actions it offers and the trail of everything
+// seen and done about it
+type Chain struct {
+	ID       string    `json:"id"`
+	Kind     ChainKind `json:"kind"`
+	OracleID string    `json:"oracleId"`
+	TenantID string    `json:"tenantId,omitempty"`
+	// Subject submitted the operation
+	Subject string `json:"subject,omitempty"`
+	VIN     string `json:"vin,omitempty"`
+	IMEI    string `json:"imei,omitempty"`
+	TokenID string `json:"tokenId,omitempty"`
+	// JobIDs are the tracker's jobs of a shared delete, the last is the current one
+	JobIDs []string `json:"jobIds,omitempty"`
+	// OnboardingID and Row are the run and manifest row of an onboarding
+	OnboardingID string        `json:"onboardingId,omitempty"`
+	Row          int           `json:"row,omitempty"`
+	State        ChainState    `json:"state"`
+	Detail       string        `json:"detail,omitempty"`
+	Steps        []ChainStep   `json:"steps"`
+	Actions      []ChainAction `json:"actions"`
+	Trail        []ChainEvent  `json:"trail"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	UpdatedAt    time.Time     `json:"updatedAt"`
+}
+
+// ChainFilter narrows List, empty fields match everything
+type ChainFilter struct {
+	OracleID string
+	TenantID string
+	Kind     ChainKind
+	State    ChainState
+}
+
+// RecoveryConfig configures recovery. Zero values take the defaults.
+type RecoveryConfig struct {
+	// StorePath is the JSONL file chains are recorded in, and reloaded from on start
+	StorePath string
+	// OracleURLs are the oracle base urls by oracle id
+	OracleURLs map[string]url.URL
+	// StallAfter is how long a step may go without progress before its chain is stalled, default 30m
+	StallAfter time.Duration
+	// OnSubmitted is called with the token id of every delete a resume submitted
+	OnSubmitted func(tokenID string)
+}
+
+// Recovery records the steps of the multi-step operations the BFF runs or follows, shared account deletes and
+// onboardings, spots those that failed or stalled half way, and resumes or rolls them back with the calls that would
+// otherwise be made by hand: a delete submitted again, an onboarding retried, or reset on the oracle. Every change
+// seen and every action taken, with its calls, goes in the chain's trail.
+type Recovery struct {
+	logger     zerolog.Logger
+	config     RecoveryConfig
+	jobs       *JobTracker
+	onboarding *OnboardingPipeline
+	store      *store.JSONL[Chain]
+	client     *http.Client
+	now        func() time.Time
+
+	mu     sync.Mutex
+	chains map[string]*Chain
+	// byJob is the chain of each delete job, byVehicle of each onboarding vehicle, by run id and row
+	byJob     map[string]string
+	byVehicle map[string]string
+	// busy are the chains a resume or rollback is running for
+	busy map[string]bool
+	// logged counts the records in the store, compactLocked brings it back to one per chain
+	logged int
+}
+
+// NewRecovery loads the chains in the store. Either of jobs and onboarding may be nil, their chains aren't followed
+// then.
+func NewRecovery(logger zerolog.Logger, config RecoveryConfig, jobs *JobTracker, onboarding *OnboardingPipeline) *Recovery {
+	if config.StallAfter <= 0 {
+		config.StallAfter = 30 * time.Minute
+	}
+	r := &Recovery{
+		logger:     logger,
+		config:     config,
+		jobs:       jobs,
+		onboarding: onboarding,
+		store:      store.NewJSONL[Chain](config.StorePath),
+		client:     &http.Client{Timeout: 30 * time.Second},
+		now:        time.Now,
+		chains:     map[string]*Chain{},
+		byJob:      map[string]string{},
+		byVehicle:  map[string]string{},
+		busy:       map[string]bool{},
+	}
+	// the store has every change, the last one of a chain wins
+	err := r.store.Scan(func(chain Chain) bool {
+		r.indexLocked(&chain)
+		r.logged++
+		return true
+	})
+	if err != nil {
+		logger.Err(err).Msg("failed to load recovery chains")
+	} else if r.logged > len(r.chains) {
+		r.compactLocked()
+	}
+	return r
+}
+
+// Start syncs the chains with the tracker and the pipeline now and every minute until ctx is done, so failures and
+// stalls are recorded as they happen rather than when someone looks
+func (r *Recovery) Start(ctx context.Context) {
+	go func() {
+		r.Sync()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Sync()
+			}
+		}
+	}()
+}
+
+// Sync records the delete jobs and half onboarded vehicles not recorded yet, and the state changes of the rest
+func (r *Recovery) Sync() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.jobs != nil {
+		jobs := r.jobs.List(JobFilter{Kind: JobDelete})
+		// oldest first, so a delete submitted again by hand joins the chain of the first
+		slices.Reverse(jobs)
+		for _, job := range jobs {
+			r.syncJobLocked(job)
+		}
+	}
+	if r.onboarding != nil {
+		for _, run := range r.onboarding.Runs() {
+			for _, v := range run.Vehicles {
+				r.syncVehicleLocked(run, v)
+			}
+		}
+	}
+	for _, chain := range r.chains {
+		r.refreshLocked(chain)
+	}
+	// every change stores the whole chain again, trail and all
+	if r.logged > 2*len(r.chains) {
+		r.compactLocked()
+	}
+}
+
+// List returns the chains matching the filter, as of the last Sync, newest first
+func (r *Recovery) List(filter ChainFilter) []Chain {
+	r.mu.Lock()
+	var chains []Chain
+	for _, chain := range r.chains {
+		if (filter.OracleID == "" || chain.OracleID == filter.OracleID) &&
+			(filter.TenantID == "" || chain.TenantID == filter.TenantID) &&
+			(filter.Kind == "" || chain.Kind == filter.Kind) &&
+			(filter.State == "" || chain.State == filter.State) {
+			chains = append(chains, snapshotChain(chain))
+		}
+	}
+	r.mu.Unlock()
+	slices.SortFunc(chains, func(a, b Chain) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return chains
+}
+
+// Get returns a chain by id, as of the last Sync
+func (r *Recovery) Get(id string) (Chain, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	chain, ok := r.chains[id]
+	if !ok {
+		return Chain{}, false
+	}
+	return snapshotChain(chain), true
+}
+
+// Inspect asks the oracle, with creds, how far the failed shared deletes of the tenant got before they failed: the
+// oracle only reports the burn, not the disconnect it chained first
+func (r *Recovery) Inspect(ctx context.Context, oracleID, tenantID string, creds JobCredentials) {
+	r.mu.Lock()
+	var vins []string
+	for _, chain := range r.chains {
+		if chain.Kind == ChainSharedDelete && chain.OracleID == oracleID && chain.TenantID == tenantID &&
+			chain.State == ChainFailed && chain.VIN != "" && chain.Steps[0].State == StepUnknown {
+			vins = append(vins, chain.VIN)
+		}
+	}
+	r.mu.Unlock()
+	base, ok := r.config.OracleURLs[oracleID]
+	if len(vins) == 0 || !ok {
+		return
+	}
+
+	target := base.JoinPath("/v1/vehicle/disconnect/status")
+	target.RawQuery = url.Values{"vins": {strings.Join(vins, ",")}}.Encode()
+	var res struct {
+		Statuses []struct {
+			VIN     string `json:"vin"`
+			Status  string `json:"status"`
+			Details string `json:"details"`
+		} `json:"statuses"`
+	}
+	if err := oracleJSON(ctx, r.client, http.MethodGet, target, creds, nil, &res); err != nil {
+		r.logger.Warn().Err(err).Msg("failed to read the disconnect status of failed shared deletes")
+		return
+	}
+	statuses := map[string]ChainStep{}
+	for _, s := range res.Statuses {
+		step := ChainStep{Name: "disconnect", State: StepRunning, Detail: strings.TrimSpace(s.Status + " " + s.Details)}
+		switch status := strings.ToLower(s.Status); {
+		case status == "success":
+			step.State = StepSucceeded
+		case strings.Contains(status, "fail") || strings.Contains(status, "error"):
+			step.State = StepFailed
+		}
+		statuses[strings.ToUpper(s.VIN)] = step
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, chain := range r.chains {
+		step, ok := statuses[strings.ToUpper(chain.VIN)]
+		if !ok || chain.Kind != ChainSharedDelete || chain.OracleID != oracleID || chain.TenantID != tenantID ||
+			chain.State != ChainFailed || chain.Steps[0].State != StepUnknown {
+			continue
+		}
+		chain.Steps[0] = step
+		detail := "the oracle reports the disconnect as " + string(step.State)
+		if step.State == StepSucceeded {
+			detail = "the vehicle was disconnected but not deleted"
+		}
+		r.changedLocked(chain, ChainEvent{Action: chainObserved, Detail: detail})
+	}
+}
+
+// Resume carries the chain on from where it stopped, with the caller's creds. A shared delete that failed is submitted
+// again, one whose job waits for credentials gets the caller's. An onboarding vehicle is retried by its run.
+func (r *Recovery) Resume(ctx context.Context, id, subject string, creds JobCredentials) (Chain, error) {
+	chain, err := r.begin(id, ChainResume)
+	if err != nil {
+		return Chain{}, err
+	}
+	defer r.end(id)
+
+	event := ChainEvent{Subject: subject, Action: string(ChainResume)}
+	switch {
+	case chain.Kind == ChainOnboarding:
+		if _, err := r.onboarding.Resume(chain.OnboardingID, subject, creds, chain.VIN); err != nil {
+			return Chain{}, err
+		}
+		event.Detail = "retried by onboarding " + chain.OnboardingID
+	case chain.State == ChainStalled:
+		job, _ := r.jobs.Get(chain.JobIDs[len(chain.JobIDs)-1])
+		r.jobs.Authorize(job.OracleID, job.TenantID, job.Subject, creds)
+		event.Detail = "handed the delete job fresh credentials"
+	default:
+		return r.resubmitDelete(ctx, chain, event, creds)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.chains[id]
+	r.changedLocked(c, event)
+	r.refreshLocked(c)
+	return snapshotChain(c), nil
+}
+
+// resubmitDelete submits a failed shared delete again and follows its new job in the chain
+func (r *Recovery) resubmitDelete(ctx context.Context, chain Chain, event ChainEvent, creds JobCredentials) (Chain, error) {
+	base, ok := r.config.OracleURLs[chain.OracleID]
+	if !ok {
+		return Chain{}, fmt.Errorf("%w: unknown oracle %s", ErrChainAction, chain.OracleID)
+	}
+	target := base.JoinPath("/v1/vehicle/delete/shared")
+	var res struct {
+		JobID json.RawMessage `json:"jobId"`
+	}
+	err := oracleJSON(ctx, r.client, http.MethodPost, target, creds, map[string]json.Number{"tokenId": json.Number(chain.TokenID)}, &res)
+	event.Calls = []ChainCall{chainCall(http.MethodPost, target, err)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.chains[chain.ID]
+	if err != nil {
+		event.Detail = "the oracle refused the delete"
+		r.changedLocked(c, event)
+		return snapshotChain(c), fmt.Errorf("%w: %v", ErrCompensationFailed, err)
+	}
+	if r.config.OnSubmitted != nil {
+		r.config.OnSubmitted(chain.TokenID)
+	}
+	// tracked under the lock, so a sync can't take the new job for another chain
+	job := r.jobs.Track(Job{
+		Kind: JobDelete, OracleJobID: strings.Trim(string(res.JobID), `"`), OracleID: chain.OracleID,
+		TenantID: chain.TenantID, Subject: event.Subject, TokenID: chain.TokenID, VIN: chain.VIN,
+	}, creds)
+	c.JobIDs = append(c.JobIDs, job.ID)
+	r.byJob[job.ID] = c.ID
+	event.Detail = "submitted the delete again as job " + job.ID
+	r.changedLocked(c, event)
+	r.refreshLocked(c)
+	return snapshotChain(c), nil
+}
+
+// Rollback undoes a half onboarded vehicle on the oracle with the caller's creds: reset-onboarding, or with force the
+// oracle's forced reset, for a vehicle reset-onboarding refuses. The device goes back to pending. Shared deletes
+// can't be rolled back, neither the disconnect nor the burn can be undone.
+func (r *Recovery) Rollback(ctx context.Context, id, subject string, creds JobCredentials, force bool) (Chain, error) {
+	chain, err := r.begin(id, ChainRollback)
+	if err != nil {
+		return Chain{}, err
+	}
+	defer r.end(id)
+	// the run's pass could be at the vehicle
+	if run, ok := r.onboarding.Get(chain.OnboardingID); ok && run.State == OnboardingRunRunning {
+		return Chain{}, ErrOnboardingRunning
+	}
+	base, ok := r.config.OracleURLs[chain.OracleID]
+	if !ok {
+		return Chain{}, fmt.Errorf("%w: unknown oracle %s", ErrChainAction, chain.OracleID)
+	}
+
+	target := base.JoinPath("/v1/vehicle/reset-onboarding", chain.IMEI)
+	if force {
+		target = base.JoinPath("/v1/vehicle/force", chain.IMEI)
+	}
+	var res json.RawMessage
+	err = oracleJSON(ctx, r.client, http.MethodDelete, target, creds, nil, &res)
+	event := ChainEvent{Subject: subject, Action: string(ChainRollback), Calls: []ChainCall{chainCall(http.MethodDelete, target, err)}}
+	if err == nil {
+		event.Detail = "the device is back to pending"
+		_, err = r.onboarding.RollBack(chain.OnboardingID, chain.Row, "rolled back by "+cmp.Or(subject, "an unknown caller"))
+	} else {
+		event.Detail = "the oracle refused the reset"
+		err = fmt.Errorf("%w: %v", ErrCompensationFailed, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.chains[id]
+	r.changedLocked(c, event)
+	r.refreshLocked(c)
+	return snapshotChain(c), err
+}
+
+// begin claims the chain for an action it offers, see end
+func (r *Recovery) begin(id string, action ChainAction) (Chain, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	chain, ok := r.chains[id]
+	switch {
+	case !ok:
+		return Chain{}, ErrChainNotFound
+	case r.busy[id]:
+		return Chain{}, fmt.Errorf("%w: a resume or rollback is already running", ErrChainAction)
+	case !slices.Contains(chain.Actions, action):
+		return Chain{}, fmt.Errorf("%w: a %s chain that is %s can't %s", ErrChainAction, chain.Kind, chain.State, action)
+	}
+	r.busy[id] = true
+	return snapshotChain(chain), nil
+}
+
+func (r *Recovery) end(id string) {
+	r.mu.Lock()
+	delete(r.busy, id)
+	r.mu.Unlock()
+}
+
+// syncJobLocked records a delete job, in the chain of its vehicle when one is still open
+func (r *Recovery) syncJobLocked(job Job) {
+	if _, ok := r.byJob[job.ID]; ok {
+		return
+	}
+	for _, chain := range r.chains {
+		if chain.Kind == ChainSharedDelete && chain.OracleID == job.OracleID && chain.TenantID == job.TenantID &&
+			job.TokenID != "" && chain.TokenID == job.TokenID && (chain.State == ChainFailed || chain.State == ChainStalled) {
+			chain.JobIDs = append(chain.JobIDs, job.ID)
+			r.byJob[job.ID] = chain.ID
+			r.changedLocked(chain, ChainEvent{Subject: job.Subject, Action: chainObserved, Detail: "the delete was submitted again as job " + job.ID})
+			return
+		}
+	}
+	chain := &Chain{
+		ID: newJobID(), Kind: ChainSharedDelete, OracleID: job.OracleID, TenantID: job.TenantID, Subject: job.Subject,
+		VIN: job.VIN, TokenID: job.TokenID, JobIDs: []string{job.ID}, State: ChainRunning,
+		Steps:     []ChainStep{{Name: "disconnect", State: StepRunning}, {Name: "delete", State: StepPending}},
+		CreatedAt: job.CreatedAt,
+	}
+	r.indexLocked(chain)
+	r.changedLocked(chain, ChainEvent{Subject: job.Subject, Action: chainRecorded, Detail: "delete job " + job.ID})
+}
+
+// syncVehicleLocked records an onboarding vehicle once it's half onboarded and failed or stalled
+func (r *Recovery) syncVehicleLocked(run Onboarding, v OnboardingVehicle) {
+	if _, ok := r.byVehicle[vehicleKey(run.ID, v.Row)]; ok || v.Stage == StageLink || v.Stage == StageDone {
+		return
+	}
+	state, detail, _ := r.onboardingState(run, v)
+	if state != ChainFailed && state != ChainStalled {
+		return
+	}
+	chain := &Chain{
+		ID: newJobID(), Kind: ChainOnboarding, OracleID: run.OracleID, TenantID: run.TenantID, Subject: run.Subject,
+		VIN: v.VIN, IMEI: v.IMEI, TokenID: v.TokenID, OnboardingID: run.ID, Row: v.Row, State: ChainRunning,
+		CreatedAt: run.CreatedAt,
+	}
+	r.indexLocked(chain)
+	r.changedLocked(chain, ChainEvent{Action: chainRecorded, Detail: fmt.Sprintf("row %d of onboarding %s: %s", v.Row, run.ID, detail)})
+}
+
+// refreshLocked brings the chain's state and steps in line with its job or onboarding vehicle, recording a change of
+// state in the trail
+func (r *Recovery) refreshLocked(chain *Chain) {
+	var state ChainState
+	var detail string
+	var steps []ChainStep
+	rollback := false
+	switch chain.Kind {
+	case ChainSharedDelete:
+		if r.jobs == nil {
+			return
+		}
+		job, ok := r.jobs.Get(chain.JobIDs[len(chain.JobIDs)-1])
+		if !ok {
+			// gone from the tracker after its retention, the last state seen stands
+			return
+		}
+		state, detail, steps = sharedDeleteState(job, chain.Steps)
+	case ChainOnboarding:
+		if r.onboarding == nil {
+			return
+		}
+		run, ok := r.onboarding.Get(chain.OnboardingID)
+		if !ok || chain.Row > len(run.Vehicles) {
+			return
+		}
+		v := run.Vehicles[chain.Row-1]
+		state, detail, steps = r.onboardingState(run, v)
+		chain.TokenID = v.TokenID
+		rollback = r.rollbackable(v)
+	}
+
+	chain.Steps = steps
+	chain.Actions = []ChainAction{}
+	if state == ChainFailed || state == ChainStalled {
+		chain.Actions = append(chain.Actions, ChainResume)
+		if rollback {
+			chain.Actions = append(chain.Actions, ChainRollback)
+		}
+	}
+	if state == chain.State && detail == chain.Detail {
+		return
+	}
+	chain.State, chain.Detail = state, detail
+	r.changedLocked(chain, ChainEvent{Action: chainObserved, Detail: strings.TrimSpace(string(state) + " " + detail)})
+}
+
+// sharedDeleteState reads the chain from its current delete job. The oracle polls the burn, the disconnect before it
+// is only known to have gone through once the burn has; until Inspect asks, a failed delete's disconnect is unknown.
+func sharedDeleteState(job Job, previous []ChainStep) (ChainState, string, []ChainStep) {
+	disconnect := ChainStep{Name: "disconnect", State: StepRunning}
+	remove := ChainStep{Name: "delete", State: StepPending}
+	switch job.State {
+	case JobSucceeded:
+		disconnect.State, remove.State = StepSucceeded, StepSucceeded
+		return ChainSucceeded, "", []ChainStep{disconnect, remove}
+	case JobFailed, JobTimedOut:
+		disconnect.State = StepUnknown
+		if len(previous) > 0 && previous[0].State != StepRunning {
+			disconnect = previous[0]
+		}
+		remove.State, remove.Detail = StepFailed, job.Detail
+		return ChainFailed, cmp.Or(job.Detail, "the delete "+strings.ReplaceAll(string(job.State), "_", " ")), []ChainStep{disconnect, remove}
+	case JobAwaitingAuth:
+		return ChainStalled, "the delete job waits for credentials, resume to hand it yours", []ChainStep{disconnect, remove}
+	}
+	return ChainRunning, job.Detail, []ChainStep{disconnect, remove}
+}
+
+// onboardingState reads the chain from its onboarding vehicle: the stages before the vehicle's are done, a roll back
+// undid them
+func (r *Recovery) onboardingState(run Onboarding, v OnboardingVehicle) (ChainState, string, []ChainStep) {
+	current := slices.Index(OnboardingStages, v.Stage)
+	if v.Stage == StageDone {
+		current = len(OnboardingStages)
+	}
+	steps := make([]ChainStep, len(OnboardingStages))
+	for i, stage := range OnboardingStages {
+		steps[i] = ChainStep{Name: string(stage), State: StepPending}
+		switch {
+		case i < current && v.Status == OnboardingRolledBack:
+			steps[i].State = StepCompensated
+		case i < current:
+			steps[i].State = StepSucceeded
+		case i == current && (v.Status == OnboardingFailed || v.Status == OnboardingRolledBack):
+			steps[i].State, steps[i].Detail = StepFailed, v.Error
+		case i == current && v.Status != OnboardingPending:
+			steps[i].State = StepRunning
+		}
+	}
+
+	switch {
+	case v.Stage == StageDone:
+		return ChainSucceeded, "", steps
+	case v.Status == OnboardingRolledBack:
+		return ChainRolledBack, v.Error, steps
+	case v.Status == OnboardingFailed:
+		return ChainFailed, v.Error, steps
+	case v.Status == OnboardingAwaitingSignature:
+		return ChainRunning, "waiting for the owner's signature of the mint data", steps
+	case run.State != OnboardingRunRunning:
+		return ChainStalled, cmp.Or(run.Detail, "the onboarding stopped before the vehicle was through"), steps
+	case v.Status == OnboardingRunning && r.now().Sub(v.UpdatedAt) > r.config.StallAfter:
+		return ChainStalled, fmt.Sprintf("no progress in the %s stage since %s", v.Stage, v.UpdatedAt.UTC().Format(time.RFC3339)), steps
+	}
+	return ChainRunning, "", steps
+}
+
+// rollbackable says the vehicle can be reset on the oracle: it's past linking and not minted, nor has a mint job that
+// may still mint it
+func (r *Recovery) rollbackable(v OnboardingVehicle) bool {
+	switch {
+	case v.IMEI == "" || v.TokenID != "" || v.Stage == StageLink || v.Stage == StageFleet || v.Stage == StageDone:
+		return false
+	case v.Stage == StageMint && v.JobID != "":
+		if r.jobs == nil {
+			return false
+		}
+		job, ok := r.jobs.Get(v.JobID)
+		return ok && (job.State == JobFailed || job.State == JobTimedOut)
+	}
+	return true
+}
+
+func (r *Recovery) indexLocked(chain *Chain) {
+	r.chains[chain.ID] = chain
+	for _, id := range chain.JobIDs {
+		r.byJob[id] = chain.ID
+	}
+	if chain.OnboardingID != "" {
+		r.byVehicle[vehicleKey(chain.OnboardingID, chain.Row)] = chain.ID
+	}
+}
+
+// changedLocked adds the event to the chain's trail and stores the chain
+func (r *Recovery) changedLocked(chain *Chain, event ChainEvent) {
+	event.At = r.now()
+	chain.Trail = append(chain.Trail, event)
+	chain.UpdatedAt = event.At
+	if err := r.store.Append(*chain); err != nil {
+		r.logger.Err(err).Str("chainId", chain.ID).Msg("failed to store recovery chain")
+		return
+	}
+	r.logged++
+}
+
+// compactLocked rewrites the store with the latest state of each chain, oldest change first
+func (r *Recovery) compactLocked() {
+	chains := make([]Chain, 0, len(r.chains))
+	for _, chain := range r.chains {
+		chains = append(chains, *chain)
+	}
+	slices.SortFunc(chains, func(a, b Chain) int {
+		return a.UpdatedAt.Compare(b.UpdatedAt)
+	})
+	if err := r.store.Rewrite(chains); err != nil {
+		r.logger.Err(err).Msg("failed to compact recovery chains")
+		return
+	}
+	r.logged = len(chains)
+}
+
+func snapshotChain(chain *Chain) Chain {
+	c := *chain
+	c.JobIDs = slices.Clone(chain.JobIDs)
+	c.Steps = slices.Clone(chain.Steps)
+	c.Actions = slices.Clone(chain.Actions)
+	c.Trail = slices.Clone(chain.Trail)
+	return c
+}
+
+func chainCall(method string, target *url.URL, err error) ChainCall {
+	call := ChainCall{Method: method, Path: target.Path}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	return call
+}
+
+func vehicleKey(runID string, row int) string {
+	return runID + "/" + strconv.Itoa(row)
+}
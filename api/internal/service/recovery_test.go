@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+	"github.com/rs/zerolog"
+)
+
+func TestRecovery(t *testing.T) {
+	const (
+		deletedVIN = "1HGCM82633A004352"
+		onboardVIN = "5YJSA1E27HF000337"
+		mintedVIN  = "WVWZZZ1JZXW00000N"
+	)
+	var mu sync.Mutex
+	resets := 0
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.Method + " " + r.URL.Path
+		switch key {
+		case "GET /v1/vehicle/disconnect/status":
+			_, _ = w.Write([]byte(`{"statuses":[{"vin":"` + deletedVIN + `","status":"Success"}]}`))
+		case "POST /v1/vehicle/delete/shared":
+			_, _ = w.Write([]byte(`{"jobId":"delete-2"}`))
+		case "DELETE /v1/vehicle/reset-onboarding/356938035643809":
+			if resets++; resets == 1 {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = w.Write([]byte(`{"message":"vehicle is mid verification"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer oracle.Close()
+	u, _ := url.Parse(oracle.URL)
+	oracles := map[string]url.URL{"kaufmann": *u}
+	dir := t.TempDir()
+	logger := zerolog.Nop()
+	creds := JobCredentials{Authorization: "Bearer alice", TenantID: "t1"}
+
+	// an onboarding the BFF stopped in: one vehicle failed verification after it was linked, one minted
+	now := time.Now()
+	onboardings := newRunStore[Onboarding](filepath.Join(dir, "onboarding.jsonl"), func(v OnboardingVehicle) int { return v.Row })
+	run := Onboarding{ID: "run-1", OracleID: "kaufmann", TenantID: "t1", Subject: "alice", State: OnboardingRunDone, CreatedAt: now, UpdatedAt: now}
+	_ = onboardings.appendRun(run.ID, run)
+	_ = onboardings.appendRow(run.ID, OnboardingVehicle{Row: 1, VIN: onboardVIN, IMEI: "356938035643809",
+		Stage: StageVerify, Status: OnboardingFailed, Error: "verification failed: no signal", UpdatedAt: now})
+	_ = onboardings.appendRow(run.ID, OnboardingVehicle{Row: 2, VIN: mintedVIN, IMEI: "356938035643817",
+		Stage: StageDone, Status: OnboardingSucceeded, TokenID: "9", UpdatedAt: now})
+
+	jobs := NewJobTracker(logger, JobTrackerConfig{StorePath: filepath.Join(dir, "jobs.jsonl"), OracleURLs: oracles})
+	pipeline := NewOnboardingPipeline(logger, OnboardingConfig{StorePath: filepath.Join(dir, "onboarding.jsonl"), OracleURLs: oracles}, jobs)
+	var invalidated []string
+	newRecovery := func() *Recovery {
+		return NewRecovery(logger, RecoveryConfig{
+			StorePath: filepath.Join(dir, "recovery.jsonl"), OracleURLs: oracles,
+			OnSubmitted: func(tokenID string) { invalidated = append(invalidated, tokenID) },
+		}, jobs, pipeline)
+	}
+	recovery := newRecovery()
+	ctx := context.Background()
+
+	// a shared delete whose burn failed
+	deleteJob := jobs.Track(Job{Kind: JobDelete, OracleID: "kaufmann", TenantID: "t1", Subject: "alice", TokenID: "7", VIN: deletedVIN, OracleJobID: "delete-1"}, creds)
+	jobs.polled(deleteJob.ID, JobFailed, "Failure burn reverted", nil)
+
+	recovery.Sync()
+	chains := recovery.List(ChainFilter{OracleID: "kaufmann", TenantID: "t1", State: ChainFailed})
+	if len(chains) != 2 {
+		t.Fatalf("expected the failed delete and onboarding, got %+v", chains)
+	}
+	var deleteChain, onboardChain Chain
+	for _, chain := range chains {
+		switch chain.Kind {
+		case ChainSharedDelete:
+			deleteChain = chain
+		case ChainOnboarding:
+			onboardChain = chain
+		}
+	}
+	if deleteChain.Steps[0].State != StepUnknown || deleteChain.Steps[1].State != StepFailed ||
+		!slices.Equal(deleteChain.Actions, []ChainAction{ChainResume}) || deleteChain.Detail != "Failure burn reverted" {
+		t.Errorf("unexpected failed delete %+v", deleteChain)
+	}
+	if onboardChain.VIN != onboardVIN || onboardChain.Steps[0].State != StepSucceeded || onboardChain.Steps[2].State != StepFailed ||
+		!slices.Equal(onboardChain.Actions, []ChainAction{ChainResume, ChainRollback}) {
+		t.Errorf("unexpected failed onboarding %+v", onboardChain)
+	}
+
+	// how far the delete got
+	recovery.Inspect(ctx, "kaufmann", "t1", creds)
+	deleteChain, _ = recovery.Get(deleteChain.ID)
+	if deleteChain.Steps[0].State != StepSucceeded || deleteChain.Trail[len(deleteChain.Trail)-1].Detail != "the vehicle was disconnected but not deleted" {
+		t.Errorf("expected the disconnect found through, got %+v", deleteChain)
+	}
+
+	if _, err := recovery.Rollback(ctx, deleteChain.ID, "bob", creds, false); !errors.Is(err, ErrChainAction) {
+		t.Errorf("expected a delete rollback refused, got %v", err)
+	}
+	deleteChain, err := recovery.Resume(ctx, deleteChain.ID, "bob", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, _ := jobs.Get(deleteChain.JobIDs[1])
+	if deleteChain.State != ChainRunning || len(deleteChain.JobIDs) != 2 || resumed.OracleJobID != "delete-2" || resumed.Subject != "bob" ||
+		!slices.Equal(invalidated, []string{"7"}) {
+		t.Errorf("expected the delete submitted again and followed, got %+v %+v", deleteChain, resumed)
+	}
+	if i := slices.IndexFunc(deleteChain.Trail, func(e ChainEvent) bool { return e.Action == "resume" }); i < 0 ||
+		deleteChain.Trail[i].Subject != "bob" || len(deleteChain.Trail[i].Calls) != 1 {
+		t.Errorf("expected the resume in the trail, got %+v", deleteChain.Trail)
+	}
+	if len(recovery.List(ChainFilter{Kind: ChainSharedDelete})) != 1 {
+		t.Error("expected the resubmitted delete kept in its chain")
+	}
+
+	// the first reset is refused, and recorded
+	if _, err := recovery.Rollback(ctx, onboardChain.ID, "bob", creds, false); !errors.Is(err, ErrCompensationFailed) {
+		t.Fatalf("expected the refused reset reported, got %v", err)
+	}
+	onboardChain, err = recovery.Rollback(ctx, onboardChain.ID, "bob", creds, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onboardChain.State != ChainRolledBack || onboardChain.Steps[0].State != StepCompensated || len(onboardChain.Actions) != 0 {
+		t.Errorf("expected the onboarding rolled back, got %+v", onboardChain)
+	}
+	var rollbacks []ChainEvent
+	for _, e := range onboardChain.Trail {
+		if e.Action == "rollback" {
+			rollbacks = append(rollbacks, e)
+		}
+	}
+	if len(rollbacks) != 2 || rollbacks[0].Calls[0].Error == "" || rollbacks[1].Calls[0].Error != "" {
+		t.Errorf("expected both reset calls in the trail, got %+v", rollbacks)
+	}
+	if r, _ := pipeline.Get("run-1"); r.Vehicles[0].Status != OnboardingRolledBack {
+		t.Errorf("expected the pipeline vehicle rolled back, got %+v", r.Vehicles[0])
+	}
+	if _, err := pipeline.Resume("run-1", "bob", creds); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if r, _ := pipeline.Get("run-1"); r.Vehicles[0].Status != OnboardingRolledBack {
+		t.Errorf("expected a rolled back vehicle left out of a resume, got %+v", r.Vehicles[0])
+	}
+
+	// everything seen and done is kept across a restart
+	reloaded, ok := newRecovery().Get(onboardChain.ID)
+	if !ok || reloaded.State != ChainRolledBack || len(reloaded.Trail) != len(onboardChain.Trail) {
+		t.Errorf("expected the chain reloaded, got %+v", reloaded)
+	}
+	if len(recovery.List(ChainFilter{Kind: ChainOnboarding})) != 1 {
+		t.Error("expected the minted vehicle not to be a chain")
+	}
+	// and compacted down to the latest state of each chain
+	records := 0
+	_ = store.NewJSONL[Chain](filepath.Join(dir, "recovery.jsonl")).Scan(func(Chain) bool { records++; return true })
+	if records != 2 {
+		t.Errorf("expected the store compacted to 2 chains, got %d records", records)
+	}
+}
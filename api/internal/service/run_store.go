@@ -0,0 +1,105 @@
+package service
+
+import (
+	"github.com/DIMO-Network/b2b-fleet-mgr-app/internal/store"
+)
+
+// runRecord is a line of a run store, a run's header or one of its rows. The last record of each wins.
+type runRecord[R, V any] struct {
+	RunID string `json:"runId"`
+	Run   *R     `json:"run,omitempty"`
+	Row   *V     `json:"row,omitempty"`
+}
+
+// storedRun is a run as its store has it, the header and the rows in order
+type storedRun[R, V any] struct {
+	ID   string
+	Run  R
+	Rows []V
+}
+
+// runStore records background runs over a list of rows, bulk transfers and onboardings: a header record whenever
+// the run changes and a row record whenever a row does, so a restart picks each run up where it stopped. Its owner
+// keeps the runs in memory and serializes the calls.
+type runStore[R, V any] struct {
+	store *store.JSONL[runRecord[R, V]]
+	// row is the 1 based position of a row in its run
+	row func(V) int
+	// logged counts the records in the store, compact brings it back to one per header and row
+	logged int
+}
+
+func newRunStore[R, V any](path string, row func(V) int) *runStore[R, V] {
+	return &runStore[R, V]{store: store.NewJSONL[runRecord[R, V]](path), row: row}
+}
+
+// load returns the runs in the store by id, each in its latest state. Rows of unknown runs, or out of order, are
+// dropped.
+func (s *runStore[R, V]) load() (map[string]*storedRun[R, V], error) {
+	runs := map[string]*storedRun[R, V]{}
+	s.logged = 0
+	err := s.store.Scan(func(rec runRecord[R, V]) bool {
+		s.logged++
+		sr, ok := runs[rec.RunID]
+		switch {
+		case rec.Run != nil && ok:
+			sr.Run = *rec.Run
+		case rec.Run != nil:
+			runs[rec.RunID] = &storedRun[R, V]{ID: rec.RunID, Run: *rec.Run}
+		case rec.Row != nil && ok:
+			if n := s.row(*rec.Row); n == len(sr.Rows)+1 {
+				sr.Rows = append(sr.Rows, *rec.Row)
+			} else if n >= 1 && n <= len(sr.Rows) {
+				sr.Rows[n-1] = *rec.Row
+			}
+		}
+		return true
+	})
+	return runs, err
+}
+
+// appendRun records a run's header, without its rows
+func (s *runStore[R, V]) appendRun(id string, header R) error {
+	if err := s.store.Append(runRecord[R, V]{RunID: id, Run: &header}); err != nil {
+		return err
+	}
+	s.logged++
+	return nil
+}
+
+// appendRow records a row of a run
+func (s *runStore[R, V]) appendRow(id string, row V) error {
+	if err := s.store.Append(runRecord[R, V]{RunID: id, Row: &row}); err != nil {
+		return err
+	}
+	s.logged++
+	return nil
+}
+
+// compact rewrites the store with runs, a header and one record per row each in the order given, once it holds more
+// than factor times as many records as that leaves
+func (s *runStore[R, V]) compact(runs []storedRun[R, V], factor int) error {
+	if s.logged <= factor*records(runs) {
+		return nil
+	}
+	recs := make([]runRecord[R, V], 0, records(runs))
+	for _, sr := range runs {
+		recs = append(recs, runRecord[R, V]{RunID: sr.ID, Run: &sr.Run})
+		for _, row := range sr.Rows {
+			recs = append(recs, runRecord[R, V]{RunID: sr.ID, Row: &row})
+		}
+	}
+	if err := s.store.Rewrite(recs); err != nil {
+		return err
+	}
+	s.logged = len(recs)
+	return nil
+}
+
+func records[R, V any](runs []storedRun[R, V]) int {
+	n := 0
+	for _, sr := range runs {
+		n += 1 + len(sr.Rows)
+	}
+	return n
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRunStore(t *testing.T) {
+	type row struct {
+		N     int
+		State string
+	}
+	path := filepath.Join(t.TempDir(), "runs.jsonl")
+	s := newRunStore[string](path, func(r row) int { return r.N })
+	_ = s.appendRun("a", "running")
+	_ = s.appendRow("a", row{N: 1, State: "pending"})
+	_ = s.appendRow("a", row{N: 2, State: "pending"})
+	_ = s.appendRow("a", row{N: 1, State: "done"})
+	// rows out of order, or of a run never recorded, are dropped
+	_ = s.appendRow("a", row{N: 4, State: "pending"})
+	_ = s.appendRow("b", row{N: 1, State: "pending"})
+	_ = s.appendRun("a", "done")
+
+	reloaded := newRunStore[string](path, func(r row) int { return r.N })
+	runs, err := reloaded.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, ok := runs["a"]
+	if len(runs) != 1 || !ok || a.Run != "done" || len(a.Rows) != 2 || a.Rows[0].State != "done" || a.Rows[1].State != "pending" {
+		t.Fatalf("expected the latest state of run a, got %+v", runs)
+	}
+	if reloaded.logged != 7 {
+		t.Errorf("expected 7 records counted, got %d", reloaded.logged)
+	}
+
+	// compacting waits for the store to outgrow the runs by the factor given
+	kept := []storedRun[string, row]{*a}
+	if err := reloaded.compact(kept, 3); err != nil || reloaded.logged != 7 {
+		t.Errorf("expected the store left alone under the factor, got %d records, %v", reloaded.logged, err)
+	}
+	if err := reloaded.compact(kept, 2); err != nil || reloaded.logged != 3 {
+		t.Errorf("expected the store compacted to 3 records, got %d, %v", reloaded.logged, err)
+	}
+	runs, _ = newRunStore[string](path, func(r row) int { return r.N }).load()
+	if a := runs["a"]; len(runs) != 1 || a.Run != "done" || len(a.Rows) != 2 || a.Rows[0].State != "done" {
+		t.Errorf("expected the compacted store to load the same run, got %+v", runs)
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/DIMO-Network/shared/privileges"
+)
+
+// vehiclePrivilegeNames are the vehicle privileges by id, named as DIMO's APIs name them
+var vehiclePrivilegeNames = map[int64]string{
+	int64(privileges.VehicleNonLocationData):     "VEHICLE_NON_LOCATION_DATA",
+	int64(privileges.VehicleCommands):            "VEHICLE_COMMANDS",
+	int64(privileges.VehicleCurrentLocation):     "VEHICLE_CURRENT_LOCATION",
+	int64(privileges.VehicleAllTimeLocation):     "VEHICLE_ALL_TIME_LOCATION",
+	int64(privileges.VehicleVinCredential):       "VEHICLE_VIN_CREDENTIAL",
+	privileges.VehicleSubscribeLiveDataPrivilege: "VEHICLE_SUBSCRIBE_LIVE_DATA",
+	privileges.VehicleRawData:                    "VEHICLE_RAW_DATA",
+	privileges.VehicleApproximateLocation:        "VEHICLE_APPROXIMATE_LOCATION",
+}
+
+// PrivilegeName is the name of a vehicle privilege, PRIVILEGE_<id> for one we don't know yet
+func PrivilegeName(id int64) string {
+	if name, ok := vehiclePrivilegeNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("PRIVILEGE_%d", id)
+}
+
+// ParsePrivilege takes a privilege id or name, eg. 4 or VEHICLE_ALL_TIME_LOCATION
+func ParsePrivilege(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if id, err := strconv.ParseInt(s, 10, 64); err == nil && id > 0 && id < 128 {
+		return id, nil
+	}
+	for id, name := range vehiclePrivilegeNames {
+		if strings.EqualFold(name, s) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown privilege %q", s)
+}
+
+// DecodeSACDPermissions reads the privileges out of a SACD permissions mask, eg. 0x3ffc. Each privilege takes two
+// bits, privilege n at bits 2n and 2n+1, and is granted when both are set.
+func DecodeSACDPermissions(mask string) ([]int64, error) {
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(mask), "0x"), 16)
+	if !ok || n.Sign() < 0 {
+		return nil, fmt.Errorf("invalid permissions mask %q", mask)
+	}
+	var granted []int64
+	for id := int64(1); 2*id+1 < int64(n.BitLen()); id++ {
+		if n.Bit(int(2*id)) == 1 && n.Bit(int(2*id+1)) == 1 {
+			granted = append(granted, id)
+		}
+	}
+	return granted, nil
+}
+
+// EncodeSACDPermissions is the permissions mask granting the privileges, the reverse of DecodeSACDPermissions
+func EncodeSACDPermissions(privs []int64) string {
+	n := new(big.Int)
+	for _, id := range privs {
+		n.SetBit(n, int(2*id), 1)
+		n.SetBit(n, int(2*id+1), 1)
+	}
+	return "0x" + n.Text(16)
+}
+
+// MissingPrivileges is the required privileges not in granted, both sorted or not
+func MissingPrivileges(granted, required []int64) []int64 {
+	var missing []int64
+	for _, id := range required {
+		if !slices.Contains(granted, id) {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
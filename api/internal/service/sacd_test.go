@@ -0,0 +1,54 @@
+package service
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDecodeSACDPermissions(t *testing.T) {
+	tests := []struct {
+		mask    string
+		want    []int64
+		wantErr bool
+	}{
+		{mask: "0x3ffc", want: []int64{1, 2, 3, 4, 5, 6}},
+		{mask: "0X0C", want: []int64{1}},
+		{mask: "0x3c", want: []int64{1, 2}},
+		{mask: "0x34", want: []int64{2}}, // privilege 1 has only one of its bits set
+		{mask: "0x0", want: nil},
+		{mask: "0xzz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mask, func(t *testing.T) {
+			got, err := DecodeSACDPermissions(tt.mask)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEncodeSACDPermissions(t *testing.T) {
+	if got := EncodeSACDPermissions([]int64{1, 2, 3, 4, 5, 6}); got != "0x3ffc" {
+		t.Errorf("expected 0x3ffc, got %s", got)
+	}
+	privs := []int64{1, 4, 8}
+	got, err := DecodeSACDPermissions(EncodeSACDPermissions(privs))
+	if err != nil || !slices.Equal(got, privs) {
+		t.Errorf("expected %v back, got %v %v", privs, got, err)
+	}
+}
+
+func TestParsePrivilege(t *testing.T) {
+	for in, want := range map[string]int64{"4": 4, "vehicle_commands": 2, " VEHICLE_RAW_DATA ": 7} {
+		if got, err := ParsePrivilege(in); err != nil || got != want {
+			t.Errorf("%q: expected %d, got %d %v", in, want, got, err)
+		}
+	}
+	if _, err := ParsePrivilege("VEHICLE_TELEPORT"); err == nil {
+		t.Error("expected an unknown privilege to fail")
+	}
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pem headers recording a key's lifecycle, so the rotation schedule survives restarts
+const (
+	pemHeaderCreatedAt    = "Created-At"
+	pemHeaderActivateAt   = "Activate-At"
+	pemHeaderRegisteredAt = "Registered-At"
+)
+
+// ErrKeyStoreReadOnly is returned by stores that can't persist a rotated key, eg. a key injected as a secret
+var ErrKeyStoreReadOnly = errors.New("signing key store is read-only")
+
+// signingKey is a developer JWT signing key. A key only signs once it is registered with DIMO and its activation
+// time has passed; until then the previous key keeps signing, which is the rotation overlap.
+type signingKey struct {
+	key          *ecdsa.PrivateKey
+	createdAt    time.Time
+	activateAt   time.Time
+	registeredAt time.Time
+}
+
+func newSigningKey(now time.Time, activateAt time.Time) (*signingKey, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	return &signingKey{key: k, createdAt: now, activateAt: activateAt}, nil
+}
+
+// kid is the compressed public key in hex, which is also what gets registered with DIMO
+func (k *signingKey) kid() string {
+	return hex.EncodeToString(elliptic.MarshalCompressed(elliptic.P256(), k.key.X, k.key.Y))
+}
+
+func (k *signingKey) registered() bool {
+	return !k.registeredAt.IsZero()
+}
+
+// SigningKeyStore loads and saves the developer JWT signing keys
+type SigningKeyStore interface {
+	Load() ([]*signingKey, error)
+	Save(keys []*signingKey) error
+}
+
+// NewFileKeyStore keeps the keys in a PEM file, created on first use
+func NewFileKeyStore(path string) SigningKeyStore {
+	return &fileKeyStore{path: path}
+}
+
+type fileKeyStore struct {
+	path string
+}
+
+func (f *fileKeyStore) Load() ([]*signingKey, error) {
+	dat, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSigningKeys(dat)
+}
+
+func (f *fileKeyStore) Save(keys []*signingKey) error {
+	dat, err := encodeSigningKeys(keys)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+		return err
+	}
+	// write then rename, a crash mid write must not lose the key
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, dat, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// NewStaticKeyStore reads the keys from PEM handed over by a secret provider, eg. an env var from a k8s secret.
+// It can't save, so its keys are managed with the secret: they are taken as registered already, and never rotated.
+func NewStaticKeyStore(pemData string) SigningKeyStore {
+	return &staticKeyStore{pem: pemData}
+}
+
+type staticKeyStore struct {
+	pem string
+}
+
+// Load takes a key without a Registered-At header as registered when the secret was made. Registering it here
+// would happen again on every boot, since the record of it can't be saved.
+func (s *staticKeyStore) Load() ([]*signingKey, error) {
+	keys, err := decodeSigningKeys([]byte(s.pem))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key in the PEM")
+	}
+	for _, k := range keys {
+		if !k.registered() {
+			k.registeredAt = time.Unix(0, 0).UTC()
+		}
+	}
+	return keys, nil
+}
+
+func (s *staticKeyStore) Save([]*signingKey) error {
+	return ErrKeyStoreReadOnly
+}
+
+// memoryKeyStore is used when no store is configured, the key lasts as long as the process
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys []*signingKey
+}
+
+func (m *memoryKeyStore) Load() ([]*signingKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys, nil
+}
+
+func (m *memoryKeyStore) Save(keys []*signingKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = keys
+	return nil
+}
+
+func encodeSigningKeys(keys []*signingKey) ([]byte, error) {
+	var out []byte
+	for _, k := range keys {
+		der, err := x509.MarshalECPrivateKey(k.key)
+		if err != nil {
+			return nil, err
+		}
+		headers := map[string]string{
+			pemHeaderCreatedAt:  k.createdAt.UTC().Format(time.RFC3339),
+			pemHeaderActivateAt: k.activateAt.UTC().Format(time.RFC3339),
+		}
+		if k.registered() {
+			headers[pemHeaderRegisteredAt] = k.registeredAt.UTC().Format(time.RFC3339)
+		}
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Headers: headers, Bytes: der})...)
+	}
+	return out, nil
+}
+
+// decodeSigningKeys reads EC or PKCS8 P-256 keys. A key without lifecycle headers, eg. one made with openssl, is
+// taken as active and not yet registered.
+func decodeSigningKeys(dat []byte) ([]*signingKey, error) {
+	var keys []*signingKey
+	for {
+		var block *pem.Block
+		block, dat = pem.Decode(dat)
+		if block == nil {
+			break
+		}
+		var key *ecdsa.PrivateKey
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			k, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse signing key: %w", err)
+			}
+			key = k
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse signing key: %w", err)
+			}
+			ec, ok := k.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("signing key must be an EC key")
+			}
+			key = ec
+		default:
+			continue
+		}
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("signing key must be on the P-256 curve")
+		}
+		keys = append(keys, &signingKey{
+			key:          key,
+			createdAt:    pemTime(block.Headers[pemHeaderCreatedAt]),
+			activateAt:   pemTime(block.Headers[pemHeaderActivateAt]),
+			registeredAt: pemTime(block.Headers[pemHeaderRegisteredAt]),
+		})
+	}
+	return keys, nil
+}
+
+func pemTime(v string) time.Time {
+	t, _ := time.Parse(time.RFC3339, v)
+	return t
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/shared/privileges"
+	"github.com/rs/zerolog"
+)
+
+// Aggregation is how telemetry-api rolls up a float signal over an interval
+type Aggregation string
+
+const (
+	AggAvg  Aggregation = "AVG"
+	AggMax  Aggregation = "MAX"
+	AggMin  Aggregation = "MIN"
+	AggLast Aggregation = "LAST"
+)
+
+// ParseAggregation accepts avg, max, min and last in any case
+func ParseAggregation(s string) (Aggregation, error) {
+	switch a := Aggregation(strings.ToUpper(s)); a {
+	case AggAvg, AggMax, AggMin, AggLast:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown aggregation %q, expected avg, max, min or last", s)
+}
+
+// signalNamePattern is a telemetry-api signal field. Only float signals are supported, location isn't one of them
+// and needs location privileges we don't ask for.
+var signalNamePattern = regexp.MustCompile(`^[a-z][A-Za-z0-9]{1,100}$`)
+
+// ValidSignalName says whether a signal name is safe to put in a query
+func ValidSignalName(name string) bool {
+	return signalNamePattern.MatchString(name) && !strings.HasPrefix(name, "currentLocation")
+}
+
+// SignalValue is the latest value of a signal
+type SignalValue struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// LatestSignals is the latest value of each signal asked for, signals without a value are left out
+type LatestSignals struct {
+	LastSeen *time.Time             `json:"lastSeen"`
+	Signals  map[string]SignalValue `json:"signals"`
+}
+
+// SignalAgg is a signal and how to aggregate it
+type SignalAgg struct {
+	Name string
+	Agg  Aggregation
+}
+
+// HistoryQuery asks for the signals aggregated over buckets of Interval between From and To
+type HistoryQuery struct {
+	Signals  []SignalAgg
+	From     time.Time
+	To       time.Time
+	Interval time.Duration
+}
+
+// HistoryPoint is one bucket, values are nil where the vehicle sent nothing
+type HistoryPoint struct {
+	Timestamp time.Time           `json:"timestamp"`
+	Values    map[string]*float64 `json:"values"`
+}
+
+// TelemetryAPI reads vehicle signals straight from DIMO's telemetry-api with a vehicle privilege token
+type TelemetryAPI interface {
+	GetLatestSignals(ctx context.Context, tokenID uint64, signals []string) (*LatestSignals, error)
+	GetSignalHistory(ctx context.Context, tokenID uint64, q HistoryQuery) ([]HistoryPoint, error)
+}
+
+type telemetryAPIService struct {
+	apiURL        string
+	tokenExchange TokenExchangeService
+	httpClient    *http.Client
+	logger        zerolog.Logger
+}
+
+func NewTelemetryAPIService(logger zerolog.Logger, telemetryAPIURL string, tokenExchange TokenExchangeService) TelemetryAPI {
+	return &telemetryAPIService{
+		apiURL:        telemetryAPIURL,
+		tokenExchange: tokenExchange,
+		httpClient:    &http.Client{Timeout: 20 * time.Second},
+		logger:        logger,
+	}
+}
+
+func (t *telemetryAPIService) GetLatestSignals(ctx context.Context, tokenID uint64, signals []string) (*LatestSignals, error) {
+	if err := checkSignalNames(signals...); err != nil {
+		return nil, err
+	}
+	var fields strings.Builder
+	for _, s := range signals {
+		fields.WriteString("\n    " + s + " { timestamp value }")
+	}
+	query := fmt.Sprintf("{\n  signalsLatest(tokenId: %d) {\n    lastSeen%s\n  }\n}", tokenID, fields.String())
+
+	var data struct {
+		SignalsLatest map[string]json.RawMessage `json:"signalsLatest"`
+	}
+	if err := t.query(ctx, tokenID, query, &data); err != nil {
+		return nil, err
+	}
+
+	res := &LatestSignals{Signals: map[string]SignalValue{}}
+	for name, raw := range data.SignalsLatest {
+		if name == "lastSeen" {
+			var ts *time.Time
+			if err := json.Unmarshal(raw, &ts); err == nil {
+				res.LastSeen = ts
+			}
+			continue
+		}
+		var v *SignalValue
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("unexpected value for signal %s: %w", name, err)
+		}
+		if v != nil {
+			res.Signals[name] = *v
+		}
+	}
+	return res, nil
+}
+
+func (t *telemetryAPIService) GetSignalHistory(ctx context.Context, tokenID uint64, q HistoryQuery) ([]HistoryPoint, error) {
+	if len(q.Signals) == 0 {
+		return nil, errors.New("no signals requested")
+	}
+	if !q.From.Before(q.To) {
+		return nil, errors.New("from must be before to")
+	}
+	var fields strings.Builder
+	for _, s := range q.Signals {
+		if err := checkSignalNames(s.Name); err != nil {
+			return nil, err
+		}
+		if _, err := ParseAggregation(string(s.Agg)); err != nil {
+			return nil, err
+		}
+		fields.WriteString(fmt.Sprintf("\n    %s: %s(agg: %s)", s.Key(), s.Name, s.Agg))
+	}
+	query := fmt.Sprintf("{\n  signals(tokenId: %d, interval: %q, from: %q, to: %q) {\n    timestamp%s\n  }\n}",
+		tokenID, FormatInterval(q.Interval), q.From.UTC().Format(time.RFC3339), q.To.UTC().Format(time.RFC3339), fields.String())
+
+	var data struct {
+		Signals []map[string]json.RawMessage `json:"signals"`
+	}
+	if err := t.query(ctx, tokenID, query, &data); err != nil {
+		return nil, err
+	}
+
+	points := make([]HistoryPoint, 0, len(data.Signals))
+	for _, row := range data.Signals {
+		var p HistoryPoint
+		if err := json.Unmarshal(row["timestamp"], &p.Timestamp); err != nil {
+			return nil, fmt.Errorf("unexpected signals timestamp: %w", err)
+		}
+		p.Values = make(map[string]*float64, len(q.Signals))
+		for _, s := range q.Signals {
+			var v *float64
+			if raw, ok := row[s.Key()]; ok {
+				_ = json.Unmarshal(raw, &v)
+			}
+			p.Values[s.Key()] = v
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// Key is how a signal is named in results and aliased in the query, eg. speed_avg, so the same signal can be asked
+// for with two aggregations
+func (s SignalAgg) Key() string {
+	return s.Name + "_" + strings.ToLower(string(s.Agg))
+}
+
+// FormatInterval writes a duration the way telemetry-api takes it, eg. 90s, 15m, 6h
+func FormatInterval(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
+func checkSignalNames(names ...string) error {
+	for _, n := range names {
+		if !ValidSignalName(n) {
+			return fmt.Errorf("%w: unsupported signal %q", ErrBadRequest, n)
+		}
+	}
+	return nil
+}
+
+// query runs a telemetry-api query with a non-location privilege token for the vehicle
+func (t *telemetryAPIService) query(ctx context.Context, tokenID uint64, query string, data any) error {
+	token, err := t.tokenExchange.GetPrivilegeToken(ctx, tokenID, []int64{int64(privileges.VehicleNonLocationData)})
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(GraphQLRequest{Query: query})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.apiURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		t.logger.Err(err).Uint64("tokenId", tokenID).Msg("Failed to query telemetry-api")
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		// the grant may have been revoked since the token was issued
+		t.tokenExchange.Invalidate(tokenID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("telemetry-api returned status %d: %s", resp.StatusCode, body)
+	}
+
+	var gqlRes struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &gqlRes); err != nil {
+		return fmt.Errorf("unexpected telemetry-api response: %w", err)
+	}
+	if len(gqlRes.Errors) > 0 {
+		msgs := make([]string, len(gqlRes.Errors))
+		for i, e := range gqlRes.Errors {
+			msgs[i] = e.Message
+		}
+		return fmt.Errorf("telemetry-api: %s", strings.Join(msgs, "; "))
+	}
+	return json.Unmarshal(gqlRes.Data, data)
+}
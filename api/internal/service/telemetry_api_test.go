@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type stubTokenExchange struct {
+	invalidated []uint64
+}
+
+func (s *stubTokenExchange) GetPrivilegeToken(_ context.Context, tokenID uint64, privileges []int64) (string, error) {
+	if len(privileges) != 1 || privileges[0] != 1 {
+		return "", errors.New("expected only the non-location data privilege")
+	}
+	return "priv-token", nil
+}
+
+func (s *stubTokenExchange) Invalidate(tokenID uint64) {
+	s.invalidated = append(s.invalidated, tokenID)
+}
+
+// newFakeTelemetryAPI answers every query with response, recording the query it was sent
+func newFakeTelemetryAPI(t *testing.T, status int, response string, query *string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req GraphQLRequest
+		if r.Header.Get("Authorization") != "Bearer priv-token" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*query = req.Query
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTelemetryAPIService_GetLatestSignals(t *testing.T) {
+	var query string
+	srv := newFakeTelemetryAPI(t, http.StatusOK, `{"data":{"signalsLatest":{
+		"lastSeen":"2026-10-01T10:00:00Z",
+		"speed":{"timestamp":"2026-10-01T09:59:00Z","value":42.5},
+		"powertrainFuelSystemRelativeLevel":null}}}`, &query)
+	svc := NewTelemetryAPIService(zerolog.Nop(), srv.URL, &stubTokenExchange{})
+
+	latest, err := svc.GetLatestSignals(context.Background(), 7, []string{"speed", "powertrainFuelSystemRelativeLevel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "signalsLatest(tokenId: 7)") || !strings.Contains(query, "speed { timestamp value }") {
+		t.Errorf("unexpected query %s", query)
+	}
+	if latest.LastSeen == nil || latest.Signals["speed"].Value != 42.5 {
+		t.Errorf("unexpected result %+v", latest)
+	}
+	if _, ok := latest.Signals["powertrainFuelSystemRelativeLevel"]; ok {
+		t.Errorf("a signal without a value should be left out")
+	}
+
+	if _, err := svc.GetLatestSignals(context.Background(), 7, []string{"currentLocationCoordinates"}); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("expected location signals to be refused, got %v", err)
+	}
+	if _, err := svc.GetLatestSignals(context.Background(), 7, []string{"speed }"}); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("expected a malformed signal to be refused, got %v", err)
+	}
+}
+
+func TestTelemetryAPIService_GetSignalHistory(t *testing.T) {
+	var query string
+	srv := newFakeTelemetryAPI(t, http.StatusOK, `{"data":{"signals":[
+		{"timestamp":"2026-10-01T00:00:00Z","speed_avg":10.5,"speed_max":30},
+		{"timestamp":"2026-10-01T01:00:00Z","speed_avg":null,"speed_max":null}]}}`, &query)
+	svc := NewTelemetryAPIService(zerolog.Nop(), srv.URL, &stubTokenExchange{})
+
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	points, err := svc.GetSignalHistory(context.Background(), 7, HistoryQuery{
+		Signals:  []SignalAgg{{Name: "speed", Agg: AggAvg}, {Name: "speed", Agg: AggMax}},
+		From:     from,
+		To:       from.Add(2 * time.Hour),
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`interval: "1h"`, `from: "2026-10-01T00:00:00Z"`, "speed_avg: speed(agg: AVG)", "speed_max: speed(agg: MAX)"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query missing %s: %s", want, query)
+		}
+	}
+	if len(points) != 2 || *points[0].Values["speed_avg"] != 10.5 || *points[0].Values["speed_max"] != 30 {
+		t.Fatalf("unexpected points %+v", points)
+	}
+	if v, ok := points[1].Values["speed_avg"]; !ok || v != nil {
+		t.Errorf("an empty bucket should have nil values, got %v", v)
+	}
+}
+
+func TestTelemetryAPIService_Errors(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		response        string
+		wantInvalidated bool
+	}{
+		{name: "graphql error", status: http.StatusOK, response: `{"errors":[{"message":"unknown field"}],"data":null}`},
+		{name: "token refused", status: http.StatusUnauthorized, response: `{}`, wantInvalidated: true},
+		{name: "server error", status: http.StatusInternalServerError, response: `oops`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			srv := newFakeTelemetryAPI(t, tt.status, tt.response, &query)
+			exchange := &stubTokenExchange{}
+			svc := NewTelemetryAPIService(zerolog.Nop(), srv.URL, exchange)
+			if _, err := svc.GetLatestSignals(context.Background(), 9, []string{"speed"}); err == nil {
+				t.Fatal("expected an error")
+			}
+			if (len(exchange.invalidated) > 0) != tt.wantInvalidated {
+				t.Errorf("invalidated = %v, want %v", exchange.invalidated, tt.wantInvalidated)
+			}
+		})
+	}
+}
+
+func TestFormatInterval(t *testing.T) {
+	tests := map[time.Duration]string{
+		90 * time.Second: "90s",
+		15 * time.Minute: "15m",
+		6 * time.Hour:    "6h",
+		48 * time.Hour:   "48h",
+	}
+	for d, want := range tests {
+		if got := FormatInterval(d); got != want {
+			t.Errorf("FormatInterval(%s) = %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+)
+
+// privilegeTokenMargin is how long before its exp a privilege token stops being handed out, so it can't run out
+// on its way to the API
+const privilegeTokenMargin = time.Minute
+
+// TokenExchangeService swaps the developer JWT for vehicle privilege tokens, the credentials DIMO's telemetry and
+// fetch APIs want, so the BFF can read vehicle data directly when the oracle doesn't offer it.
+type TokenExchangeService interface {
+	// GetPrivilegeToken returns a token for the vehicle carrying at least the given privileges, see shared/privileges
+	GetPrivilegeToken(ctx context.Context, tokenID uint64, privileges []int64) (string, error)
+	// Invalidate drops the cached tokens of a vehicle, eg. after it's been transferred or its grants revoked
+	Invalidate(tokenID uint64)
+}
+
+type tokenExchangeService struct {
+	apiURL      string
+	nftContract string
+	devJWT      DIMOJWTService
+	httpClient  *http.Client
+	logger      zerolog.Logger
+
+	// mu guards tokens, vehicle token id => privilege set => token
+	mu       sync.Mutex
+	tokens   map[uint64]map[string]privilegeToken
+	exchange singleflight.Group
+}
+
+type privilegeToken struct {
+	token      string
+	privileges []int64
+	expiresAt  time.Time
+}
+
+// covers says whether the token carries all the privileges, both sorted
+func (p privilegeToken) covers(privileges []int64) bool {
+	for _, priv := range privileges {
+		if _, found := slices.BinarySearch(p.privileges, priv); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// NewTokenExchangeService needs the token exchange api url, eg. https://token-exchange-api.dimo.zone, and the vehicle
+// NFT contract address
+func NewTokenExchangeService(logger zerolog.Logger, apiURL string, nftContract string, devJWT DIMOJWTService) TokenExchangeService {
+	return &tokenExchangeService{
+		apiURL:      strings.TrimSuffix(apiURL, "/"),
+		nftContract: nftContract,
+		devJWT:      devJWT,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		logger:      logger,
+		tokens:      map[uint64]map[string]privilegeToken{},
+	}
+}
+
+func (t *tokenExchangeService) GetPrivilegeToken(ctx context.Context, tokenID uint64, privileges []int64) (string, error) {
+	privs := slices.Clone(privileges)
+	slices.Sort(privs)
+	privs = slices.Compact(privs)
+	key := privilegeKey(privs)
+
+	// any unexpired token for the vehicle with at least these privileges will do
+	now := time.Now()
+	t.mu.Lock()
+	for _, cached := range t.tokens[tokenID] {
+		if now.Before(cached.expiresAt) && cached.covers(privs) {
+			t.mu.Unlock()
+			return cached.token, nil
+		}
+	}
+	t.mu.Unlock()
+
+	// concurrent requests for the same vehicle and privileges share one exchange, which mustn't fail for all of
+	// them when the first caller goes away
+	token, err, _ := t.exchange.Do(strconv.FormatUint(tokenID, 10)+"|"+key, func() (any, error) {
+		return t.exchangeToken(context.WithoutCancel(ctx), tokenID, privs, key)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token.(string), nil
+}
+
+func (t *tokenExchangeService) Invalidate(tokenID uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tokens, tokenID)
+}
+
+func (t *tokenExchangeService) exchangeToken(ctx context.Context, tokenID uint64, privileges []int64, key string) (string, error) {
+	devJWT, err := t.devJWT.GetDeveloperJWT()
+	if err != nil {
+		return "", fmt.Errorf("failed to get developer JWT: %w", err)
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"nftContractAddress": t.nftContract,
+		"privileges":         privileges,
+		"tokenId":            tokenID,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.apiURL+"/v1/tokens/exchange", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+devJWT)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// most often the vehicle hasn't granted us these privileges
+		return "", &PrivilegeExchangeError{TokenID: tokenID, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.Token == "" {
+		return "", fmt.Errorf("unexpected token exchange response: %s", body)
+	}
+
+	// the token comes straight from the exchange, its exp is all we need from it
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(res.Token, claims); err != nil {
+		return "", fmt.Errorf("failed to parse privilege token: %w", err)
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return "", fmt.Errorf("privilege token for vehicle %d has no expiry", tokenID)
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens[tokenID] == nil {
+		t.tokens[tokenID] = map[string]privilegeToken{}
+	}
+	t.tokens[tokenID][key] = privilegeToken{
+		token:      res.Token,
+		privileges: privileges,
+		expiresAt:  exp.Add(-privilegeTokenMargin),
+	}
+	t.pruneLocked(now)
+
+	t.logger.Debug().Uint64("tokenId", tokenID).Str("privileges", key).Msg("Exchanged vehicle privilege token")
+	return res.Token, nil
+}
+
+// pruneLocked drops expired tokens, which keeps the cache at about the vehicles in use in the last hour or so
+func (t *tokenExchangeService) pruneLocked(now time.Time) {
+	for tokenID, byPrivs := range t.tokens {
+		for k, tok := range byPrivs {
+			if !now.Before(tok.expiresAt) {
+				delete(byPrivs, k)
+			}
+		}
+		if len(byPrivs) == 0 {
+			delete(t.tokens, tokenID)
+		}
+	}
+}
+
+func privilegeKey(privileges []int64) string {
+	parts := make([]string, len(privileges))
+	for i, p := range privileges {
+		parts[i] = strconv.FormatInt(p, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// PrivilegeExchangeError is a refused exchange, StatusCode is what the token exchange api answered
+type PrivilegeExchangeError struct {
+	TokenID    uint64
+	StatusCode int
+	Body       string
+}
+
+func (e *PrivilegeExchangeError) Error() string {
+	return fmt.Sprintf("token exchange for vehicle %d failed with status %d: %s", e.TokenID, e.StatusCode, e.Body)
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+type stubDeveloperJWT struct{}
+
+func (stubDeveloperJWT) GetDeveloperJWT() (string, error) { return "dev-jwt", nil }
+func (stubDeveloperJWT) RefreshJWT() (string, error)      { return "dev-jwt", nil }
+func (stubDeveloperJWT) Start(context.Context)            {}
+func (stubDeveloperJWT) RotateKey() error                 { return nil }
+
+// newFakeTokenExchange issues privilege tokens valid for ttl, refusing vehicle 403
+func newFakeTokenExchange(t *testing.T, ttl time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var exchanges atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			NftContractAddress string  `json:"nftContractAddress"`
+			Privileges         []int64 `json:"privileges"`
+			TokenID            uint64  `json:"tokenId"`
+		}
+		if r.URL.Path != "/v1/tokens/exchange" || r.Header.Get("Authorization") != "Bearer dev-jwt" ||
+			json.NewDecoder(r.Body).Decode(&req) != nil || req.NftContractAddress != "0xnft" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		exchanges.Add(1)
+		if req.TokenID == 403 {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"privileges not granted"}`))
+			return
+		}
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp": time.Now().Add(ttl).Unix(),
+			"sub": req.TokenID,
+			"jti": exchanges.Load(),
+		}).SignedString([]byte("secret"))
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": token})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &exchanges
+}
+
+func TestTokenExchangeService_Cache(t *testing.T) {
+	srv, exchanges := newFakeTokenExchange(t, time.Hour)
+	svc := NewTokenExchangeService(zerolog.Nop(), srv.URL+"/", "0xnft", stubDeveloperJWT{})
+	ctx := context.Background()
+
+	steps := []struct {
+		name          string
+		tokenID       uint64
+		privileges    []int64
+		invalidate    bool
+		wantExchanges int32
+	}{
+		{name: "first exchange", tokenID: 7, privileges: []int64{4, 1}, wantExchanges: 1},
+		{name: "same privileges in another order", tokenID: 7, privileges: []int64{1, 4, 4}, wantExchanges: 1},
+		{name: "subset of a cached token", tokenID: 7, privileges: []int64{4}, wantExchanges: 1},
+		{name: "privilege not covered", tokenID: 7, privileges: []int64{1, 6}, wantExchanges: 2},
+		{name: "other vehicle", tokenID: 8, privileges: []int64{1}, wantExchanges: 3},
+		{name: "after a transfer", tokenID: 7, privileges: []int64{1}, invalidate: true, wantExchanges: 4},
+	}
+	for _, step := range steps {
+		if step.invalidate {
+			svc.Invalidate(step.tokenID)
+		}
+		token, err := svc.GetPrivilegeToken(ctx, step.tokenID, step.privileges)
+		if err != nil || token == "" {
+			t.Fatalf("%s: unexpected error %v", step.name, err)
+		}
+		if n := exchanges.Load(); n != step.wantExchanges {
+			t.Errorf("%s: expected %d exchanges, got %d", step.name, step.wantExchanges, n)
+		}
+	}
+}
+
+func TestTokenExchangeService_ExpiringTokensAreNotReused(t *testing.T) {
+	// inside the margin from the start, so never handed out from the cache
+	srv, exchanges := newFakeTokenExchange(t, 30*time.Second)
+	svc := NewTokenExchangeService(zerolog.Nop(), srv.URL, "0xnft", stubDeveloperJWT{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := svc.GetPrivilegeToken(context.Background(), 7, []int64{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := exchanges.Load(); n != 2 {
+		t.Errorf("expected a fresh exchange per call, got %d", n)
+	}
+}
+
+func TestTokenExchangeService_Refused(t *testing.T) {
+	srv, _ := newFakeTokenExchange(t, time.Hour)
+	svc := NewTokenExchangeService(zerolog.Nop(), srv.URL, "0xnft", stubDeveloperJWT{})
+
+	_, err := svc.GetPrivilegeToken(context.Background(), 403, []int64{1})
+	var exErr *PrivilegeExchangeError
+	if !errors.As(err, &exErr) || exErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a PrivilegeExchangeError with 403, got %v", err)
+	}
+}
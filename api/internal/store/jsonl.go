@@ -0,0 +1,182 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JSONL is an append-only file of JSON records, one per line. It is the BFF's only persistence: enough for
+// logs that are written often and read rarely, without bringing a database into an app that has none.
+type JSONL[T any] struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewJSONL returns a store backed by the file at path. Nothing is created until the first Append.
+func NewJSONL[T any](path string) *JSONL[T] {
+	return &JSONL[T]{path: path}
+}
+
+// Append writes rec as a new line at the end of the file
+func (j *JSONL[T]) Append(rec T) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o750); err != nil {
+		return fmt.Errorf("failed to create store dir: %w", err)
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to append record: %w", err)
+	}
+	return nil
+}
+
+// Scan calls fn for every record in the order they were written until fn returns false.
+// A missing file is an empty store. Lines that fail to decode, eg. a half written last line after a crash, are skipped.
+func (j *JSONL[T]) Scan(fn func(rec T) bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var rec T
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if !fn(rec) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Cursor is how far Tail has read a store, the zero value is its start
+type Cursor struct {
+	file   os.FileInfo
+	offset int64
+}
+
+// Tail calls fn for every record written since the cursor, in order, and moves the cursor past them, so a store other
+// processes append to can be followed without reading it all again. When the file was replaced since, by a Rewrite
+// here or elsewhere, or truncated, it's read from the start and Tail returns true. A half written last line is left
+// for the next call.
+func (j *JSONL[T]) Tail(cursor *Cursor, fn func(rec T)) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			reset := cursor.file != nil
+			*cursor = Cursor{}
+			return reset, nil
+		}
+		return false, fmt.Errorf("failed to open store: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat store: %w", err)
+	}
+	reset := false
+	if cursor.file == nil || !os.SameFile(cursor.file, info) || info.Size() < cursor.offset {
+		reset = cursor.file != nil
+		cursor.offset = 0
+	}
+	cursor.file = info
+	if _, err := f.Seek(cursor.offset, io.SeekStart); err != nil {
+		return reset, fmt.Errorf("failed to seek store: %w", err)
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return reset, nil
+		}
+		if err != nil {
+			return reset, fmt.Errorf("failed to read store: %w", err)
+		}
+		cursor.offset += int64(len(line))
+		var rec T
+		if json.Unmarshal(line, &rec) == nil {
+			fn(rec)
+		}
+	}
+}
+
+// Rewrite replaces the file with recs, eg. to compact it down to the last record of each id. The new file is written
+// next to the old one and renamed over it, so a crash leaves one or the other.
+func (j *JSONL[T]) Rewrite(recs []T) error {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o750); err != nil {
+		return fmt.Errorf("failed to create store dir: %w", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o640); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to replace store: %w", err)
+	}
+	return nil
+}
+
+// CheckWritable makes sure records can be written under dir, creating it if needed. Every store only touches its
+// file on first use, so without this a read-only data dir would surface as failed requests long after startup.
+func CheckWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create data dir %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("data dir %s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("failed to clean up in data dir %s: %w", dir, err)
+	}
+	return nil
+}
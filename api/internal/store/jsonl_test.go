@@ -0,0 +1,130 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testRecord struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestJSONL_AppendScan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "records.jsonl")
+	s := NewJSONL[testRecord](path)
+
+	// scanning before anything was written is an empty store, not an error
+	if err := s.Scan(func(testRecord) bool { t.Fatal("unexpected record"); return true }); err != nil {
+		t.Fatalf("Scan on missing file: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := s.Append(testRecord{ID: i, Name: "r"}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	// a torn last line, as a crash mid write would leave, is skipped
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o640)
+	_, _ = f.WriteString(`{"id": 4, "na`)
+	_ = f.Close()
+
+	var got []int
+	if err := s.Scan(func(r testRecord) bool { got = append(got, r.ID); return true }); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("expected records 1..3 in order, got %v", got)
+	}
+
+	got = nil
+	_ = s.Scan(func(r testRecord) bool { got = append(got, r.ID); return false })
+	if len(got) != 1 {
+		t.Errorf("expected Scan to stop after the first record, got %v", got)
+	}
+}
+
+func TestJSONL_Rewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	s := NewJSONL[testRecord](path)
+	for i := 1; i <= 3; i++ {
+		_ = s.Append(testRecord{ID: i % 2, Name: "r"})
+	}
+	if err := s.Rewrite([]testRecord{{ID: 0, Name: "last"}, {ID: 1, Name: "last"}}); err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	_ = s.Append(testRecord{ID: 2, Name: "after"})
+
+	var got []testRecord
+	_ = s.Scan(func(r testRecord) bool { got = append(got, r); return true })
+	if len(got) != 3 || got[0].Name != "last" || got[2].ID != 2 {
+		t.Errorf("expected the rewritten records then the appended one, got %v", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected no temp file left behind, got %v", err)
+	}
+}
+
+func TestJSONL_Tail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	s := NewJSONL[testRecord](path)
+	var cursor Cursor
+	var got []int
+	tail := func() bool {
+		t.Helper()
+		got = nil
+		reset, err := s.Tail(&cursor, func(r testRecord) { got = append(got, r.ID) })
+		if err != nil {
+			t.Fatalf("Tail: %v", err)
+		}
+		return reset
+	}
+	if tail() || len(got) != 0 {
+		t.Errorf("expected nothing from a missing file, got %v", got)
+	}
+
+	_ = s.Append(testRecord{ID: 1})
+	_ = s.Append(testRecord{ID: 2})
+	if tail() || len(got) != 2 {
+		t.Errorf("expected records 1 and 2, got %v", got)
+	}
+	// only what was appended since, and a torn line once it's whole
+	_ = s.Append(testRecord{ID: 3})
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o640)
+	_, _ = f.WriteString(`{"id": 4, "na`)
+	if tail() || len(got) != 1 || got[0] != 3 {
+		t.Errorf("expected record 3 only, got %v", got)
+	}
+	_, _ = f.WriteString(`me": "r"}` + "\n")
+	_ = f.Close()
+	if tail() || len(got) != 1 || got[0] != 4 {
+		t.Errorf("expected record 4 once written, got %v", got)
+	}
+
+	// a rewrite is read from the start
+	_ = s.Rewrite([]testRecord{{ID: 5}})
+	if !tail() || len(got) != 1 || got[0] != 5 {
+		t.Errorf("expected the rewritten store read again, got %v", got)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := CheckWritable(dir); err != nil {
+		t.Fatalf("expected a new data dir to be writable: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the check to leave nothing behind, got %v", entries)
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to a read-only dir")
+	}
+	if err := os.Chmod(dir, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o750) //nolint:errcheck
+	if err := CheckWritable(dir); err == nil {
+		t.Error("expected a read-only data dir refused")
+	}
+}
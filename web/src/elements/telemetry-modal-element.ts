@@ -99,6 +99,9 @@ export class TelemetryModalElement extends LitElement {
     @state()
     private immobilizerError = "";
 
+    @state()
+    private showImmobilizerConfirm = false;
+
     // Paging over raw telemetry rows
     @state()
     private currentIndex: number = 0;
@@ -350,6 +353,18 @@ export class TelemetryModalElement extends LitElement {
               @modal-confirm=${this.handleRemoveVinConfirm}
               @modal-cancel=${this.handleRemoveVinCancel}
             ></confirm-modal-element>
+
+            <!-- Immobilizer On Confirmation Modal -->
+            <confirm-modal-element
+              .show=${this.showImmobilizerConfirm}
+              .title=${msg('Immobilizer ON')}
+              .message=${msg('Are you sure you want to turn the immobilizer on for this vehicle? The engine will not start until it is turned off.')}
+              .confirmText=${msg('Turn ON')}
+              .cancelText=${msg('Cancel')}
+              .confirmButtonClass=${'btn-danger'}
+              @modal-confirm=${this.handleImmobilizerConfirm}
+              @modal-cancel=${this.handleImmobilizerCancel}
+            ></confirm-modal-element>
         `;
     }
 
@@ -696,10 +711,26 @@ export class TelemetryModalElement extends LitElement {
         this.immobilizerError = "";
         
         try {
+            const command: Record<string, string> = { command: `immobilizer/${state}` };
+            // immobilizer/on is destructive, the BFF only sends it with a confirmation token
+            if (state === 'on') {
+                const confirmation = await this.apiService.callApi<{ confirmationToken: string }>(
+                    'POST',
+                    `/pending-vehicle/command/${this.imei}/confirmation`,
+                    command,
+                    true,
+                    true
+                );
+                if (!confirmation.success || !confirmation.data) {
+                    this.immobilizerError = confirmation.error || `Failed to send immobilizer ${state} command`;
+                    return;
+                }
+                command.confirmationToken = confirmation.data.confirmationToken;
+            }
             const response = await this.apiService.callApi(
                 'POST', 
                 `/pending-vehicle/command/${this.imei}`, 
-                { command: `immobilizer/${state}` },
+                command,
                 true, 
                 true
             );
@@ -716,10 +747,20 @@ export class TelemetryModalElement extends LitElement {
         }
     }
 
+    // immobilizer/on is destructive: the confirmation token is only asked for once the user confirms
     private immobilizerOn() {
+        this.showImmobilizerConfirm = true;
+    }
+
+    private handleImmobilizerConfirm() {
+        this.showImmobilizerConfirm = false;
         this.sendImmobilizerCommand('on');
     }
 
+    private handleImmobilizerCancel() {
+        this.showImmobilizerConfirm = false;
+    }
+
     private immobilizerOff() {
         this.sendImmobilizerCommand('off');
     }
@@ -1373,10 +1373,26 @@ export class VehicleDetailView extends LitElement {
     this.immobilizerError = "";
 
     try {
+      const command: Record<string, string> = { command: `immobilizer/${state}` };
+      // immobilizer/on is destructive, the BFF only sends it with a confirmation token
+      if (state === 'on') {
+        const confirmation = await this.apiService.callApi<{ confirmationToken: string }>(
+          'POST',
+          `/pending-vehicle/command/${this.vehicle.imei}/confirmation`,
+          command,
+          true,
+          true
+        );
+        if (!confirmation.success || !confirmation.data) {
+          this.immobilizerError = confirmation.error || `Failed to send immobilizer ${state} command`;
+          return;
+        }
+        command.confirmationToken = confirmation.data.confirmationToken;
+      }
       const response = await this.apiService.callApi(
         'POST',
         `/pending-vehicle/command/${this.vehicle.imei}`,
-        { command: `immobilizer/${state}` },
+        command,
         true,
         true
       );